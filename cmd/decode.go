@@ -12,23 +12,43 @@ import (
 	"github.com/CodisLabs/codis/pkg/utils/bytesize"
 	"github.com/CodisLabs/codis/pkg/utils/log"
 	"github.com/CodisLabs/codis/pkg/utils/sync2/atomic2"
+
+	"github.com/CodisLabs/redis-port/pkg/rdb"
 )
 
 func main() {
 	const usage = `
 Usage:
-	redis-decode [--ncpu=N] [--input=INPUT|INPUT] [--output=OUTPUT]
+	redis-decode [--ncpu=N] [--input=INPUT|INPUT] [--output=OUTPUT] [--format=FORMAT] [--encoding=ENCODING] [--input-format=FORMAT] [--columns=COLUMNS] [--header] [--report=REPORT [--top=N] [--delimiter=DELIM] [--codis] [--shard=SHARD]...]
 	redis-decode  --version
 
 Options:
 	-n N, --ncpu=N                    Set runtime.GOMAXPROCS to N.
 	-i INPUT, --input=INPUT           Set input rdb encoded file.  [default: /dev/stdin].
 	-o OUTPUT, --output=OUTPUT        Set output file. [default: /dev/stdout].
+	--format=FORMAT                   Set output format, json, json-object, csv, tsv, resp or redis-cli, json-object is a line of json per key. [default: json].
+	--encoding=ENCODING               Set encoding of keys and values in json, csv and tsv, raw, hex, base64 or auto, auto is raw in csv and tsv. [default: auto].
+	--input-format=FORMAT             Set input format, rdb or json decoded before, json is restored to resp or redis-cli. [default: rdb].
+	--columns=COLUMNS                 Set the comma separated columns of csv and tsv, encoding is also available. [default: db,key,type,index,field,member,value,score,expire_at_ms].
+	--header                          Write the names of columns as the first row of csv and tsv.
+	--report=REPORT                   Write a report instead of objects, memory is the estimated memory usage of keys, slots is the distribution of keys in slots.
+	--top=N                           Set the number of keys, prefixes or slots in the report. [default: 20].
+	--delimiter=DELIM                 Roll up keys by the prefix before DELIM in the report. [default: :].
+	--codis                           Project the load of nodes by slots of Codis, default is slots of Redis Cluster.
+	--shard=SHARD                     Project the load of a node, SHARD is SLOTS:NODE, SLOTS is a comma separated list of slots or ranges.
 
 Examples:
 	$ redis-decode -i dump.rdb -o dump.log
 	$ redis-decode    dump.rdb -o dump.log
 	$ cat dump.rdb | redis-decode --ncpu=8 > dump.log
+	$ redis-decode    dump.rdb --format=resp | redis-cli --pipe
+	$ redis-decode    dump.rdb --format=redis-cli -o dump.txt
+	$ redis-decode    dump.rdb --format=json-object | jq -c 'select(.type == "hash")'
+	$ redis-decode    dump.rdb --format=csv --header --columns=db,key,type,value -o dump.csv
+	$ redis-decode    dump.rdb --report=memory --top=50 --delimiter=/ -o memory.json
+	$ redis-decode    dump.rdb --report=slots --shard=0-8191:node1 --shard=8192-16383:node2
+	$ redis-decode    dump.rdb --encoding=base64 -o dump.log
+	$ redis-decode    dump.log --input-format=json --format=resp | redis-cli --pipe
 `
 	var flags = parseFlags(usage)
 
@@ -56,7 +76,29 @@ Examples:
 	if len(output.Path) == 0 {
 		log.Panicf("invalid output file")
 	}
-	log.Infof("decode: input = %q, output = %q\n", input.Path, output.Path)
+	switch flags.Format {
+	case "json", "json-object", "csv", "tsv", "resp", "redis-cli":
+	default:
+		log.Panicf("invalid format %q", flags.Format)
+	}
+	switch flags.Report {
+	case "", "memory", "slots":
+	default:
+		log.Panicf("invalid report %q", flags.Report)
+	}
+	switch flags.InputFormat {
+	case "rdb":
+	case "json":
+		if flags.Report != "" {
+			log.Panicf("invalid report %q of json input", flags.Report)
+		}
+		if flags.Format != "resp" && flags.Format != "redis-cli" {
+			log.Panicf("invalid format %q of json input", flags.Format)
+		}
+	default:
+		log.Panicf("invalid input format %q", flags.InputFormat)
+	}
+	log.Infof("decode: input = %q, output = %q, format = %q\n", input.Path, output.Path, flags.Format)
 
 	var objects atomic2.Int64
 
@@ -67,8 +109,14 @@ Examples:
 	} else {
 		input.Reader = os.Stdin
 	}
-	input.rd = rBuilder(input.Reader).Must().
-		Buffer(ReaderBufferSize).Count(&input.rbytes).Reader
+	// The json input ends with io.EOF, so it's not wrapped by MustReader.
+	if flags.InputFormat == "json" {
+		input.rd = rBuilder(input.Reader).
+			Buffer(ReaderBufferSize).Count(&input.rbytes).Reader
+	} else {
+		input.rd = rBuilder(input.Reader).Must().
+			Buffer(ReaderBufferSize).Count(&input.rbytes).Reader
+	}
 
 	if output.Path != "/dev/stdout" {
 		file := openWriteFile(output.Path)
@@ -80,19 +128,83 @@ Examples:
 	output.wt = wBuilder(output.Writer).Must().
 		Count(&output.wbytes).Buffer(WriterBufferSize).Writer.(*bufio.Writer)
 
-	var mu sync.Mutex
+	if flags.Header && (flags.Format == "csv" || flags.Format == "tsv") {
+		toCsvRecord(flags.Columns, flags.Format == "tsv", output.wt)
+	}
 
-	var entryChan = newRDBLoader(input.rd, 32)
+	var mu sync.Mutex
 
-	var jobs = NewParallelJob(flags.Parallel, func() {
-		for e := range entryChan {
+	var jobs <-chan struct{}
+	if flags.InputFormat == "json" {
+		// The json records are turned back into commands, it's sequential
+		// because records of a key must be adjacent.
+		var restorer jsonRestorer
+		var writeCommand = func(cmd string, args ...interface{}) {
+			if flags.Format == "resp" {
+				toRespCommand(output.wt, cmd, args...)
+			} else {
+				toRedisCliCommand(output.wt, cmd, args...)
+			}
+		}
+		jobs = NewJob(func() {
+			readJsonRecords(input.rd, func(r *jsonRecord) {
+				synchronized(&mu, func() {
+					objects.Incr()
+					restorer.Restore(r, writeCommand)
+				})
+			})
 			synchronized(&mu, func() {
-				objects.Incr()
-				toJsonDBEntry(e, output.wt)
+				restorer.Flush(writeCommand)
 			})
-			e.DecrRefCount()
+		}).Run()
+	} else {
+		var loader, entryChan = newRDBLoader(input.rd, 32)
+
+		var writer = newEntryWriter(loader, flags, output.wt)
+
+		// Reports are written after all objects are added.
+		var addReport func(e *rdb.DBEntry, u *rdb.MemoryUsage)
+		var writeReport func()
+		switch flags.Report {
+		case "memory":
+			var report = newMemoryReport(flags.Top, flags.Delimiter, flags.Encoding)
+			addReport, writeReport = report.Add, func() {
+				report.Write(output.wt)
+			}
+		case "slots":
+			var report = newSlotReport(flags.Top)
+			addReport, writeReport = report.Add, func() {
+				report.Write(output.wt, flags.Shards, flags.Codis)
+			}
 		}
-	}).Run()
+
+		jobs = NewParallelJob(flags.Parallel, func() {
+			for e := range entryChan {
+				if addReport != nil {
+					var usage = e.MemoryUsage()
+					synchronized(&mu, func() {
+						objects.Incr()
+						addReport(e, usage)
+					})
+					e.DecrRefCount()
+					continue
+				}
+				synchronized(&mu, func() {
+					objects.Incr()
+					writer.Write(e)
+				})
+				e.DecrRefCount()
+			}
+		}).Then(func() {
+			synchronized(&mu, func() {
+				if writeReport != nil {
+					writeReport()
+				} else {
+					writer.Close()
+				}
+			})
+		}).Run()
+	}
 
 	var done = NewJob(func() {
 		for stop := false; !stop; {
@@ -0,0 +1,516 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/CodisLabs/codis/pkg/utils/bytesize"
+	"github.com/CodisLabs/codis/pkg/utils/log"
+	"github.com/CodisLabs/codis/pkg/utils/sync2/atomic2"
+
+	"github.com/CodisLabs/redis-port/pkg/rdb"
+)
+
+func main() {
+	const usage = `
+Usage:
+	redis-diff [--ncpu=N] [--output=OUTPUT] [--partitions=N] [--ttl-tolerance=DURATION] INPUT INPUT
+	redis-diff  --version
+
+Options:
+	-n N, --ncpu=N                    Set runtime.GOMAXPROCS to N.
+	-o OUTPUT, --output=OUTPUT        Set output file of the differences. [default: /dev/stdout].
+	--partitions=N                    Split the inputs into N temporary files by key, only one of them is kept in memory. By default, N is chosen by the size of the inputs.
+	--ttl-tolerance=DURATION          Ignore expire differences up to DURATION. [default: 0s].
+
+Inputs:
+	INPUT is PATH[,db=FROM:TO]...[,prefix=PREFIX], keys of db FROM are compared as db TO and PREFIX is added to them.
+
+Examples:
+	$ redis-diff before.rdb after.rdb
+	$ redis-diff before.rdb after.rdb -o diff.log --partitions=64 --ttl-tolerance=1s
+	$ redis-diff before.rdb,db=0:2 after.rdb
+`
+	var flags = parseFlags(usage)
+
+	if len(flags.Inputs) != 2 {
+		log.Panicf("invalid input files")
+	}
+	var inputs = flags.Inputs
+	var partitions = diffPartitionsOf(inputs)
+	if flags.Partitions != 0 {
+		partitions = flags.Partitions
+	}
+	for _, in := range inputs {
+		if in.Path == "/dev/stdin" && partitions > 1 {
+			log.Panicf("invalid input file %q, inputs are read more than once", in.Path)
+		}
+	}
+
+	var output struct {
+		Path string
+		io.Writer
+		wt *bufio.Writer
+
+		wbytes atomic2.Int64
+	}
+	output.Path = flags.Target
+	if len(output.Path) == 0 {
+		log.Panicf("invalid output file")
+	}
+	log.Infof("diff: inputs = [%q, %q], output = %q, partitions = %d\n", inputs[0].Path, inputs[1].Path, output.Path, partitions)
+
+	if output.Path != "/dev/stdout" {
+		file := openWriteFile(output.Path)
+		defer closeFile(file)
+		output.Writer = file
+	} else {
+		output.Writer = os.Stdout
+	}
+	output.wt = wBuilder(output.Writer).Must().
+		Count(&output.wbytes).Buffer(WriterBufferSize).Writer.(*bufio.Writer)
+
+	var input struct {
+		rbytes atomic2.Int64
+	}
+	var stats struct {
+		keys, same, onlyA, onlyB, types, values, expires atomic2.Int64
+	}
+
+	var loadFile = func(r io.Reader, on func(e *rdb.DBEntry)) {
+		var rd = rBuilder(r).Must().
+			Buffer(ReaderBufferSize).Count(&input.rbytes).Reader
+		var _, entryChan = newRDBLoader(rd, 32)
+		for e := range entryChan {
+			on(e)
+			e.DecrRefCount()
+		}
+	}
+	var loadInput = func(in *Input, on func(e *rdb.DBEntry)) {
+		if in.Path == "/dev/stdin" {
+			loadFile(os.Stdin, on)
+			return
+		}
+		file, _ := openReadFile(in.Path)
+		defer file.Close()
+		loadFile(file, on)
+	}
+
+	type diffKey struct {
+		db  uint64
+		key string
+	}
+
+	var jobs = NewJob(func() {
+		// With more than one partition, the entries of each input are written
+		// to temporary rdb files by the hash of the key, so the entries of a
+		// key are always in the partitions of the same index. At most
+		// diffMaxOpenFiles of them are written in one pass of the input.
+		var files = make([][]string, len(inputs))
+		if partitions > 1 {
+			defer func() {
+				for _, names := range files {
+					for _, name := range names {
+						os.Remove(name)
+					}
+				}
+			}()
+			for i, in := range inputs {
+				for lo := 0; lo < partitions; lo += diffMaxOpenFiles {
+					var hi = lo + diffMaxOpenFiles
+					if hi > partitions {
+						hi = partitions
+					}
+					var temps = make([]*os.File, hi-lo)
+					var buffers = make([]*bufio.Writer, hi-lo)
+					var writers = make([]*rdb.Writer, hi-lo)
+					for p := range writers {
+						temps[p] = openTempFile("", "redis-diff-")
+						files[i] = append(files[i], temps[p].Name())
+						buffers[p] = bufio.NewWriterSize(temps[p], WriterBufferSize)
+						writers[p] = rdb.NewWriter(buffers[p])
+						if err := writers[p].Header(); err != nil {
+							log.PanicErrorf(err, "write rdb header failed")
+						}
+					}
+					loadInput(in, func(e *rdb.DBEntry) {
+						db, key := inputTarget(in, e)
+						var p = diffPartition(db, key, partitions)
+						if p < lo || p >= hi {
+							return
+						}
+						if err := writers[p-lo].WriteEntry(e); err != nil {
+							log.PanicErrorf(err, "write rdb entry failed")
+						}
+					})
+					for p := range writers {
+						if err := writers[p].Footer(); err != nil {
+							log.PanicErrorf(err, "write rdb footer failed")
+						}
+						flushWriter(buffers[p])
+						closeFile(temps[p])
+					}
+				}
+			}
+		}
+		var loadPartition = func(i, p int, on func(e *rdb.DBEntry)) {
+			if partitions > 1 {
+				file, _ := openReadFile(files[i][p])
+				defer closeFile(file)
+				loadFile(file, on)
+			} else {
+				loadInput(inputs[i], on)
+			}
+		}
+
+		for p := 0; p < partitions; p++ {
+			var entries = make(map[diffKey]*rdb.DBEntry)
+			loadPartition(0, p, func(e *rdb.DBEntry) {
+				db, key := inputTarget(inputs[0], e)
+				entries[diffKey{db, string(key)}] = e.IncrRefCount()
+			})
+			loadPartition(1, p, func(b *rdb.DBEntry) {
+				db, key := inputTarget(inputs[1], b)
+				var k = diffKey{db, string(key)}
+				var a = entries[k]
+				if a == nil {
+					stats.onlyB.Incr()
+					toJsonLine(&diffRecord{Type: "only-b", DB: db, Key: k.key}, output.wt)
+					return
+				}
+				delete(entries, k)
+				stats.keys.Incr()
+				if diffDBEntry(db, k.key, a, b, flags.TTLTolerance, &stats.types, &stats.values, &stats.expires, output.wt) {
+					stats.same.Incr()
+				}
+				a.DecrRefCount()
+			})
+			var keys = make([]diffKey, 0, len(entries))
+			for k := range entries {
+				keys = append(keys, k)
+			}
+			sort.Slice(keys, func(i, j int) bool {
+				if keys[i].db != keys[j].db {
+					return keys[i].db < keys[j].db
+				}
+				return keys[i].key < keys[j].key
+			})
+			for _, k := range keys {
+				stats.onlyA.Incr()
+				toJsonLine(&diffRecord{Type: "only-a", DB: k.db, Key: k.key}, output.wt)
+				entries[k].DecrRefCount()
+			}
+		}
+
+		toJsonLine(&struct {
+			Type    string `json:"type"`
+			Keys    int64  `json:"keys"`
+			Same    int64  `json:"same"`
+			OnlyA   int64  `json:"only_a"`
+			OnlyB   int64  `json:"only_b"`
+			Types   int64  `json:"type_mismatches"`
+			Values  int64  `json:"value_differences"`
+			Expires int64  `json:"ttl_differences"`
+		}{
+			"summary", stats.keys.Int64(), stats.same.Int64(), stats.onlyA.Int64(), stats.onlyB.Int64(),
+			stats.types.Int64(), stats.values.Int64(), stats.expires.Int64(),
+		}, output.wt)
+		flushWriter(output.wt)
+	}).Run()
+
+	log.Infof("diff: (r,w,k,a,b,t,v,e) = (read,write,keys,only-a,only-b,type,value,expire)")
+
+	NewJob(func() {
+		for stop := false; !stop; {
+			select {
+			case <-jobs:
+				stop = true
+			case <-time.After(time.Second):
+			}
+			var b bytes.Buffer
+			fmt.Fprintf(&b, "diff: (r,w,k,a,b,t,v,e)=%s",
+				formatAlign(4, "(%d,%d,%d,%d,%d,%d,%d,%d)", input.rbytes.Int64(), output.wbytes.Int64(),
+					stats.keys.Int64(), stats.onlyA.Int64(), stats.onlyB.Int64(),
+					stats.types.Int64(), stats.values.Int64(), stats.expires.Int64()))
+			fmt.Fprintf(&b, "  ~  (%s,%s,-,-,-,-,-,-)",
+				bytesize.Int64(input.rbytes.Int64()).HumanString(), bytesize.Int64(output.wbytes.Int64()).HumanString())
+			log.Info(b.String())
+		}
+	}).RunAndWait()
+
+	if stats.keys.Int64() != stats.same.Int64() || stats.onlyA.Int64() != 0 || stats.onlyB.Int64() != 0 {
+		log.Warn("diff: done, snapshots are different")
+		os.Exit(1)
+	}
+	log.Info("diff: done, snapshots are the same")
+}
+
+const (
+	// diffPartitionSize is the size of an input that is kept in memory at
+	// once if --partitions is not given.
+	diffPartitionSize = bytesize.MB * 256
+
+	// diffMaxOpenFiles is the number of temporary files that are written at
+	// the same time, an input is read once for each group of them.
+	diffMaxOpenFiles = 64
+)
+
+// diffPartitionsOf returns the number of partitions so that each partition of
+// the larger input is about diffPartitionSize, inputs from stdin can only be
+// read once.
+func diffPartitionsOf(inputs []*Input) int {
+	var size int64
+	for _, in := range inputs {
+		if in.Path == "/dev/stdin" {
+			return 1
+		}
+		s, err := os.Stat(in.Path)
+		if err != nil {
+			log.PanicErrorf(err, "can't stat file %q", in.Path)
+		}
+		if s.Size() > size {
+			size = s.Size()
+		}
+	}
+	var n = (size + diffPartitionSize - 1) / diffPartitionSize
+	switch {
+	case n < 1:
+		return 1
+	case n > 4096:
+		return 4096
+	}
+	return int(n)
+}
+
+func diffPartition(db uint64, key []byte, partitions int) int {
+	var h = crc32.NewIEEE()
+	fmt.Fprintf(h, "%d:", db)
+	h.Write(key)
+	return int(h.Sum32() % uint32(partitions))
+}
+
+// diffRecord is a line of the details, A or B is omitted if the key, field or
+// member is missing in that input.
+type diffRecord struct {
+	Type   string      `json:"type"`
+	DB     uint64      `json:"db"`
+	Key    string      `json:"key"`
+	Field  *string     `json:"field,omitempty"`
+	Member *string     `json:"member,omitempty"`
+	Index  *int        `json:"index,omitempty"`
+	ID     string      `json:"id,omitempty"`
+	A      interface{} `json:"a,omitempty"`
+	B      interface{} `json:"b,omitempty"`
+}
+
+func diffTypeName(e *rdb.DBEntry) string {
+	switch t := e.Type(); t {
+	case rdb.OBJ_STRING:
+		return "string"
+	case rdb.OBJ_LIST:
+		return "list"
+	case rdb.OBJ_SET:
+		return "set"
+	case rdb.OBJ_ZSET:
+		return "zset"
+	case rdb.OBJ_HASH:
+		return "hash"
+	case rdb.OBJ_STREAM:
+		return "stream"
+	case rdb.OBJ_MODULE:
+		return "module"
+	default:
+		return t.String()
+	}
+}
+
+// diffDBEntry writes the differences of a and b, it returns true if they are
+// the same.
+func diffDBEntry(db uint64, key string, a, b *rdb.DBEntry, tolerance time.Duration,
+	types, values, expires *atomic2.Int64, w *bufio.Writer) bool {
+	var same = true
+	var emit = func(r *diffRecord) {
+		r.DB, r.Key = db, key
+		toJsonLine(r, w)
+		same = false
+	}
+
+	var ttl = func(e *rdb.DBEntry) interface{} {
+		if e.Expire == rdb.NoExpire {
+			return nil
+		}
+		return int64(e.Expire / time.Millisecond)
+	}
+	switch {
+	case a.Expire == rdb.NoExpire && b.Expire == rdb.NoExpire:
+	case a.Expire == rdb.NoExpire || b.Expire == rdb.NoExpire ||
+		a.Expire-b.Expire > tolerance || b.Expire-a.Expire > tolerance:
+		expires.Incr()
+		emit(&diffRecord{Type: "ttl", A: ttl(a), B: ttl(b)})
+	}
+
+	if a.Type() != b.Type() {
+		types.Incr()
+		emit(&diffRecord{Type: "type", A: diffTypeName(a), B: diffTypeName(b)})
+		return false
+	}
+
+	var differ = false
+	var emitValue = func(r *diffRecord) {
+		emit(r)
+		differ = true
+	}
+	switch a.Type() {
+	case rdb.OBJ_STRING:
+		var x, y = a.Value.AsString().String(), b.Value.AsString().String()
+		if x != y {
+			emitValue(&diffRecord{Type: "value", A: x, B: y})
+		}
+	case rdb.OBJ_MODULE:
+		if a.Module.Name != b.Module.Name || !bytes.Equal(a.Module.Raw, b.Module.Raw) {
+			emitValue(&diffRecord{Type: "value", A: a.Module.Name, B: b.Module.Name})
+		}
+	case rdb.OBJ_LIST:
+		var x, y = a.Value.AsList().Strings(), b.Value.AsList().Strings()
+		for i := 0; i < len(x) || i < len(y); i++ {
+			var r = &diffRecord{Type: "index", Index: new(int)}
+			*r.Index = i
+			if i < len(x) {
+				r.A = x[i]
+			}
+			if i < len(y) {
+				r.B = y[i]
+			}
+			if i >= len(x) || i >= len(y) || x[i] != y[i] {
+				emitValue(r)
+			}
+		}
+	case rdb.OBJ_HASH:
+		var x, y = a.Value.AsHash().Map(), b.Value.AsHash().Map()
+		for _, field := range diffSortedKeys(x, y) {
+			var u, ok1 = x[field]
+			var v, ok2 = y[field]
+			if ok1 && ok2 && u == v {
+				continue
+			}
+			var r = &diffRecord{Type: "field", Field: new(string)}
+			*r.Field = field
+			if ok1 {
+				r.A = u
+			}
+			if ok2 {
+				r.B = v
+			}
+			emitValue(r)
+		}
+	case rdb.OBJ_SET:
+		var x, y = a.Value.AsSet().Map(), b.Value.AsSet().Map()
+		for _, member := range diffSortedKeys(x, y) {
+			if x[member] && y[member] {
+				continue
+			}
+			var r = &diffRecord{Type: "member", Member: new(string)}
+			*r.Member = member
+			if x[member] {
+				r.A = true
+			}
+			if y[member] {
+				r.B = true
+			}
+			emitValue(r)
+		}
+	case rdb.OBJ_ZSET:
+		var x, y = a.Value.AsZset().Map(), b.Value.AsZset().Map()
+		for _, member := range diffSortedKeys(x, y) {
+			var u, ok1 = x[member]
+			var v, ok2 = y[member]
+			if ok1 && ok2 && (u == v || u != u && v != v) {
+				continue
+			}
+			var r = &diffRecord{Type: "member", Member: new(string)}
+			*r.Member = member
+			if ok1 {
+				r.A = u
+			}
+			if ok2 {
+				r.B = v
+			}
+			emitValue(r)
+		}
+	case rdb.OBJ_STREAM:
+		var s, t = a.Value.AsStream(), b.Value.AsStream()
+		var x, y = diffStreamEntries(s), diffStreamEntries(t)
+		for _, id := range diffSortedKeys(x, y) {
+			var u, ok1 = x[id]
+			var v, ok2 = y[id]
+			if ok1 && ok2 && reflect.DeepEqual(u, v) {
+				continue
+			}
+			var r = &diffRecord{Type: "entry", ID: id}
+			if ok1 {
+				r.A = u
+			}
+			if ok2 {
+				r.B = v
+			}
+			emitValue(r)
+		}
+		if s.LastID() != t.LastID() || !reflect.DeepEqual(s.Groups(), t.Groups()) {
+			var meta = func(o *rdb.RedisStreamObject) interface{} {
+				var groups = make([]string, 0, len(o.Groups()))
+				for _, g := range o.Groups() {
+					groups = append(groups, g.Name)
+				}
+				return &struct {
+					LastID string   `json:"lastid"`
+					Groups []string `json:"groups"`
+				}{o.LastID().String(), groups}
+			}
+			emitValue(&diffRecord{Type: "stream", A: meta(s), B: meta(t)})
+		}
+	}
+	if differ {
+		values.Incr()
+	}
+	return same
+}
+
+func diffStreamEntries(o *rdb.RedisStreamObject) map[string][]string {
+	var entries = make(map[string][]string)
+	o.ForEach(func(iter *rdb.RedisStreamIterator, index int) bool {
+		var entry = iter.Next()
+		if entry == nil {
+			return false
+		}
+		var fields = make([]string, 0, len(entry.Fields)*2)
+		for i := range entry.Fields {
+			fields = append(fields, entry.Fields[i].String(), entry.Values[i].String())
+		}
+		entries[entry.ID.String()] = fields
+		return true
+	})
+	return entries
+}
+
+// diffSortedKeys returns the union of the keys of two maps of the same type.
+func diffSortedKeys(x, y interface{}) []string {
+	var set = make(map[string]bool)
+	for _, m := range []reflect.Value{reflect.ValueOf(x), reflect.ValueOf(y)} {
+		for _, k := range m.MapKeys() {
+			set[k.String()] = true
+		}
+	}
+	var keys = make([]string, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
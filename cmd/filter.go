@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/CodisLabs/codis/pkg/utils/bytesize"
+	"github.com/CodisLabs/codis/pkg/utils/log"
+	"github.com/CodisLabs/codis/pkg/utils/sync2/atomic2"
+
+	"github.com/CodisLabs/redis-port/pkg/rdb"
+)
+
+func main() {
+	const usage = `
+Usage:
+	redis-filter [--ncpu=N] [--input=INPUT|INPUT] [--output=OUTPUT] [--db=DB] [--match=PATTERN]... [--exclude=PATTERN]... [--type=TYPES] [--ttl=TTL] [--skip-expired] [--remap-db=MAP]... [--rewrite-prefix=RULE]...
+	redis-filter  --version
+
+Options:
+	-n N, --ncpu=N                    Set runtime.GOMAXPROCS to N.
+	-i INPUT, --input=INPUT           Set input rdb encoded file. [default: /dev/stdin].
+	-o OUTPUT, --output=OUTPUT        Set output rdb file. [default: /dev/stdout].
+	--db=DB                           Accept db = DB, default is *.
+	--match=PATTERN                   Accept keys matching the glob-style PATTERN, can be repeated.
+	--exclude=PATTERN                 Drop keys matching the glob-style PATTERN, can be repeated.
+	--type=TYPES                      Accept the comma separated types: string,list,set,zset,hash,stream,module.
+	--ttl=TTL                         Accept keys without expire (persist) or with expire (volatile) only.
+	--skip-expired                    Drop keys that have already expired.
+	--remap-db=MAP                    Move keys of db FROM to db TO, MAP is FROM:TO, can be repeated.
+	--rewrite-prefix=RULE             Replace key prefix OLD with NEW, RULE is OLD,NEW, can be repeated.
+
+Examples:
+	$ redis-filter -i dump.rdb -o user.rdb --db=2 --match="user:*" --exclude="session:*"
+	$ redis-filter    dump.rdb -o small.rdb --type=string,hash --ttl=persist
+	$ redis-filter    dump.rdb -o moved.rdb --remap-db=2:0 --rewrite-prefix="user:,u:"
+	$ cat dump.rdb | redis-filter --skip-expired > alive.rdb
+`
+	var flags = parseFlags(usage)
+
+	var input struct {
+		Path string
+		Size int64
+		io.Reader
+		rd io.Reader
+
+		rbytes, forward, skip atomic2.Int64
+	}
+	input.Path = flags.Source
+	if len(input.Path) == 0 {
+		log.Panicf("invalid input file")
+	}
+
+	var output struct {
+		Path string
+		io.Writer
+		wt *bufio.Writer
+
+		wbytes atomic2.Int64
+	}
+	output.Path = flags.Target
+	if len(output.Path) == 0 {
+		log.Panicf("invalid output file")
+	}
+	log.Infof("filter: input = %q, output = %q\n", input.Path, output.Path)
+
+	if input.Path != "/dev/stdin" {
+		file, size := openReadFile(input.Path)
+		defer file.Close()
+		input.Reader, input.Size = file, size
+	} else {
+		input.Reader = os.Stdin
+	}
+	input.rd = rBuilder(input.Reader).Must().
+		Buffer(ReaderBufferSize).Count(&input.rbytes).Reader
+
+	if output.Path != "/dev/stdout" {
+		file := openWriteFile(output.Path)
+		defer closeFile(file)
+		output.Writer = file
+	} else {
+		output.Writer = os.Stdout
+	}
+	output.wt = wBuilder(output.Writer).Must().
+		Count(&output.wbytes).Buffer(WriterBufferSize).Writer.(*bufio.Writer)
+
+	var loader, entryChan = newRDBLoader(input.rd, 32)
+
+	var writer = rdb.NewWriter(output.wt)
+
+	var accept = func(e *rdb.DBEntry, now time.Duration) bool {
+		var volatile = e.Expire != rdb.NoExpire
+		switch {
+		case !acceptDB(e.DB):
+			return false
+		case !acceptExpire(volatile):
+			return false
+		case volatile && flags.SkipExpired && e.Expire <= now:
+			return false
+		case !acceptType(strings.ToLower(strings.TrimPrefix(e.Type().String(), "OBJ_"))):
+			return false
+		}
+		return acceptKey(e.Key.BytesUnsafe())
+	}
+
+	// Remapped dbs and rewritten keys may collide with the existing ones,
+	// keys are tracked only if flags.RewriteKeys is set.
+	var written = make(map[uint64]map[string]bool)
+	var collide = func(e *rdb.DBEntry) bool {
+		if written[e.DB] == nil {
+			written[e.DB] = make(map[string]bool)
+		}
+		var key = e.Key.String()
+		if written[e.DB][key] {
+			return true
+		}
+		written[e.DB][key] = true
+		return false
+	}
+
+	var jobs = NewJob(func() {
+		var header = false
+		var writeHeader = func() {
+			if header {
+				return
+			}
+			if err := writer.Header(); err != nil {
+				log.PanicErrorf(err, "write rdb header failed")
+			}
+			var aux = loader.Aux()
+			var keys = make([]string, 0, len(aux))
+			for key := range aux {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			for _, key := range keys {
+				if err := writer.WriteAux(key, aux[key]); err != nil {
+					log.PanicErrorf(err, "write rdb aux failed")
+				}
+			}
+			header = true
+		}
+		for e := range entryChan {
+			if !accept(e, time.Duration(time.Now().UnixNano())) {
+				input.skip.Incr()
+				e.DecrRefCount()
+				continue
+			}
+			// The entry is shared with the loader, rewrite a shallow copy.
+			var x = *e
+			x.DB = remapDB(e.DB)
+			key, rewritten := rewriteKey(e.Key.BytesUnsafe())
+			if rewritten {
+				x.Key = rdb.NewRedisStringObject(key)
+			}
+			if flags.RewriteKeys && collide(&x) {
+				log.Warnf("filter: duplicate key db=%d key=%q, skipped", x.DB, x.Key.String())
+				input.skip.Incr()
+			} else {
+				writeHeader()
+				if err := writer.WriteEntry(&x); err != nil {
+					log.PanicErrorf(err, "write rdb entry failed")
+				}
+				input.forward.Incr()
+			}
+			if rewritten {
+				x.Key.DecrRefCount()
+			}
+			e.DecrRefCount()
+		}
+		writeHeader()
+		if err := writer.Footer(); err != nil {
+			log.PanicErrorf(err, "write rdb footer failed")
+		}
+		flushWriter(output.wt)
+	}).Run()
+
+	log.Infof("filter: (r,w,f,s) = (read,write,forward,skip)")
+
+	NewJob(func() {
+		for stop := false; !stop; {
+			select {
+			case <-jobs:
+				stop = true
+			case <-time.After(time.Second):
+			}
+			stats := &struct {
+				input, output, forward, skip int64
+			}{
+				input.rbytes.Int64(), output.wbytes.Int64(), input.forward.Int64(), input.skip.Int64(),
+			}
+
+			var b bytes.Buffer
+			var percent float64
+			if input.Size != 0 {
+				percent = float64(stats.input) * 100 / float64(input.Size)
+			}
+			fmt.Fprintf(&b, "filter: file = %d - [%6.2f%%]", input.Size, percent)
+			fmt.Fprintf(&b, "   (r,w,f,s)=%s",
+				formatAlign(4, "(%d,%d,%d,%d)", stats.input, stats.output, stats.forward, stats.skip))
+			fmt.Fprintf(&b, "  ~  (%s,%s,-,-)",
+				bytesize.Int64(stats.input).HumanString(), bytesize.Int64(stats.output).HumanString())
+			log.Info(b.String())
+		}
+	}).RunAndWait()
+
+	log.Info("filter: done")
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"os"
 	"runtime"
@@ -30,12 +31,91 @@ type Flags struct {
 		Size int64
 	}
 	ExpireOffset time.Duration
+
+	// DB is the db of --db, it's -1 if every db is accepted.
+	DB int
+	// Keys are the exact keys, Patterns are the glob-style patterns of
+	// --match, both are accepted by acceptKey.
+	Keys     []string
+	Patterns []string
+
+	Index      string
+	BuildIndex bool
+
+	// NoPayload restores keys by commands instead of RESTORE payloads.
+	NoPayload bool
+
+	SkipExpired bool
+	// RewriteKeys is set if dbs are remapped or keys are rewritten.
+	RewriteKeys bool
+
+	Codis  bool
+	Format string
+	Shards []*Shard
+
+	// Cluster is set if the target is a redis cluster.
+	Cluster bool
+
+	Encoding    string
+	InputFormat string
+
+	Columns []string
+	Header  bool
+
+	Report    string
+	Top       int
+	Delimiter string
+
+	Now time.Time
+
+	Conflict    string
+	ConflictLog string
+	Inputs      []*Input
+
+	MaxErrors  int64
+	DeadLetter string
+
+	Partitions   int
+	TTLTolerance time.Duration
+}
+
+// Input is an input rdb file with its own db mapping and key prefix.
+type Input struct {
+	Path    string
+	RemapDB map[uint64]uint64
+	Prefix  string
+}
+
+// Shard is the output of the slot ranges, both ends of a range are included.
+type Shard struct {
+	Slots [][2]int
+	Path  string
 }
 
 var acceptDB = func(db uint64) bool {
 	return true
 }
 
+var acceptKey = func(key []byte) bool {
+	return true
+}
+
+var acceptType = func(name string) bool {
+	return true
+}
+
+var acceptExpire = func(volatile bool) bool {
+	return true
+}
+
+var remapDB = func(db uint64) uint64 {
+	return db
+}
+
+var rewriteKey = func(key []byte) ([]byte, bool) {
+	return key, false
+}
+
 func parseFlags(usage string) *Flags {
 	return parseFlagsFromArgs(usage, os.Args[1:])
 }
@@ -67,6 +147,7 @@ func parseFlagsFromArgs(usage string, args []string) *Flags {
 	var ncpu = runtime.GOMAXPROCS(0)
 
 	var flags Flags
+	flags.DB = -1
 	switch {
 	case ncpu <= 1:
 		flags.Parallel = 8
@@ -121,11 +202,316 @@ func parseFlagsFromArgs(usage string, args []string) *Flags {
 		if n < 0 {
 			log.Panicf("parse --db=%q failed", s)
 		}
+		flags.DB = n
 		acceptDB = func(db uint64) bool {
 			return db == uint64(n)
 		}
 	}
 
+	var match, exclude []string
+	if list, ok := d["--match"].([]string); ok {
+		match = list
+	}
+	if list, ok := d["--exclude"].([]string); ok {
+		exclude = list
+	}
+	var keys = make(map[string]bool)
+	if list, ok := d["--key"].([]string); ok {
+		for _, key := range list {
+			if !keys[key] {
+				flags.Keys = append(flags.Keys, key)
+			}
+			keys[key] = true
+		}
+	}
+	flags.Patterns = match
+	if len(match) != 0 || len(exclude) != 0 || len(keys) != 0 {
+		acceptKey = func(key []byte) bool {
+			var s = string(key)
+			for _, pattern := range exclude {
+				if matchPattern(pattern, s) {
+					return false
+				}
+			}
+			if keys[s] {
+				return true
+			}
+			if len(match) == 0 {
+				return len(keys) == 0
+			}
+			for _, pattern := range match {
+				if matchPattern(pattern, s) {
+					return true
+				}
+			}
+			return false
+		}
+	}
+
+	if s, ok := d["--index"].(string); ok {
+		flags.Index = s
+	}
+	if b, ok := d["--build-index"].(bool); ok {
+		flags.BuildIndex = b
+	}
+	if b, ok := d["--no-payload"].(bool); ok {
+		flags.NoPayload = b
+	}
+
+	if s, ok := d["--type"].(string); ok && s != "" {
+		var types = make(map[string]bool)
+		for _, name := range strings.Split(s, ",") {
+			switch name = strings.ToLower(strings.TrimSpace(name)); name {
+			case "string", "list", "set", "zset", "hash", "stream", "module":
+				types[name] = true
+			default:
+				log.Panicf("parse --type=%q failed, unknown type %q", s, name)
+			}
+		}
+		acceptType = func(name string) bool {
+			return types[name]
+		}
+	}
+
+	if s, ok := d["--ttl"].(string); ok && s != "" {
+		switch s {
+		case "persist":
+			acceptExpire = func(volatile bool) bool {
+				return !volatile
+			}
+		case "volatile":
+			acceptExpire = func(volatile bool) bool {
+				return volatile
+			}
+		default:
+			log.Panicf("parse --ttl=%q failed", s)
+		}
+	}
+	if b, ok := d["--skip-expired"].(bool); ok {
+		flags.SkipExpired = b
+	}
+
+	if list, ok := d["--remap-db"].([]string); ok && len(list) != 0 {
+		var mapping = make(map[uint64]uint64)
+		for _, s := range list {
+			var split = strings.Split(s, ":")
+			if len(split) != 2 {
+				log.Panicf("parse --remap-db=%q failed", s)
+			}
+			from, err := strconv.ParseUint(split[0], 10, 64)
+			if err != nil {
+				log.PanicErrorf(err, "parse --remap-db=%q failed", s)
+			}
+			to, err := strconv.ParseUint(split[1], 10, 64)
+			if err != nil {
+				log.PanicErrorf(err, "parse --remap-db=%q failed", s)
+			}
+			mapping[from] = to
+		}
+		flags.RewriteKeys = true
+		remapDB = func(db uint64) uint64 {
+			if to, ok := mapping[db]; ok {
+				return to
+			}
+			return db
+		}
+	}
+
+	if list, ok := d["--rewrite-prefix"].([]string); ok && len(list) != 0 {
+		var rules [][2][]byte
+		for _, s := range list {
+			var split = strings.SplitN(s, ",", 2)
+			if len(split) != 2 {
+				log.Panicf("parse --rewrite-prefix=%q failed", s)
+			}
+			rules = append(rules, [2][]byte{[]byte(split[0]), []byte(split[1])})
+		}
+		flags.RewriteKeys = true
+		// The first matched rule wins, an empty OLD adds NEW to every key.
+		rewriteKey = func(key []byte) ([]byte, bool) {
+			for _, r := range rules {
+				if bytes.HasPrefix(key, r[0]) {
+					var b = make([]byte, 0, len(r[1])+len(key)-len(r[0]))
+					b = append(b, r[1]...)
+					return append(b, key[len(r[0]):]...), true
+				}
+			}
+			return key, false
+		}
+	}
+
+	if b, ok := d["--codis"].(bool); ok {
+		flags.Codis = b
+	}
+	if b, ok := d["--cluster"].(bool); ok {
+		flags.Cluster = b
+	}
+	if flags.Codis && flags.Cluster {
+		log.Panicf("--codis and --cluster can't be used together")
+	}
+	if s, ok := d["--format"].(string); ok {
+		flags.Format = s
+	}
+	if s, ok := d["--encoding"].(string); ok {
+		switch s {
+		case "raw", "hex", "base64", "auto":
+			flags.Encoding = s
+		default:
+			log.Panicf("parse --encoding=%q failed", s)
+		}
+	}
+	if s, ok := d["--input-format"].(string); ok {
+		flags.InputFormat = s
+	}
+	if s, ok := d["--columns"].(string); ok {
+		for _, name := range strings.Split(s, ",") {
+			switch name = strings.ToLower(strings.TrimSpace(name)); name {
+			case "db", "key", "type", "index", "field", "member", "value", "score", "expire_at_ms", "encoding":
+				flags.Columns = append(flags.Columns, name)
+			default:
+				log.Panicf("parse --columns=%q failed, unknown column %q", s, name)
+			}
+		}
+	}
+	if b, ok := d["--header"].(bool); ok {
+		flags.Header = b
+	}
+	if s, ok := d["--report"].(string); ok {
+		flags.Report = s
+	}
+	if s, ok := d["--top"].(string); ok {
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			log.PanicErrorf(err, "parse --top=%q failed", s)
+		}
+		if n <= 0 {
+			log.Panicf("parse --top=%q failed, invalid", s)
+		}
+		flags.Top = n
+	}
+	if s, ok := d["--now"].(string); ok && s != "" {
+		if s[0] == '@' {
+			n, err := strconv.ParseInt(s[1:], 10, 64)
+			if err != nil {
+				log.PanicErrorf(err, "parse --now=%q failed", s)
+			}
+			flags.Now = time.Unix(0, n*int64(time.Millisecond))
+		} else {
+			t, err := time.Parse("2006-01-02 15:04:05", s)
+			if err != nil {
+				log.PanicErrorf(err, "parse --now=%q failed", s)
+			}
+			flags.Now = t
+		}
+	}
+	if s, ok := d["--delimiter"].(string); ok {
+		if s == "" {
+			log.Panicf("parse --delimiter=%q failed", s)
+		}
+		flags.Delimiter = s
+	}
+	if list, ok := d["--shard"].([]string); ok {
+		for _, s := range list {
+			var split = strings.SplitN(s, ":", 2)
+			if len(split) != 2 || split[1] == "" {
+				log.Panicf("parse --shard=%q failed", s)
+			}
+			var shard = &Shard{Path: split[1]}
+			for _, r := range strings.Split(split[0], ",") {
+				var beg, end = r, r
+				if i := strings.IndexByte(r, '-'); i >= 0 {
+					beg, end = r[:i], r[i+1:]
+				}
+				lo, err := strconv.Atoi(beg)
+				if err != nil {
+					log.PanicErrorf(err, "parse --shard=%q failed", s)
+				}
+				hi, err := strconv.Atoi(end)
+				if err != nil {
+					log.PanicErrorf(err, "parse --shard=%q failed", s)
+				}
+				if lo < 0 || lo > hi {
+					log.Panicf("parse --shard=%q failed, invalid range %q", s, r)
+				}
+				shard.Slots = append(shard.Slots, [2]int{lo, hi})
+			}
+			flags.Shards = append(flags.Shards, shard)
+		}
+	}
+
+	if s, ok := d["--conflict"].(string); ok {
+		flags.Conflict = s
+	}
+	if s, ok := d["--conflict-log"].(string); ok {
+		flags.ConflictLog = s
+	}
+	if s, ok := d["--max-errors"].(string); ok {
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			log.PanicErrorf(err, "parse --max-errors=%q failed", s)
+		}
+		if n < 0 {
+			log.Panicf("parse --max-errors=%q failed, invalid", s)
+		}
+		flags.MaxErrors = n
+	}
+	if s, ok := d["--dead-letter"].(string); ok {
+		flags.DeadLetter = s
+	}
+	if list, ok := d["INPUT"].([]string); ok {
+		for _, s := range list {
+			var split = strings.Split(s, ",")
+			if split[0] == "" {
+				log.Panicf("parse input %q failed", s)
+			}
+			var input = &Input{Path: split[0], RemapDB: make(map[uint64]uint64)}
+			for _, opt := range split[1:] {
+				switch {
+				case strings.HasPrefix(opt, "db="):
+					var pair = strings.Split(opt[3:], ":")
+					if len(pair) != 2 {
+						log.Panicf("parse input %q failed, invalid %q", s, opt)
+					}
+					from, err := strconv.ParseUint(pair[0], 10, 64)
+					if err != nil {
+						log.PanicErrorf(err, "parse input %q failed", s)
+					}
+					to, err := strconv.ParseUint(pair[1], 10, 64)
+					if err != nil {
+						log.PanicErrorf(err, "parse input %q failed", s)
+					}
+					input.RemapDB[from] = to
+				case strings.HasPrefix(opt, "prefix="):
+					input.Prefix = opt[7:]
+				default:
+					log.Panicf("parse input %q failed, unknown option %q", s, opt)
+				}
+			}
+			flags.Inputs = append(flags.Inputs, input)
+		}
+	}
+
+	if s, ok := d["--partitions"].(string); ok && s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			log.PanicErrorf(err, "parse --partitions=%q failed", s)
+		}
+		if n <= 0 || n > 4096 {
+			log.Panicf("parse --partitions=%q failed, invalid", s)
+		}
+		flags.Partitions = n
+	}
+	if s, ok := d["--ttl-tolerance"].(string); ok && s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			log.PanicErrorf(err, "parse --ttl-tolerance=%q failed", s)
+		}
+		if d < 0 {
+			log.Panicf("parse --ttl-tolerance=%q failed, invalid", s)
+		}
+		flags.TTLTolerance = d
+	}
+
 	if s, ok := d["--tmpfile"].(string); ok {
 		flags.TmpFile.Path = s
 	}
@@ -143,3 +529,73 @@ func parseFlagsFromArgs(usage string, args []string) *Flags {
 	}
 	return &flags
 }
+
+// matchPattern reports whether key matches the glob-style pattern, it follows
+// the rules of stringmatchlen() used by KEYS and SCAN.
+func matchPattern(pattern, key string) bool {
+	var p, k int
+	for p < len(pattern) {
+		switch pattern[p] {
+		case '*':
+			for p+1 < len(pattern) && pattern[p+1] == '*' {
+				p++
+			}
+			if p+1 == len(pattern) {
+				return true
+			}
+			for i := k; i <= len(key); i++ {
+				if matchPattern(pattern[p+1:], key[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if k == len(key) {
+				return false
+			}
+			k++
+		case '[':
+			if k == len(key) {
+				return false
+			}
+			p++
+			var not = p < len(pattern) && pattern[p] == '^'
+			if not {
+				p++
+			}
+			var match bool
+			for ; p < len(pattern) && pattern[p] != ']'; p++ {
+				switch {
+				case pattern[p] == '\\' && p+1 < len(pattern):
+					p++
+					match = match || pattern[p] == key[k]
+				case p+2 < len(pattern) && pattern[p+1] == '-':
+					var lo, hi = pattern[p], pattern[p+2]
+					if lo > hi {
+						lo, hi = hi, lo
+					}
+					match = match || (lo <= key[k] && key[k] <= hi)
+					p += 2
+				default:
+					match = match || pattern[p] == key[k]
+				}
+			}
+			if match == not {
+				return false
+			}
+			k++
+		case '\\':
+			if p+1 < len(pattern) {
+				p++
+			}
+			fallthrough
+		default:
+			if k == len(key) || pattern[p] != key[k] {
+				return false
+			}
+			k++
+		}
+		p++
+	}
+	return k == len(key)
+}
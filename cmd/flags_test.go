@@ -2,6 +2,7 @@ package main
 
 import (
 	"math"
+	"reflect"
 	"strings"
 	"testing"
 	"time"
@@ -51,6 +52,19 @@ func TestParseFlagsMasterTarget(t *testing.T) {
 	testcase("-m abc -t xyz", "abc", "xyz")
 }
 
+func TestParseFlagsInputDefault(t *testing.T) {
+	const usage = `
+Usage:
+	test [--input=INPUT|INPUT]
+	test  --version
+
+Options:
+	-i INPUT, --input=INPUT           Set input file. [default: /dev/stdin].
+`
+	assert.Must(parseFlagsFromArgs(usage, []string{}).Source == "/dev/stdin")
+	assert.Must(parseFlagsFromArgs(usage, []string{"-i", "b.rdb"}).Source == "b.rdb")
+}
+
 func TestParseFlagsFileSize(t *testing.T) {
 	var testcase = func(line string, path string, size int64) {
 		var flags = parseFlagsFromString(line)
@@ -73,3 +87,208 @@ func TestParseFlagsUnixtime(t *testing.T) {
 	testcase("--unixtime-in-milliseconds=+1000ms", time.Second, 0)
 	testcase("--unixtime-in-milliseconds=-1000ms", -time.Second, 0)
 }
+
+func TestMatchPattern(t *testing.T) {
+	var testcase = func(pattern, key string, expected bool) {
+		assert.Must(matchPattern(pattern, key) == expected)
+	}
+	testcase("*", "", true)
+	testcase("*", "abc", true)
+	testcase("user:*", "user:1", true)
+	testcase("user:*", "session:1", false)
+	testcase("*:1", "user:1", true)
+	testcase("u?er", "user", true)
+	testcase("u?er", "uer", false)
+	testcase("h[ae]llo", "hello", true)
+	testcase("h[ae]llo", "hillo", false)
+	testcase("h[^e]llo", "hallo", true)
+	testcase("h[^e]llo", "hello", false)
+	testcase("h[a-b]llo", "hbllo", true)
+	testcase("h[b-a]llo", "hallo", true)
+	testcase("h[a-b]llo", "hcllo", false)
+	testcase("a\\*b", "a*b", true)
+	testcase("a\\*b", "axb", false)
+	testcase("a/*", "a/b/c", true)
+	testcase("abc", "abcd", false)
+}
+
+func TestParseFlagsFilter(t *testing.T) {
+	const usage = `
+Usage:
+	test [--match=PATTERN]... [--exclude=PATTERN]... [--type=TYPES] [--ttl=TTL] [--skip-expired] [--remap-db=MAP]... [--rewrite-prefix=RULE]...
+	test  --version
+`
+	var flags = parseFlagsFromArgs(usage, []string{
+		"--match=user:*", "--match=order:*", "--exclude=user:admin*",
+		"--type=string,Hash", "--ttl=volatile", "--skip-expired",
+		"--remap-db=2:0", "--remap-db=3:1",
+		"--rewrite-prefix=user:,u:", "--rewrite-prefix=,x:",
+	})
+	assert.Must(flags.SkipExpired && flags.RewriteKeys)
+
+	assert.Must(acceptKey([]byte("user:1")))
+	assert.Must(acceptKey([]byte("order:1")))
+	assert.Must(!acceptKey([]byte("user:admin")))
+	assert.Must(!acceptKey([]byte("session:1")))
+
+	assert.Must(acceptType("string") && acceptType("hash"))
+	assert.Must(!acceptType("list"))
+
+	assert.Must(acceptExpire(true) && !acceptExpire(false))
+
+	assert.Must(remapDB(2) == 0 && remapDB(3) == 1 && remapDB(4) == 4)
+
+	var testcase = func(key, expected string, rewritten bool) {
+		b, ok := rewriteKey([]byte(key))
+		assert.Must(string(b) == expected && ok == rewritten)
+	}
+	testcase("user:1", "u:1", true)
+	testcase("order:1", "x:order:1", true)
+}
+
+func TestParseFlagsShard(t *testing.T) {
+	const usage = `
+Usage:
+	test [--codis] [--format=FORMAT] [--shard=SHARD]...
+	test  --version
+`
+	var flags = parseFlagsFromArgs(usage, []string{
+		"--codis", "--format=resp", "--shard=0-511:a.rdb", "--shard=512-1000,1001,1002-1023:/b/c:d.rdb",
+	})
+	assert.Must(flags.Codis && flags.Format == "resp")
+	assert.Must(len(flags.Shards) == 2)
+	assert.Must(flags.Shards[0].Path == "a.rdb")
+	assert.Must(reflect.DeepEqual(flags.Shards[0].Slots, [][2]int{{0, 511}}))
+	assert.Must(flags.Shards[1].Path == "/b/c:d.rdb")
+	assert.Must(reflect.DeepEqual(flags.Shards[1].Slots, [][2]int{{512, 1000}, {1001, 1001}, {1002, 1023}}))
+}
+
+func TestParseFlagsInputs(t *testing.T) {
+	const usage = `
+Usage:
+	test [--conflict=POLICY] INPUT...
+	test  --version
+`
+	var flags = parseFlagsFromArgs(usage, []string{
+		"--conflict=last", "a.rdb", "b.rdb,db=0:1,db=2:3,prefix=b:", "c.rdb,prefix=",
+	})
+	assert.Must(flags.Conflict == "last")
+	assert.Must(len(flags.Inputs) == 3)
+	assert.Must(flags.Inputs[0].Path == "a.rdb" && len(flags.Inputs[0].RemapDB) == 0 && flags.Inputs[0].Prefix == "")
+	assert.Must(flags.Inputs[1].Path == "b.rdb" && flags.Inputs[1].Prefix == "b:")
+	assert.Must(reflect.DeepEqual(flags.Inputs[1].RemapDB, map[uint64]uint64{0: 1, 2: 3}))
+	assert.Must(flags.Inputs[2].Path == "c.rdb" && flags.Inputs[2].Prefix == "")
+}
+
+func TestParseFlagsPartitions(t *testing.T) {
+	const usage = `
+Usage:
+	test [--partitions=N] [--ttl-tolerance=DURATION] INPUT INPUT
+	test  --version
+`
+	var flags = parseFlagsFromArgs(usage, []string{"--partitions=16", "--ttl-tolerance=1500ms", "a.rdb", "b.rdb,prefix=x:"})
+	assert.Must(flags.Partitions == 16 && flags.TTLTolerance == 1500*time.Millisecond)
+	assert.Must(len(flags.Inputs) == 2 && flags.Inputs[1].Prefix == "x:")
+}
+
+func TestParseFlagsEncoding(t *testing.T) {
+	const usage = `
+Usage:
+	test [--encoding=ENCODING] [--input-format=FORMAT]
+	test  --version
+`
+	var flags = parseFlagsFromArgs(usage, []string{"--encoding=base64", "--input-format=json"})
+	assert.Must(flags.Encoding == "base64" && flags.InputFormat == "json")
+}
+
+func TestParseFlagsColumns(t *testing.T) {
+	const usage = `
+Usage:
+	test [--columns=COLUMNS] [--header]
+	test  --version
+`
+	var flags = parseFlagsFromArgs(usage, []string{"--columns=db, KEY,expire_at_ms", "--header"})
+	assert.Must(len(flags.Columns) == 3 && flags.Header)
+	assert.Must(flags.Columns[1] == "key" && flags.Columns[2] == "expire_at_ms")
+}
+
+func TestParseFlagsNow(t *testing.T) {
+	const usage = `
+Usage:
+	test [--now=NOW]
+	test  --version
+`
+	var flags = parseFlagsFromArgs(usage, []string{"--now=@1526919030474"})
+	assert.Must(flags.Now.UnixNano() == 1526919030474*int64(time.Millisecond))
+	flags = parseFlagsFromArgs(usage, []string{"--now=2018-05-21 16:10:30"})
+	assert.Must(flags.Now.Unix() == 1526919030)
+}
+
+func TestParseFlagsKey(t *testing.T) {
+	const usage = `
+Usage:
+	test [--db=DB] [--key=KEY]... [--match=PATTERN]...
+	test  --version
+`
+	var flags = parseFlagsFromArgs(usage, []string{"--db=2", "--key=a", "--key=b:1", "--key=a"})
+	assert.Must(flags.DB == 2 && acceptDB(2) && !acceptDB(0))
+	assert.Must(reflect.DeepEqual(flags.Keys, []string{"a", "b:1"}) && len(flags.Patterns) == 0)
+	assert.Must(acceptKey([]byte("a")) && acceptKey([]byte("b:1")))
+	assert.Must(!acceptKey([]byte("b:2")))
+
+	flags = parseFlagsFromArgs(usage, []string{"--key=a", "--match=b:*"})
+	assert.Must(flags.DB == -1)
+	assert.Must(reflect.DeepEqual(flags.Patterns, []string{"b:*"}))
+	assert.Must(acceptKey([]byte("a")) && acceptKey([]byte("b:2")))
+	assert.Must(!acceptKey([]byte("c")))
+}
+
+func TestParseFlagsNoPayload(t *testing.T) {
+	const usage = `
+Usage:
+	test [--no-payload]
+	test  --version
+`
+	assert.Must(!parseFlagsFromArgs(usage, []string{}).NoPayload)
+	assert.Must(parseFlagsFromArgs(usage, []string{"--no-payload"}).NoPayload)
+}
+
+func TestParseFlagsCluster(t *testing.T) {
+	const usage = `
+Usage:
+	test [--codis [--shard=SLOTS:SERVER]...] [--cluster]
+	test  --version
+`
+	var flags = parseFlagsFromArgs(usage, []string{"--cluster"})
+	assert.Must(flags.Cluster && !flags.Codis)
+	flags = parseFlagsFromArgs(usage, []string{"--codis", "--shard=0-511:127.0.0.1:6380"})
+	assert.Must(flags.Codis && !flags.Cluster)
+	assert.Must(len(flags.Shards) == 1 && flags.Shards[0].Path == "127.0.0.1:6380")
+}
+
+func TestParseFlagsConflictLog(t *testing.T) {
+	const usage = `
+Usage:
+	test [--conflict=POLICY [--conflict-log=FILE]]
+	test  --version
+
+Options:
+	--conflict=POLICY                 Conflict policy. [default: replace].
+`
+	var flags = parseFlagsFromArgs(usage, []string{})
+	assert.Must(flags.Conflict == "replace" && flags.ConflictLog == "")
+	flags = parseFlagsFromArgs(usage, []string{"--conflict=skip", "--conflict-log=a.json"})
+	assert.Must(flags.Conflict == "skip" && flags.ConflictLog == "a.json")
+}
+
+func TestParseFlagsMaxErrors(t *testing.T) {
+	const usage = `
+Usage:
+	test [--max-errors=N] [--dead-letter=FILE]
+	test  --version
+`
+	var flags = parseFlagsFromArgs(usage, []string{})
+	assert.Must(flags.MaxErrors == 0 && flags.DeadLetter == "")
+	flags = parseFlagsFromArgs(usage, []string{"--max-errors=100", "--dead-letter=a.json"})
+	assert.Must(flags.MaxErrors == 100 && flags.DeadLetter == "a.json")
+}
@@ -66,6 +66,28 @@ func (r *CountReader) Read(b []byte) (int, error) {
 	return n, err
 }
 
+// BufferedSeeker is a buffered reader that can be moved by Seek, reads of r
+// and seeks of s must share the same offset, such as a file wrapped by Count.
+type BufferedSeeker struct {
+	*bufio.Reader
+	s io.Seeker
+	r io.Reader
+}
+
+func newBufferedSeeker(r io.Reader, s io.Seeker, size int) *BufferedSeeker {
+	return &BufferedSeeker{bufio.NewReaderSize(r, size), s, r}
+}
+
+// Seek drops the buffered bytes.
+func (b *BufferedSeeker) Seek(offset int64, whence int) (int64, error) {
+	if whence == io.SeekCurrent {
+		offset -= int64(b.Buffered())
+	}
+	n, err := b.s.Seek(offset, whence)
+	b.Reset(b.r)
+	return n, err
+}
+
 type WriterBuilder struct {
 	io.Writer
 }
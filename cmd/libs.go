@@ -3,6 +3,8 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -14,12 +16,15 @@ import (
 	"strings"
 	"sync"
 	"time"
+	"unicode/utf8"
 
 	"github.com/CodisLabs/codis/pkg/proxy/redis"
 	"github.com/CodisLabs/codis/pkg/utils/bufio2"
+	"github.com/CodisLabs/codis/pkg/utils/errors"
 	"github.com/CodisLabs/codis/pkg/utils/log"
 	"github.com/CodisLabs/codis/pkg/utils/sync2/atomic2"
 
+	"github.com/CodisLabs/redis-port/pkg/libs/slot"
 	"github.com/CodisLabs/redis-port/pkg/rdb"
 
 	redigo "github.com/garyburd/redigo/redis"
@@ -234,19 +239,78 @@ func closeFile(file *os.File) {
 	}
 }
 
-func newRDBLoader(r io.Reader, size int) <-chan *rdb.DBEntry {
+func newRDBLoader(r io.Reader, size int) (*rdb.Loader, <-chan *rdb.DBEntry) {
 	var entryChan = make(chan *rdb.DBEntry, size)
+	var loader = rdb.NewLoader(r)
 	go func() {
 		defer close(entryChan)
-		loader := rdb.NewLoader(r)
-		loader.Header()
-		loader.ForEach(func(e *rdb.DBEntry) bool {
+		if err := loader.Header(); err != nil {
+			log.PanicErrorf(err, "load rdb header failed")
+		}
+		if _, err := loader.ForEach(func(e *rdb.DBEntry) bool {
 			entryChan <- e.IncrRefCount()
 			return true
-		})
-		loader.Footer()
+		}); err != nil {
+			log.PanicErrorf(err, "load rdb entries failed")
+		}
+		if err := loader.Footer(); err != nil {
+			log.PanicErrorf(err, "load rdb footer failed")
+		}
 	}()
-	return entryChan
+	return loader, entryChan
+}
+
+// assignShards returns the index of the shard of each slot, it's -1 if the
+// slot isn't assigned to any shard.
+func assignShards(shards []*Shard, maxSlotNum int) []int {
+	var slots = make([]int, maxSlotNum)
+	for i := range slots {
+		slots[i] = -1
+	}
+	for n, shard := range shards {
+		for _, r := range shard.Slots {
+			if r[1] >= maxSlotNum {
+				log.Panicf("invalid slot range [%d,%d] of %q, max slot is %d", r[0], r[1], shard.Path, maxSlotNum-1)
+			}
+			for i := r[0]; i <= r[1]; i++ {
+				if slots[i] >= 0 {
+					log.Panicf("slot %d is assigned to both %q and %q", i, shards[slots[i]].Path, shard.Path)
+				}
+				slots[i] = n
+			}
+		}
+	}
+	return slots
+}
+
+// inputTarget returns the db and the key of e with the db mapping and the key
+// prefix of the input applied.
+func inputTarget(in *Input, e *rdb.DBEntry) (uint64, []byte) {
+	var db = e.DB
+	if to, ok := in.RemapDB[db]; ok {
+		db = to
+	}
+	var key = e.Key.BytesUnsafe()
+	if in.Prefix != "" {
+		key = append([]byte(in.Prefix), key...)
+	}
+	return db, key
+}
+
+func loaderTotalKeys(loader *rdb.Loader) int64 {
+	var total int64
+	for _, size := range loader.DBSize() {
+		total += int64(size.Keys)
+	}
+	return total
+}
+
+func formatETA(elapsed time.Duration, done, total int64) string {
+	if done <= 0 || total <= 0 || done >= total {
+		return "-"
+	}
+	var eta = time.Duration(float64(elapsed) * float64(total-done) / float64(done))
+	return (eta / time.Second * time.Second).String()
 }
 
 func synchronized(l sync.Locker, fn func()) {
@@ -328,30 +392,273 @@ func toJson(v interface{}) string {
 	return string(b)
 }
 
-func toJsonDBEntry(e *rdb.DBEntry, w *bufio.Writer) {
-	encodeJson := func(o interface{}) {
-		b, err := json.Marshal(o)
-		if err != nil {
-			log.PanicError(err, "encode to json failed")
+func toJsonLine(o interface{}, w *bufio.Writer) {
+	b, err := json.Marshal(o)
+	if err != nil {
+		log.PanicError(err, "encode to json failed")
+	}
+	if _, err := w.Write(b); err != nil {
+		log.PanicError(err, "encode to json failed")
+	}
+	if _, err := w.WriteString("\n"); err != nil {
+		log.PanicError(err, "encode to json failed")
+	}
+}
+
+func toJsonHeader(loader *rdb.Loader, w *bufio.Writer) {
+	toJsonLine(&struct {
+		Type    string            `json:"type"`
+		Version int64             `json:"version"`
+		Aux     map[string]string `json:"aux"`
+	}{
+		"header", loader.Version(), loader.Aux(),
+	}, w)
+}
+
+func toJsonDBSize(db uint64, size rdb.DBSize, w *bufio.Writer) {
+	toJsonLine(&struct {
+		DB      uint64 `json:"db"`
+		Type    string `json:"type"`
+		Keys    uint64 `json:"keys"`
+		Expires uint64 `json:"expires"`
+	}{
+		db, "resizedb", size.Keys, size.Expires,
+	}, w)
+}
+
+// jsonEncoding returns the encoding of a json record and the function that
+// encodes its strings. In auto mode the record is encoded in base64 only if
+// any of the strings isn't valid UTF-8, raw strings have no encoding field.
+func jsonEncoding(encoding string, values ...[]byte) (string, func(b []byte) string) {
+	if encoding == "auto" {
+		encoding = "raw"
+		for _, b := range values {
+			if !utf8.Valid(b) {
+				encoding = "base64"
+				break
+			}
+		}
+	}
+	switch encoding {
+	case "hex":
+		return encoding, hex.EncodeToString
+	case "base64":
+		return encoding, base64.StdEncoding.EncodeToString
+	default:
+		return "", func(b []byte) string {
+			return string(b)
+		}
+	}
+}
+
+// decodeJsonString returns the bytes of s written with the encoding.
+func decodeJsonString(s, encoding string) ([]byte, error) {
+	switch encoding {
+	case "", "raw":
+		return []byte(s), nil
+	case "hex":
+		return hex.DecodeString(s)
+	case "base64":
+		return base64.StdEncoding.DecodeString(s)
+	default:
+		return nil, errors.Errorf("unknown encoding %q", encoding)
+	}
+}
+
+// jsonRecord is a line written by toJsonHeader, toJsonDBSize or toJsonDBEntry,
+// strings of the key and the value are encoded with Encoding.
+type jsonRecord struct {
+	DB       uint64   `json:"db"`
+	Type     string   `json:"type"`
+	Key      string   `json:"key"`
+	Field    string   `json:"field"`
+	Value    string   `json:"value"`
+	Member   string   `json:"member"`
+	Score    float64  `json:"score"`
+	ID       string   `json:"id"`
+	Fields   []string `json:"fields"`
+	Args     []string `json:"args"`
+	Group    string   `json:"group"`
+	LastID   string   `json:"lastid"`
+	ExpireAt int64    `json:"expireat"`
+	Pending  []struct {
+		ID            string `json:"id"`
+		Consumer      string `json:"consumer"`
+		DeliveryTime  int64  `json:"delivery_time"`
+		DeliveryCount uint64 `json:"delivery_count"`
+	} `json:"pending"`
+	EntriesRead  *int64  `json:"entries_read"`
+	EntriesAdded *uint64 `json:"entries_added"`
+	MaxDeletedID string  `json:"max_deleted_id"`
+	Encoding     string  `json:"encoding"`
+}
+
+func (r *jsonRecord) Bytes(s string) []byte {
+	b, err := decodeJsonString(s, r.Encoding)
+	if err != nil {
+		log.PanicErrorf(err, "decode json record failed, db=%d type=%q key=%q", r.DB, r.Type, r.Key)
+	}
+	return b
+}
+
+func readJsonRecords(rd io.Reader, on func(r *jsonRecord)) {
+	var dec = json.NewDecoder(rd)
+	for {
+		var r = &jsonRecord{}
+		if err := dec.Decode(r); err != nil {
+			if err == io.EOF {
+				return
+			}
+			log.PanicErrorf(err, "decode json record failed")
+		}
+		on(r)
+	}
+}
+
+// jsonRestorer turns the json records back into the commands that are
+// generated by genRestoreCommands, records of a key must be adjacent.
+type jsonRestorer struct {
+	db  uint64
+	key []byte
+
+	exists bool
+
+	// Elements of the same key are batched like genRestoreCommands.
+	cmd  string
+	args []interface{}
+}
+
+func (s *jsonRestorer) pushArgs(cmd string, on func(cmd string, args ...interface{}), added ...interface{}) {
+	const MaxArgsNum = 511
+	if s.cmd != cmd {
+		s.Flush(on)
+	}
+	if len(s.args) == 0 {
+		s.cmd, s.args = cmd, append(s.args, s.key)
+	}
+	s.args = append(s.args, added...)
+	if len(s.args) >= MaxArgsNum {
+		s.Flush(on)
+	}
+}
+
+// Flush sends the batched command, it must be called after the last record.
+func (s *jsonRestorer) Flush(on func(cmd string, args ...interface{})) {
+	if len(s.args) == 0 {
+		return
+	}
+	on(s.cmd, s.args...)
+	s.cmd, s.args = "", nil
+}
+
+func (s *jsonRestorer) Restore(r *jsonRecord, on func(cmd string, args ...interface{})) {
+	switch r.Type {
+	case "header", "resizedb", "error":
+		return
+	case "module":
+		log.Warnf("module value can't be restored from json, db=%d key=%q", r.DB, r.Key)
+		return
+	case "command":
+		if len(r.Args) == 0 {
+			log.Panicf("bad json command record, db=%d key=%q", r.DB, r.Key)
+		}
+		s.Flush(on)
+		if s.db != r.DB {
+			on("SELECT", r.DB)
+		}
+		s.db, s.key = r.DB, nil
+		var args = make([]interface{}, len(r.Args)-1)
+		for i := range args {
+			args[i] = r.Bytes(r.Args[i+1])
+		}
+		on(string(r.Bytes(r.Args[0])), args...)
+		return
+	}
+	var key = r.Bytes(r.Key)
+	if s.key == nil || s.db != r.DB || !bytes.Equal(s.key, key) {
+		s.Flush(on)
+		if s.db != r.DB {
+			on("SELECT", r.DB)
+		}
+		on("DEL", key)
+		s.db, s.key, s.exists = r.DB, key, false
+	}
+	switch r.Type {
+	case "list":
+		s.pushArgs("RPUSH", on, r.Bytes(r.Value))
+		return
+	case "hash":
+		s.pushArgs("HMSET", on, r.Bytes(r.Field), r.Bytes(r.Value))
+		return
+	case "dict":
+		s.pushArgs("SADD", on, r.Bytes(r.Member))
+		return
+	case "zset":
+		s.pushArgs("ZADD", on, r.Score, r.Bytes(r.Member))
+		return
+	}
+	s.Flush(on)
+	switch r.Type {
+	default:
+		log.Panicf("unknown json record type=%q db=%d key=%q", r.Type, r.DB, r.Key)
+	case "string":
+		on("SET", key, r.Bytes(r.Value))
+	case "expire":
+		on("PEXPIREAT", key, r.ExpireAt)
+	case "stream":
+		var args = make([]interface{}, 0, 2+len(r.Fields))
+		args = append(args, key, r.ID)
+		for _, f := range r.Fields {
+			args = append(args, r.Bytes(f))
 		}
-		if _, err := w.Write(b); err != nil {
-			log.PanicError(err, "encode to json failed")
+		on("XADD", args...)
+		s.exists = true
+	case "stream-group":
+		var group = r.Bytes(r.Group)
+		var args = []interface{}{"CREATE", key, group, r.LastID}
+		if !s.exists {
+			args = append(args, "MKSTREAM")
+			s.exists = true
 		}
-		if _, err := w.WriteString("\n"); err != nil {
-			log.PanicError(err, "encode to json failed")
+		if r.EntriesRead != nil {
+			args = append(args, "ENTRIESREAD", *r.EntriesRead)
 		}
+		on("XGROUP", args...)
+		for _, p := range r.Pending {
+			on("XCLAIM", key, group, r.Bytes(p.Consumer), 0, p.ID,
+				"TIME", p.DeliveryTime, "RETRYCOUNT", p.DeliveryCount, "FORCE", "JUSTID")
+		}
+	case "stream-meta":
+		if !s.exists {
+			genRestoreEmptyStream(key, on)
+		}
+		var args = []interface{}{key, r.LastID}
+		if r.EntriesAdded != nil {
+			args = append(args, "ENTRIESADDED", *r.EntriesAdded, "MAXDELETEDID", r.MaxDeletedID)
+		}
+		on("XSETID", args...)
+	}
+}
+
+func toJsonDBEntry(e *rdb.DBEntry, encoding string, w *bufio.Writer) {
+	encodeJson := func(o interface{}) {
+		toJsonLine(o, w)
 	}
-	switch e.Value.Type() {
+	var key = e.Key.BytesUnsafe()
+	switch e.Type() {
 	default:
-		log.Panicf("unknown object type=%s db=%d key=%q", e.Value.Type(), e.DB, e.Key.String())
+		log.Panicf("unknown object type=%s db=%d key=%q", e.Type(), e.DB, e.Key.String())
 	case rdb.OBJ_STRING:
+		var value = e.Value.AsString().BytesUnsafe()
+		var enc, s = jsonEncoding(encoding, key, value)
 		encodeJson(&struct {
-			DB    uint64 `json:"db"`
-			Type  string `json:"type"`
-			Key   string `json:"key"`
-			Value string `json:"value"`
+			DB       uint64 `json:"db"`
+			Type     string `json:"type"`
+			Key      string `json:"key"`
+			Value    string `json:"value"`
+			Encoding string `json:"encoding,omitempty"`
 		}{
-			e.DB, "string", e.Key.StringUnsafe(), e.Value.AsString().StringUnsafe(),
+			e.DB, "string", s(key), s(value), enc,
 		})
 	case rdb.OBJ_LIST:
 		e.Value.AsList().ForEach(func(iter *rdb.RedisListIterator, index int) bool {
@@ -359,14 +666,16 @@ func toJsonDBEntry(e *rdb.DBEntry, w *bufio.Writer) {
 			if field == nil {
 				return false
 			}
+			var enc, s = jsonEncoding(encoding, key, field.BytesUnsafe())
 			encodeJson(&struct {
-				DB    uint64 `json:"db"`
-				Type  string `json:"type"`
-				Key   string `json:"key"`
-				Index int    `json:"index"`
-				Value string `json:"value"`
+				DB       uint64 `json:"db"`
+				Type     string `json:"type"`
+				Key      string `json:"key"`
+				Index    int    `json:"index"`
+				Value    string `json:"value"`
+				Encoding string `json:"encoding,omitempty"`
 			}{
-				e.DB, "list", e.Key.StringUnsafe(), index, field.StringUnsafe(),
+				e.DB, "list", s(key), index, s(field.BytesUnsafe()), enc,
 			})
 			return true
 		})
@@ -376,14 +685,16 @@ func toJsonDBEntry(e *rdb.DBEntry, w *bufio.Writer) {
 			if field == nil {
 				return false
 			}
+			var enc, s = jsonEncoding(encoding, key, field.BytesUnsafe(), value.BytesUnsafe())
 			encodeJson(&struct {
-				DB    uint64 `json:"db"`
-				Type  string `json:"type"`
-				Key   string `json:"key"`
-				Field string `json:"field"`
-				Value string `json:"value"`
+				DB       uint64 `json:"db"`
+				Type     string `json:"type"`
+				Key      string `json:"key"`
+				Field    string `json:"field"`
+				Value    string `json:"value"`
+				Encoding string `json:"encoding,omitempty"`
 			}{
-				e.DB, "hash", e.Key.StringUnsafe(), field.StringUnsafe(), value.StringUnsafe(),
+				e.DB, "hash", s(key), s(field.BytesUnsafe()), s(value.BytesUnsafe()), enc,
 			})
 			return true
 		})
@@ -393,13 +704,15 @@ func toJsonDBEntry(e *rdb.DBEntry, w *bufio.Writer) {
 			if member == nil {
 				return false
 			}
+			var enc, s = jsonEncoding(encoding, key, member.BytesUnsafe())
 			encodeJson(&struct {
-				DB     uint64 `json:"db"`
-				Type   string `json:"type"`
-				Key    string `json:"key"`
-				Member string `json:"member"`
+				DB       uint64 `json:"db"`
+				Type     string `json:"type"`
+				Key      string `json:"key"`
+				Member   string `json:"member"`
+				Encoding string `json:"encoding,omitempty"`
 			}{
-				e.DB, "dict", e.Key.StringUnsafe(), member.StringUnsafe(),
+				e.DB, "dict", s(key), s(member.BytesUnsafe()), enc,
 			})
 			return true
 		})
@@ -409,193 +722,2459 @@ func toJsonDBEntry(e *rdb.DBEntry, w *bufio.Writer) {
 			if member == nil {
 				return false
 			}
+			var enc, s = jsonEncoding(encoding, key, member.BytesUnsafe())
+			encodeJson(&struct {
+				DB       uint64  `json:"db"`
+				Type     string  `json:"type"`
+				Key      string  `json:"key"`
+				Index    int     `json:"index"`
+				Member   string  `json:"member"`
+				Score    float64 `json:"score"`
+				Encoding string  `json:"encoding,omitempty"`
+			}{
+				e.DB, "zset", s(key), index, s(member.BytesUnsafe()), member.Score, enc,
+			})
+			return true
+		})
+	case rdb.OBJ_MODULE:
+		var enc, s = jsonEncoding(encoding, key)
+		encodeJson(&struct {
+			DB       uint64 `json:"db"`
+			Type     string `json:"type"`
+			Key      string `json:"key"`
+			Module   string `json:"module"`
+			Version  int    `json:"encver"`
+			Size     int    `json:"size"`
+			Encoding string `json:"encoding,omitempty"`
+		}{
+			e.DB, "module", s(key), e.Module.Name, e.Module.Version, e.Module.Len(), enc,
+		})
+	case rdb.OBJ_STREAM:
+		var stream = e.Value.AsStream()
+		stream.ForEach(func(iter *rdb.RedisStreamIterator, index int) bool {
+			var entry = iter.Next()
+			if entry == nil {
+				return false
+			}
+			var values = make([][]byte, 0, len(entry.Fields)*2+1)
+			values = append(values, key)
+			for i := range entry.Fields {
+				values = append(values, entry.Fields[i].BytesUnsafe(), entry.Values[i].BytesUnsafe())
+			}
+			var enc, s = jsonEncoding(encoding, values...)
+			var fields = make([]string, 0, len(values)-1)
+			for _, b := range values[1:] {
+				fields = append(fields, s(b))
+			}
 			encodeJson(&struct {
-				DB     uint64  `json:"db"`
-				Type   string  `json:"type"`
-				Key    string  `json:"key"`
-				Index  int     `json:"index"`
-				Member string  `json:"member"`
-				Score  float64 `json:"score"`
+				DB       uint64   `json:"db"`
+				Type     string   `json:"type"`
+				Key      string   `json:"key"`
+				Index    int      `json:"index"`
+				ID       string   `json:"id"`
+				Fields   []string `json:"fields"`
+				Encoding string   `json:"encoding,omitempty"`
 			}{
-				e.DB, "zset", e.Key.StringUnsafe(), index, member.StringUnsafe(), member.Score,
+				e.DB, "stream", s(key), index, entry.ID.String(), fields, enc,
 			})
 			return true
 		})
+		type pending struct {
+			ID            string `json:"id"`
+			Consumer      string `json:"consumer"`
+			DeliveryTime  uint64 `json:"delivery_time"`
+			DeliveryCount uint64 `json:"delivery_count"`
+		}
+		type consumer struct {
+			Name     string   `json:"name"`
+			SeenTime uint64   `json:"seen_time"`
+			Pending  []string `json:"pending"`
+		}
+		var meta = stream.Meta()
+		for _, g := range stream.Groups() {
+			var values = [][]byte{key, []byte(g.Name)}
+			for _, c := range g.Consumers {
+				values = append(values, []byte(c.Name))
+			}
+			var enc, s = jsonEncoding(encoding, values...)
+			var pendings = make([]*pending, 0, len(g.Pending))
+			for _, p := range g.Pending {
+				pendings = append(pendings, &pending{
+					p.ID.String(), s([]byte(p.Consumer)), uint64(p.DeliveryTime / time.Millisecond), p.DeliveryCount,
+				})
+			}
+			var consumers = make([]*consumer, 0, len(g.Consumers))
+			for _, c := range g.Consumers {
+				var ids = make([]string, 0, len(c.Pending))
+				for _, id := range c.Pending {
+					ids = append(ids, id.String())
+				}
+				consumers = append(consumers, &consumer{
+					s([]byte(c.Name)), uint64(c.SeenTime / time.Millisecond), ids,
+				})
+			}
+			var entriesRead *int64
+			if meta != nil && g.EntriesRead >= 0 {
+				entriesRead = &g.EntriesRead
+			}
+			encodeJson(&struct {
+				DB          uint64      `json:"db"`
+				Type        string      `json:"type"`
+				Key         string      `json:"key"`
+				Group       string      `json:"group"`
+				LastID      string      `json:"lastid"`
+				EntriesRead *int64      `json:"entries_read,omitempty"`
+				Pending     []*pending  `json:"pending"`
+				Consumers   []*consumer `json:"consumers"`
+				Encoding    string      `json:"encoding,omitempty"`
+			}{
+				e.DB, "stream-group", s(key), s([]byte(g.Name)), g.LastID.String(), entriesRead, pendings, consumers, enc,
+			})
+		}
+		var entriesAdded *uint64
+		var maxDeletedID string
+		if meta != nil {
+			entriesAdded, maxDeletedID = &meta.EntriesAdded, meta.MaxDeletedID.String()
+		}
+		var enc, s = jsonEncoding(encoding, key)
+		encodeJson(&struct {
+			DB           uint64  `json:"db"`
+			Type         string  `json:"type"`
+			Key          string  `json:"key"`
+			Length       int     `json:"length"`
+			LastID       string  `json:"lastid"`
+			EntriesAdded *uint64 `json:"entries_added,omitempty"`
+			MaxDeletedID string  `json:"max_deleted_id,omitempty"`
+			Encoding     string  `json:"encoding,omitempty"`
+		}{
+			e.DB, "stream-meta", s(key), stream.Len(), stream.LastID().String(), entriesAdded, maxDeletedID, enc,
+		})
 	}
 	if e.Expire != rdb.NoExpire {
+		var enc, s = jsonEncoding(encoding, key)
 		encodeJson(&struct {
 			DB       uint64 `json:"db"`
 			Type     string `json:"type"`
 			Key      string `json:"key"`
 			ExpireAt uint64 `json:"expireat"`
+			Encoding string `json:"encoding,omitempty"`
 		}{
-			e.DB, "expire", e.Key.StringUnsafe(), uint64(e.Expire / time.Millisecond),
+			e.DB, "expire", s(key), uint64(e.Expire / time.Millisecond), enc,
 		})
 	}
 }
 
-func redigoOpenConn(addr, auth string) redigo.Conn {
-	return redigo.NewConn(openConn(addr, auth), 0, 0)
-}
-
-func redigoSendCommand(c redigo.Conn, cmd string, args ...interface{}) {
-	if err := c.Send(cmd, args...); err != nil {
-		log.PanicErrorf(err, "send redigo request failed")
-	}
-}
-
-func redigoFlushConnIf(c redigo.Conn, on func() bool) {
-	if on() {
-		redigoFlushConn(c)
-	}
-}
-
-func redigoFlushConn(c redigo.Conn) {
-	if err := c.Flush(); err != nil {
-		log.PanicErrorf(err, "flush redigo connection failed")
+// objectEncoding returns the encoding name of the object that is reported
+// by OBJECT ENCODING of redis. Listpacks are converted by the loader, they're
+// told by the type of the object in the RDB.
+func objectEncoding(e *rdb.DBEntry) string {
+	switch e.RDBType {
+	case rdb.RDB_TYPE_HASH_LISTPACK, rdb.RDB_TYPE_ZSET_LISTPACK, rdb.RDB_TYPE_SET_LISTPACK:
+		return "listpack"
+	case rdb.RDB_TYPE_LIST_QUICKLIST_2:
+		return "quicklist"
 	}
-}
-
-func redigoGetResponse(c redigo.Conn) {
-	_, err := c.Receive()
-	if err != nil {
-		log.PanicErrorf(err, "fetch redigo reply failed")
+	switch enc := e.Value.Encoding(); enc {
+	case rdb.OBJ_ENCODING_HT:
+		return "hashtable"
+	default:
+		return strings.ToLower(strings.TrimPrefix(enc.String(), "ENCODING_"))
 	}
 }
 
-func genRestoreCommands(e *rdb.DBEntry, db uint64, on func(cmd string, args ...interface{})) {
-	if db != e.DB {
-		on("SELECT", e.DB)
-	}
+// toJsonObjectDBEntry writes the entry as a json object of its own line with
+// the db, type, encoding and expireat of the key. Values are strings, arrays
+// of list elements and set members, objects of hash fields and zset member
+// scores.
+func toJsonObjectDBEntry(e *rdb.DBEntry, encoding string, w *bufio.Writer) {
 	var key = e.Key.BytesUnsafe()
-	on("DEL", key)
 
-	const MaxArgsNum = 511
-	var args []interface{}
-	var pushArgs = func(cmd string, added ...interface{}) {
-		if len(args) == 0 {
-			args = append(args, key)
-		}
-		args = append(args, added...)
-		if len(args) < MaxArgsNum {
-			return
-		}
-		on(cmd, args...)
-		args = make([]interface{}, 0, MaxArgsNum+1)
-	}
-	var flushCommand = func(cmd string) {
-		if len(args) == 0 {
-			return
-		}
-		on(cmd, args...)
-	}
-	switch e.Value.Type() {
+	// All strings of the key are collected first, they share one encoding.
+	var elems = [][]byte{key}
+	var scores []float64
+	var stream *rdb.RedisStreamObject
+	switch e.Type() {
 	default:
-		log.Panicf("unknown object type db=%d key=%s", e.DB, e.Key.String())
+		log.Panicf("unknown object type=%s db=%d key=%q", e.Type(), e.DB, e.Key.String())
+	case rdb.OBJ_MODULE:
 	case rdb.OBJ_STRING:
-		on("SET", key, e.Value.AsString().BytesUnsafe())
+		elems = append(elems, e.Value.AsString().BytesUnsafe())
 	case rdb.OBJ_LIST:
 		e.Value.AsList().ForEach(func(iter *rdb.RedisListIterator, index int) bool {
 			var field = iter.Next()
 			if field == nil {
 				return false
 			}
-			pushArgs("RPUSH", field.BytesUnsafe())
+			elems = append(elems, field.BytesUnsafe())
 			return true
 		})
-		flushCommand("RPUSH")
 	case rdb.OBJ_HASH:
 		e.Value.AsHash().ForEach(func(iter *rdb.RedisHashIterator, index int) bool {
 			var field, value = iter.Next()
 			if field == nil {
 				return false
 			}
-			pushArgs("HMSET", field.BytesUnsafe(), value.BytesUnsafe())
+			elems = append(elems, field.BytesUnsafe(), value.BytesUnsafe())
 			return true
 		})
-		flushCommand("HMSET")
 	case rdb.OBJ_SET:
 		e.Value.AsSet().ForEach(func(iter *rdb.RedisSetIterator, index int) bool {
 			var member = iter.Next()
 			if member == nil {
 				return false
 			}
-			pushArgs("SADD", member.BytesUnsafe())
+			elems = append(elems, member.BytesUnsafe())
 			return true
 		})
-		flushCommand("SADD")
 	case rdb.OBJ_ZSET:
 		e.Value.AsZset().ForEach(func(iter *rdb.RedisZsetIterator, index int) bool {
 			var member = iter.Next()
 			if member == nil {
 				return false
 			}
-			pushArgs("ZADD", member.Score, member.BytesUnsafe())
+			elems = append(elems, member.BytesUnsafe())
+			scores = append(scores, member.Score)
 			return true
 		})
-		flushCommand("ZADD")
+	case rdb.OBJ_STREAM:
+		stream = e.Value.AsStream()
+		stream.ForEach(func(iter *rdb.RedisStreamIterator, index int) bool {
+			var entry = iter.Next()
+			if entry == nil {
+				return false
+			}
+			for i := range entry.Fields {
+				elems = append(elems, entry.Fields[i].BytesUnsafe(), entry.Values[i].BytesUnsafe())
+			}
+			return true
+		})
+		for _, g := range stream.Groups() {
+			elems = append(elems, []byte(g.Name))
+			for _, c := range g.Consumers {
+				elems = append(elems, []byte(c.Name))
+			}
+		}
+	}
+	var enc, s = jsonEncoding(encoding, elems...)
+
+	var object = struct {
+		DB       uint64      `json:"db"`
+		Key      string      `json:"key"`
+		Type     string      `json:"type"`
+		Encoding string      `json:"encoding"`
+		ExpireAt uint64      `json:"expireat,omitempty"`
+		Value    interface{} `json:"value"`
+		Strings  string      `json:"string_encoding,omitempty"`
+	}{
+		DB: e.DB, Key: s(key), Strings: enc,
+	}
+	if e.Type() != rdb.OBJ_MODULE {
+		object.Encoding = objectEncoding(e)
 	}
 	if e.Expire != rdb.NoExpire {
-		on("PEXPIREAT", key, int64(e.Expire/time.Millisecond))
+		object.ExpireAt = uint64(e.Expire / time.Millisecond)
 	}
-}
-
-func doRestoreDBEntry(entryChan <-chan *rdb.DBEntry, addr, auth string, on func(e *rdb.DBEntry) bool) {
-	var ticker = time.NewTicker(time.Millisecond * 250)
-	defer ticker.Stop()
 
-	var tick atomic2.Int64
-	go func() {
-		for range ticker.C {
-			tick.Incr()
+	var strs = func(elems [][]byte) []string {
+		var list = make([]string, 0, len(elems))
+		for _, b := range elems {
+			list = append(list, s(b))
 		}
-	}()
-
-	var c = redigoOpenConn(addr, auth)
-	defer c.Close()
-
-	var replyChan = make(chan *rdb.DBEntry, 128)
-
-	NewJob(func() {
-		defer close(replyChan)
-		var db uint64
-		for e := range entryChan {
-			if on(e) {
-				genRestoreCommands(e, db, func(cmd string, args ...interface{}) {
-					redigoSendCommand(c, cmd, args...)
-					redigoFlushConnIf(c, func() bool {
-						switch {
-						case tick.Swap(0) != 0:
-							return true
-						case len(replyChan) == cap(replyChan):
-							return true
-						default:
-							return len(entryChan) == 0
-						}
-					})
-					replyChan <- e.IncrRefCount()
+		return list
+	}
+	switch e.Type() {
+	case rdb.OBJ_MODULE:
+		object.Type, object.Encoding = "module", "module"
+		object.Value = &struct {
+			Module  string `json:"module"`
+			Version int    `json:"encver"`
+			Size    int    `json:"size"`
+		}{
+			e.Module.Name, e.Module.Version, e.Module.Len(),
+		}
+	case rdb.OBJ_STRING:
+		object.Type, object.Value = "string", s(elems[1])
+	case rdb.OBJ_LIST:
+		object.Type, object.Value = "list", strs(elems[1:])
+	case rdb.OBJ_SET:
+		object.Type, object.Value = "set", strs(elems[1:])
+	case rdb.OBJ_HASH:
+		var hash = make(map[string]string, len(elems)/2)
+		for i := 1; i+1 < len(elems); i += 2 {
+			hash[s(elems[i])] = s(elems[i+1])
+		}
+		object.Type, object.Value = "hash", hash
+	case rdb.OBJ_ZSET:
+		var zset = make(map[string]float64, len(scores))
+		for i, score := range scores {
+			zset[s(elems[i+1])] = score
+		}
+		object.Type, object.Value = "sortedset", zset
+	case rdb.OBJ_STREAM:
+		type entry struct {
+			ID     string   `json:"id"`
+			Fields []string `json:"fields"`
+		}
+		type consumer struct {
+			Name     string   `json:"name"`
+			SeenTime uint64   `json:"seen_time"`
+			Pending  []string `json:"pending"`
+		}
+		type group struct {
+			Name      string      `json:"name"`
+			LastID    string      `json:"lastid"`
+			Consumers []*consumer `json:"consumers"`
+		}
+		var entries = make([]*entry, 0, stream.Len())
+		stream.ForEach(func(iter *rdb.RedisStreamIterator, index int) bool {
+			var x = iter.Next()
+			if x == nil {
+				return false
+			}
+			var fields = make([]string, 0, len(x.Fields)*2)
+			for i := range x.Fields {
+				fields = append(fields, s(x.Fields[i].BytesUnsafe()), s(x.Values[i].BytesUnsafe()))
+			}
+			entries = append(entries, &entry{x.ID.String(), fields})
+			return true
+		})
+		var groups = make([]*group, 0, len(stream.Groups()))
+		for _, g := range stream.Groups() {
+			var consumers = make([]*consumer, 0, len(g.Consumers))
+			for _, c := range g.Consumers {
+				var ids = make([]string, 0, len(c.Pending))
+				for _, id := range c.Pending {
+					ids = append(ids, id.String())
+				}
+				consumers = append(consumers, &consumer{
+					s([]byte(c.Name)), uint64(c.SeenTime / time.Millisecond), ids,
 				})
-				db = e.DB
 			}
-			e.DecrRefCount()
+			groups = append(groups, &group{s([]byte(g.Name)), g.LastID.String(), consumers})
 		}
-		redigoFlushConn(c)
-	}).Run()
-
-	NewJob(func() {
-		for e := range replyChan {
-			e.DecrRefCount()
-			redigoGetResponse(c)
+		object.Type = "stream"
+		object.Value = &struct {
+			Length  int      `json:"length"`
+			LastID  string   `json:"lastid"`
+			Entries []*entry `json:"entries"`
+			Groups  []*group `json:"groups"`
+		}{
+			stream.Len(), stream.LastID().String(), entries, groups,
 		}
-	}).RunAndWait()
+	}
+	toJsonLine(&object, w)
 }
 
-func doRestoreAoflog(reader *bufio2.Reader, addr, auth string, on func(db uint64, cmd string) bool) {
-	var ticker = time.NewTicker(time.Millisecond * 100)
-	defer ticker.Stop()
-
-	var tick atomic2.Int64
-	go func() {
+// toCsvRecord writes a row of csv, or tsv if tsv is set. Fields of csv are
+// quoted as RFC 4180, backslash, tab and line breaks are escaped in tsv.
+func toCsvRecord(record []string, tsv bool, w *bufio.Writer) {
+	var b bytes.Buffer
+	for i, field := range record {
+		switch {
+		case tsv:
+			if i != 0 {
+				b.WriteByte('\t')
+			}
+			for j := 0; j < len(field); j++ {
+				switch c := field[j]; c {
+				case '\\':
+					b.WriteString("\\\\")
+				case '\t':
+					b.WriteString("\\t")
+				case '\n':
+					b.WriteString("\\n")
+				case '\r':
+					b.WriteString("\\r")
+				default:
+					b.WriteByte(c)
+				}
+			}
+		default:
+			if i != 0 {
+				b.WriteByte(',')
+			}
+			if !strings.ContainsAny(field, ",\"\r\n") {
+				b.WriteString(field)
+				continue
+			}
+			b.WriteByte('"')
+			b.WriteString(strings.Replace(field, `"`, `""`, -1))
+			b.WriteByte('"')
+		}
+	}
+	b.WriteByte('\n')
+	if _, err := w.Write(b.Bytes()); err != nil {
+		log.PanicErrorf(err, "write csv record failed")
+	}
+}
+
+// toCsvDBEntry writes a row for each element of the entry, columns that
+// don't apply to the type are left empty. Entries of streams are written
+// as rows of their fields, the member is the entry id.
+func toCsvDBEntry(e *rdb.DBEntry, columns []string, tsv bool, encoding string, w *bufio.Writer) {
+	// Both csv and tsv hold any bytes, so keys and values are raw in auto mode.
+	if encoding == "auto" {
+		encoding = "raw"
+	}
+	var key = e.Key.BytesUnsafe()
+	var typ = strings.ToLower(strings.TrimPrefix(e.Type().String(), "OBJ_"))
+	var record = make([]string, len(columns))
+	var writeRow = func(index int, field, member, value []byte, score *float64) {
+		var enc, s = jsonEncoding(encoding, key, field, member, value)
+		for i, column := range columns {
+			switch column {
+			case "db":
+				record[i] = strconv.FormatUint(e.DB, 10)
+			case "key":
+				record[i] = s(key)
+			case "type":
+				record[i] = typ
+			case "index":
+				record[i] = ""
+				if index >= 0 {
+					record[i] = strconv.Itoa(index)
+				}
+			case "field":
+				record[i] = s(field)
+			case "member":
+				record[i] = s(member)
+			case "value":
+				record[i] = s(value)
+			case "score":
+				record[i] = ""
+				if score != nil {
+					record[i] = strconv.FormatFloat(*score, 'g', -1, 64)
+				}
+			case "expire_at_ms":
+				record[i] = ""
+				if e.Expire != rdb.NoExpire {
+					record[i] = strconv.FormatInt(int64(e.Expire/time.Millisecond), 10)
+				}
+			case "encoding":
+				record[i] = enc
+			}
+		}
+		toCsvRecord(record, tsv, w)
+	}
+	switch e.Type() {
+	default:
+		log.Panicf("unknown object type=%s db=%d key=%q", e.Type(), e.DB, e.Key.String())
+	case rdb.OBJ_MODULE:
+		writeRow(-1, nil, nil, nil, nil)
+	case rdb.OBJ_STRING:
+		writeRow(-1, nil, nil, e.Value.AsString().BytesUnsafe(), nil)
+	case rdb.OBJ_LIST:
+		e.Value.AsList().ForEach(func(iter *rdb.RedisListIterator, index int) bool {
+			var field = iter.Next()
+			if field == nil {
+				return false
+			}
+			writeRow(index, nil, nil, field.BytesUnsafe(), nil)
+			return true
+		})
+	case rdb.OBJ_HASH:
+		e.Value.AsHash().ForEach(func(iter *rdb.RedisHashIterator, index int) bool {
+			var field, value = iter.Next()
+			if field == nil {
+				return false
+			}
+			writeRow(-1, field.BytesUnsafe(), nil, value.BytesUnsafe(), nil)
+			return true
+		})
+	case rdb.OBJ_SET:
+		e.Value.AsSet().ForEach(func(iter *rdb.RedisSetIterator, index int) bool {
+			var member = iter.Next()
+			if member == nil {
+				return false
+			}
+			writeRow(-1, nil, member.BytesUnsafe(), nil, nil)
+			return true
+		})
+	case rdb.OBJ_ZSET:
+		e.Value.AsZset().ForEach(func(iter *rdb.RedisZsetIterator, index int) bool {
+			var member = iter.Next()
+			if member == nil {
+				return false
+			}
+			var score = member.Score
+			writeRow(index, nil, member.BytesUnsafe(), nil, &score)
+			return true
+		})
+	case rdb.OBJ_STREAM:
+		e.Value.AsStream().ForEach(func(iter *rdb.RedisStreamIterator, index int) bool {
+			var entry = iter.Next()
+			if entry == nil {
+				return false
+			}
+			var id = []byte(entry.ID.String())
+			for i := range entry.Fields {
+				writeRow(index, entry.Fields[i].BytesUnsafe(), id, entry.Values[i].BytesUnsafe(), nil)
+			}
+			return true
+		})
+	}
+}
+
+func toRespDBEntry(e *rdb.DBEntry, db uint64, w *bufio.Writer) {
+	genRestoreCommands(e, db, func(cmd string, args ...interface{}) {
+		toRespCommand(w, cmd, args...)
+	})
+}
+
+func toRedisCliDBEntry(e *rdb.DBEntry, db uint64, w *bufio.Writer) {
+	genRestoreCommands(e, db, func(cmd string, args ...interface{}) {
+		toRedisCliCommand(w, cmd, args...)
+	})
+}
+
+func toRespCommand(w *bufio.Writer, cmd string, args ...interface{}) {
+	if err := redis.Encode(w, redisNewCommand(cmd, args...)); err != nil {
+		log.PanicErrorf(err, "encode resp failed")
+	}
+}
+
+func toRedisCliCommand(w *bufio.Writer, cmd string, args ...interface{}) {
+	var b bytes.Buffer
+	for i, r := range redisNewCommand(cmd, args...).Array {
+		if i != 0 {
+			b.WriteByte(' ')
+		}
+		redisCliQuote(&b, r.Value)
+	}
+	b.WriteByte('\n')
+	if _, err := w.Write(b.Bytes()); err != nil {
+		log.PanicErrorf(err, "write command failed")
+	}
+}
+
+// redisCliQuote writes s as an argument that can be parsed by redis-cli, it's
+// quoted if it's empty or has any whitespace, quote or non-printable byte.
+func redisCliQuote(b *bytes.Buffer, s []byte) {
+	var plain = len(s) != 0
+	for _, c := range s {
+		if c <= ' ' || c >= 0x7f || c == '"' || c == '\'' || c == '\\' {
+			plain = false
+			break
+		}
+	}
+	if plain {
+		b.Write(s)
+		return
+	}
+	b.WriteByte('"')
+	for _, c := range s {
+		switch c {
+		case '\\', '"':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case '\n':
+			b.WriteString("\\n")
+		case '\r':
+			b.WriteString("\\r")
+		case '\t':
+			b.WriteString("\\t")
+		default:
+			if c < ' ' || c >= 0x7f {
+				fmt.Fprintf(b, "\\x%02x", c)
+			} else {
+				b.WriteByte(c)
+			}
+		}
+	}
+	b.WriteByte('"')
+}
+
+// entryWriter writes entries in the output formats of redis-decode, the
+// header record goes before the first entry, and the resizedb record goes
+// before the first entry of each database, both are json only.
+type entryWriter struct {
+	loader *rdb.Loader
+	flags  *Flags
+	wt     *bufio.Writer
+
+	header bool
+	dbsize map[uint64]bool
+
+	// Commands are generated with the db of the previous entry, so SELECT
+	// is sent only if the db is changed.
+	db uint64
+}
+
+func newEntryWriter(loader *rdb.Loader, flags *Flags, wt *bufio.Writer) *entryWriter {
+	return &entryWriter{
+		loader: loader, flags: flags, wt: wt,
+		header: flags.Format != "json",
+		dbsize: make(map[uint64]bool),
+	}
+}
+
+func (w *entryWriter) writeHeader(e *rdb.DBEntry) {
+	if !w.header {
+		toJsonHeader(w.loader, w.wt)
+		w.header = true
+	}
+	if e == nil || w.dbsize[e.DB] || w.flags.Format != "json" {
+		return
+	}
+	if size, ok := w.loader.DBSize()[e.DB]; ok {
+		toJsonDBSize(e.DB, size, w.wt)
+	}
+	w.dbsize[e.DB] = true
+}
+
+func (w *entryWriter) Write(e *rdb.DBEntry) {
+	w.writeHeader(e)
+	switch w.flags.Format {
+	case "resp":
+		toRespDBEntry(e, w.db, w.wt)
+	case "redis-cli":
+		toRedisCliDBEntry(e, w.db, w.wt)
+	case "json-object":
+		toJsonObjectDBEntry(e, w.flags.Encoding, w.wt)
+	case "csv", "tsv":
+		toCsvDBEntry(e, w.flags.Columns, w.flags.Format == "tsv", w.flags.Encoding, w.wt)
+	default:
+		toJsonDBEntry(e, w.flags.Encoding, w.wt)
+	}
+	w.db = e.DB
+}
+
+// Close writes the header if no entry has been written.
+func (w *entryWriter) Close() {
+	w.writeHeader(nil)
+}
+
+func redigoOpenConn(addr, auth string) redigo.Conn {
+	return redigo.NewConn(openConn(addr, auth), 0, 0)
+}
+
+func redigoSendCommand(c redigo.Conn, cmd string, args ...interface{}) {
+	if err := c.Send(cmd, args...); err != nil {
+		log.PanicErrorf(err, "send redigo request failed")
+	}
+}
+
+func redigoFlushConnIf(c redigo.Conn, on func() bool) {
+	if on() {
+		redigoFlushConn(c)
+	}
+}
+
+func redigoFlushConn(c redigo.Conn) {
+	if err := c.Flush(); err != nil {
+		log.PanicErrorf(err, "flush redigo connection failed")
+	}
+}
+
+func redigoGetResponse(c redigo.Conn) {
+	_, err := c.Receive()
+	if err != nil {
+		log.PanicErrorf(err, "fetch redigo reply failed")
+	}
+}
+
+func genRestoreCommands(e *rdb.DBEntry, db uint64, on func(cmd string, args ...interface{})) {
+	if db != e.DB {
+		on("SELECT", e.DB)
+	}
+	var key = e.Key.BytesUnsafe()
+	on("DEL", key)
+
+	const MaxArgsNum = 511
+	var args []interface{}
+	var pushArgs = func(cmd string, added ...interface{}) {
+		if len(args) == 0 {
+			args = append(args, key)
+		}
+		args = append(args, added...)
+		if len(args) < MaxArgsNum {
+			return
+		}
+		on(cmd, args...)
+		args = make([]interface{}, 0, MaxArgsNum+1)
+	}
+	var flushCommand = func(cmd string) {
+		if len(args) == 0 {
+			return
+		}
+		on(cmd, args...)
+	}
+	switch e.Type() {
+	default:
+		log.Panicf("unknown object type db=%d key=%s", e.DB, e.Key.String())
+	case rdb.OBJ_MODULE:
+		on("RESTORE", key, 0, e.Module.CreateDumpPayload())
+	case rdb.OBJ_STRING:
+		on("SET", key, e.Value.AsString().BytesUnsafe())
+	case rdb.OBJ_LIST:
+		e.Value.AsList().ForEach(func(iter *rdb.RedisListIterator, index int) bool {
+			var field = iter.Next()
+			if field == nil {
+				return false
+			}
+			pushArgs("RPUSH", field.BytesUnsafe())
+			return true
+		})
+		flushCommand("RPUSH")
+	case rdb.OBJ_HASH:
+		e.Value.AsHash().ForEach(func(iter *rdb.RedisHashIterator, index int) bool {
+			var field, value = iter.Next()
+			if field == nil {
+				return false
+			}
+			pushArgs("HMSET", field.BytesUnsafe(), value.BytesUnsafe())
+			return true
+		})
+		flushCommand("HMSET")
+	case rdb.OBJ_SET:
+		e.Value.AsSet().ForEach(func(iter *rdb.RedisSetIterator, index int) bool {
+			var member = iter.Next()
+			if member == nil {
+				return false
+			}
+			pushArgs("SADD", member.BytesUnsafe())
+			return true
+		})
+		flushCommand("SADD")
+	case rdb.OBJ_ZSET:
+		e.Value.AsZset().ForEach(func(iter *rdb.RedisZsetIterator, index int) bool {
+			var member = iter.Next()
+			if member == nil {
+				return false
+			}
+			pushArgs("ZADD", member.Score, member.BytesUnsafe())
+			return true
+		})
+		flushCommand("ZADD")
+	case rdb.OBJ_STREAM:
+		genRestoreStreamCommands(key, e.Value.AsStream(), on)
+	}
+	if e.Expire != rdb.NoExpire {
+		on("PEXPIREAT", key, int64(e.Expire/time.Millisecond))
+	}
+}
+
+// MaxRestorePayloadSize is the default proto-max-bulk-len of redis, larger
+// payloads are restored by commands.
+const MaxRestorePayloadSize = 512 * 1024 * 1024
+
+// genRestorePayloadCommand generates RESTORE with the DUMP payload of e, which
+// replaces the key at once if replace is set, or fails with BUSYKEY if the
+// key exists. It returns false if the payload is too large or e can't be
+// restored by payloads.
+// ABSTTL is supported by redis 5.0 and later, which is also required by the
+// payloads of RDB_VERSION 9.
+func genRestorePayloadCommand(e *rdb.DBEntry, db uint64, replace bool, on func(cmd string, args ...interface{})) bool {
+	if !canRestorePayload(e) {
+		return false
+	}
+	var payload []byte
+	if e.Module != nil {
+		payload = e.Module.CreateDumpPayload()
+	} else {
+		var sds = e.Value.CreateDumpPayloadUnsafe()
+		defer sds.Release()
+		payload = sds.BytesUnsafe()
+	}
+	if len(payload) > MaxRestorePayloadSize {
+		return false
+	}
+	if db != e.DB {
+		on("SELECT", e.DB)
+	}
+	var ttl int64
+	if e.Expire != rdb.NoExpire {
+		ttl = int64(e.Expire / time.Millisecond)
+	}
+	var args = []interface{}{e.Key.BytesUnsafe(), ttl, payload}
+	if replace {
+		args = append(args, "REPLACE")
+	}
+	if e.Expire != rdb.NoExpire {
+		args = append(args, "ABSTTL")
+	}
+	on("RESTORE", args...)
+	return true
+}
+
+// canRestorePayload reports whether e can be restored by the DUMP payload.
+// Payloads are written as STREAM_LISTPACKS of RDB_VERSION 9, which loses the
+// entries_added, max_deleted_id and entries_read of streams that carry them,
+// so such streams are restored by commands.
+func canRestorePayload(e *rdb.DBEntry) bool {
+	if e.Module != nil || e.Type() != rdb.OBJ_STREAM {
+		return true
+	}
+	return e.Value.AsStream().Meta() == nil
+}
+
+// redisVersionToRDB returns the RDB version of the redis_version, or 0 if
+// it's unknown.
+func redisVersionToRDB(version string) int64 {
+	var major, minor int
+	if _, err := fmt.Sscanf(version, "%d.%d", &major, &minor); err != nil {
+		return 0
+	}
+	switch v := major*100 + minor; {
+	case v >= 704:
+		return 12
+	case v >= 702:
+		return 11
+	case v >= 700:
+		return 10
+	case v >= 500:
+		return 9
+	case v >= 400:
+		return 8
+	case v >= 302:
+		return 7
+	case v >= 206:
+		return 6
+	}
+	return 0
+}
+
+// checkRestorePayload reports whether the target can load the payloads of
+// RESTORE, the RDB version of the target is known by INFO.
+func checkRestorePayload(addr, auth string) bool {
+	var c = redigoOpenConn(addr, auth)
+	defer c.Close()
+	info, err := redigo.String(c.Do("INFO", "server"))
+	if err != nil {
+		log.WarnErrorf(err, "fetch info of target %q failed, keys are restored by commands", addr)
+		return false
+	}
+	var version string
+	for _, line := range strings.Split(info, "\n") {
+		if strings.HasPrefix(line, "redis_version:") {
+			version = strings.TrimSpace(strings.TrimPrefix(line, "redis_version:"))
+		}
+	}
+	if redisVersionToRDB(version) < rdb.RDB_VERSION {
+		log.Warnf("target %q of redis_version = %q can't load payloads of rdb version %d, keys are restored by commands", addr, version, rdb.RDB_VERSION)
+		return false
+	}
+	return true
+}
+
+func genRestoreStreamCommands(key []byte, stream *rdb.RedisStreamObject, on func(cmd string, args ...interface{})) {
+	var exists bool
+	stream.ForEach(func(iter *rdb.RedisStreamIterator, index int) bool {
+		var entry = iter.Next()
+		if entry == nil {
+			return false
+		}
+		var args = make([]interface{}, 0, 2+len(entry.Fields)*2)
+		args = append(args, key, entry.ID.String())
+		for i := range entry.Fields {
+			args = append(args, entry.Fields[i].BytesUnsafe(), entry.Values[i].BytesUnsafe())
+		}
+		on("XADD", args...)
+		exists = true
+		return true
+	})
+	var meta = stream.Meta()
+	for _, g := range stream.Groups() {
+		var args = []interface{}{"CREATE", key, g.Name, g.LastID.String()}
+		if !exists {
+			args = append(args, "MKSTREAM")
+			exists = true
+		}
+		if meta != nil && g.EntriesRead >= 0 {
+			args = append(args, "ENTRIESREAD", g.EntriesRead)
+		}
+		on("XGROUP", args...)
+		// XCLAIM with FORCE recreates the pending entry and assigns it to the
+		// consumer, idle consumers without pending entries are not restored.
+		for _, p := range g.Pending {
+			on("XCLAIM", key, g.Name, p.Consumer, 0, p.ID.String(),
+				"TIME", int64(p.DeliveryTime/time.Millisecond),
+				"RETRYCOUNT", p.DeliveryCount, "FORCE", "JUSTID")
+		}
+	}
+	if !exists {
+		genRestoreEmptyStream(key, on)
+	}
+	// ENTRIESADDED and MAXDELETEDID are only known to redis 7.0 and later,
+	// they're sent only if the stream carries them.
+	var args = []interface{}{key, stream.LastID().String()}
+	if meta != nil {
+		args = append(args, "ENTRIESADDED", meta.EntriesAdded, "MAXDELETEDID", meta.MaxDeletedID.String())
+	}
+	on("XSETID", args...)
+}
+
+// genRestoreEmptyStream creates an empty stream, XADD can't add the entry of
+// 0-0, so the stream is created by a group that is destroyed at once.
+func genRestoreEmptyStream(key []byte, on func(cmd string, args ...interface{})) {
+	const group = "redis-port"
+	on("XGROUP", "CREATE", key, group, "$", "MKSTREAM")
+	on("XGROUP", "DESTROY", key, group)
+}
+
+// restoreConflict is the policy of keys that exist in the target, keys that
+// are skipped or conflicted are counted and written to Log as json.
+type restoreConflict struct {
+	Policy string
+	Count  atomic2.Int64
+
+	mu  sync.Mutex
+	Log *bufio.Writer
+}
+
+// Merge reports whether e is merged into the key in the target, only lists,
+// hashes, sets and zsets can be merged. The ttl of e is set only if the key
+// doesn't exist, a key that exists keeps its own ttl.
+func (c *restoreConflict) Merge(e *rdb.DBEntry) bool {
+	if c == nil || c.Policy != "merge" {
+		return false
+	}
+	switch e.Type() {
+	case rdb.OBJ_LIST, rdb.OBJ_HASH, rdb.OBJ_SET, rdb.OBJ_ZSET:
+		return true
+	}
+	return false
+}
+
+// Report counts the conflict of e, restore is aborted if the policy is fail.
+func (c *restoreConflict) Report(e *rdb.DBEntry, reason string) {
+	c.Count.Incr()
+	var key = e.Key.BytesUnsafe()
+	if c.Log != nil {
+		var enc, s = jsonEncoding("auto", key)
+		synchronized(&c.mu, func() {
+			toJsonLine(&struct {
+				DB       uint64 `json:"db"`
+				Type     string `json:"type"`
+				Key      string `json:"key"`
+				Conflict string `json:"conflict"`
+				Encoding string `json:"encoding,omitempty"`
+			}{
+				e.DB, strings.ToLower(strings.TrimPrefix(e.Type().String(), "OBJ_")), s(key), reason, enc,
+			}, c.Log)
+		})
+	}
+	if c.Policy == "fail" {
+		synchronized(&c.mu, func() {
+			if c.Log != nil {
+				c.Log.Flush()
+			}
+		})
+		log.Panicf("restore: conflict db=%d key=%q reason=%s, aborted", e.DB, e.Key.String(), reason)
+	}
+}
+
+// Transient errors of the target are retried, the delay is doubled after
+// each retry.
+const (
+	MaxRestoreRetries = 6
+	RestoreRetryDelay = time.Millisecond * 200
+)
+
+// isTransientError reports whether the error reply is likely to be gone if
+// the command is sent again later.
+func isTransientError(err error) bool {
+	if _, ok := err.(redigo.Error); !ok {
+		return false
+	}
+	for _, prefix := range []string{"LOADING ", "BUSY ", "OOM ", "TRYAGAIN ", "MASTERDOWN "} {
+		if strings.HasPrefix(err.Error(), prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// retryTransient calls fn again after a delay while it fails with transient
+// errors, the last error is returned.
+func retryTransient(fn func() error) error {
+	var delay = RestoreRetryDelay
+	for i := 0; ; i++ {
+		var err = fn()
+		if err == nil || i >= MaxRestoreRetries || !isTransientError(err) {
+			return err
+		}
+		log.WarnErrorf(err, "retry in %s", delay)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// restoreErrors records the keys and commands that fail in the target. They
+// are written to Log as json records of redis-decode, which are replayed by
+// redis-decode --input-format=json, and records of type error that tell the
+// error of each key. Restore is aborted once there are more than Max errors,
+// a nil restoreErrors aborts at the first error.
+type restoreErrors struct {
+	Max   int64
+	Count atomic2.Int64
+
+	mu  sync.Mutex
+	Log *bufio.Writer
+}
+
+// Key records the error of e, cmd is the command that fails.
+func (t *restoreErrors) Key(e *rdb.DBEntry, cmd string, err error) {
+	var key = e.Key.BytesUnsafe()
+	if t == nil {
+		log.PanicErrorf(err, "restore key %q of db %d failed, command = %s", e.Key.String(), e.DB, cmd)
+	}
+	log.WarnErrorf(err, "restore key %q of db %d failed, command = %s", e.Key.String(), e.DB, cmd)
+	if t.Log != nil {
+		var enc, s = jsonEncoding("auto", key)
+		synchronized(&t.mu, func() {
+			toJsonLine(&struct {
+				DB       uint64 `json:"db"`
+				Type     string `json:"type"`
+				Key      string `json:"key"`
+				Command  string `json:"command"`
+				Error    string `json:"error"`
+				Encoding string `json:"encoding,omitempty"`
+			}{
+				e.DB, "error", s(key), cmd, err.Error(), enc,
+			}, t.Log)
+			toJsonDBEntry(e, "auto", t.Log)
+		})
+	}
+	t.incr(err)
+}
+
+// Command records the error of a command of the aof stream.
+func (t *restoreErrors) Command(db uint64, args [][]byte, err error) {
+	if t == nil {
+		log.PanicErrorf(err, "restore command %s of db %d failed", args[0], db)
+	}
+	log.WarnErrorf(err, "restore command %s of db %d failed", args[0], db)
+	if t.Log != nil {
+		var enc, s = jsonEncoding("auto", args...)
+		var argv = make([]string, len(args))
+		for i := range args {
+			argv[i] = s(args[i])
+		}
+		var key string
+		if len(argv) > 1 {
+			key = argv[1]
+		}
+		synchronized(&t.mu, func() {
+			toJsonLine(&struct {
+				DB       uint64   `json:"db"`
+				Type     string   `json:"type"`
+				Key      string   `json:"key"`
+				Args     []string `json:"args"`
+				Error    string   `json:"error"`
+				Encoding string   `json:"encoding,omitempty"`
+			}{
+				db, "command", key, argv, err.Error(), enc,
+			}, t.Log)
+		})
+	}
+	t.incr(err)
+}
+
+func (t *restoreErrors) incr(err error) {
+	if t.Count.Incr() > t.Max {
+		t.Flush()
+		log.PanicErrorf(err, "restore: %d errors, aborted", t.Count.Int64())
+	}
+}
+
+// Flush flushes Log, it must be called after restore is done.
+func (t *restoreErrors) Flush() {
+	if t != nil && t.Log != nil {
+		synchronized(&t.mu, func() {
+			flushWriter(t.Log)
+		})
+	}
+}
+
+// MaxRestoreBatchKeys is the number of keys that are restored in a batch on
+// the fallback connection once they're known not to exist in the target.
+const MaxRestoreBatchKeys = 128
+
+// doRestoreDBEntry restores entries by RESTORE payloads if payload is set, or
+// by commands. Keys that the target fails to load from payloads are restored
+// by commands on another connection. If conflict isn't nil, keys that exist
+// in the target are skipped, or merged by commands without DEL, and the keys
+// that don't exist are restored on the other connection in batches. Keys that
+// fail with transient errors are restored again, and keys that still fail
+// are recorded by errs.
+func doRestoreDBEntry(entryChan <-chan *rdb.DBEntry, addr, auth string, payload bool,
+	conflict *restoreConflict, errs *restoreErrors, on func(e *rdb.DBEntry) bool) {
+	var ticker = time.NewTicker(time.Millisecond * 250)
+	defer ticker.Stop()
+
+	var tick atomic2.Int64
+	go func() {
+		for range ticker.C {
+			tick.Incr()
+		}
+	}()
+
+	var c = redigoOpenConn(addr, auth)
+	defer c.Close()
+
+	const (
+		replyCommand = iota
+		replyPayload
+		replyExists
+		replyMerge
+	)
+	// Commands of an entry are followed by a reply with done set, which
+	// has no command and ends the entry.
+	type restoreReply struct {
+		e    *rdb.DBEntry
+		cmd  string
+		kind int
+		done bool
+	}
+	var replyChan = make(chan *restoreReply, 128)
+
+	NewJob(func() {
+		defer close(replyChan)
+		var db uint64
+		for e := range entryChan {
+			if on(e) {
+				var push = func(r *restoreReply) {
+					redigoFlushConnIf(c, func() bool {
+						switch {
+						case tick.Swap(0) != 0:
+							return true
+						case len(replyChan) == cap(replyChan):
+							return true
+						default:
+							return len(entryChan) == 0
+						}
+					})
+					replyChan <- r
+				}
+				var kind int
+				var send = func(cmd string, args ...interface{}) {
+					redigoSendCommand(c, cmd, args...)
+					var r = &restoreReply{cmd: cmd}
+					switch {
+					case kind == replyMerge && cmd == "EXISTS":
+						r.kind = replyExists
+					case kind == replyMerge:
+						r.kind = kind
+					case kind == replyPayload && cmd == "RESTORE", kind == replyExists && cmd == "EXISTS":
+						r.kind = kind
+					}
+					push(r)
+				}
+				switch {
+				case conflict.Merge(e):
+					kind = replyMerge
+					genRestoreCommands(e, db, func(cmd string, args ...interface{}) {
+						switch {
+						case cmd == "DEL" && e.Expire != rdb.NoExpire:
+							// PEXPIREAT is sent after the merge if the key
+							// doesn't exist before.
+							send("EXISTS", args...)
+						case cmd == "DEL", cmd == "PEXPIREAT":
+						default:
+							send(cmd, args...)
+						}
+					})
+				case payload && genRestorePayloadCommand(e, db, conflict == nil, func(cmd string, args ...interface{}) {
+					kind = replyPayload
+					send(cmd, args...)
+				}):
+				case conflict == nil:
+					genRestoreCommands(e, db, send)
+				default:
+					kind = replyExists
+					if db != e.DB {
+						send("SELECT", e.DB)
+					}
+					send("EXISTS", e.Key.BytesUnsafe())
+				}
+				push(&restoreReply{e: e.IncrRefCount(), kind: kind, done: true})
+				db = e.DB
+			}
+			e.DecrRefCount()
+		}
+		redigoFlushConn(c)
+	}).Run()
+
+	var fallback redigo.Conn
+	var fallbackDB uint64
+	defer func() {
+		if fallback != nil {
+			fallback.Close()
+		}
+	}()
+
+	// restore restores e on the fallback connection, the key is checked by
+	// EXISTS first if check is set. It reports whether the key exists, and
+	// the first error reply and its command.
+	var restore = func(e *rdb.DBEntry, payload, check bool) (bool, string, error) {
+		if fallback == nil {
+			fallback = redigoOpenConn(addr, auth)
+		}
+		if check {
+			if fallbackDB != e.DB {
+				if _, err := fallback.Do("SELECT", e.DB); err != nil {
+					return false, "SELECT", err
+				}
+				fallbackDB = e.DB
+			}
+			n, err := redigo.Int(fallback.Do("EXISTS", e.Key.BytesUnsafe()))
+			if err != nil || n != 0 {
+				return n != 0, "EXISTS", err
+			}
+		}
+		cmd, err := doRestoreEntrySync(fallback, fallbackDB, e, payload, conflict == nil)
+		fallbackDB = e.DB
+		if cmd == "RESTORE" && conflict != nil && err != nil && strings.HasPrefix(err.Error(), "BUSYKEY") {
+			return true, cmd, nil
+		}
+		return false, cmd, err
+	}
+
+	// expire sets the ttl of the merged e on the fallback connection.
+	var expire = func(e *rdb.DBEntry) (string, error) {
+		if fallback == nil {
+			fallback = redigoOpenConn(addr, auth)
+		}
+		if fallbackDB != e.DB {
+			if _, err := fallback.Do("SELECT", e.DB); err != nil {
+				return "SELECT", err
+			}
+			fallbackDB = e.DB
+		}
+		_, err := fallback.Do("PEXPIREAT", e.Key.BytesUnsafe(), int64(e.Expire/time.Millisecond))
+		return "PEXPIREAT", err
+	}
+
+	// Keys that don't exist in the target are restored on the fallback
+	// connection in batches, the commands of a batch are pipelined. Keys
+	// that fail with transient errors are restored again one by one.
+	type fallbackEntry struct {
+		e     *rdb.DBEntry
+		merge bool
+	}
+	var batch []*fallbackEntry
+	var flush = func() {
+		if len(batch) == 0 {
+			return
+		}
+		if fallback == nil {
+			fallback = redigoOpenConn(addr, auth)
+		}
+		var cmds []string
+		var index []int
+		for i, b := range batch {
+			var on = func(cmd string, args ...interface{}) {
+				redigoSendCommand(fallback, cmd, args...)
+				cmds, index = append(cmds, cmd), append(index, i)
+			}
+			if !b.merge {
+				genRestoreCommands(b.e, fallbackDB, on)
+			} else {
+				if fallbackDB != b.e.DB {
+					on("SELECT", b.e.DB)
+				}
+				on("PEXPIREAT", b.e.Key.BytesUnsafe(), int64(b.e.Expire/time.Millisecond))
+			}
+			fallbackDB = b.e.DB
+		}
+		redigoFlushConn(fallback)
+		var failed = make([]string, len(batch))
+		var lastErr = make([]error, len(batch))
+		for j, cmd := range cmds {
+			_, err := fallback.Receive()
+			if _, ok := err.(redigo.Error); err != nil && !ok {
+				log.PanicErrorf(err, "fetch redigo reply failed")
+			}
+			if i := index[j]; err != nil && lastErr[i] == nil {
+				failed[i], lastErr[i] = cmd, err
+			}
+		}
+		for i, b := range batch {
+			var cmd, err = failed[i], lastErr[i]
+			if isTransientError(err) {
+				err = retryTransient(func() error {
+					var err error
+					if b.merge {
+						cmd, err = expire(b.e)
+					} else {
+						_, cmd, err = restore(b.e, false, false)
+					}
+					return err
+				})
+			}
+			if err != nil {
+				errs.Key(b.e, cmd, err)
+			}
+			b.e.DecrRefCount()
+		}
+		batch = batch[:0]
+	}
+
+	NewJob(func() {
+		defer flush()
+		var exists bool
+		var failed *restoreReply
+		var lastErr error
+		for r := range replyChan {
+			if !r.done {
+				reply, err := c.Receive()
+				if _, ok := err.(redigo.Error); err != nil && !ok {
+					log.PanicErrorf(err, "fetch redigo reply failed")
+				}
+				if r.kind == replyExists && err == nil {
+					n, _ := redigo.Int(reply, nil)
+					exists = n != 0
+				}
+				if err != nil && failed == nil {
+					failed, lastErr = r, err
+				}
+				continue
+			}
+			var e, cmd, err = r.e, "", lastErr
+			if failed != nil {
+				cmd = failed.cmd
+			}
+			var retry = func(payload, check bool) {
+				err = retryTransient(func() error {
+					var exists bool
+					exists, cmd, err = restore(e, payload, check)
+					if exists {
+						conflict.Report(e, "exists")
+					}
+					return err
+				})
+			}
+			switch {
+			case err == nil && r.kind == replyExists && exists:
+				conflict.Report(e, "exists")
+			case err == nil && r.kind == replyExists:
+				batch = append(batch, &fallbackEntry{e: e.IncrRefCount()})
+			case err == nil && r.kind == replyMerge && !exists && e.Expire != rdb.NoExpire:
+				batch = append(batch, &fallbackEntry{e: e.IncrRefCount(), merge: true})
+			case err == nil:
+			case r.kind == replyPayload && cmd == "RESTORE" && strings.HasPrefix(err.Error(), "BUSYKEY"):
+				conflict.Report(e, "exists")
+				err = nil
+			case r.kind == replyMerge && strings.HasPrefix(err.Error(), "WRONGTYPE"):
+				conflict.Report(e, "wrongtype")
+				err = nil
+			case r.kind == replyMerge:
+				// Merges aren't retried, elements of lists would be added twice.
+			case r.kind == replyPayload && cmd == "RESTORE" && !isTransientError(err):
+				log.Warnf("RESTORE of key %q is rejected, restore it by commands, %s", e.Key.String(), err)
+				retry(false, conflict != nil)
+			case isTransientError(err):
+				retry(r.kind == replyPayload, conflict != nil && r.kind != replyCommand)
+			}
+			if err != nil {
+				errs.Key(e, cmd, err)
+			}
+			exists, failed, lastErr = false, nil, nil
+			e.DecrRefCount()
+			if len(batch) >= MaxRestoreBatchKeys || len(replyChan) == 0 {
+				flush()
+			}
+		}
+	}).RunAndWait()
+}
+
+// doRestoreEntrySync restores e by the RESTORE payload if payload is set, or
+// by commands, and waits for the replies. The first error reply and its
+// command are returned.
+func doRestoreEntrySync(c redigo.Conn, db uint64, e *rdb.DBEntry, payload, replace bool) (string, error) {
+	var cmds []string
+	var on = func(cmd string, args ...interface{}) {
+		redigoSendCommand(c, cmd, args...)
+		cmds = append(cmds, cmd)
+	}
+	if !payload || !genRestorePayloadCommand(e, db, replace, on) {
+		genRestoreCommands(e, db, on)
+	}
+	redigoFlushConn(c)
+	var failed string
+	var lastErr error
+	for _, cmd := range cmds {
+		_, err := c.Receive()
+		if _, ok := err.(redigo.Error); err != nil && !ok {
+			log.PanicErrorf(err, "fetch redigo reply failed")
+		}
+		if err != nil && lastErr == nil {
+			failed, lastErr = cmd, err
+		}
+	}
+	return failed, lastErr
+}
+
+// Limits of SLOTSRESTORE batches, the pending batches of all slots are sent
+// once they hold more than MaxCodisPendingSize bytes of payloads.
+const (
+	MaxCodisBatchKeys   = 128
+	MaxCodisBatchSize   = 1024 * 1024
+	MaxCodisPendingSize = 64 * 1024 * 1024
+)
+
+// codisTarget is the codis-proxy, or a codis-server that serves some slots.
+// Payload is set if it can load the DUMP payloads, which is checked for each
+// target, codis-servers may run different versions.
+type codisTarget struct {
+	Addr, Auth string
+	Payload    bool
+}
+
+// newCodisTargets returns the targets and the index of the target of each
+// slot, slots of shards are sent straight to the codis-servers and the
+// others are sent to the codis-proxy.
+func newCodisTargets(addr, auth string, shards []*Shard) ([]*codisTarget, []int) {
+	var targets = []*codisTarget{{Addr: addr, Auth: auth}}
+	var route = make([]int, slot.MaxCodisSlotNum)
+	for _, shard := range shards {
+		var t = &codisTarget{}
+		t.Addr, t.Auth = redisParsePath(shard.Path)
+		if len(t.Addr) == 0 {
+			log.Panicf("invalid codis-server address %q", shard.Path)
+		}
+		targets = append(targets, t)
+		for _, r := range shard.Slots {
+			if r[1] >= slot.MaxCodisSlotNum {
+				log.Panicf("invalid slot range [%d,%d] of %q", r[0], r[1], shard.Path)
+			}
+			for i := r[0]; i <= r[1]; i++ {
+				if route[i] != 0 {
+					log.Panicf("slot %d is served by both %q and %q", i, targets[route[i]].Addr, t.Addr)
+				}
+				route[i] = len(targets) - 1
+			}
+		}
+	}
+	return targets, route
+}
+
+// codisProgress counts the restored keys of each slot.
+type codisProgress [slot.MaxCodisSlotNum]atomic2.Int64
+
+func (p *codisProgress) Done(slot int, n int) {
+	p[slot].Add(int64(n))
+}
+
+// Slots returns the number of slots that have restored keys.
+func (p *codisProgress) Slots() int {
+	var n int
+	for i := range p {
+		if p[i].Int64() != 0 {
+			n++
+		}
+	}
+	return n
+}
+
+// doRestoreCodisEntry restores entries by SLOTSRESTORE, keys of the same slot
+// are sent to the codis-servers in batches, or by commands if the target can't
+// load payloads. The codis-proxy doesn't serve SLOTSRESTORE, keys of the slots
+// that aren't given by shards are restored through it by RESTORE key by key.
+// A batch or RESTORE that fails with transient errors is sent again, if it's
+// still rejected, it's restored again by commands key by key, and keys that
+// still fail are recorded by errs. The number of restored
+// keys of each slot is reported by done.
+func doRestoreCodisEntry(entryChan <-chan *rdb.DBEntry, targets []*codisTarget, route []int,
+	errs *restoreErrors, on func(e *rdb.DBEntry) bool, done func(slot int, n int)) {
+	var ticker = time.NewTicker(time.Millisecond * 250)
+	defer ticker.Stop()
+
+	var tick atomic2.Int64
+	go func() {
+		for range ticker.C {
+			tick.Incr()
+		}
+	}()
+
+	type codisReply struct {
+		slot    int
+		entries []*rdb.DBEntry
+		payload bool
+		cmd     string
+	}
+	type codisConn struct {
+		*codisTarget
+		c         redigo.Conn
+		replyChan chan *codisReply
+		fallback  redigo.Conn
+	}
+	var conns = make([]*codisConn, len(targets))
+	for i, t := range targets {
+		conns[i] = &codisConn{
+			codisTarget: t,
+			c:           redigoOpenConn(t.Addr, t.Auth),
+			replyChan:   make(chan *codisReply, 128),
+		}
+	}
+	defer func() {
+		for _, c := range conns {
+			c.c.Close()
+			if c.fallback != nil {
+				c.fallback.Close()
+			}
+		}
+	}()
+
+	var send = func(c *codisConn, r *codisReply, cmd string, args ...interface{}) {
+		redigoSendCommand(c.c, cmd, args...)
+		r.cmd = cmd
+		redigoFlushConnIf(c.c, func() bool {
+			switch {
+			case tick.Swap(0) != 0:
+				return true
+			case len(c.replyChan) == cap(c.replyChan):
+				return true
+			default:
+				return len(entryChan) == 0
+			}
+		})
+		c.replyChan <- r
+	}
+
+	// ttl returns the relative ttl of e in milliseconds, 0 means no expire
+	// and -1 means e has expired. It's computed just before it's sent, a
+	// batch may wait for a while.
+	var ttl = func(e *rdb.DBEntry) int64 {
+		if e.Expire == rdb.NoExpire {
+			return 0
+		}
+		var ttl = int64((e.Expire - time.Duration(time.Now().UnixNano())) / time.Millisecond)
+		if ttl <= 0 {
+			return -1
+		}
+		return ttl
+	}
+
+	type codisBatch struct {
+		entries []*rdb.DBEntry
+		data    [][]byte
+		sds     []*rdb.RedisSds
+		size    int
+	}
+	var batches = make([]*codisBatch, slot.MaxCodisSlotNum)
+	var pending int
+
+	var flush = func(i int) {
+		var b = batches[i]
+		if b == nil {
+			return
+		}
+		batches[i], pending = nil, pending-b.size
+		var args = make([]interface{}, 0, len(b.entries)*3)
+		var entries = b.entries[:0]
+		for j, e := range b.entries {
+			var key = e.Key.BytesUnsafe()
+			if ttl := ttl(e); ttl >= 0 {
+				args = append(args, key, ttl, b.data[j])
+				entries = append(entries, e)
+			} else {
+				send(conns[route[i]], &codisReply{slot: i, entries: []*rdb.DBEntry{e}}, "DEL", key)
+			}
+		}
+		if len(entries) != 0 {
+			send(conns[route[i]], &codisReply{slot: i, entries: entries, payload: true}, "SLOTSRESTORE", args...)
+		}
+		for _, sds := range b.sds {
+			sds.Release()
+		}
+	}
+
+	NewJob(func() {
+		defer func() {
+			for _, c := range conns {
+				close(c.replyChan)
+			}
+		}()
+		for e := range entryChan {
+			if on(e) {
+				var key = e.Key.BytesUnsafe()
+				var i = slot.CodisSlot(key)
+				var expire = ttl(e)
+				var expired = expire < 0
+				var data []byte
+				var sds *rdb.RedisSds
+				if conns[route[i]].Payload && !expired && canRestorePayload(e) {
+					if e.Module != nil {
+						data = e.Module.CreateDumpPayload()
+					} else {
+						sds = e.Value.CreateDumpPayloadUnsafe()
+						data = sds.BytesUnsafe()
+					}
+					if len(data) > MaxRestorePayloadSize {
+						if sds != nil {
+							sds.Release()
+						}
+						data, sds = nil, nil
+					}
+				}
+				switch {
+				case expired:
+					send(conns[route[i]], &codisReply{slot: i, entries: []*rdb.DBEntry{e.IncrRefCount()}}, "DEL", key)
+				case data == nil:
+					var r = &codisReply{slot: i}
+					var cmds [][]interface{}
+					genRestoreCommands(e, e.DB, func(cmd string, args ...interface{}) {
+						cmds = append(cmds, append([]interface{}{cmd}, args...))
+					})
+					for j, args := range cmds {
+						if j == len(cmds)-1 {
+							r.entries = []*rdb.DBEntry{e.IncrRefCount()}
+						}
+						send(conns[route[i]], r, args[0].(string), args[1:]...)
+						r = &codisReply{slot: i}
+					}
+				case route[i] == 0:
+					var r = &codisReply{slot: i, entries: []*rdb.DBEntry{e.IncrRefCount()}, payload: true}
+					send(conns[0], r, "RESTORE", key, expire, data, "REPLACE")
+					if sds != nil {
+						sds.Release()
+					}
+				default:
+					var b = batches[i]
+					if b == nil {
+						b = &codisBatch{}
+						batches[i] = b
+					}
+					b.entries = append(b.entries, e.IncrRefCount())
+					b.data = append(b.data, data)
+					if sds != nil {
+						b.sds = append(b.sds, sds)
+					}
+					b.size, pending = b.size+len(data), pending+len(data)
+					switch {
+					case len(b.entries) >= MaxCodisBatchKeys, b.size >= MaxCodisBatchSize:
+						flush(i)
+					case pending >= MaxCodisPendingSize:
+						for i := range batches {
+							flush(i)
+						}
+					}
+				}
+			}
+			e.DecrRefCount()
+		}
+		for i := range batches {
+			flush(i)
+		}
+		for _, c := range conns {
+			redigoFlushConn(c.c)
+		}
+	}).Run()
+
+	var jobs = make([]<-chan struct{}, len(conns))
+	for i, c := range conns {
+		var c = c
+		var fallback = func() redigo.Conn {
+			if c.fallback == nil {
+				c.fallback = redigoOpenConn(c.Addr, c.Auth)
+			}
+			return c.fallback
+		}
+		// restore restores e by commands on the fallback connection, and
+		// retries transient errors.
+		var restore = func(e *rdb.DBEntry) {
+			var cmd string
+			var err = retryTransient(func() error {
+				var err error
+				cmd, err = doRestoreEntrySync(fallback(), e.DB, e, false, true)
+				return err
+			})
+			if err != nil {
+				errs.Key(e, cmd, err)
+			}
+		}
+		// resend sends the RESTORE or SLOTSRESTORE of r again on the fallback
+		// connection, the payloads have been released and are created again.
+		var resend = func(r *codisReply) error {
+			if r.cmd == "RESTORE" {
+				_, err := doRestoreEntrySync(fallback(), r.entries[0].DB, r.entries[0], true, true)
+				return err
+			}
+			var args = make([]interface{}, 0, len(r.entries)*3)
+			for _, e := range r.entries {
+				// Keys that have expired meanwhile expire at once.
+				var expire = ttl(e)
+				if expire < 0 {
+					expire = 1
+				}
+				if e.Module != nil {
+					args = append(args, e.Key.BytesUnsafe(), expire, e.Module.CreateDumpPayload())
+				} else {
+					var sds = e.Value.CreateDumpPayloadUnsafe()
+					defer sds.Release()
+					args = append(args, e.Key.BytesUnsafe(), expire, sds.BytesUnsafe())
+				}
+			}
+			_, err := fallback().Do("SLOTSRESTORE", args...)
+			if _, ok := err.(redigo.Error); err != nil && !ok {
+				log.PanicErrorf(err, "fetch redigo reply failed")
+			}
+			return err
+		}
+		jobs[i] = NewJob(func() {
+			// The commands of a key end with the reply that has entries.
+			var failed string
+			var lastErr error
+			for r := range c.replyChan {
+				_, err := c.c.Receive()
+				if _, ok := err.(redigo.Error); err != nil && !ok {
+					log.PanicErrorf(err, "fetch redigo reply failed")
+				}
+				switch {
+				case err != nil && r.payload:
+					if isTransientError(err) {
+						log.WarnErrorf(err, "%s of slot %d failed, send it again", r.cmd, r.slot)
+						err = retryTransient(func() error {
+							return resend(r)
+						})
+					}
+					if err != nil {
+						log.Warnf("%s of slot %d is rejected, restore %d keys by commands, %s", r.cmd, r.slot, len(r.entries), err)
+						for _, e := range r.entries {
+							restore(e)
+						}
+					}
+				case err != nil && lastErr == nil:
+					failed, lastErr = r.cmd, err
+				}
+				if !r.payload && len(r.entries) != 0 && lastErr != nil {
+					if isTransientError(lastErr) {
+						restore(r.entries[0])
+					} else {
+						errs.Key(r.entries[0], failed, lastErr)
+					}
+					failed, lastErr = "", nil
+				}
+				for _, e := range r.entries {
+					e.DecrRefCount()
+				}
+				if len(r.entries) != 0 {
+					done(r.slot, len(r.entries))
+				}
+			}
+		}).Run()
+	}
+	for _, job := range jobs {
+		<-job
+	}
+}
+
+// MaxClusterRedirects is the number of redirections followed by a command.
+const MaxClusterRedirects = 5
+
+// MaxClusterAsks is the number of ASK redirections before the slot map is
+// reloaded, a slot that is being migrated is only redirected by ASK.
+const MaxClusterAsks = 64
+
+// clusterRoute is the slot map of a redis cluster, it's loaded by CLUSTER
+// SLOTS and updated by MOVED redirections.
+type clusterRoute struct {
+	mu    sync.RWMutex
+	seed  string
+	auth  string
+	nodes []string
+	stale bool
+	asks  int
+}
+
+func newClusterRoute(addr, auth string) *clusterRoute {
+	var r = &clusterRoute{seed: addr, auth: auth}
+	if err := r.Reload(); err != nil {
+		log.PanicErrorf(err, "load slots of cluster %q failed", addr)
+	}
+	return r
+}
+
+// Reload loads the slot map from the seed, or from any known master if the
+// seed is gone.
+func (r *clusterRoute) Reload() error {
+	var lastErr error
+	for _, addr := range append([]string{r.seed}, r.Masters()...) {
+		nodes, err := r.load(addr)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		r.mu.Lock()
+		r.nodes, r.stale, r.asks = nodes, false, 0
+		r.mu.Unlock()
+		return nil
+	}
+	return lastErr
+}
+
+func (r *clusterRoute) load(addr string) ([]string, error) {
+	c, err := redigo.Dial("tcp", addr, redigo.DialPassword(r.auth),
+		redigo.DialConnectTimeout(time.Second*5), redigo.DialReadTimeout(time.Second*5))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer c.Close()
+	values, err := redigo.Values(c.Do("CLUSTER", "SLOTS"))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	var nodes = make([]string, slot.MaxClusterSlotNum)
+	for _, v := range values {
+		var beg, end int
+		var master []interface{}
+		if _, err := redigo.Scan(v.([]interface{}), &beg, &end, &master); err != nil {
+			return nil, errors.Trace(err)
+		}
+		var host string
+		var port int
+		if _, err := redigo.Scan(master, &host, &port); err != nil {
+			return nil, errors.Trace(err)
+		}
+		if host == "" {
+			host, _, _ = net.SplitHostPort(addr)
+		}
+		for i := beg; i <= end && i < len(nodes); i++ {
+			nodes[i] = net.JoinHostPort(host, strconv.Itoa(port))
+		}
+	}
+	for i, node := range nodes {
+		if node == "" {
+			return nil, errors.Errorf("slot %d of cluster %q isn't served", i, addr)
+		}
+	}
+	return nodes, nil
+}
+
+// Lookup returns the master of the slot.
+func (r *clusterRoute) Lookup(i int) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.nodes[i]
+}
+
+// Masters returns the masters that serve slots.
+func (r *clusterRoute) Masters() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var masters []string
+	var exists = make(map[string]bool)
+	for _, node := range r.nodes {
+		if !exists[node] {
+			exists[node] = true
+			masters = append(masters, node)
+		}
+	}
+	return masters
+}
+
+// parseClusterRedirect parses the MOVED and ASK errors, e.g.
+// "MOVED 3999 127.0.0.1:6381", it returns false if err isn't one of them.
+func parseClusterRedirect(err error) (ask bool, i int, addr string, ok bool) {
+	if _, ok := err.(redigo.Error); !ok {
+		return false, 0, "", false
+	}
+	var fields = strings.Fields(err.Error())
+	if len(fields) != 3 || (fields[0] != "MOVED" && fields[0] != "ASK") {
+		return false, 0, "", false
+	}
+	i, err = strconv.Atoi(fields[1])
+	if err != nil || i < 0 || i >= slot.MaxClusterSlotNum {
+		return false, 0, "", false
+	}
+	return fields[0] == "ASK", i, fields[2], true
+}
+
+// Redirect parses the MOVED and ASK errors, the slot of MOVED is updated and
+// the slot map is marked stale, so is it after MaxClusterAsks ASK
+// redirections. It should be called once for each reply.
+func (r *clusterRoute) Redirect(err error) (ask bool, addr string, ok bool) {
+	ask, i, addr, ok := parseClusterRedirect(err)
+	if !ok {
+		return false, "", false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if ask {
+		if r.asks++; r.asks >= MaxClusterAsks {
+			r.stale = true
+		}
+	} else {
+		r.nodes[i], r.stale = addr, true
+	}
+	return ask, addr, true
+}
+
+// RefreshIfStale reloads the slot map after MOVED or repeated ASK
+// redirections, the slots updated by MOVED are kept if it fails.
+func (r *clusterRoute) RefreshIfStale() {
+	r.mu.RLock()
+	var stale = r.stale
+	r.mu.RUnlock()
+	if !stale {
+		return
+	}
+	if err := r.Reload(); err != nil {
+		log.WarnErrorf(err, "reload slots of cluster %q failed", r.seed)
+	}
+}
+
+// clusterReply is the pending reply of a command sent to a node, a reply
+// with done set has no command and ends the commands of e.
+type clusterReply struct {
+	e       *rdb.DBEntry
+	db      uint64
+	cmd     string
+	args    []interface{}
+	payload bool
+	done    bool
+
+	// A command queued by MULTI has tx set to the reply of its EXEC until
+	// EXEC is done, and err is its error reply when it's queued. multi of
+	// EXEC are the queued commands, their replies are in the reply of EXEC.
+	tx    *clusterReply
+	err   error
+	multi []*clusterReply
+}
+
+type clusterNode struct {
+	addr      string
+	c         redigo.Conn
+	replyChan chan *clusterReply
+	jobs      <-chan struct{}
+	pending   bool
+
+	// failed, err and redirect are used by the reply job only.
+	failed   string
+	err      error
+	redirect map[string]redigo.Conn
+}
+
+// clusterPipeline keeps a pipelined connection of each master, replies of a
+// node are checked by handle in order.
+type clusterPipeline struct {
+	mu     sync.Mutex
+	route  *clusterRoute
+	nodes  map[string]*clusterNode
+	handle func(n *clusterNode, r *clusterReply, err error)
+}
+
+func newClusterPipeline(route *clusterRoute, handle func(n *clusterNode, r *clusterReply, err error)) *clusterPipeline {
+	return &clusterPipeline{route: route, nodes: make(map[string]*clusterNode), handle: handle}
+}
+
+func (p *clusterPipeline) node(addr string) *clusterNode {
+	if n := p.nodes[addr]; n != nil {
+		return n
+	}
+	var n = &clusterNode{
+		addr:      addr,
+		c:         redigoOpenConn(addr, p.route.auth),
+		replyChan: make(chan *clusterReply, 128),
+		redirect:  make(map[string]redigo.Conn),
+	}
+	n.jobs = NewJob(func() {
+		for r := range n.replyChan {
+			if r.done {
+				p.handle(n, r, nil)
+				continue
+			}
+			reply, err := n.c.Receive()
+			if _, ok := err.(redigo.Error); err != nil && !ok {
+				log.PanicErrorf(err, "fetch redigo reply of %q failed", n.addr)
+			}
+			if values, ok := reply.([]interface{}); ok && r.multi != nil {
+				for i, v := range values {
+					if err, ok := v.(redigo.Error); ok && i < len(r.multi) {
+						r.multi[i].tx = nil
+						p.handle(n, r.multi[i], err)
+					}
+				}
+			}
+			p.handle(n, r, err)
+		}
+	}).Run()
+	p.nodes[addr] = n
+	return n
+}
+
+// Send sends the command to addr, r is checked when the reply arrives.
+func (p *clusterPipeline) Send(addr string, r *clusterReply, cmd string, args ...interface{}) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var n = p.node(addr)
+	redigoSendCommand(n.c, cmd, args...)
+	n.pending = true
+	r.cmd = cmd
+	p.push(n, r)
+}
+
+// Done ends the commands of r.e that have been sent to addr.
+func (p *clusterPipeline) Done(addr string, r *clusterReply) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	r.done = true
+	p.push(p.node(addr), r)
+}
+
+func (p *clusterPipeline) push(n *clusterNode, r *clusterReply) {
+	if len(n.replyChan) == cap(n.replyChan) {
+		p.flush(n)
+	}
+	n.replyChan <- r
+}
+
+func (p *clusterPipeline) flush(n *clusterNode) {
+	if n.pending {
+		redigoFlushConn(n.c)
+		n.pending = false
+	}
+}
+
+// Flush flushes the pending commands of all nodes.
+func (p *clusterPipeline) Flush() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, n := range p.nodes {
+		p.flush(n)
+	}
+}
+
+// Close waits for all replies and closes the connections.
+func (p *clusterPipeline) Close() {
+	p.Flush()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, n := range p.nodes {
+		close(n.replyChan)
+	}
+	for _, n := range p.nodes {
+		<-n.jobs
+		n.c.Close()
+		for _, c := range n.redirect {
+			c.Close()
+		}
+	}
+}
+
+// Do runs the commands of gen on addr synchronously and follows the
+// redirections, it's called by the reply job of n. The first error reply
+// that isn't a redirection and its command are returned.
+func (p *clusterPipeline) Do(n *clusterNode, addr string, ask bool, gen func(on func(cmd string, args ...interface{}))) (string, error) {
+	for i := 0; ; i++ {
+		var c = n.redirect[addr]
+		if c == nil {
+			c = redigoOpenConn(addr, p.route.auth)
+			n.redirect[addr] = c
+		}
+		var cmds []string
+		gen(func(cmd string, args ...interface{}) {
+			if ask {
+				redigoSendCommand(c, "ASKING")
+			}
+			redigoSendCommand(c, cmd, args...)
+			cmds = append(cmds, cmd)
+		})
+		redigoFlushConn(c)
+		var failedCmd string
+		var redirect, failed error
+		var redirectAsk bool
+		var redirectAddr string
+		for _, cmd := range cmds {
+			if ask {
+				redigoGetResponse(c)
+			}
+			_, err := c.Receive()
+			if _, ok := err.(redigo.Error); err != nil && !ok {
+				log.PanicErrorf(err, "fetch redigo reply of %q failed", addr)
+			}
+			if a, to, ok := p.route.Redirect(err); ok {
+				if redirect == nil {
+					redirect, redirectAsk, redirectAddr = err, a, to
+				}
+			} else if err != nil && failed == nil {
+				failedCmd, failed = cmd, err
+			}
+		}
+		if redirect == nil {
+			return failedCmd, failed
+		}
+		if i >= MaxClusterRedirects {
+			log.PanicErrorf(redirect, "too many redirections of cluster")
+		}
+		ask, addr = redirectAsk, redirectAddr
+	}
+}
+
+// genClusterRestoreCommands generates the commands that restore e without
+// SELECT, it returns whether a RESTORE payload is used.
+func genClusterRestoreCommands(e *rdb.DBEntry, payload bool, on func(cmd string, args ...interface{})) bool {
+	if payload && genRestorePayloadCommand(e, e.DB, true, on) {
+		return true
+	}
+	genRestoreCommands(e, e.DB, on)
+	return false
+}
+
+// doRestoreClusterEntry restores entries to the masters of their slots, keys
+// that are redirected by MOVED or ASK are restored again on the new node.
+// Keys that fail with transient errors are restored again, and keys that
+// still fail are recorded by errs.
+func doRestoreClusterEntry(entryChan <-chan *rdb.DBEntry, route *clusterRoute, payload bool,
+	errs *restoreErrors, on func(e *rdb.DBEntry) bool) {
+	var ticker = time.NewTicker(time.Millisecond * 250)
+	defer ticker.Stop()
+
+	var tick atomic2.Int64
+	go func() {
+		for range ticker.C {
+			tick.Incr()
+		}
+	}()
+
+	var p *clusterPipeline
+	p = newClusterPipeline(route, func(n *clusterNode, r *clusterReply, err error) {
+		if !r.done {
+			if err != nil && n.err == nil {
+				n.failed, n.err = r.cmd, err
+			}
+			return
+		}
+		var gen = func(on func(cmd string, args ...interface{})) {
+			r.payload = genClusterRestoreCommands(r.e, r.payload, on)
+		}
+		var cmd string
+		cmd, err, n.failed, n.err = n.failed, n.err, "", nil
+		if ask, addr, ok := route.Redirect(err); ok {
+			cmd, err = p.Do(n, addr, ask, gen)
+		}
+		if err != nil && r.payload && !isTransientError(err) {
+			log.Warnf("RESTORE of key %q is rejected, restore it by commands, %s", r.e.Key.String(), err)
+			r.payload = false
+			cmd, err = p.Do(n, route.Lookup(slot.ClusterSlot(r.e.Key.BytesUnsafe())), false, gen)
+		}
+		if isTransientError(err) {
+			err = retryTransient(func() error {
+				var err error
+				cmd, err = p.Do(n, route.Lookup(slot.ClusterSlot(r.e.Key.BytesUnsafe())), false, gen)
+				return err
+			})
+		}
+		if err != nil {
+			errs.Key(r.e, cmd, err)
+		}
+		r.e.DecrRefCount()
+	})
+
+	for e := range entryChan {
+		if on(e) {
+			var addr = route.Lookup(slot.ClusterSlot(e.Key.BytesUnsafe()))
+			var restore = genClusterRestoreCommands(e, payload, func(cmd string, args ...interface{}) {
+				p.Send(addr, &clusterReply{}, cmd, args...)
+			})
+			p.Done(addr, &clusterReply{e: e.IncrRefCount(), payload: restore})
+			if tick.Swap(0) != 0 || len(entryChan) == 0 {
+				p.Flush()
+				route.RefreshIfStale()
+			}
+		}
+		e.DecrRefCount()
+	}
+	p.Close()
+}
+
+// clusterCommand is a command of the aof stream that is routed by slot, slot
+// is -1 if it's sent to every master.
+type clusterCommand struct {
+	slot int
+	args [][]byte
+}
+
+// clusterSplitCommand routes a command of the aof stream by the slots of its
+// keys. Commands that span slots are split if they are DEL, UNLINK, TOUCH,
+// EXISTS or MSET, and are rejected otherwise.
+func clusterSplitCommand(args [][]byte) ([]*clusterCommand, error) {
+	var cmd = strings.ToUpper(string(args[0]))
+	switch cmd {
+	case "PING", "SELECT", "MULTI", "EXEC", "DISCARD", "REPLCONF":
+		return nil, nil
+	case "FLUSHALL", "FLUSHDB", "SCRIPT", "FUNCTION":
+		return []*clusterCommand{{-1, args}}, nil
+	case "PUBLISH":
+		return []*clusterCommand{{0, args}}, nil
+	case "SWAPDB", "MOVE":
+		return nil, errors.Errorf("command %s isn't supported by cluster", cmd)
+	}
+
+	var first, last, step = 1, 1, 1
+	switch cmd {
+	case "DEL", "UNLINK", "TOUCH", "EXISTS", "SDIFFSTORE", "SINTERSTORE", "SUNIONSTORE", "PFMERGE":
+		last = len(args) - 1
+	case "MSET", "MSETNX":
+		last, step = len(args)-2, 2
+	case "RENAME", "RENAMENX", "RPOPLPUSH", "BRPOPLPUSH", "LMOVE", "BLMOVE", "SMOVE", "COPY", "ZRANGESTORE", "GEOSEARCHSTORE":
+		last = 2
+	case "BITOP":
+		first, last = 2, len(args)-1
+	case "ZUNIONSTORE", "ZINTERSTORE", "ZDIFFSTORE", "EVAL", "EVALSHA", "FCALL":
+		var numkeys int
+		if len(args) > 2 {
+			numkeys, _ = strconv.Atoi(string(args[2]))
+		}
+		if cmd == "ZUNIONSTORE" || cmd == "ZINTERSTORE" || cmd == "ZDIFFSTORE" {
+			first, last = 1, 2+numkeys
+		} else {
+			first, last = 3, 2+numkeys
+		}
+	}
+	if last >= len(args) {
+		last = len(args) - 1
+	}
+	if first > last {
+		return []*clusterCommand{{0, args}}, nil
+	}
+
+	var slots []int
+	var split = make(map[int]*clusterCommand)
+	for i := first; i <= last; i += step {
+		if cmd == "ZUNIONSTORE" || cmd == "ZINTERSTORE" || cmd == "ZDIFFSTORE" {
+			if i == 2 {
+				continue
+			}
+		}
+		var s = slot.ClusterSlot(args[i])
+		var c = split[s]
+		if c == nil {
+			c = &clusterCommand{slot: s, args: [][]byte{args[0]}}
+			split[s] = c
+			slots = append(slots, s)
+		}
+		c.args = append(c.args, args[i:i+step]...)
+	}
+	if len(slots) == 1 {
+		return []*clusterCommand{{slots[0], args}}, nil
+	}
+	switch cmd {
+	case "DEL", "UNLINK", "TOUCH", "EXISTS", "MSET":
+		var cmds = make([]*clusterCommand, len(slots))
+		for i, s := range slots {
+			cmds[i] = split[s]
+		}
+		return cmds, nil
+	}
+	return nil, errors.Errorf("command %s spans %d slots", cmd, len(slots))
+}
+
+// clusterCommandsSlot returns the slot shared by cmds, or -1 if they span
+// slots or are sent to every master.
+func clusterCommandsSlot(cmds []*clusterCommand) int {
+	if len(cmds) == 0 {
+		return -1
+	}
+	for _, c := range cmds {
+		if c.slot < 0 || c.slot != cmds[0].slot {
+			return -1
+		}
+	}
+	return cmds[0].slot
+}
+
+// clusterRedirected reports whether any of the queued commands is redirected.
+func clusterRedirected(multi []*clusterReply) bool {
+	for _, r := range multi {
+		if _, _, _, ok := parseClusterRedirect(r.err); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// doRestoreClusterAoflog replays the aof stream on the masters of the slots
+// of the commands, redirections are followed and the failed commands are
+// recorded by errs. Transient errors aren't retried, the following commands
+// have been applied, and a retry would be out of order. Commands are flushed
+// by the ticker, so they're not held if the stream stalls. It returns at the
+// end of the stream once all replies are checked.
+// Commands in MULTI are sent in MULTI to the master of their slot, they're
+// sent one by one if they span slots or the transaction is redirected.
+func doRestoreClusterAoflog(reader *bufio2.Reader, route *clusterRoute, errs *restoreErrors, on func(db uint64, cmd string) bool) {
+	var ticker = time.NewTicker(time.Millisecond * 100)
+	defer ticker.Stop()
+
+	var record = func(r *clusterReply, err error) {
+		var args = make([][]byte, len(r.args))
+		args[0] = []byte(r.args[0].(string))
+		for i := 1; i < len(r.args); i++ {
+			args[i] = r.args[i].([]byte)
+		}
+		errs.Command(r.db, args, err)
+	}
+
+	var p *clusterPipeline
+	p = newClusterPipeline(route, func(n *clusterNode, r *clusterReply, err error) {
+		var redirect = func(r *clusterReply, addr string, ask bool) error {
+			_, err := p.Do(n, addr, ask, func(on func(cmd string, args ...interface{})) {
+				on(r.args[0].(string), r.args[1:]...)
+			})
+			return err
+		}
+		switch {
+		case r.tx != nil:
+			// EXEC is aborted by the error of a queued command, commands
+			// that are redirected are replayed after EXEC.
+			if _, _, _, ok := parseClusterRedirect(err); !ok && err != nil {
+				record(r, err)
+			}
+			r.err = err
+			return
+		case clusterRedirected(r.multi):
+			log.Warnf("transaction of %d commands of db %d is redirected, replay them without MULTI", len(r.multi), r.db)
+			for _, q := range r.multi {
+				var err error
+				if q.err == nil {
+					err = redirect(q, n.addr, false)
+				} else if ask, addr, ok := route.Redirect(q.err); ok {
+					err = redirect(q, addr, ask)
+				} else {
+					continue
+				}
+				if err != nil {
+					record(q, err)
+				}
+			}
+			return
+		}
+		if ask, addr, ok := route.Redirect(err); ok {
+			err = redirect(r, addr, ask)
+		}
+		if err != nil {
+			record(r, err)
+		}
+	})
+	defer p.Close()
+
+	go func() {
+		for range ticker.C {
+			p.Flush()
+			route.RefreshIfStale()
+		}
+	}()
+
+	// The commands of tx are sent to addr, the node of MULTI, even if the
+	// slot map is reloaded meanwhile.
+	var send = func(db uint64, c *clusterCommand, addr string, tx *clusterReply) {
+		var argv = make([]interface{}, len(c.args))
+		argv[0] = strings.ToUpper(string(c.args[0]))
+		for i := 1; i < len(c.args); i++ {
+			argv[i] = c.args[i]
+		}
+		var nodes []string
+		switch {
+		case tx != nil:
+			nodes = []string{addr}
+		case c.slot < 0:
+			nodes = route.Masters()
+		default:
+			nodes = []string{route.Lookup(c.slot)}
+		}
+		for _, addr := range nodes {
+			var r = &clusterReply{db: db, args: argv, tx: tx}
+			if tx != nil {
+				tx.multi = append(tx.multi, r)
+			}
+			p.Send(addr, r, argv[0].(string), argv[1:]...)
+		}
+	}
+
+	// multi holds the commands in MULTI until EXEC, it's nil if the stream
+	// isn't in MULTI.
+	var multi []*clusterCommand
+	var queued bool
+
+	var decoder = redis.NewDecoderBuffer(reader)
+	var db uint64
+	for {
+		r, err := decoder.Decode()
+		if errors.Cause(err) == io.EOF {
+			return
+		}
+		if err != nil {
+			p.Flush()
+			log.PanicErrorf(err, "decode command failed")
+		}
+		if r.Type != redis.TypeArray || len(r.Array) == 0 {
+			log.Panicf("invalid command %+v", r)
+		}
+		var cmd = strings.ToUpper(string(r.Array[0].Value))
+		if cmd == "SELECT" {
+			if len(r.Array) != 2 {
+				log.Panicf("bad select command %+v", r)
+			}
+			n, err := strconv.ParseInt(string(r.Array[1].Value), 10, 64)
+			if err != nil {
+				log.PanicErrorf(err, "bad select command %+v", r)
+			}
+			db = uint64(n)
+		}
+		if !on(db, cmd) {
+			continue
+		}
+		switch cmd {
+		case "MULTI":
+			multi, queued = nil, true
+			continue
+		case "DISCARD":
+			multi, queued = nil, false
+			continue
+		case "EXEC":
+			if !queued {
+				continue
+			}
+			if s := clusterCommandsSlot(multi); s >= 0 {
+				var addr = route.Lookup(s)
+				var tx = &clusterReply{db: db, args: []interface{}{"EXEC"}}
+				p.Send(addr, &clusterReply{db: db, args: []interface{}{"MULTI"}}, "MULTI")
+				for _, c := range multi {
+					send(db, c, addr, tx)
+				}
+				p.Send(addr, tx, "EXEC")
+			} else {
+				if len(multi) > 1 {
+					log.Warnf("transaction of %d commands of db %d spans slots, replay them without MULTI", len(multi), db)
+				}
+				for _, c := range multi {
+					send(db, c, "", nil)
+				}
+			}
+			multi, queued = nil, false
+			continue
+		}
+		var args = make([][]byte, len(r.Array))
+		for i, a := range r.Array {
+			args[i] = a.Value
+		}
+		cmds, err := clusterSplitCommand(args)
+		if err != nil {
+			log.WarnErrorf(err, "drop command %s of db %d", cmd, db)
+		}
+		if queued {
+			multi = append(multi, cmds...)
+			continue
+		}
+		for _, c := range cmds {
+			send(db, c, "", nil)
+		}
+	}
+}
+
+// doRestoreAoflog replays the aof stream on the target, the failed commands
+// are recorded by errs, including the commands in MULTI that fail in the
+// reply of EXEC. Transient errors aren't retried, the following commands have
+// been applied, and a retry would be out of order. It returns at the end of
+// the stream once all replies are checked.
+func doRestoreAoflog(reader *bufio2.Reader, addr, auth string, errs *restoreErrors, on func(db uint64, cmd string) bool) {
+	var ticker = time.NewTicker(time.Millisecond * 100)
+	defer ticker.Stop()
+
+	var tick atomic2.Int64
+	go func() {
 		for range ticker.C {
 			tick.Incr()
 		}
@@ -604,13 +3183,56 @@ func doRestoreAoflog(reader *bufio2.Reader, addr, auth string, on func(db uint64
 	var c = openConn(addr, auth)
 	defer c.Close()
 
-	go ioCopyBuffer(ioutil.Discard, c)
+	type aoflogCommand struct {
+		db   uint64
+		args [][]byte
+	}
+	var pending = make(chan *aoflogCommand, 4096)
+
+	var replies = NewJob(func() {
+		// Commands in MULTI are queued, their replies are in the reply of EXEC.
+		var multi []*aoflogCommand
+		var queued bool
+		var decoder = redis.NewDecoderSize(c, ReaderBufferSize)
+		for r := range pending {
+			resp, err := decoder.Decode()
+			if err != nil {
+				log.PanicErrorf(err, "decode reply failed")
+			}
+			switch cmd := strings.ToUpper(string(r.args[0])); {
+			case cmd == "MULTI":
+				multi, queued = nil, !resp.IsError()
+			case cmd == "EXEC" && resp.IsArray():
+				for i, resp := range resp.Array {
+					if resp.IsError() && i < len(multi) {
+						errs.Command(multi[i].db, multi[i].args, redigo.Error(resp.Value))
+					}
+				}
+				multi, queued = nil, false
+			case cmd == "EXEC", cmd == "DISCARD":
+				multi, queued = nil, false
+			case queued && !resp.IsError():
+				multi = append(multi, r)
+			}
+			if resp.IsError() {
+				errs.Command(r.db, r.args, redigo.Error(resp.Value))
+			}
+		}
+	}).Run()
 
 	var encoder = redis.NewEncoder(c)
 	var decoder = redis.NewDecoderBuffer(reader)
 	var db uint64
 	for {
 		r, err := decoder.Decode()
+		if errors.Cause(err) == io.EOF {
+			// The replies of the pending commands are checked before it
+			// returns, so they're counted and recorded by errs.
+			redisFlushEncoder(encoder)
+			close(pending)
+			<-replies
+			return
+		}
 		if err != nil {
 			redisFlushEncoder(encoder)
 			log.PanicErrorf(err, "decode command failed")
@@ -629,9 +3251,14 @@ func doRestoreAoflog(reader *bufio2.Reader, addr, auth string, on func(db uint64
 			}
 			db = uint64(n)
 		}
-		if !on(db, cmd) {
+		if cmd == "REPLCONF" || !on(db, cmd) {
 			continue
 		}
-		redisSendCommand(encoder, r, tick.Swap(0) != 0)
+		var args = make([][]byte, len(r.Array))
+		for i := range r.Array {
+			args[i] = r.Array[i].Value
+		}
+		redisSendCommand(encoder, r, tick.Swap(0) != 0 || len(pending) == cap(pending))
+		pending <- &aoflogCommand{db: db, args: args}
 	}
 }
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/CodisLabs/codis/pkg/utils/assert"
+	"github.com/CodisLabs/codis/pkg/utils/errors"
+
+	"github.com/CodisLabs/redis-port/pkg/libs/slot"
+
+	redigo "github.com/garyburd/redigo/redis"
+)
+
+func TestClusterSplitCommand(t *testing.T) {
+	var s = func(key string) int {
+		return slot.ClusterSlot([]byte(key))
+	}
+	var testcase = func(line string, expect ...string) {
+		var args [][]byte
+		for _, arg := range strings.Fields(line) {
+			args = append(args, []byte(arg))
+		}
+		cmds, err := clusterSplitCommand(args)
+		if len(expect) == 1 && expect[0] == "error" {
+			assert.Must(err != nil)
+			return
+		}
+		assert.MustNoError(err)
+		assert.Must(len(cmds) == len(expect))
+		for i, c := range cmds {
+			assert.Must(fmt.Sprintf("%d %s", c.slot, c.args) == expect[i])
+		}
+	}
+	assert.Must(s("a") != s("b"))
+
+	testcase("PING")
+	testcase("SELECT 1")
+	testcase("FLUSHALL", "-1 [FLUSHALL]")
+	testcase("SWAPDB 0 1", "error")
+	testcase("SET a 1", fmt.Sprintf("%d [SET a 1]", s("a")))
+	testcase("DEL {t}a {t}b", fmt.Sprintf("%d [DEL {t}a {t}b]", s("t")))
+	testcase("DEL a b", fmt.Sprintf("%d [DEL a]", s("a")), fmt.Sprintf("%d [DEL b]", s("b")))
+	testcase("MSET a 1 b 2 a 3", fmt.Sprintf("%d [MSET a 1 a 3]", s("a")), fmt.Sprintf("%d [MSET b 2]", s("b")))
+	testcase("MSETNX a 1 b 2", "error")
+	testcase("MSETNX {t}a 1 {t}b 2", fmt.Sprintf("%d [MSETNX {t}a 1 {t}b 2]", s("t")))
+	testcase("RENAME a b", "error")
+	testcase("RENAME {t}a {t}b", fmt.Sprintf("%d [RENAME {t}a {t}b]", s("t")))
+	testcase("BITOP AND {t}d {t}a {t}b", fmt.Sprintf("%d [BITOP AND {t}d {t}a {t}b]", s("t")))
+	testcase("BITOP AND a b", "error")
+	testcase("EVAL return 0", "0 [EVAL return 0]")
+	testcase("EVAL return 2 {t}a {t}b a b", fmt.Sprintf("%d [EVAL return 2 {t}a {t}b a b]", s("t")))
+	testcase("EVAL return 2 a b", "error")
+	testcase("ZUNIONSTORE {t}d 2 {t}a {t}b WEIGHTS 1 2", fmt.Sprintf("%d [ZUNIONSTORE {t}d 2 {t}a {t}b WEIGHTS 1 2]", s("t")))
+	testcase("ZUNIONSTORE {t}d 1 a", "error")
+	testcase("ZINTERSTORE {t}d 9 {t}a", fmt.Sprintf("%d [ZINTERSTORE {t}d 9 {t}a]", s("t")))
+}
+
+func TestClusterCommandsSlot(t *testing.T) {
+	var testcase = func(expect int, lines ...string) {
+		var cmds []*clusterCommand
+		for _, line := range lines {
+			var args [][]byte
+			for _, arg := range strings.Fields(line) {
+				args = append(args, []byte(arg))
+			}
+			split, err := clusterSplitCommand(args)
+			assert.MustNoError(err)
+			cmds = append(cmds, split...)
+		}
+		assert.Must(clusterCommandsSlot(cmds) == expect)
+	}
+	var s = slot.ClusterSlot([]byte("t"))
+	testcase(-1)
+	testcase(s, "SET {t}a 1", "INCR {t}b", "DEL {t}a {t}b")
+	testcase(-1, "SET {t}a 1", "INCR b")
+	testcase(-1, "SET {t}a 1", "DEL {t}a b")
+	testcase(-1, "SET {t}a 1", "FLUSHALL")
+}
+
+func TestClusterRouteRedirect(t *testing.T) {
+	var r = &clusterRoute{nodes: make([]string, slot.MaxClusterSlotNum)}
+	var testcase = func(err error, ask bool, addr string, ok bool) {
+		a, b, c := r.Redirect(err)
+		assert.Must(a == ask && b == addr && c == ok)
+	}
+	testcase(nil, false, "", false)
+	testcase(errors.New("MOVED 3999 127.0.0.1:6381"), false, "", false)
+	testcase(redigo.Error("ERR unknown command"), false, "", false)
+	testcase(redigo.Error("MOVED 16384 127.0.0.1:6381"), false, "", false)
+	testcase(redigo.Error("MOVED x 127.0.0.1:6381"), false, "", false)
+	testcase(redigo.Error("MOVED 3999"), false, "", false)
+	assert.Must(!r.stale)
+
+	testcase(redigo.Error("ASK 3999 127.0.0.1:6382"), true, "127.0.0.1:6382", true)
+	assert.Must(!r.stale && r.nodes[3999] == "")
+	testcase(redigo.Error("MOVED 3999 127.0.0.1:6381"), false, "127.0.0.1:6381", true)
+	assert.Must(r.stale && r.nodes[3999] == "127.0.0.1:6381")
+
+	r.stale, r.asks = false, 0
+	for i := 0; i < MaxClusterAsks; i++ {
+		assert.Must(!r.stale)
+		testcase(redigo.Error("ASK 100 127.0.0.1:6382"), true, "127.0.0.1:6382", true)
+	}
+	assert.Must(r.stale && r.nodes[100] == "")
+}
+
+func TestRestoreErrorsCommand(t *testing.T) {
+	var b bytes.Buffer
+	var errs = &restoreErrors{Max: 2, Log: bufio.NewWriter(&b)}
+	errs.Command(2, [][]byte{[]byte("SET"), []byte("key"), []byte("\x00\xff")}, redigo.Error("LOADING Redis is loading"))
+	errs.Command(2, [][]byte{[]byte("INCR"), []byte("counter")}, redigo.Error("ERR value is not an integer"))
+	errs.Flush()
+	assert.Must(errs.Count.Int64() == 2)
+
+	var cmds []string
+	var restorer jsonRestorer
+	var on = func(cmd string, args ...interface{}) {
+		for _, arg := range args {
+			if b, ok := arg.([]byte); ok {
+				cmd += fmt.Sprintf(" %q", b)
+			} else {
+				cmd += fmt.Sprintf(" %v", arg)
+			}
+		}
+		cmds = append(cmds, cmd)
+	}
+	readJsonRecords(&b, func(r *jsonRecord) {
+		assert.Must(r.Type == "command" && r.DB == 2)
+		restorer.Restore(r, on)
+	})
+	restorer.Flush(on)
+	assert.Must(len(cmds) == 3)
+	assert.Must(cmds[0] == `SELECT 2`)
+	assert.Must(cmds[1] == `SET "key" "\x00\xff"`)
+	assert.Must(cmds[2] == `INCR "counter"`)
+}
+
+func TestRestoreStreamMeta(t *testing.T) {
+	f, err := os.Open("../pkg/rdb/testing/stream_listpacks_3.rdb")
+	assert.MustNoError(err)
+	defer f.Close()
+
+	var cmds []string
+	var on = func(cmd string, args ...interface{}) {
+		for _, arg := range args {
+			if b, ok := arg.([]byte); ok {
+				cmd += fmt.Sprintf(" %s", b)
+			} else {
+				cmd += fmt.Sprintf(" %v", arg)
+			}
+		}
+		cmds = append(cmds, cmd)
+	}
+	_, entryChan := newRDBLoader(f, 32)
+	for e := range entryChan {
+		if string(e.Key.BytesUnsafe()) == "stream" {
+			// Payloads of RDB_VERSION 9 lose the metadata of the stream.
+			assert.Must(!genRestorePayloadCommand(e, e.DB, true, on))
+			assert.Must(!genClusterRestoreCommands(e, true, on))
+		}
+		e.DecrRefCount()
+	}
+	var xgroup, xsetid bool
+	for _, cmd := range cmds {
+		switch {
+		case strings.HasPrefix(cmd, "RESTORE "):
+			t.Fatalf("unexpected %q", cmd)
+		case strings.HasPrefix(cmd, "XGROUP CREATE stream grp "):
+			xgroup = strings.HasSuffix(cmd, " ENTRIESREAD 1")
+		case strings.HasPrefix(cmd, "XSETID stream "):
+			xsetid = strings.Contains(cmd, " ENTRIESADDED 3 MAXDELETEDID ")
+		}
+	}
+	assert.Must(xgroup && xsetid)
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/CodisLabs/codis/pkg/utils/bytesize"
+	"github.com/CodisLabs/codis/pkg/utils/log"
+	"github.com/CodisLabs/codis/pkg/utils/sync2/atomic2"
+
+	"github.com/CodisLabs/redis-port/pkg/rdb"
+)
+
+func main() {
+	const usage = `
+Usage:
+	redis-lookup [--ncpu=N] [--input=INPUT|INPUT] [--output=OUTPUT] [--db=DB] [--format=FORMAT] [--encoding=ENCODING] [--columns=COLUMNS] [--header] [--index=INDEX] (--key=KEY|--match=PATTERN)...
+	redis-lookup [--ncpu=N] [--input=INPUT|INPUT] --index=INDEX --build-index
+	redis-lookup  --version
+
+Options:
+	-n N, --ncpu=N                    Set runtime.GOMAXPROCS to N.
+	-i INPUT, --input=INPUT           Set input rdb encoded file. [default: /dev/stdin].
+	-o OUTPUT, --output=OUTPUT        Set output file. [default: /dev/stdout].
+	--db=DB                           Look up keys in db = DB, default is *.
+	--format=FORMAT                   Set output format, json, json-object, csv, tsv, resp or redis-cli. [default: json-object].
+	--encoding=ENCODING               Set encoding of keys and values in json, csv and tsv, raw, hex, base64 or auto, auto is raw in csv and tsv. [default: auto].
+	--columns=COLUMNS                 Set the comma separated columns of csv and tsv, encoding is also available. [default: db,key,type,index,field,member,value,score,expire_at_ms].
+	--header                          Write the names of columns as the first row of csv and tsv.
+	--key=KEY                         Look up the exact KEY, can be repeated.
+	--match=PATTERN                   Look up keys matching the glob-style PATTERN, can be repeated.
+	--index=INDEX                     Set the index file of the input, keys are loaded at their offsets instead of a full scan.
+	--build-index                     Write the db, type and offset of every key of the input to the index file.
+
+The values of other keys are skipped without being decoded. If --db is set and
+there is no PATTERN, the lookup stops once all KEYs are found.
+
+Examples:
+	$ redis-lookup -i dump.rdb --key=user:1 --key=user:2
+	$ redis-lookup    dump.rdb --db=0 --key=user:1 --format=redis-cli
+	$ redis-lookup    dump.rdb --match="session:*" --format=csv --header -o session.csv
+	$ cat dump.rdb | redis-lookup --key=counter --encoding=hex
+	$ redis-lookup    dump.rdb --index=dump.rdb.idx --build-index
+	$ redis-lookup    dump.rdb --index=dump.rdb.idx --key=user:1
+`
+	var flags = parseFlags(usage)
+
+	var input struct {
+		Path string
+		Size int64
+		io.Reader
+		rd io.Reader
+
+		rbytes, scan atomic2.Int64
+	}
+	input.Path = flags.Source
+	if len(input.Path) == 0 {
+		log.Panicf("invalid input file")
+	}
+
+	var output struct {
+		Path string
+		io.Writer
+		wt *bufio.Writer
+
+		wbytes atomic2.Int64
+	}
+	output.Path = flags.Target
+	if len(output.Path) == 0 {
+		log.Panicf("invalid output file")
+	}
+	switch flags.Format {
+	case "json", "json-object", "csv", "tsv", "resp", "redis-cli":
+	default:
+		log.Panicf("invalid format %q", flags.Format)
+	}
+	if flags.BuildIndex {
+		output.Path = flags.Index
+	}
+	if flags.Index != "" && input.Path == "/dev/stdin" {
+		log.Panicf("invalid input file, it's required by index")
+	}
+	log.Infof("lookup: input = %q, output = %q, keys = %d, patterns = %d\n", input.Path, output.Path, len(flags.Keys), len(flags.Patterns))
+
+	var objects atomic2.Int64
+
+	if input.Path != "/dev/stdin" {
+		file, size := openReadFile(input.Path)
+		defer file.Close()
+		input.Reader, input.Size = file, size
+	} else {
+		input.Reader = os.Stdin
+	}
+	// Keys are loaded at their offsets with the index, the buffered bytes are
+	// dropped by Seek.
+	if flags.Index != "" && !flags.BuildIndex {
+		input.rd = newBufferedSeeker(rBuilder(input.Reader).Must().Count(&input.rbytes).Reader,
+			input.Reader.(io.Seeker), ReaderBufferSize)
+	} else {
+		input.rd = rBuilder(input.Reader).Must().
+			Buffer(ReaderBufferSize).Count(&input.rbytes).Reader
+	}
+
+	if output.Path != "/dev/stdout" {
+		file := openWriteFile(output.Path)
+		defer closeFile(file)
+		output.Writer = file
+	} else {
+		output.Writer = os.Stdout
+	}
+	output.wt = wBuilder(output.Writer).Must().
+		Count(&output.wbytes).Buffer(WriterBufferSize).Writer.(*bufio.Writer)
+
+	if flags.Header && (flags.Format == "csv" || flags.Format == "tsv") && !flags.BuildIndex {
+		toCsvRecord(flags.Columns, flags.Format == "tsv", output.wt)
+	}
+
+	// A key may be in any db, so the rest of the rdb is skipped only if all
+	// keys are found in the given db.
+	var missing = make(map[string]bool)
+	for _, key := range flags.Keys {
+		missing[key] = true
+	}
+	var early = flags.DB >= 0 && len(flags.Patterns) == 0
+
+	var mu sync.Mutex
+
+	var jobs <-chan struct{}
+	switch {
+	case flags.BuildIndex:
+		var loader, entryChan = newRDBLoader(input.rd, 32)
+
+		// The selectdb record goes before the first key of each database.
+		var selectdb = make(map[uint64]bool)
+		jobs = NewJob(func() {
+			for e := range entryChan {
+				synchronized(&mu, func() {
+					objects.Incr()
+					if offset, ok := loader.SelectDB()[e.DB]; ok && !selectdb[e.DB] {
+						toJsonLine(&indexRecord{DB: e.DB, Type: "selectdb", Offset: offset}, output.wt)
+						selectdb[e.DB] = true
+					}
+					toJsonLine(newIndexRecord(e), output.wt)
+				})
+				e.DecrRefCount()
+			}
+		}).Then(func() {
+			synchronized(&mu, func() {
+				toJsonLine(&indexRecord{Type: "footer", Version: loader.Version(), Size: input.Size}, output.wt)
+			})
+		}).Run()
+
+	case flags.Index != "":
+		var loader = rdb.NewLoader(input.rd)
+		var writer = newEntryWriter(loader, flags, output.wt)
+
+		jobs = NewJob(func() {
+			if err := loader.Header(); err != nil {
+				log.PanicErrorf(err, "load rdb header failed")
+			}
+			var records = readIndexRecords(flags.Index, input.Size, func(r *indexRecord) bool {
+				input.scan.Incr()
+				return acceptDB(r.DB) && acceptKey(r.Bytes())
+			})
+			for _, r := range records {
+				if err := loader.SeekTo(r.Offset, r.DB); err != nil {
+					log.PanicErrorf(err, "seek rdb to offset %d failed", r.Offset)
+				}
+				e, err := loader.Next()
+				if err != nil {
+					log.PanicErrorf(err, "load rdb entry at offset %d failed", r.Offset)
+				}
+				if e == nil || !bytes.Equal(e.Key.BytesUnsafe(), r.Bytes()) {
+					log.Panicf("load rdb entry at offset %d failed, the index doesn't match", r.Offset)
+				}
+				synchronized(&mu, func() {
+					objects.Incr()
+					writer.Write(e)
+				})
+				delete(missing, e.Key.String())
+				e.DecrRefCount()
+			}
+			synchronized(&mu, func() {
+				writer.Close()
+			})
+		}).Run()
+
+	default:
+		var loader = rdb.NewLoader(input.rd)
+		loader.SetKeyFilter(func(db uint64, key []byte) bool {
+			input.scan.Incr()
+			return acceptDB(db) && acceptKey(key)
+		})
+		var writer = newEntryWriter(loader, flags, output.wt)
+
+		jobs = NewJob(func() {
+			if err := loader.Header(); err != nil {
+				log.PanicErrorf(err, "load rdb header failed")
+			}
+			var stopped bool
+			if _, err := loader.ForEach(func(e *rdb.DBEntry) bool {
+				synchronized(&mu, func() {
+					objects.Incr()
+					writer.Write(e)
+				})
+				delete(missing, e.Key.String())
+				stopped = early && len(missing) == 0
+				return !stopped
+			}); err != nil {
+				log.PanicErrorf(err, "load rdb entries failed")
+			}
+			if !stopped {
+				if err := loader.Footer(); err != nil {
+					log.PanicErrorf(err, "load rdb footer failed")
+				}
+			} else {
+				log.Infof("lookup: all keys are found, the rest is skipped")
+			}
+			synchronized(&mu, func() {
+				writer.Close()
+			})
+		}).Run()
+	}
+
+	var done = NewJob(func() {
+		for stop := false; !stop; {
+			select {
+			case <-jobs:
+				stop = true
+			case <-time.After(time.Second):
+			}
+			synchronized(&mu, func() {
+				flushWriter(output.wt)
+			})
+		}
+	}).Run()
+
+	log.Infof("lookup: (r,w,s,o) = (read,write,scan,objects)")
+
+	NewJob(func() {
+		for stop := false; !stop; {
+			select {
+			case <-done:
+				stop = true
+			case <-time.After(time.Second):
+			}
+			stats := &struct {
+				input, output, scan, objects int64
+			}{
+				input.rbytes.Int64(), output.wbytes.Int64(), input.scan.Int64(), objects.Int64(),
+			}
+
+			var b bytes.Buffer
+			var percent float64
+			if input.Size != 0 {
+				percent = float64(stats.input) * 100 / float64(input.Size)
+			}
+			fmt.Fprintf(&b, "lookup: file = %d - [%6.2f%%]", input.Size, percent)
+			fmt.Fprintf(&b, "   (r,w,s,o)=%s",
+				formatAlign(4, "(%d,%d,%d,%d)", stats.input, stats.output, stats.scan, stats.objects))
+			fmt.Fprintf(&b, "  ~  (%s,%s,-,-)",
+				bytesize.Int64(stats.input).HumanString(), bytesize.Int64(stats.output).HumanString())
+			log.Info(b.String())
+		}
+	}).RunAndWait()
+
+	for _, key := range flags.Keys {
+		if missing[key] && !flags.BuildIndex {
+			log.Warnf("lookup: key %q is not found", key)
+		}
+	}
+	log.Info("lookup: done")
+}
+
+// indexRecord is a line of the index of an rdb, keys are encoded like the
+// json records of redis-decode. The footer is the last line, it has the size
+// of the rdb, so an incomplete or a stale index is rejected.
+type indexRecord struct {
+	DB       uint64 `json:"db"`
+	Type     string `json:"type"`
+	Key      string `json:"key,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+	Offset   int64  `json:"offset,omitempty"`
+	Version  int64  `json:"version,omitempty"`
+	Size     int64  `json:"size,omitempty"`
+}
+
+func newIndexRecord(e *rdb.DBEntry) *indexRecord {
+	var key = e.Key.BytesUnsafe()
+	var encoding, encode = jsonEncoding("auto", key)
+	return &indexRecord{
+		DB:       e.DB,
+		Type:     strings.ToLower(strings.TrimPrefix(e.Type().String(), "OBJ_")),
+		Key:      encode(key),
+		Encoding: encoding,
+		Offset:   e.Offset,
+	}
+}
+
+func (r *indexRecord) Bytes() []byte {
+	b, err := decodeJsonString(r.Key, r.Encoding)
+	if err != nil {
+		log.PanicErrorf(err, "decode index record failed, db=%d key=%q", r.DB, r.Key)
+	}
+	return b
+}
+
+// readIndexRecords returns the keys of the index that are accepted, size is
+// the size of the rdb.
+func readIndexRecords(path string, size int64, accept func(r *indexRecord) bool) []*indexRecord {
+	file, _ := openReadFile(path)
+	defer file.Close()
+
+	var records []*indexRecord
+	var footer *indexRecord
+	var dec = json.NewDecoder(bufio.NewReaderSize(file, ReaderBufferSize))
+	for {
+		var r = &indexRecord{}
+		if err := dec.Decode(r); err != nil {
+			if err == io.EOF {
+				break
+			}
+			log.PanicErrorf(err, "decode index %q failed", path)
+		}
+		switch {
+		case footer != nil:
+			log.Panicf("decode index %q failed, unexpected record after footer", path)
+		case r.Type == "footer":
+			footer = r
+		case r.Type != "selectdb" && accept(r):
+			records = append(records, r)
+		}
+	}
+	switch {
+	case footer == nil:
+		log.Panicf("invalid index %q, footer is missing", path)
+	case footer.Size != size:
+		log.Panicf("invalid index %q, it's built for rdb of size %d, not %d", path, footer.Size, size)
+	}
+	return records
+}
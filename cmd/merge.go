@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/CodisLabs/codis/pkg/utils/bytesize"
+	"github.com/CodisLabs/codis/pkg/utils/log"
+	"github.com/CodisLabs/codis/pkg/utils/sync2/atomic2"
+
+	"github.com/CodisLabs/redis-port/pkg/rdb"
+)
+
+func main() {
+	const usage = `
+Usage:
+	redis-merge [--ncpu=N] --output=OUTPUT [--conflict=POLICY] INPUT...
+	redis-merge  --version
+
+Options:
+	-n N, --ncpu=N                    Set runtime.GOMAXPROCS to N.
+	-o OUTPUT, --output=OUTPUT        Set output rdb file.
+	--conflict=POLICY                 Keep the key of the first or the last input, or fail with a report. [default: fail].
+
+Inputs:
+	INPUT is PATH[,db=FROM:TO]...[,prefix=PREFIX], keys of db FROM are moved to db TO and PREFIX is added to them.
+
+Examples:
+	$ redis-merge -o merged.rdb a.rdb b.rdb c.rdb
+	$ redis-merge -o merged.rdb a.rdb,db=0:1 b.rdb,db=0:2 --conflict=last
+	$ redis-merge -o merged.rdb a.rdb,prefix=a: b.rdb,prefix=b:
+`
+	var flags = parseFlags(usage)
+
+	if len(flags.Inputs) == 0 {
+		log.Panicf("invalid input files")
+	}
+	for _, in := range flags.Inputs {
+		if in.Path == "/dev/stdin" {
+			log.Panicf("invalid input file %q, inputs are read twice", in.Path)
+		}
+	}
+	switch flags.Conflict {
+	case "first", "last", "fail":
+	default:
+		log.Panicf("invalid conflict policy %q", flags.Conflict)
+	}
+
+	var output struct {
+		Path string
+		io.Writer
+		wt *bufio.Writer
+
+		wbytes atomic2.Int64
+	}
+	output.Path = flags.Target
+	if len(output.Path) == 0 {
+		log.Panicf("invalid output file")
+	}
+	log.Infof("merge: inputs = %d, output = %q, conflict = %q\n", len(flags.Inputs), output.Path, flags.Conflict)
+
+	var input struct {
+		rbytes, keys, conflicts atomic2.Int64
+	}
+
+	var loadInput = func(path string, on func(e *rdb.DBEntry)) *rdb.Loader {
+		file, _ := openReadFile(path)
+		defer file.Close()
+		var rd = rBuilder(file).Must().
+			Buffer(ReaderBufferSize).Count(&input.rbytes).Reader
+		var loader, entryChan = newRDBLoader(rd, 32)
+		for e := range entryChan {
+			on(e)
+			e.DecrRefCount()
+		}
+		return loader
+	}
+
+	// The owner of a key is the entry that goes to the output, entries are
+	// identified by the index of the input and the sequence in the input.
+	type owner struct {
+		input, seq int
+	}
+
+	var aux map[string]string
+	var owners = make(map[uint64]map[string]owner)
+
+	var jobs = NewJob(func() {
+		var conflicts = make(map[uint64]map[string][]int)
+		for i, in := range flags.Inputs {
+			var seq int
+			var loader = loadInput(in.Path, func(e *rdb.DBEntry) {
+				seq++
+				db, key := inputTarget(in, e)
+				if owners[db] == nil {
+					owners[db] = make(map[string]owner)
+				}
+				var last, ok = owners[db][string(key)]
+				switch {
+				case !ok:
+					input.keys.Incr()
+				case flags.Conflict == "first":
+					input.conflicts.Incr()
+					return
+				case flags.Conflict == "last":
+					input.conflicts.Incr()
+				default:
+					input.conflicts.Incr()
+					if conflicts[db] == nil {
+						conflicts[db] = make(map[string][]int)
+					}
+					if conflicts[db][string(key)] == nil {
+						conflicts[db][string(key)] = []int{last.input}
+					}
+					conflicts[db][string(key)] = append(conflicts[db][string(key)], i)
+				}
+				owners[db][string(key)] = owner{i, seq}
+			})
+			if i == 0 {
+				aux = loader.Aux()
+			}
+		}
+		if flags.Conflict == "fail" && len(conflicts) != 0 {
+			for db, keys := range conflicts {
+				for key, inputs := range keys {
+					var paths = make([]string, 0, len(inputs))
+					for _, i := range inputs {
+						paths = append(paths, flags.Inputs[i].Path)
+					}
+					log.Warnf("merge: conflict db=%d key=%q inputs=%q", db, key, paths)
+				}
+			}
+			log.Panicf("merge: %d conflicts, aborted", input.conflicts.Int64())
+		}
+
+		// Entries are grouped by db into temporary rdb files, so that the
+		// size of each db is known before it's written to the output.
+		type tmpfile struct {
+			*os.File
+			wt   *bufio.Writer
+			rdb  *rdb.Writer
+			size rdb.DBSize
+		}
+		var tmpfiles = make(map[uint64]*tmpfile)
+		defer func() {
+			for _, t := range tmpfiles {
+				closeFile(t.File)
+				os.Remove(t.Name())
+			}
+		}()
+		for i, in := range flags.Inputs {
+			var seq int
+			loadInput(in.Path, func(e *rdb.DBEntry) {
+				seq++
+				db, key := inputTarget(in, e)
+				if owners[db][string(key)] != (owner{i, seq}) {
+					return
+				}
+				var t = tmpfiles[db]
+				if t == nil {
+					t = &tmpfile{File: openTempFile("", "redis-merge-")}
+					t.wt = bufio.NewWriterSize(t.File, WriterBufferSize)
+					t.rdb = rdb.NewWriter(t.wt)
+					if err := t.rdb.Header(); err != nil {
+						log.PanicErrorf(err, "write rdb header failed")
+					}
+					tmpfiles[db] = t
+				}
+				var x = *e
+				x.DB = db
+				if in.Prefix != "" {
+					x.Key = rdb.NewRedisStringObject(key)
+					defer x.Key.DecrRefCount()
+				}
+				if err := t.rdb.WriteEntry(&x); err != nil {
+					log.PanicErrorf(err, "write rdb entry failed")
+				}
+				t.size.Keys++
+				if x.Expire != rdb.NoExpire {
+					t.size.Expires++
+				}
+			})
+		}
+		owners = nil
+
+		var dbs = make([]uint64, 0, len(tmpfiles))
+		for db, t := range tmpfiles {
+			if err := t.rdb.Footer(); err != nil {
+				log.PanicErrorf(err, "write rdb footer failed")
+			}
+			flushWriter(t.wt)
+			if _, err := t.Seek(0, io.SeekStart); err != nil {
+				log.PanicErrorf(err, "seek temp file %q failed", t.Name())
+			}
+			dbs = append(dbs, db)
+		}
+		sort.Slice(dbs, func(i, j int) bool {
+			return dbs[i] < dbs[j]
+		})
+
+		file := openWriteFile(output.Path)
+		defer closeFile(file)
+		output.Writer = file
+		output.wt = wBuilder(output.Writer).Must().
+			Count(&output.wbytes).Buffer(WriterBufferSize).Writer.(*bufio.Writer)
+
+		var writer = rdb.NewWriter(output.wt)
+		if err := writer.Header(); err != nil {
+			log.PanicErrorf(err, "write rdb header failed")
+		}
+		var keys = make([]string, 0, len(aux))
+		for key := range aux {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if err := writer.WriteAux(key, aux[key]); err != nil {
+				log.PanicErrorf(err, "write rdb aux failed")
+			}
+		}
+		for _, db := range dbs {
+			var t = tmpfiles[db]
+			if err := writer.SelectDB(db); err != nil {
+				log.PanicErrorf(err, "write rdb selectdb failed")
+			}
+			if err := writer.ResizeDB(t.size); err != nil {
+				log.PanicErrorf(err, "write rdb resizedb failed")
+			}
+			var rd = rBuilder(t.File).Must().Buffer(ReaderBufferSize).Reader
+			var _, entryChan = newRDBLoader(rd, 32)
+			for e := range entryChan {
+				if err := writer.WriteEntry(e); err != nil {
+					log.PanicErrorf(err, "write rdb entry failed")
+				}
+				e.DecrRefCount()
+			}
+		}
+		if err := writer.Footer(); err != nil {
+			log.PanicErrorf(err, "write rdb footer failed")
+		}
+		flushWriter(output.wt)
+	}).Run()
+
+	log.Infof("merge: (r,w,k,c) = (read,write,keys,conflicts)")
+
+	NewJob(func() {
+		for stop := false; !stop; {
+			select {
+			case <-jobs:
+				stop = true
+			case <-time.After(time.Second):
+			}
+			stats := &struct {
+				input, output, keys, conflicts int64
+			}{
+				input.rbytes.Int64(), output.wbytes.Int64(), input.keys.Int64(), input.conflicts.Int64(),
+			}
+
+			var b bytes.Buffer
+			fmt.Fprintf(&b, "merge: inputs = %d", len(flags.Inputs))
+			fmt.Fprintf(&b, "   (r,w,k,c)=%s",
+				formatAlign(4, "(%d,%d,%d,%d)", stats.input, stats.output, stats.keys, stats.conflicts))
+			fmt.Fprintf(&b, "  ~  (%s,%s,-,-)",
+				bytesize.Int64(stats.input).HumanString(), bytesize.Int64(stats.output).HumanString())
+			log.Info(b.String())
+		}
+	}).RunAndWait()
+
+	log.Info("merge: done")
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"container/heap"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/CodisLabs/codis/pkg/utils/log"
+
+	"github.com/CodisLabs/redis-port/pkg/libs/slot"
+	"github.com/CodisLabs/redis-port/pkg/rdb"
+)
+
+const MaxReportElementLen = 128
+
+type memoryReportKey struct {
+	DB       uint64 `json:"db"`
+	Key      string `json:"key"`
+	Type     string `json:"type"`
+	Encoding string `json:"encoding"`
+	ExpireAt uint64 `json:"expireat,omitempty"`
+	Size     int64  `json:"size"`
+	Elements int    `json:"elements"`
+
+	LargestElement     string `json:"largest_element"`
+	LargestElementSize int64  `json:"largest_element_size"`
+
+	Strings string `json:"string_encoding,omitempty"`
+}
+
+type memoryReportSize struct {
+	Keys    int64 `json:"keys"`
+	Expires int64 `json:"expires"`
+	Size    int64 `json:"size"`
+}
+
+func (s *memoryReportSize) add(e *rdb.DBEntry, u *rdb.MemoryUsage) {
+	s.Keys++
+	if e.Expire != rdb.NoExpire {
+		s.Expires++
+	}
+	s.Size += u.Size
+}
+
+// memoryKeyHeap keeps the top keys, the smallest one is at the root.
+type memoryKeyHeap struct {
+	keys []*memoryReportKey
+	size func(k *memoryReportKey) int64
+}
+
+func (h *memoryKeyHeap) Len() int {
+	return len(h.keys)
+}
+
+func (h *memoryKeyHeap) Less(i, j int) bool {
+	return h.size(h.keys[i]) < h.size(h.keys[j])
+}
+
+func (h *memoryKeyHeap) Swap(i, j int) {
+	h.keys[i], h.keys[j] = h.keys[j], h.keys[i]
+}
+
+func (h *memoryKeyHeap) Push(x interface{}) {
+	h.keys = append(h.keys, x.(*memoryReportKey))
+}
+
+func (h *memoryKeyHeap) Pop() interface{} {
+	var k = h.keys[len(h.keys)-1]
+	h.keys = h.keys[:len(h.keys)-1]
+	return k
+}
+
+// Accept returns whether a key of the size goes to the top n keys.
+func (h *memoryKeyHeap) Accept(n int, size int64) bool {
+	return len(h.keys) < n || size > h.size(h.keys[0])
+}
+
+func (h *memoryKeyHeap) Add(n int, k *memoryReportKey) {
+	if len(h.keys) < n {
+		heap.Push(h, k)
+	} else {
+		h.keys[0] = k
+		heap.Fix(h, 0)
+	}
+}
+
+// Sorted returns the keys in descending order of size.
+func (h *memoryKeyHeap) Sorted() []*memoryReportKey {
+	var keys = append([]*memoryReportKey{}, h.keys...)
+	sort.Slice(keys, func(i, j int) bool {
+		if a, b := h.size(keys[i]), h.size(keys[j]); a != b {
+			return a > b
+		}
+		if keys[i].DB != keys[j].DB {
+			return keys[i].DB < keys[j].DB
+		}
+		return keys[i].Key < keys[j].Key
+	})
+	return keys
+}
+
+// memoryReport rolls up the estimated memory usage of keys by db and by key
+// prefix, and keeps the biggest keys and the keys of the largest elements.
+type memoryReport struct {
+	top       int
+	delimiter []byte
+	encoding  string
+
+	total    memoryReportSize
+	dbs      map[uint64]*memoryReportSize
+	prefixes map[string]*memoryReportSize
+
+	keys, elements memoryKeyHeap
+}
+
+func newMemoryReport(top int, delimiter, encoding string) *memoryReport {
+	return &memoryReport{
+		top: top, delimiter: []byte(delimiter), encoding: encoding,
+		dbs:      make(map[uint64]*memoryReportSize),
+		prefixes: make(map[string]*memoryReportSize),
+		keys: memoryKeyHeap{size: func(k *memoryReportKey) int64 {
+			return k.Size
+		}},
+		elements: memoryKeyHeap{size: func(k *memoryReportKey) int64 {
+			return k.LargestElementSize
+		}},
+	}
+}
+
+// Prefix returns the part of the key before the delimiter, keys without the
+// delimiter are rolled up into the empty prefix.
+func (r *memoryReport) Prefix(key []byte) []byte {
+	if i := bytes.Index(key, r.delimiter); i >= 0 {
+		return key[:i]
+	}
+	return nil
+}
+
+func (r *memoryReport) Add(e *rdb.DBEntry, u *rdb.MemoryUsage) {
+	var key = e.Key.BytesUnsafe()
+
+	r.total.add(e, u)
+	if r.dbs[e.DB] == nil {
+		r.dbs[e.DB] = &memoryReportSize{}
+	}
+	r.dbs[e.DB].add(e, u)
+	var prefix = r.Prefix(key)
+	if r.prefixes[string(prefix)] == nil {
+		r.prefixes[string(prefix)] = &memoryReportSize{}
+	}
+	r.prefixes[string(prefix)].add(e, u)
+
+	var collection bool
+	switch e.Type() {
+	case rdb.OBJ_LIST, rdb.OBJ_HASH, rdb.OBJ_SET, rdb.OBJ_ZSET, rdb.OBJ_STREAM:
+		collection = true
+	}
+	var accept = r.keys.Accept(r.top, u.Size)
+	var element = collection && r.elements.Accept(r.top, u.LargestElementSize)
+	if !accept && !element {
+		return
+	}
+	var k = &memoryReportKey{
+		DB: e.DB, Size: u.Size, Elements: u.Elements,
+		Type:               strings.ToLower(strings.TrimPrefix(e.Type().String(), "OBJ_")),
+		LargestElementSize: u.LargestElementSize,
+	}
+	// Elements of lists are values, only the beginning of them is kept.
+	var largest = u.LargestElement
+	if len(largest) > MaxReportElementLen {
+		largest = largest[:MaxReportElementLen]
+	}
+	var enc, s = jsonEncoding(r.encoding, key, largest)
+	k.Key, k.LargestElement, k.Strings = s(key), s(largest), enc
+	if e.Module != nil {
+		k.Encoding = "module"
+	} else {
+		k.Encoding = objectEncoding(e)
+	}
+	if e.Expire != rdb.NoExpire {
+		k.ExpireAt = uint64(e.Expire / time.Millisecond)
+	}
+	if accept {
+		r.keys.Add(r.top, k)
+	}
+	if element {
+		r.elements.Add(r.top, k)
+	}
+}
+
+func (r *memoryReport) Write(w *bufio.Writer) {
+	type db struct {
+		DB uint64 `json:"db"`
+		*memoryReportSize
+	}
+	var dbs = make([]*db, 0, len(r.dbs))
+	for i, s := range r.dbs {
+		dbs = append(dbs, &db{i, s})
+	}
+	sort.Slice(dbs, func(i, j int) bool {
+		return dbs[i].DB < dbs[j].DB
+	})
+
+	type prefix struct {
+		Prefix string `json:"prefix"`
+		*memoryReportSize
+		Strings string `json:"string_encoding,omitempty"`
+	}
+	var prefixes = make([]*prefix, 0, len(r.prefixes))
+	for p, s := range r.prefixes {
+		prefixes = append(prefixes, &prefix{Prefix: p, memoryReportSize: s})
+	}
+	sort.Slice(prefixes, func(i, j int) bool {
+		if prefixes[i].Size != prefixes[j].Size {
+			return prefixes[i].Size > prefixes[j].Size
+		}
+		return prefixes[i].Prefix < prefixes[j].Prefix
+	})
+	if len(prefixes) > r.top {
+		prefixes = prefixes[:r.top]
+	}
+	for _, p := range prefixes {
+		var enc, s = jsonEncoding(r.encoding, []byte(p.Prefix))
+		p.Prefix, p.Strings = s([]byte(p.Prefix)), enc
+	}
+
+	var report = &struct {
+		Total           *memoryReportSize  `json:"total"`
+		DBs             []*db              `json:"dbs"`
+		Keys            []*memoryReportKey `json:"top_keys"`
+		LargestElements []*memoryReportKey `json:"top_largest_elements"`
+		Delimiter       string             `json:"delimiter"`
+		PrefixNum       int                `json:"prefix_count"`
+		Prefixes        []*prefix          `json:"top_prefixes"`
+	}{
+		&r.total, dbs, r.keys.Sorted(), r.elements.Sorted(),
+		string(r.delimiter), len(r.prefixes), prefixes,
+	}
+	if _, err := w.WriteString(toJson(report) + "\n"); err != nil {
+		log.PanicErrorf(err, "write memory report failed")
+	}
+}
+
+// slotReport counts keys and the estimated memory usage of the slots of both
+// Redis Cluster and Codis, and projects the load of nodes by their slots.
+type slotReport struct {
+	top int
+
+	total memoryReportSize
+	dbs   map[uint64]bool
+	codis []memoryReportSize
+	redis []memoryReportSize
+}
+
+func newSlotReport(top int) *slotReport {
+	return &slotReport{
+		top:   top,
+		dbs:   make(map[uint64]bool),
+		codis: make([]memoryReportSize, slot.MaxCodisSlotNum),
+		redis: make([]memoryReportSize, slot.MaxClusterSlotNum),
+	}
+}
+
+func (r *slotReport) Add(e *rdb.DBEntry, u *rdb.MemoryUsage) {
+	var key = e.Key.BytesUnsafe()
+	r.total.add(e, u)
+	r.dbs[e.DB] = true
+	r.codis[slot.CodisSlot(key)].add(e, u)
+	r.redis[slot.ClusterSlot(key)].add(e, u)
+}
+
+// Write writes the report, nodes are the shards of the slots of Codis if
+// codis is set, or of Redis Cluster otherwise.
+func (r *slotReport) Write(w *bufio.Writer, nodes []*Shard, codis bool) {
+	if len(r.dbs) > 1 {
+		log.Warnf("slots: keys of %d dbs are counted together", len(r.dbs))
+	}
+	type slotSize struct {
+		Slot int `json:"slot"`
+		*memoryReportSize
+	}
+	type slotsReport struct {
+		Slots    int         `json:"slots"`
+		Used     int         `json:"used_slots"`
+		MaxKeys  int64       `json:"max_keys"`
+		MaxSize  int64       `json:"max_size"`
+		AvgKeys  float64     `json:"avg_keys"`
+		AvgSize  float64     `json:"avg_size"`
+		Hottest  []*slotSize `json:"hottest"`
+		PerSlots []*slotSize `json:"per_slot"`
+	}
+	var summarize = func(sizes []memoryReportSize) *slotsReport {
+		var x = &slotsReport{Slots: len(sizes)}
+		for i := range sizes {
+			var s = &sizes[i]
+			if s.Keys == 0 {
+				continue
+			}
+			x.Used++
+			if s.Keys > x.MaxKeys {
+				x.MaxKeys = s.Keys
+			}
+			if s.Size > x.MaxSize {
+				x.MaxSize = s.Size
+			}
+			x.PerSlots = append(x.PerSlots, &slotSize{i, s})
+		}
+		x.AvgKeys = float64(r.total.Keys) / float64(len(sizes))
+		x.AvgSize = float64(r.total.Size) / float64(len(sizes))
+		x.Hottest = append([]*slotSize{}, x.PerSlots...)
+		sort.Slice(x.Hottest, func(i, j int) bool {
+			var a, b = x.Hottest[i], x.Hottest[j]
+			if a.Size != b.Size {
+				return a.Size > b.Size
+			}
+			return a.Slot < b.Slot
+		})
+		if len(x.Hottest) > r.top {
+			x.Hottest = x.Hottest[:r.top]
+		}
+		if x.PerSlots == nil {
+			x.PerSlots, x.Hottest = []*slotSize{}, []*slotSize{}
+		}
+		return x
+	}
+
+	type nodeSize struct {
+		Node  string `json:"node,omitempty"`
+		Slots int    `json:"slots"`
+		memoryReportSize
+		KeysShare float64 `json:"keys_share"`
+		SizeShare float64 `json:"size_share"`
+	}
+	var sizes = r.redis
+	if codis {
+		sizes = r.codis
+	}
+	var projected = make([]*nodeSize, 0, len(nodes))
+	for _, n := range nodes {
+		projected = append(projected, &nodeSize{Node: n.Path})
+	}
+	var unassigned = &nodeSize{}
+	for i, n := range assignShards(nodes, len(sizes)) {
+		var x = unassigned
+		if n >= 0 {
+			x = projected[n]
+		}
+		x.Slots++
+		x.Keys += sizes[i].Keys
+		x.Expires += sizes[i].Expires
+		x.Size += sizes[i].Size
+	}
+	for _, x := range append(projected, unassigned) {
+		if r.total.Keys != 0 {
+			x.KeysShare = float64(x.Keys) * 100 / float64(r.total.Keys)
+		}
+		if r.total.Size != 0 {
+			x.SizeShare = float64(x.Size) * 100 / float64(r.total.Size)
+		}
+	}
+
+	var report = &struct {
+		Total *memoryReportSize `json:"total"`
+		Redis *slotsReport      `json:"cluster"`
+		Codis *slotsReport      `json:"codis"`
+		Nodes []*nodeSize       `json:"nodes"`
+
+		Unassigned *nodeSize `json:"unassigned,omitempty"`
+	}{
+		&r.total, summarize(r.redis), summarize(r.codis), projected, nil,
+	}
+	if len(nodes) != 0 && unassigned.Slots != 0 {
+		report.Unassigned = unassigned
+	}
+	if _, err := w.WriteString(toJson(report) + "\n"); err != nil {
+		log.PanicErrorf(err, "write slots report failed")
+	}
+}
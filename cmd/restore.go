@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"fmt"
 	"io"
@@ -17,7 +18,7 @@ import (
 func main() {
 	const usage = `
 Usage:
-	redis-restore [--ncpu=N] [--input=INPUT|INPUT] --target=TARGET [--aof=FILE] [--db=DB] [--unixtime-in-milliseconds=EXPR]
+	redis-restore [--ncpu=N] [--input=INPUT|INPUT] --target=TARGET [--aof=FILE] [--db=DB] [--unixtime-in-milliseconds=EXPR] [--no-payload] [--codis [--shard=SLOTS:SERVER]...] [--cluster] [--conflict=POLICY [--conflict-log=FILE]] [--max-errors=N] [--dead-letter=FILE]
 	redis-restore  --version
 
 Options:
@@ -27,12 +28,26 @@ Options:
 	-a FILE, --aof=FILE               Also restore the replication backlog.
 	--db=DB                           Accept db = DB, default is *.
 	--unixtime-in-milliseconds=EXPR   Update expire time when restoring objects from RDB.
+	--no-payload                      Restore keys with DEL and the commands that rebuild them, instead of RESTORE with DUMP payloads, streams of RDB version 10 and later are always restored by commands.
+	--codis                           Target is codis-proxy, keys of db 0 are restored by RESTORE through it, or by SLOTSRESTORE in batches of the same slot if they are sent to codis-servers by --shard, payloads of rdb version 9 are loaded by redis 5.0 and later, keys of the targets that can't load them are restored by commands.
+	--shard=SLOTS:SERVER              Send keys of SLOTS straight to the codis-server ([auth@]host:port), e.g. 0-511,1000:127.0.0.1:6380.
+	--cluster                         Target is a node of redis cluster, keys of db 0 are restored to the masters of their slots.
+	--conflict=POLICY                 Replace keys that exist in the target, skip them, fail with a report, or merge lists, hashes, sets and zsets into them. [default: replace].
+	--conflict-log=FILE               Write keys that are skipped or conflicted to FILE as json lines.
+	--max-errors=N                    Abort once more than N keys or commands fail in the target, transient errors of keys are retried first, default is 0.
+	--dead-letter=FILE                Write keys and commands that fail to FILE as json lines, which can be replayed by redis-decode --input-format=json.
 
 Examples:
 	$ redis-restore    dump.rdb -t 127.0.0.1:6379
 	$ redis-restore -i dump.rdb -t 127.0.0.1:6379 --aof dump.aof --db=1
 	$ redis-restore             -t 127.0.0.1:6379 --aof dump.aof
 	$ redis-restore             -t 127.0.0.1:6379 --db=0
+	$ redis-restore -i dump.rdb -t 127.0.0.1:6379 --no-payload
+	$ redis-restore -i dump.rdb -t 127.0.0.1:19000 --codis
+	$ redis-restore -i dump.rdb -t 127.0.0.1:19000 --codis --shard=0-511:127.0.0.1:6380 --shard=512-1023:127.0.0.1:6381
+	$ redis-restore -i dump.rdb -t 127.0.0.1:7000 --cluster --aof dump.aof
+	$ redis-restore -i dump.rdb -t 127.0.0.1:6379 --conflict=skip --conflict-log=conflicts.json
+	$ redis-restore -i dump.rdb -t 127.0.0.1:6379 --max-errors=100 --dead-letter=failed.json
 	$ redis-restore -i dump.rdb -t 127.0.0.1:6379 --unixtime-in-milliseconds="@209059200000"       // ttlms += (now - '1976-08-17')
 	$ redis-restore -i dump.rdb -t 127.0.0.1:6379 --unixtime-in-milliseconds="+1000"               // ttlms += 1s
 	$ redis-restore -i dump.rdb -t 127.0.0.1:6379 --unixtime-in-milliseconds="-1000"               // ttlms -= 1s
@@ -69,6 +84,33 @@ Examples:
 	}
 	log.Infof("restore: input = %q, aoflog = %q target = %q\n", input.Path, aoflog.Path, target.Path)
 
+	var conflict *restoreConflict
+	switch flags.Conflict {
+	case "", "replace":
+		if flags.ConflictLog != "" {
+			log.Panicf("invalid conflict log, keys are always replaced")
+		}
+	case "skip", "fail", "merge":
+		if flags.Codis || flags.Cluster {
+			log.Panicf("conflict policy %q isn't supported by --codis or --cluster", flags.Conflict)
+		}
+		conflict = &restoreConflict{Policy: flags.Conflict}
+	default:
+		log.Panicf("invalid conflict policy %q", flags.Conflict)
+	}
+	if conflict != nil && flags.ConflictLog != "" {
+		file := openWriteFile(flags.ConflictLog)
+		defer closeFile(file)
+		conflict.Log = wBuilder(file).Must().Buffer(WriterBufferSize).Writer.(*bufio.Writer)
+	}
+
+	var errs = &restoreErrors{Max: flags.MaxErrors}
+	if flags.DeadLetter != "" {
+		file := openWriteFile(flags.DeadLetter)
+		defer closeFile(file)
+		errs.Log = wBuilder(file).Must().Buffer(WriterBufferSize).Writer.(*bufio.Writer)
+	}
+
 	if input.Path != "" {
 		file, size := openReadFile(input.Path)
 		defer file.Close()
@@ -86,45 +128,91 @@ Examples:
 	} else {
 		aoflog.Reader = bytes.NewReader(nil)
 	}
-	aoflog.rd = rBuilder(aoflog.Reader).Must().
+	// The aof stream ends with io.EOF, so it's not wrapped by MustReader.
+	aoflog.rd = rBuilder(aoflog.Reader).
 		Count(&aoflog.rbytes).Buffer2(ReaderBufferSize).Reader.(*bufio2.Reader)
 
+	var loader *rdb.Loader
+	var entryChan <-chan *rdb.DBEntry
+	if input.Path != "" {
+		loader, entryChan = newRDBLoader(input.rd, 32)
+	}
+
+	var codis struct {
+		targets  []*codisTarget
+		route    []int
+		progress codisProgress
+	}
+	if flags.Codis {
+		codis.targets, codis.route = newCodisTargets(target.Addr, target.Auth, flags.Shards)
+	} else {
+		codis.targets = []*codisTarget{{Addr: target.Addr, Auth: target.Auth}}
+	}
+	var cluster *clusterRoute
+	if flags.Cluster {
+		cluster = newClusterRoute(target.Addr, target.Auth)
+	}
+	if flags.Codis || flags.Cluster {
+		var accept = acceptDB
+		acceptDB = func(db uint64) bool {
+			return db == 0 && accept(db)
+		}
+	}
+
+	var payload = !flags.NoPayload && input.Path != ""
+	for _, t := range codis.targets {
+		t.Payload = payload && checkRestorePayload(t.Addr, t.Auth)
+	}
+	payload = codis.targets[0].Payload
+
 	var jobs = NewJob(func() {
 		if input.Path == "" {
 			return
 		}
-		var entryChan = newRDBLoader(input.rd, 32)
 		NewParallelJob(flags.Parallel, func() {
-			doRestoreDBEntry(entryChan, target.Addr, target.Auth,
-				func(e *rdb.DBEntry) bool {
-					if e.Expire != rdb.NoExpire {
-						e.Expire += flags.ExpireOffset
-					}
-					if !acceptDB(e.DB) {
-						input.skip.Incr()
-						return false
-					}
-					input.forward.Incr()
-					return true
-				})
+			var on = func(e *rdb.DBEntry) bool {
+				if e.Expire != rdb.NoExpire {
+					e.Expire += flags.ExpireOffset
+				}
+				if !acceptDB(e.DB) {
+					input.skip.Incr()
+					return false
+				}
+				input.forward.Incr()
+				return true
+			}
+			switch {
+			case flags.Codis:
+				doRestoreCodisEntry(entryChan, codis.targets, codis.route, errs, on, codis.progress.Done)
+			case flags.Cluster:
+				doRestoreClusterEntry(entryChan, cluster, payload, errs, on)
+			default:
+				doRestoreDBEntry(entryChan, target.Addr, target.Auth, payload, conflict, errs, on)
+			}
 		}).RunAndWait()
 	}).Then(func() {
 		if aoflog.Path == "" {
 			return
 		}
-		doRestoreAoflog(aoflog.rd, target.Addr, target.Auth,
-			func(db uint64, cmd string) bool {
-				if !acceptDB(db) && cmd != "PING" {
-					aoflog.skip.Incr()
-					return false
-				}
-				aoflog.forward.Incr()
-				return true
-			})
+		var on = func(db uint64, cmd string) bool {
+			if !acceptDB(db) && cmd != "PING" {
+				aoflog.skip.Incr()
+				return false
+			}
+			aoflog.forward.Incr()
+			return true
+		}
+		if flags.Cluster {
+			doRestoreClusterAoflog(aoflog.rd, cluster, errs, on)
+		} else {
+			doRestoreAoflog(aoflog.rd, target.Addr, target.Auth, errs, on)
+		}
 	}).Run()
 
 	log.Infof("restore: (r,f,s/a,f,s) = (rdb,rdb.forward,rdb.skip/aof,rdb.forward,rdb.skip)")
 
+	var start = time.Now()
+
 	NewJob(func() {
 		for stop := false; !stop; {
 			select {
@@ -152,9 +240,32 @@ Examples:
 					stats.aoflog, aoflog.forward.Int64(), aoflog.skip.Int64()))
 			fmt.Fprintf(&b, "  ~  (%s,-,-/%s,-,-)",
 				bytesize.Int64(stats.input).HumanString(), bytesize.Int64(stats.aoflog).HumanString())
+			if loader != nil {
+				var keys = input.forward.Int64() + input.skip.Int64()
+				var total = loaderTotalKeys(loader)
+				var elapsed = time.Since(start)
+				fmt.Fprintf(&b, "  ~  keys=%d/%d", keys, total)
+				fmt.Fprintf(&b, "  eta=(%s,%s)",
+					formatETA(elapsed, stats.input, input.Size), formatETA(elapsed, keys, total))
+			}
+			if flags.Codis {
+				fmt.Fprintf(&b, "  ~  slots=%d/%d", codis.progress.Slots(), len(codis.progress))
+			}
+			if conflict != nil {
+				fmt.Fprintf(&b, "  ~  conflicts=%d", conflict.Count.Int64())
+			}
+			if errs.Max != 0 || errs.Log != nil {
+				fmt.Fprintf(&b, "  ~  errors=%d", errs.Count.Int64())
+				errs.Flush()
+			}
 			log.Info(b.String())
 		}
 	}).RunAndWait()
 
+	if conflict != nil && conflict.Log != nil {
+		flushWriter(conflict.Log)
+	}
+	errs.Flush()
+
 	log.Info("restore: done")
 }
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/CodisLabs/codis/pkg/proxy/redis"
+	"github.com/CodisLabs/codis/pkg/utils/bytesize"
+	"github.com/CodisLabs/codis/pkg/utils/log"
+	"github.com/CodisLabs/codis/pkg/utils/sync2/atomic2"
+
+	"github.com/CodisLabs/redis-port/pkg/libs/slot"
+	"github.com/CodisLabs/redis-port/pkg/rdb"
+)
+
+func main() {
+	const usage = `
+Usage:
+	redis-split [--ncpu=N] [--input=INPUT|INPUT] [--codis] [--format=FORMAT] [--db=DB] --shard=SHARD...
+	redis-split  --version
+
+Options:
+	-n N, --ncpu=N                    Set runtime.GOMAXPROCS to N.
+	-i INPUT, --input=INPUT           Set input rdb encoded file. [default: /dev/stdin].
+	--codis                           Route keys by crc32(key) % 1024 of Codis, default is crc16(key) % 16384 of Redis Cluster.
+	--format=FORMAT                   Set format of the outputs, rdb or resp. [default: rdb].
+	--db=DB                           Accept db = DB, default is *.
+	--shard=SHARD                     Write keys of the slots to a file, SHARD is SLOTS:OUTPUT, SLOTS is a comma separated list of slots or ranges.
+
+Examples:
+	$ redis-split -i dump.rdb --shard=0-5460:shard0.rdb --shard=5461-10922:shard1.rdb --shard=10923-16383:shard2.rdb
+	$ redis-split    dump.rdb --codis --shard=0-511:group1.rdb --shard=512-1023:group2.rdb
+	$ redis-split    dump.rdb --format=resp --shard=0-8191,16383:shard0.aof --shard=8192-16382:shard1.aof
+`
+	var flags = parseFlags(usage)
+
+	var input struct {
+		Path string
+		Size int64
+		io.Reader
+		rd io.Reader
+
+		rbytes, forward, skip atomic2.Int64
+	}
+	input.Path = flags.Source
+	if len(input.Path) == 0 {
+		log.Panicf("invalid input file")
+	}
+
+	var hashSlot, maxSlotNum = slot.ClusterSlot, slot.MaxClusterSlotNum
+	if flags.Codis {
+		hashSlot, maxSlotNum = slot.CodisSlot, slot.MaxCodisSlotNum
+	}
+
+	switch flags.Format {
+	case "rdb", "resp":
+	default:
+		log.Panicf("invalid format %q", flags.Format)
+	}
+
+	type output struct {
+		Path string
+		io.Writer
+		wt *bufio.Writer
+
+		rdb  *rdb.Writer
+		resp *redis.Encoder
+		db   uint64
+
+		header bool
+		wbytes atomic2.Int64
+	}
+	if len(flags.Shards) == 0 {
+		log.Panicf("invalid shards")
+	}
+	var outputs []*output
+	for _, shard := range flags.Shards {
+		outputs = append(outputs, &output{Path: shard.Path})
+	}
+	var slots = make([]*output, maxSlotNum)
+	var unassigned int
+	for i, n := range assignShards(flags.Shards, maxSlotNum) {
+		if n < 0 {
+			unassigned++
+		} else {
+			slots[i] = outputs[n]
+		}
+	}
+	if unassigned != 0 {
+		log.Warnf("split: %d slots are not assigned, their keys are skipped", unassigned)
+	}
+	log.Infof("split: input = %q, shards = %d, format = %q\n", input.Path, len(outputs), flags.Format)
+
+	if input.Path != "/dev/stdin" {
+		file, size := openReadFile(input.Path)
+		defer file.Close()
+		input.Reader, input.Size = file, size
+	} else {
+		input.Reader = os.Stdin
+	}
+	input.rd = rBuilder(input.Reader).Must().
+		Buffer(ReaderBufferSize).Count(&input.rbytes).Reader
+
+	for _, o := range outputs {
+		file := openWriteFile(o.Path)
+		defer closeFile(file)
+		o.Writer = file
+		o.wt = wBuilder(o.Writer).Must().
+			Count(&o.wbytes).Buffer(WriterBufferSize).Writer.(*bufio.Writer)
+		switch flags.Format {
+		case "rdb":
+			o.rdb = rdb.NewWriter(o.wt)
+		case "resp":
+			o.resp = redis.NewEncoder(o.wt)
+		}
+	}
+
+	var loader, entryChan = newRDBLoader(input.rd, 32)
+
+	var writeHeader = func(o *output) {
+		if o.header || o.rdb == nil {
+			return
+		}
+		if err := o.rdb.Header(); err != nil {
+			log.PanicErrorf(err, "write rdb header failed")
+		}
+		var aux = loader.Aux()
+		var keys = make([]string, 0, len(aux))
+		for key := range aux {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if err := o.rdb.WriteAux(key, aux[key]); err != nil {
+				log.PanicErrorf(err, "write rdb aux failed")
+			}
+		}
+		o.header = true
+	}
+
+	var jobs = NewJob(func() {
+		for e := range entryChan {
+			var o *output
+			if acceptDB(e.DB) {
+				o = slots[hashSlot(e.Key.BytesUnsafe())]
+			}
+			if o == nil {
+				input.skip.Incr()
+				e.DecrRefCount()
+				continue
+			}
+			writeHeader(o)
+			switch {
+			case o.rdb != nil:
+				if err := o.rdb.WriteEntry(e); err != nil {
+					log.PanicErrorf(err, "write rdb entry failed")
+				}
+			case o.resp != nil:
+				genRestoreCommands(e, o.db, func(cmd string, args ...interface{}) {
+					redisSendCommand(o.resp, redisNewCommand(cmd, args...), false)
+				})
+				o.db = e.DB
+			}
+			input.forward.Incr()
+			e.DecrRefCount()
+		}
+		for _, o := range outputs {
+			writeHeader(o)
+			if o.rdb != nil {
+				if err := o.rdb.Footer(); err != nil {
+					log.PanicErrorf(err, "write rdb footer failed")
+				}
+			}
+			if o.resp != nil {
+				redisFlushEncoder(o.resp)
+			}
+			flushWriter(o.wt)
+		}
+	}).Run()
+
+	log.Infof("split: (r,w,f,s) = (read,write,forward,skip)")
+
+	NewJob(func() {
+		for stop := false; !stop; {
+			select {
+			case <-jobs:
+				stop = true
+			case <-time.After(time.Second):
+			}
+			var wbytes int64
+			for _, o := range outputs {
+				wbytes += o.wbytes.Int64()
+			}
+			stats := &struct {
+				input, output, forward, skip int64
+			}{
+				input.rbytes.Int64(), wbytes, input.forward.Int64(), input.skip.Int64(),
+			}
+
+			var b bytes.Buffer
+			var percent float64
+			if input.Size != 0 {
+				percent = float64(stats.input) * 100 / float64(input.Size)
+			}
+			fmt.Fprintf(&b, "split: file = %d - [%6.2f%%]", input.Size, percent)
+			fmt.Fprintf(&b, "   (r,w,f,s)=%s",
+				formatAlign(4, "(%d,%d,%d,%d)", stats.input, stats.output, stats.forward, stats.skip))
+			fmt.Fprintf(&b, "  ~  (%s,%s,-,-)",
+				bytesize.Int64(stats.input).HumanString(), bytesize.Int64(stats.output).HumanString())
+			log.Info(b.String())
+		}
+	}).RunAndWait()
+
+	log.Info("split: done")
+}
@@ -0,0 +1,534 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/CodisLabs/codis/pkg/utils/bytesize"
+	"github.com/CodisLabs/codis/pkg/utils/log"
+	"github.com/CodisLabs/codis/pkg/utils/sync2/atomic2"
+
+	"github.com/CodisLabs/redis-port/pkg/rdb"
+)
+
+func main() {
+	const usage = `
+Usage:
+	redis-stats [--ncpu=N] [--input=INPUT|INPUT] [--output=OUTPUT] [--format=FORMAT] [--now=NOW]
+	redis-stats  --version
+
+Options:
+	-n N, --ncpu=N                    Set runtime.GOMAXPROCS to N.
+	-i INPUT, --input=INPUT           Set input rdb encoded file. [default: /dev/stdin].
+	-o OUTPUT, --output=OUTPUT        Set output file. [default: /dev/stdout].
+	--format=FORMAT                   Set output format, text or json. [default: text].
+	--now=NOW                         Set the time that expires are relative to, "@UNIXTIME" in milliseconds or "2006-01-02 15:04:05", default is now.
+
+Examples:
+	$ redis-stats -i dump.rdb
+	$ redis-stats    dump.rdb --format=json -o stats.json
+	$ redis-stats    dump.rdb --now="2018-05-21 16:00:00"
+`
+	var flags = parseFlags(usage)
+
+	var input struct {
+		Path string
+		Size int64
+		io.Reader
+		rd io.Reader
+
+		rbytes, objects atomic2.Int64
+	}
+	input.Path = flags.Source
+	if len(input.Path) == 0 {
+		log.Panicf("invalid input file")
+	}
+
+	var output struct {
+		Path string
+		io.Writer
+		wt *bufio.Writer
+
+		wbytes atomic2.Int64
+	}
+	output.Path = flags.Target
+	if len(output.Path) == 0 {
+		log.Panicf("invalid output file")
+	}
+	switch flags.Format {
+	case "text", "json":
+	default:
+		log.Panicf("invalid format %q", flags.Format)
+	}
+	if flags.Now.IsZero() {
+		flags.Now = time.Now()
+	}
+	log.Infof("stats: input = %q, output = %q, format = %q\n", input.Path, output.Path, flags.Format)
+
+	if input.Path != "/dev/stdin" {
+		file, size := openReadFile(input.Path)
+		defer file.Close()
+		input.Reader, input.Size = file, size
+	} else {
+		input.Reader = os.Stdin
+	}
+	input.rd = rBuilder(input.Reader).Must().
+		Buffer(ReaderBufferSize).Count(&input.rbytes).Reader
+
+	if output.Path != "/dev/stdout" {
+		file := openWriteFile(output.Path)
+		defer closeFile(file)
+		output.Writer = file
+	} else {
+		output.Writer = os.Stdout
+	}
+	output.wt = wBuilder(output.Writer).Must().
+		Count(&output.wbytes).Buffer(WriterBufferSize).Writer.(*bufio.Writer)
+
+	var _, entryChan = newRDBLoader(input.rd, 32)
+
+	var mu sync.Mutex
+	var stats = newKeyspaceStats(time.Duration(flags.Now.UnixNano()))
+
+	var jobs = NewParallelJob(flags.Parallel, func() {
+		for e := range entryChan {
+			var k = newKeyStats(e)
+			synchronized(&mu, func() {
+				stats.Add(k)
+			})
+			input.objects.Incr()
+			e.DecrRefCount()
+		}
+	}).Then(func() {
+		switch flags.Format {
+		case "json":
+			stats.WriteJson(output.wt)
+		default:
+			stats.WriteText(output.wt)
+		}
+		flushWriter(output.wt)
+	}).Run()
+
+	log.Infof("stats: (r,o) = (read,objects)")
+
+	NewJob(func() {
+		for stop := false; !stop; {
+			select {
+			case <-jobs:
+				stop = true
+			case <-time.After(time.Second):
+			}
+			stats := &struct {
+				input, objects int64
+			}{
+				input.rbytes.Int64(), input.objects.Int64(),
+			}
+
+			var b bytes.Buffer
+			var percent float64
+			if input.Size != 0 {
+				percent = float64(stats.input) * 100 / float64(input.Size)
+			}
+			fmt.Fprintf(&b, "stats: file = %d - [%6.2f%%]", input.Size, percent)
+			fmt.Fprintf(&b, "   (r,o)=%s",
+				formatAlign(4, "(%d,%d)", stats.input, stats.objects))
+			fmt.Fprintf(&b, "  ~  (%s,-)",
+				bytesize.Int64(stats.input).HumanString())
+			log.Info(b.String())
+		}
+	}).RunAndWait()
+
+	log.Info("stats: done")
+}
+
+// keyStats is what's counted of a key, it's collected out of the lock.
+type keyStats struct {
+	DB       uint64
+	Type     string
+	Encoding string
+	Expire   time.Duration
+
+	KeyLen, ValueLen int64
+	// Elements is -1 for strings and modules.
+	Elements int64
+}
+
+func newKeyStats(e *rdb.DBEntry) *keyStats {
+	var k = &keyStats{
+		DB: e.DB, Expire: e.Expire, Elements: -1,
+		Type:   strings.ToLower(strings.TrimPrefix(e.Type().String(), "OBJ_")),
+		KeyLen: int64(len(e.Key.BytesUnsafe())),
+	}
+	if e.Module != nil {
+		k.Encoding, k.ValueLen = "module", int64(e.Module.Len())
+		return k
+	}
+	k.Encoding = objectEncoding(e)
+	switch e.Type() {
+	case rdb.OBJ_STRING:
+		k.ValueLen = int64(len(e.Value.AsString().BytesUnsafe()))
+	case rdb.OBJ_LIST:
+		var list = e.Value.AsList()
+		k.Elements = int64(list.Len())
+		list.ForEach(func(iter *rdb.RedisListIterator, index int) bool {
+			var field = iter.Next()
+			if field == nil {
+				return false
+			}
+			k.ValueLen += int64(len(field.BytesUnsafe()))
+			return true
+		})
+	case rdb.OBJ_HASH:
+		var hash = e.Value.AsHash()
+		k.Elements = int64(hash.Len())
+		hash.ForEach(func(iter *rdb.RedisHashIterator, index int) bool {
+			var field, value = iter.Next()
+			if field == nil {
+				return false
+			}
+			k.ValueLen += int64(len(field.BytesUnsafe()) + len(value.BytesUnsafe()))
+			return true
+		})
+	case rdb.OBJ_SET:
+		var set = e.Value.AsSet()
+		k.Elements = int64(set.Len())
+		set.ForEach(func(iter *rdb.RedisSetIterator, index int) bool {
+			var member = iter.Next()
+			if member == nil {
+				return false
+			}
+			k.ValueLen += int64(len(member.BytesUnsafe()))
+			return true
+		})
+	case rdb.OBJ_ZSET:
+		var zset = e.Value.AsZset()
+		k.Elements = int64(zset.Len())
+		zset.ForEach(func(iter *rdb.RedisZsetIterator, index int) bool {
+			var member = iter.Next()
+			if member == nil {
+				return false
+			}
+			k.ValueLen += int64(len(member.BytesUnsafe()))
+			return true
+		})
+	case rdb.OBJ_STREAM:
+		var stream = e.Value.AsStream()
+		k.Elements = int64(stream.Len())
+		stream.ForEach(func(iter *rdb.RedisStreamIterator, index int) bool {
+			var entry = iter.Next()
+			if entry == nil {
+				return false
+			}
+			for i := range entry.Fields {
+				k.ValueLen += int64(len(entry.Fields[i].BytesUnsafe()) + len(entry.Values[i].BytesUnsafe()))
+			}
+			return true
+		})
+	}
+	return k
+}
+
+type statsCount struct {
+	Keys    int64 `json:"keys"`
+	Expires int64 `json:"expires"`
+	Bytes   int64 `json:"bytes"`
+}
+
+func (c *statsCount) add(k *keyStats) {
+	c.Keys++
+	if k.Expire != rdb.NoExpire {
+		c.Expires++
+	}
+	c.Bytes += k.KeyLen + k.ValueLen
+}
+
+// statsHistogram counts values in buckets of powers of 2, bucket i holds
+// values in [2^(i-1), 2^i), and bucket 0 holds 0.
+type statsHistogram []int64
+
+func (h *statsHistogram) add(v int64) {
+	var i int
+	for ; v > 0; v >>= 1 {
+		i++
+	}
+	for len(*h) <= i {
+		*h = append(*h, 0)
+	}
+	(*h)[i]++
+}
+
+type statsBucket struct {
+	Min   int64 `json:"min"`
+	Max   int64 `json:"max"`
+	Count int64 `json:"count"`
+}
+
+func (h statsHistogram) Buckets() []*statsBucket {
+	var buckets = make([]*statsBucket, 0, len(h))
+	for i, n := range h {
+		if n == 0 {
+			continue
+		}
+		var b = &statsBucket{Count: n}
+		if i != 0 {
+			b.Min, b.Max = int64(1)<<uint(i-1), int64(1)<<uint(i)-1
+		}
+		buckets = append(buckets, b)
+	}
+	return buckets
+}
+
+// statsExpires are the upper bounds of the expire buckets, keys that have
+// expired and keys beyond the last bound have their own buckets.
+var statsExpires = []struct {
+	Name string
+	time.Duration
+}{
+	{"1m", time.Minute},
+	{"1h", time.Hour},
+	{"1d", time.Hour * 24},
+	{"7d", time.Hour * 24 * 7},
+	{"30d", time.Hour * 24 * 30},
+	{"365d", time.Hour * 24 * 365},
+}
+
+type keyspaceStats struct {
+	now time.Duration
+
+	Total     statsCount
+	DBs       map[uint64]*statsCount
+	Types     map[string]*statsCount
+	Encodings map[string]*statsCount
+
+	KeyLen   statsHistogram
+	ValueLen map[string]*statsHistogram
+	Elements map[string]*statsHistogram
+	// Expires has a bucket of expired keys, then one for each statsExpires,
+	// and the last one of keys beyond them.
+	Expires []int64
+}
+
+func newKeyspaceStats(now time.Duration) *keyspaceStats {
+	return &keyspaceStats{
+		now:       now,
+		DBs:       make(map[uint64]*statsCount),
+		Types:     make(map[string]*statsCount),
+		Encodings: make(map[string]*statsCount),
+		ValueLen:  make(map[string]*statsHistogram),
+		Elements:  make(map[string]*statsHistogram),
+		Expires:   make([]int64, len(statsExpires)+2),
+	}
+}
+
+func (s *keyspaceStats) Add(k *keyStats) {
+	s.Total.add(k)
+	if s.DBs[k.DB] == nil {
+		s.DBs[k.DB] = &statsCount{}
+	}
+	s.DBs[k.DB].add(k)
+	if s.Types[k.Type] == nil {
+		s.Types[k.Type] = &statsCount{}
+	}
+	s.Types[k.Type].add(k)
+	if s.Encodings[k.Encoding] == nil {
+		s.Encodings[k.Encoding] = &statsCount{}
+	}
+	s.Encodings[k.Encoding].add(k)
+
+	s.KeyLen.add(k.KeyLen)
+	if s.ValueLen[k.Type] == nil {
+		s.ValueLen[k.Type] = &statsHistogram{}
+	}
+	s.ValueLen[k.Type].add(k.ValueLen)
+	if k.Elements >= 0 {
+		if s.Elements[k.Type] == nil {
+			s.Elements[k.Type] = &statsHistogram{}
+		}
+		s.Elements[k.Type].add(k.Elements)
+	}
+
+	if k.Expire != rdb.NoExpire {
+		var ttl = k.Expire - s.now
+		var i = len(statsExpires) + 1
+		if ttl <= 0 {
+			i = 0
+		} else {
+			for j, b := range statsExpires {
+				if ttl < b.Duration {
+					i = j + 1
+					break
+				}
+			}
+		}
+		s.Expires[i]++
+	}
+}
+
+func (s *keyspaceStats) expireNames() []string {
+	var names = []string{"expired"}
+	for _, b := range statsExpires {
+		names = append(names, "<"+b.Name)
+	}
+	return append(names, ">="+statsExpires[len(statsExpires)-1].Name)
+}
+
+func (s *keyspaceStats) sortedTypes(m map[string]*statsHistogram) []string {
+	var types = make([]string, 0, len(m))
+	for t := range m {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	return types
+}
+
+func (s *keyspaceStats) WriteJson(w *bufio.Writer) {
+	type named struct {
+		Name string `json:"name"`
+		*statsCount
+	}
+	var sortedCounts = func(m map[string]*statsCount) []*named {
+		var list = make([]*named, 0, len(m))
+		for name, c := range m {
+			list = append(list, &named{name, c})
+		}
+		sort.Slice(list, func(i, j int) bool {
+			return list[i].Name < list[j].Name
+		})
+		return list
+	}
+	type db struct {
+		DB uint64 `json:"db"`
+		*statsCount
+	}
+	var dbs = make([]*db, 0, len(s.DBs))
+	for i, c := range s.DBs {
+		dbs = append(dbs, &db{i, c})
+	}
+	sort.Slice(dbs, func(i, j int) bool {
+		return dbs[i].DB < dbs[j].DB
+	})
+	type histogram struct {
+		Type    string         `json:"type"`
+		Buckets []*statsBucket `json:"buckets"`
+	}
+	var histograms = func(m map[string]*statsHistogram) []*histogram {
+		var list = make([]*histogram, 0, len(m))
+		for _, t := range s.sortedTypes(m) {
+			list = append(list, &histogram{t, m[t].Buckets()})
+		}
+		return list
+	}
+	type expire struct {
+		Range string `json:"range"`
+		Count int64  `json:"count"`
+	}
+	var expires = make([]*expire, 0, len(s.Expires))
+	for i, name := range s.expireNames() {
+		expires = append(expires, &expire{name, s.Expires[i]})
+	}
+
+	var stats = &struct {
+		Now       uint64         `json:"now"`
+		Total     *statsCount    `json:"total"`
+		DBs       []*db          `json:"dbs"`
+		Types     []*named       `json:"types"`
+		Encodings []*named       `json:"encodings"`
+		KeyLen    []*statsBucket `json:"key_length"`
+		ValueLen  []*histogram   `json:"value_length"`
+		Elements  []*histogram   `json:"elements"`
+		Expires   []*expire      `json:"expires"`
+	}{
+		uint64(s.now / time.Millisecond), &s.Total, dbs,
+		sortedCounts(s.Types), sortedCounts(s.Encodings),
+		s.KeyLen.Buckets(), histograms(s.ValueLen), histograms(s.Elements), expires,
+	}
+	if _, err := w.WriteString(toJson(stats) + "\n"); err != nil {
+		log.PanicErrorf(err, "write stats failed")
+	}
+}
+
+func (s *keyspaceStats) WriteText(w *bufio.Writer) {
+	var tw = tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	var percent = func(n, total int64) string {
+		if total == 0 {
+			return "-"
+		}
+		return fmt.Sprintf("%.2f%%", float64(n)*100/float64(total))
+	}
+	var writeCount = func(name string, c *statsCount) {
+		fmt.Fprintf(tw, "  %s\tkeys=%d\t%s\texpires=%d\tbytes=%d\t%s\n", name, c.Keys,
+			percent(c.Keys, s.Total.Keys), c.Expires, c.Bytes, bytesize.Int64(c.Bytes).HumanString())
+	}
+	var writeHistogram = func(h statsHistogram) {
+		var total int64
+		for _, n := range h {
+			total += n
+		}
+		for _, b := range h.Buckets() {
+			fmt.Fprintf(tw, "    [%d,%d]\t%d\t%s\n", b.Min, b.Max, b.Count, percent(b.Count, total))
+		}
+	}
+
+	fmt.Fprintf(tw, "now: %s\n", time.Unix(0, int64(s.now)).Format("2006-01-02 15:04:05 MST"))
+	fmt.Fprintf(tw, "keys: %d, expires: %d (%s), bytes: %d (%s)\n", s.Total.Keys, s.Total.Expires,
+		percent(s.Total.Expires, s.Total.Keys), s.Total.Bytes, bytesize.Int64(s.Total.Bytes).HumanString())
+
+	fmt.Fprintf(tw, "\ndbs:\n")
+	var dbs = make([]uint64, 0, len(s.DBs))
+	for db := range s.DBs {
+		dbs = append(dbs, db)
+	}
+	sort.Slice(dbs, func(i, j int) bool {
+		return dbs[i] < dbs[j]
+	})
+	for _, db := range dbs {
+		writeCount(fmt.Sprintf("db%d", db), s.DBs[db])
+	}
+	for _, x := range []struct {
+		title  string
+		counts map[string]*statsCount
+	}{
+		{"types", s.Types}, {"encodings", s.Encodings},
+	} {
+		fmt.Fprintf(tw, "\n%s:\n", x.title)
+		var names = make([]string, 0, len(x.counts))
+		for name := range x.counts {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			writeCount(name, x.counts[name])
+		}
+	}
+
+	fmt.Fprintf(tw, "\nkey length:\n")
+	writeHistogram(s.KeyLen)
+	for _, x := range []struct {
+		title      string
+		histograms map[string]*statsHistogram
+	}{
+		{"value length", s.ValueLen}, {"elements", s.Elements},
+	} {
+		fmt.Fprintf(tw, "\n%s:\n", x.title)
+		for _, t := range s.sortedTypes(x.histograms) {
+			fmt.Fprintf(tw, "  %s\n", t)
+			writeHistogram(*x.histograms[t])
+		}
+	}
+
+	fmt.Fprintf(tw, "\nexpires:\n")
+	for i, name := range s.expireNames() {
+		fmt.Fprintf(tw, "  %s\t%d\t%s\n", name, s.Expires[i], percent(s.Expires[i], s.Total.Expires))
+	}
+	if err := tw.Flush(); err != nil {
+		log.PanicErrorf(err, "write stats failed")
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"fmt"
 	"io"
@@ -20,7 +21,7 @@ import (
 func main() {
 	const usage = `
 Usage:
-	redis-sync [--ncpu=N] (--master=MASTER|MASTER) --target=TARGET [--db=DB] [--tmpfile-size=SIZE [--tmpfile=FILE]]
+	redis-sync [--ncpu=N] (--master=MASTER|MASTER) --target=TARGET [--db=DB] [--tmpfile-size=SIZE [--tmpfile=FILE]] [--no-payload] [--codis [--shard=SLOTS:SERVER]...] [--cluster] [--max-errors=N] [--dead-letter=FILE]
 	redis-sync  --version
 
 Options:
@@ -30,6 +31,12 @@ Options:
 	--db=DB                           Accept db = DB, default is *.
 	--tmpfile=FILE                    Use FILE to as socket buffer.
 	--tmpfile-size=SIZE               Set FILE size. If no --tmpfile is provided, a temporary file under current folder will be created.
+	--no-payload                      Restore keys with DEL and the commands that rebuild them, instead of RESTORE with DUMP payloads, streams of RDB version 10 and later are always restored by commands.
+	--codis                           Target is codis-proxy, keys of db 0 are restored by RESTORE through it, or by SLOTSRESTORE in batches of the same slot if they are sent to codis-servers by --shard, payloads of rdb version 9 are loaded by redis 5.0 and later, keys of the targets that can't load them are restored by commands.
+	--shard=SLOTS:SERVER              Send keys of SLOTS straight to the codis-server ([auth@]host:port), e.g. 0-511,1000:127.0.0.1:6380.
+	--cluster                         Target is a node of redis cluster, keys of db 0 are restored to the masters of their slots.
+	--max-errors=N                    Abort once more than N keys or commands fail in the target, transient errors of keys are retried first, default is 0.
+	--dead-letter=FILE                Write keys and commands that fail to FILE as json lines, which can be replayed by redis-decode --input-format=json.
 
 Examples:
 	$ redis-sync -m 127.0.0.1:6379 -t 127.0.0.1:6380
@@ -37,6 +44,9 @@ Examples:
 	$ redis-sync    127.0.0.1:6379 -t passwd@127.0.0.1:6380 --db=0
 	$ redis-sync    127.0.0.1:6379 -t passwd@127.0.0.1:6380 --db=0 --tmpfile-size=10gb
 	$ redis-sync    127.0.0.1:6379 -t passwd@127.0.0.1:6380 --db=0 --tmpfile-size=10gb --tmpfile ~/sockfile.tmp
+	$ redis-sync    127.0.0.1:6379 -t 127.0.0.1:19000 --codis --shard=0-1023:127.0.0.1:6380
+	$ redis-sync    127.0.0.1:6379 -t 127.0.0.1:7000 --cluster
+	$ redis-sync    127.0.0.1:6379 -t 127.0.0.1:6380 --max-errors=100 --dead-letter=failed.json
 `
 	var flags = parseFlags(usage)
 
@@ -181,32 +191,79 @@ Examples:
 	var reader = rBuilder(pipeReader).Must().Count(&master.rbytes).
 		Buffer2(ReaderBufferSize).Reader.(*bufio2.Reader)
 
-	var entryChan = newRDBLoader(io.LimitReader(reader, rdbSize), 32)
+	var loader, entryChan = newRDBLoader(io.LimitReader(reader, rdbSize), 32)
+
+	var codis struct {
+		targets  []*codisTarget
+		route    []int
+		progress codisProgress
+	}
+	if flags.Codis {
+		codis.targets, codis.route = newCodisTargets(target.Addr, target.Auth, flags.Shards)
+	} else {
+		codis.targets = []*codisTarget{{Addr: target.Addr, Auth: target.Auth}}
+	}
+	var cluster *clusterRoute
+	if flags.Cluster {
+		cluster = newClusterRoute(target.Addr, target.Auth)
+	}
+	if flags.Codis || flags.Cluster {
+		var accept = acceptDB
+		acceptDB = func(db uint64) bool {
+			return db == 0 && accept(db)
+		}
+	}
+
+	var errs = &restoreErrors{Max: flags.MaxErrors}
+	if flags.DeadLetter != "" {
+		file := openWriteFile(flags.DeadLetter)
+		defer closeFile(file)
+		errs.Log = wBuilder(file).Must().Buffer(WriterBufferSize).Writer.(*bufio.Writer)
+	}
+
+	var payload = !flags.NoPayload
+	for _, t := range codis.targets {
+		t.Payload = payload && checkRestorePayload(t.Addr, t.Auth)
+	}
+	payload = codis.targets[0].Payload
 
 	var jobs = NewParallelJob(flags.Parallel, func() {
-		doRestoreDBEntry(entryChan, target.Addr, target.Auth,
-			func(e *rdb.DBEntry) bool {
-				if !acceptDB(e.DB) {
-					master.rdb.skip.Incr()
-					return false
-				}
-				master.rdb.forward.Incr()
-				return true
-			})
+		var on = func(e *rdb.DBEntry) bool {
+			if !acceptDB(e.DB) {
+				master.rdb.skip.Incr()
+				return false
+			}
+			master.rdb.forward.Incr()
+			return true
+		}
+		switch {
+		case flags.Codis:
+			doRestoreCodisEntry(entryChan, codis.targets, codis.route, errs, on, codis.progress.Done)
+		case flags.Cluster:
+			doRestoreClusterEntry(entryChan, cluster, payload, errs, on)
+		default:
+			doRestoreDBEntry(entryChan, target.Addr, target.Auth, payload, nil, errs, on)
+		}
 	}).Then(func() {
-		doRestoreAoflog(reader, target.Addr, target.Auth,
-			func(db uint64, cmd string) bool {
-				if !acceptDB(db) && cmd != "PING" {
-					master.aof.skip.Incr()
-					return false
-				}
-				master.aof.forward.Incr()
-				return true
-			})
+		var on = func(db uint64, cmd string) bool {
+			if !acceptDB(db) && cmd != "PING" {
+				master.aof.skip.Incr()
+				return false
+			}
+			master.aof.forward.Incr()
+			return true
+		}
+		if flags.Cluster {
+			doRestoreClusterAoflog(reader, cluster, errs, on)
+		} else {
+			doRestoreAoflog(reader, target.Addr, target.Auth, errs, on)
+		}
 	}).Run()
 
 	log.Infof("sync: (r/f,s/f,s) = (read,rdb.forward,rdb.skip/rdb.forward,rdb.skip)")
 
+	var start = time.Now()
+
 	NewJob(func() {
 		var last, stats struct {
 			rdb, aof struct {
@@ -246,10 +303,27 @@ Examples:
 					bytesize.Int64(stats.rbytes-last.rbytes).HumanString(),
 					stats.rdb.forward-last.rdb.forward, stats.rdb.skip-last.rdb.skip,
 					stats.aof.forward-last.aof.forward, stats.aof.skip-last.aof.skip))
+			var keys = stats.rdb.forward + stats.rdb.skip
+			var total = loaderTotalKeys(loader)
+			if stats.dumpoff < rdbSize || keys < total {
+				var elapsed = time.Since(start)
+				fmt.Fprintf(&b, "  ~  keys=%d/%d", keys, total)
+				fmt.Fprintf(&b, "  eta=(%s,%s)",
+					formatETA(elapsed, stats.dumpoff, rdbSize), formatETA(elapsed, keys, total))
+				if flags.Codis {
+					fmt.Fprintf(&b, "  ~  slots=%d/%d", codis.progress.Slots(), len(codis.progress))
+				}
+			}
+			if errs.Max != 0 || errs.Log != nil {
+				fmt.Fprintf(&b, "  ~  errors=%d", errs.Count.Int64())
+				errs.Flush()
+			}
 			last = stats
 			log.Info(b.String())
 		}
 	}).RunAndWait()
 
+	errs.Flush()
+
 	log.Info("sync: done")
 }
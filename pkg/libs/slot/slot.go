@@ -0,0 +1,68 @@
+package slot
+
+import (
+	"bytes"
+	"hash/crc32"
+)
+
+const (
+	MaxClusterSlotNum = 16384
+	MaxCodisSlotNum   = 1024
+)
+
+// ClusterHashTag returns the part of key that is hashed by Redis Cluster, the
+// content of the first {...} if it's not empty, or the whole key.
+func ClusterHashTag(key []byte) []byte {
+	if beg := bytes.IndexByte(key, '{'); beg >= 0 {
+		if end := bytes.IndexByte(key[beg+1:], '}'); end > 0 {
+			return key[beg+1 : beg+1+end]
+		}
+	}
+	return key
+}
+
+// CodisHashTag returns the part of key that is hashed by Codis, unlike Redis
+// Cluster an empty {} is also a hash tag.
+func CodisHashTag(key []byte) []byte {
+	if beg := bytes.IndexByte(key, '{'); beg >= 0 {
+		if end := bytes.IndexByte(key[beg+1:], '}'); end >= 0 {
+			return key[beg+1 : beg+1+end]
+		}
+	}
+	return key
+}
+
+// ClusterSlot returns the hash slot of key, same as CLUSTER KEYSLOT.
+func ClusterSlot(key []byte) int {
+	return int(crc16(ClusterHashTag(key)) % MaxClusterSlotNum)
+}
+
+// CodisSlot returns the slot of key that is used by codis-proxy.
+func CodisSlot(key []byte) int {
+	return int(crc32.ChecksumIEEE(CodisHashTag(key)) % MaxCodisSlotNum)
+}
+
+var crc16tab [256]uint16
+
+func init() {
+	// CRC16-CCITT (XModem), polynomial 0x1021
+	for i := range crc16tab {
+		var crc = uint16(i) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc = crc << 1
+			}
+		}
+		crc16tab[i] = crc
+	}
+}
+
+func crc16(p []byte) uint16 {
+	var crc uint16
+	for _, b := range p {
+		crc = crc<<8 ^ crc16tab[byte(crc>>8)^b]
+	}
+	return crc
+}
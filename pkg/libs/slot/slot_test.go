@@ -0,0 +1,35 @@
+package slot
+
+import (
+	"testing"
+
+	"github.com/CodisLabs/codis/pkg/utils/assert"
+)
+
+func TestCrc16(t *testing.T) {
+	assert.Must(crc16([]byte("123456789")) == 0x31c3)
+	assert.Must(crc16(nil) == 0)
+}
+
+func TestClusterSlot(t *testing.T) {
+	var testcase = func(key string, slot int) {
+		assert.Must(ClusterSlot([]byte(key)) == slot)
+	}
+	testcase("foo", 12182)
+	testcase("somekey", 11058)
+	testcase("{foo}.bar", 12182)
+	testcase("x{foo}{bar}", 12182)
+	assert.Must(string(ClusterHashTag([]byte("{}foo"))) == "{}foo")
+	assert.Must(string(ClusterHashTag([]byte("foo{bar"))) == "foo{bar")
+}
+
+func TestCodisSlot(t *testing.T) {
+	var testcase = func(key string, slot int) {
+		assert.Must(CodisSlot([]byte(key)) == slot)
+	}
+	testcase("foo", 289)
+	testcase("user1000", 870)
+	testcase("{user1000}.following", 870)
+	testcase("{}foo", CodisSlot(nil))
+	assert.Must(string(CodisHashTag([]byte("foo{bar"))) == "foo{bar")
+}
@@ -1,3 +1,6 @@
+//go:build !purego
+// +build !purego
+
 #include <redis/src/cluster.c>
 #include <redis/src/config.c>
 #include <redis/src/evict.c>
@@ -1,3 +1,6 @@
+//go:build !purego
+// +build !purego
+
 #include <stdio.h>
 #include <stdlib.h>
 #include <strings.h>
@@ -1,3 +1,6 @@
+//go:build !purego
+// +build !purego
+
 #include <redis/src/object.c>
 #include <redis/src/t_hash.c>
 #include <redis/src/t_list.c>
@@ -1,3 +1,6 @@
+//go:build !purego
+// +build !purego
+
 #include "cgo_redis.h"
 
 #ifdef LOG_MAX_LEN
@@ -15,6 +18,7 @@ void _serverAssert(const char *estr, const char *file, int line) {
       "====> %s:%d '%s' is not true\n";
   size_t len = snprintf(buf, sizeof(buf), format, file, line, estr);
 
+  redisRioAbort(buf, len);
   cgoRedisLogPanic(buf, len);
   exit(1);
 }
@@ -36,6 +40,7 @@ void _serverPanic(const char *file, int line, const char *vformat, ...) {
   size_t len2 = vsnprintf(buf + len1, sizeof(buf) - len1, vformat, ap);
   va_end(ap);
 
+  redisRioAbort(buf, len1 + len2);
   cgoRedisLogPanic(buf, len1 + len2);
   exit(1);
 }
@@ -52,36 +57,30 @@ void serverLog(int level, const char *format, ...) {
   cgoRedisLogLevel(buf, len, level);
 }
 
-int rdbCheckMode = 0;
+/* Corruptions found by rdb.c are reported through rdbCheckError, instead of
+ * running redis_check_rdb_main, so that the loader can return an error. */
+int rdbCheckMode = 1;
 
 void rdbCheckError(const char *vformat, ...) {
   char buf[LOG_MAX_LEN];
-  const char *format =
-      "===== RDB CHECK ERROR ======\n"
-      "====> %s:%d\n";
-  size_t len1 = snprintf(buf, sizeof(buf), format, __FILE__, __LINE__);
-
   va_list ap;
   va_start(ap, vformat);
-  size_t len2 = vsnprintf(buf + len1, sizeof(buf) - len1, vformat, ap);
+  size_t len = vsnprintf(buf, sizeof(buf), vformat, ap);
   va_end(ap);
 
-  cgoRedisLogPanic(buf, len1 + len2);
+  redisRioAbort(buf, len);
+  cgoRedisLogPanic(buf, len);
   exit(1);
 }
 
 void rdbCheckSetError(const char *vformat, ...) {
   char buf[LOG_MAX_LEN];
-  const char *format =
-      "===== RDB CHECK ERROR ======\n"
-      "====> %s:%d\n";
-  size_t len1 = snprintf(buf, sizeof(buf), format, __FILE__, __LINE__);
-
   va_list ap;
   va_start(ap, vformat);
-  size_t len2 = vsnprintf(buf + len1, sizeof(buf) - len1, vformat, ap);
+  size_t len = vsnprintf(buf, sizeof(buf), vformat, ap);
   va_end(ap);
 
-  cgoRedisLogPanic(buf, len1 + len2);
+  redisRioAbort(buf, len);
+  cgoRedisLogPanic(buf, len);
   exit(1);
 }
@@ -1,3 +1,6 @@
+//go:build !purego
+// +build !purego
+
 #define END_OF_MACRO2(x, y) \
   typedef struct {          \
     void *p;                \
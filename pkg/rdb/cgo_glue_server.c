@@ -1,3 +1,6 @@
+//go:build !purego
+// +build !purego
+
 #include "cgo_redis.h"
 
 #include <strings.h>
@@ -1,3 +1,6 @@
+//go:build !purego
+// +build !purego
+
 #include "cgo_redis.h"
 
 static redisTypeIterator *redisTypeIteratorInit() {
@@ -213,3 +216,69 @@ void redisSetIteratorRelease(redisTypeIterator *p) {
   setTypeReleaseIterator(p->iter);
   redisTypeIteratorFree(p);
 }
+
+void *redisStreamObjectNewIterator(void *obj) {
+  robj *o = obj;
+  serverAssert(o->type == OBJ_STREAM);
+  streamIterator *si = zmalloc(sizeof(*si));
+  streamIteratorStart(si, o->ptr, NULL, NULL, 0);
+  return si;
+}
+
+int redisStreamIteratorNext(void *iter, redisStreamID *id, int64_t *numfields) {
+  streamID sid;
+  if (!streamIteratorGetID(iter, &sid, numfields)) {
+    return C_ERR;
+  }
+  id->ms = sid.ms, id->seq = sid.seq;
+  return C_OK;
+}
+
+static void redisStreamIteratorFieldWrapper(unsigned char *buf,
+                                            unsigned char *vstr, int64_t vlen,
+                                            redisSds *p) {
+  memset(p, 0, sizeof(*p));
+  /* Integers are formatted into the iterator's own buffers, which will be
+   * overwritten by the next call, so parse them back. */
+  if (vstr == buf && string2ll((char *)vstr, vlen, &p->val)) {
+    return;
+  }
+  p->ptr = vstr, p->len = vlen;
+}
+
+void redisStreamIteratorField(void *iter, redisSds *field, redisSds *value) {
+  streamIterator *si = iter;
+  unsigned char *fptr, *vptr;
+  int64_t flen, vlen;
+  streamIteratorGetField(si, &fptr, &vptr, &flen, &vlen);
+  redisStreamIteratorFieldWrapper(si->field_buf, fptr, flen, field);
+  redisStreamIteratorFieldWrapper(si->value_buf, vptr, vlen, value);
+}
+
+void redisStreamIteratorRelease(void *iter) {
+  streamIteratorStop(iter);
+  zfree(iter);
+}
+
+void *redisRaxNewIterator(void *rax) {
+  raxIterator *ri = zmalloc(sizeof(*ri));
+  raxStart(ri, rax);
+  raxSeek(ri, "^", NULL, 0);
+  return ri;
+}
+
+int redisRaxIteratorNext(void *iter, redisSds *key, void **data) {
+  raxIterator *ri = iter;
+  if (!raxNext(ri)) {
+    return C_ERR;
+  }
+  memset(key, 0, sizeof(*key));
+  key->ptr = ri->key, key->len = ri->key_len;
+  *data = ri->data;
+  return C_OK;
+}
+
+void redisRaxIteratorRelease(void *iter) {
+  raxStop(iter);
+  zfree(iter);
+}
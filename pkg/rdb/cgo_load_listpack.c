@@ -0,0 +1,164 @@
+//go:build !purego
+// +build !purego
+
+#include "cgo_redis.h"
+
+/* Redis 7.x saves small hashes, sets, sorted sets and list nodes as listpacks,
+ * the bundled redis only knows ziplists, so elements are copied out one by one
+ * into the decoded encodings. */
+
+static sds lpGetSds(unsigned char* p) {
+  int64_t vlen;
+  unsigned char* vstr = lpGet(p, &vlen, NULL);
+  if (vstr != NULL) {
+    return sdsnewlen(vstr, vlen);
+  }
+  return sdsfromlonglong(vlen);
+}
+
+static double lpGetScore(unsigned char* p) {
+  int64_t vlen;
+  unsigned char* vstr = lpGet(p, &vlen, NULL);
+  if (vstr == NULL) {
+    return (double)vlen;
+  }
+  char buf[128];
+  if (vlen >= (int64_t)sizeof(buf)) vlen = sizeof(buf) - 1;
+  memcpy(buf, vstr, vlen);
+  buf[vlen] = '\0';
+  return strtod(buf, NULL);
+}
+
+static unsigned char* rdbLoadListpack(rio* rdb) {
+  unsigned char* lp = rdbGenericLoadStringObject(rdb, RDB_LOAD_PLAIN, NULL);
+  if (lp == NULL) return NULL;
+  if (lpFirst(lp) == NULL) {
+    /* Serialized listpacks should never be empty. */
+    zfree(lp);
+    return NULL;
+  }
+  return lp;
+}
+
+static robj* rdbLoadHashListpackObject(unsigned char* lp) {
+  robj* o = createHashObject();
+  hashTypeConvert(o, OBJ_ENCODING_HT);
+
+  unsigned char* p = lpFirst(lp);
+  while (p != NULL) {
+    unsigned char* next = lpNext(lp, p);
+    if (next == NULL) goto failed;
+    sds field = lpGetSds(p);
+    sds value = lpGetSds(next);
+    if (dictAdd(o->ptr, field, value) != DICT_OK) {
+      sdsfree(field);
+      sdsfree(value);
+      goto failed;
+    }
+    p = lpNext(lp, next);
+  }
+  return o;
+
+failed:
+  decrRefCount(o);
+  return NULL;
+}
+
+static robj* rdbLoadZsetListpackObject(unsigned char* lp) {
+  robj* o = createZsetObject();
+  zset* zs = o->ptr;
+
+  unsigned char* p = lpFirst(lp);
+  while (p != NULL) {
+    unsigned char* next = lpNext(lp, p);
+    if (next == NULL) goto failed;
+    sds sdsele = lpGetSds(p);
+    double score = lpGetScore(next);
+    zskiplistNode* znode = zslInsert(zs->zsl, score, sdsele);
+    if (dictAdd(zs->dict, sdsele, &znode->score) != DICT_OK) goto failed;
+    p = lpNext(lp, next);
+  }
+  return o;
+
+failed:
+  decrRefCount(o);
+  return NULL;
+}
+
+static robj* rdbLoadSetListpackObject(unsigned char* lp) {
+  robj* o = createSetObject();
+
+  for (unsigned char* p = lpFirst(lp); p != NULL; p = lpNext(lp, p)) {
+    sds sdsele = lpGetSds(p);
+    if (dictAdd(o->ptr, sdsele, NULL) != DICT_OK) {
+      sdsfree(sdsele);
+      decrRefCount(o);
+      return NULL;
+    }
+  }
+  return o;
+}
+
+robj* rdbLoadListpackObject(int rdbtype, rio* rdb) {
+  serverAssert(rdbtype == RDB_TYPE_HASH_LISTPACK ||
+               rdbtype == RDB_TYPE_ZSET_LISTPACK ||
+               rdbtype == RDB_TYPE_SET_LISTPACK);
+
+  unsigned char* lp = rdbLoadListpack(rdb);
+  if (lp == NULL) return NULL;
+
+  robj* o;
+  switch (rdbtype) {
+    case RDB_TYPE_HASH_LISTPACK:
+      o = rdbLoadHashListpackObject(lp);
+      break;
+    case RDB_TYPE_ZSET_LISTPACK:
+      o = rdbLoadZsetListpackObject(lp);
+      break;
+    default:
+      o = rdbLoadSetListpackObject(lp);
+      break;
+  }
+  zfree(lp);
+  return o;
+}
+
+robj* rdbLoadQuicklist2Object(int rdbtype, rio* rdb) {
+  serverAssert(rdbtype == RDB_TYPE_LIST_QUICKLIST_2);
+
+  uint64_t len;
+  if ((len = rdbLoadLen(rdb, NULL)) == RDB_LENERR) return NULL;
+
+  robj* o = createQuicklistObject();
+  quicklistSetOptions(o->ptr, server.list_max_ziplist_size,
+                      server.list_compress_depth);
+
+  while (len--) {
+    uint64_t container;
+    if ((container = rdbLoadLen(rdb, NULL)) == RDB_LENERR) goto failed;
+
+    size_t sz;
+    unsigned char* data = rdbGenericLoadStringObject(rdb, RDB_LOAD_PLAIN, &sz);
+    if (data == NULL) goto failed;
+
+    if (container == QUICKLIST_NODE_CONTAINER_PLAIN) {
+      quicklistPushTail(o->ptr, data, sz);
+    } else if (container == QUICKLIST_NODE_CONTAINER_PACKED) {
+      for (unsigned char* p = lpFirst(data); p != NULL; p = lpNext(data, p)) {
+        unsigned char buf[LP_INTBUF_SIZE];
+        int64_t vlen;
+        unsigned char* vstr = lpGet(p, &vlen, buf);
+        quicklistPushTail(o->ptr, vstr, vlen);
+      }
+    } else {
+      zfree(data);
+      goto failed;
+    }
+    zfree(data);
+  }
+  return o;
+
+failed:
+  decrRefCount(o);
+  return NULL;
+}
@@ -0,0 +1,163 @@
+//go:build !purego
+// +build !purego
+
+#include "cgo_redis.h"
+
+static int rdbLoadStreamID(rio* rdb, streamID* id) {
+  if ((id->ms = rdbLoadLen(rdb, NULL)) == RDB_LENERR) return -1;
+  if ((id->seq = rdbLoadLen(rdb, NULL)) == RDB_LENERR) return -1;
+  return 0;
+}
+
+static int rdbLoadStreamListpacks(rio* rdb, stream* s) {
+  uint64_t listpacks;
+  if ((listpacks = rdbLoadLen(rdb, NULL)) == RDB_LENERR) return -1;
+
+  while (listpacks--) {
+    /* The master ID, entries of the listpack are delta-encoded to it. */
+    sds nodekey = rdbGenericLoadStringObject(rdb, RDB_LOAD_SDS, NULL);
+    if (nodekey == NULL) return -1;
+    if (sdslen(nodekey) != sizeof(streamID)) {
+      sdsfree(nodekey);
+      return -1;
+    }
+
+    unsigned char* lp = rdbGenericLoadStringObject(rdb, RDB_LOAD_PLAIN, NULL);
+    if (lp == NULL) {
+      sdsfree(nodekey);
+      return -1;
+    }
+    if (lpFirst(lp) == NULL) {
+      /* Serialized listpacks should never be empty. */
+      zfree(lp);
+      sdsfree(nodekey);
+      return -1;
+    }
+
+    int retval = raxInsert(s->rax, (unsigned char*)nodekey, sizeof(streamID),
+                           lp, NULL);
+    sdsfree(nodekey);
+    if (!retval) {
+      zfree(lp);
+      return -1;
+    }
+  }
+  return 0;
+}
+
+static int rdbLoadStreamConsumerGroup(int rdbtype, rio* rdb, stream* s) {
+  streamID cg_id;
+  sds cgname = rdbGenericLoadStringObject(rdb, RDB_LOAD_SDS, NULL);
+  if (cgname == NULL) return -1;
+  if (rdbLoadStreamID(rdb, &cg_id) != 0) {
+    sdsfree(cgname);
+    return -1;
+  }
+  long long entries_read = -1;
+  if (rdbtype >= RDB_TYPE_STREAM_LISTPACKS_2) {
+    /* The entries_read counter of the group, unknown to the bundled redis. */
+    uint64_t n;
+    if ((n = rdbLoadLen(rdb, NULL)) == RDB_LENERR) {
+      sdsfree(cgname);
+      return -1;
+    }
+    entries_read = (long long)n;
+  }
+  streamCG* cg = streamCreateCG(s, cgname, sdslen(cgname), &cg_id);
+  if (cg == NULL) {
+    sdsfree(cgname);
+    return -1;
+  }
+  /* Grow the group to redisStreamCGExt, the consumers aren't created yet, so
+   * the rax of the groups is the only reference to it. */
+  redisStreamCGExt* x = zrealloc(cg, sizeof(redisStreamCGExt));
+  x->entries_read = entries_read;
+  raxInsert(s->cgroups, (unsigned char*)cgname, sdslen(cgname), x, NULL);
+  sdsfree(cgname);
+  cg = &x->cg;
+
+  /* Load the global PEL, owners are resolved by the consumers below. */
+  uint64_t pel_size;
+  if ((pel_size = rdbLoadLen(rdb, NULL)) == RDB_LENERR) return -1;
+  while (pel_size--) {
+    unsigned char rawid[sizeof(streamID)];
+    if (rioRead(rdb, rawid, sizeof(rawid)) == 0) return -1;
+    streamNACK* nack = streamCreateNACK(NULL);
+    if (!raxInsert(cg->pel, rawid, sizeof(rawid), nack, NULL)) {
+      zfree(nack);
+      return -1;
+    }
+    if ((nack->delivery_time = rdbLoadMillisecondTime(rdb)) == -1) return -1;
+    if ((nack->delivery_count = rdbLoadLen(rdb, NULL)) == RDB_LENERR) return -1;
+  }
+
+  uint64_t consumers;
+  if ((consumers = rdbLoadLen(rdb, NULL)) == RDB_LENERR) return -1;
+  while (consumers--) {
+    sds cname = rdbGenericLoadStringObject(rdb, RDB_LOAD_SDS, NULL);
+    if (cname == NULL) return -1;
+    streamConsumer* consumer = streamLookupConsumer(cg, cname, 1);
+    sdsfree(cname);
+    if ((consumer->seen_time = rdbLoadMillisecondTime(rdb)) == -1) return -1;
+    if (rdbtype >= RDB_TYPE_STREAM_LISTPACKS_3) {
+      /* The active_time of the consumer. */
+      if (rdbLoadMillisecondTime(rdb) == -1) return -1;
+    }
+
+    if ((pel_size = rdbLoadLen(rdb, NULL)) == RDB_LENERR) return -1;
+    while (pel_size--) {
+      unsigned char rawid[sizeof(streamID)];
+      if (rioRead(rdb, rawid, sizeof(rawid)) == 0) return -1;
+      streamNACK* nack = raxFind(cg->pel, rawid, sizeof(rawid));
+      if (nack == raxNotFound) return -1;
+      nack->consumer = consumer;
+      if (!raxInsert(consumer->pel, rawid, sizeof(rawid), nack, NULL)) {
+        return -1;
+      }
+    }
+  }
+  return 0;
+}
+
+robj* rdbLoadStreamObject(int rdbtype, rio* rdb) {
+  serverAssert(rdbtype == RDB_TYPE_STREAM_LISTPACKS ||
+               rdbtype == RDB_TYPE_STREAM_LISTPACKS_2 ||
+               rdbtype == RDB_TYPE_STREAM_LISTPACKS_3);
+
+  /* Copied from redis/src/rdb.c */
+  robj* o = createStreamObject();
+  redisStreamExt* x = o->ptr = zrealloc(o->ptr, sizeof(redisStreamExt));
+  memset(&x->meta, 0, sizeof(x->meta));
+  o->encoding = REDIS_ENCODING_STREAM_EXT;
+  stream* s = &x->s;
+
+  if (rdbLoadStreamListpacks(rdb, s) != 0) goto failed;
+  if ((s->length = rdbLoadLen(rdb, NULL)) == RDB_LENERR) goto failed;
+  if (rdbLoadStreamID(rdb, &s->last_id) != 0) goto failed;
+
+  if (rdbtype >= RDB_TYPE_STREAM_LISTPACKS_2) {
+    /* The first_id, max_deleted_entry_id and entries_added of the stream are
+     * unknown to the bundled redis, so they are kept in redisStreamExt. */
+    streamID first_id, max_deleted_id;
+    if (rdbLoadStreamID(rdb, &first_id) != 0) goto failed;
+    if (rdbLoadStreamID(rdb, &max_deleted_id) != 0) goto failed;
+    if ((x->meta.entries_added = rdbLoadLen(rdb, NULL)) == RDB_LENERR) {
+      goto failed;
+    }
+    x->meta.first_id.ms = first_id.ms, x->meta.first_id.seq = first_id.seq;
+    x->meta.max_deleted_id.ms = max_deleted_id.ms;
+    x->meta.max_deleted_id.seq = max_deleted_id.seq;
+    x->meta.valid = 1;
+  }
+
+  uint64_t cgroups;
+  if ((cgroups = rdbLoadLen(rdb, NULL)) == RDB_LENERR) goto failed;
+  while (cgroups--) {
+    if (rdbLoadStreamConsumerGroup(rdbtype, rdb, s) != 0) goto failed;
+  }
+  return o;
+
+failed:
+  decrRefCount(o);
+  return NULL;
+}
@@ -1,7 +1,18 @@
+//go:build !purego
+// +build !purego
+
 #include "cgo_redis.h"
 
 int redisObjectType(void *obj) { return ((robj *)obj)->type; }
-int redisObjectEncoding(void *obj) { return ((robj *)obj)->encoding; }
+
+int redisObjectEncoding(void *obj) {
+  robj *o = obj;
+  if (o->encoding == REDIS_ENCODING_STREAM_EXT) {
+    return OBJ_ENCODING_STREAM;
+  }
+  return o->encoding;
+}
+
 int redisObjectRefCount(void *obj) { return ((robj *)obj)->refcount; }
 
 extern size_t lazyfreeObjectGetFreeEffort(robj *o);
@@ -44,6 +55,10 @@ void *redisObjectDecodeFromPayload(void *buf, size_t len) {
   return obj;
 }
 
+void *redisStringObjectCreate(void *buf, size_t len) {
+  return createStringObject(buf, len);
+}
+
 size_t redisStringObjectLen(void *obj) {
   robj *o = obj;
   serverAssert(o->type == OBJ_STRING);
@@ -87,3 +102,72 @@ size_t redisSetObjectLen(void *obj) {
   serverAssert(o->type == OBJ_SET);
   return setTypeSize(o);
 }
+
+size_t redisStreamObjectLen(void *obj) {
+  robj *o = obj;
+  serverAssert(o->type == OBJ_STREAM);
+  return ((stream *)o->ptr)->length;
+}
+
+void redisStreamObjectLastID(void *obj, redisStreamID *id) {
+  robj *o = obj;
+  serverAssert(o->type == OBJ_STREAM);
+  stream *s = o->ptr;
+  id->ms = s->last_id.ms, id->seq = s->last_id.seq;
+}
+
+int redisStreamObjectMeta(void *obj, redisStreamMeta *meta) {
+  robj *o = obj;
+  serverAssert(o->type == OBJ_STREAM);
+  if (o->encoding != REDIS_ENCODING_STREAM_EXT) {
+    return -1;
+  }
+  *meta = ((redisStreamExt *)o->ptr)->meta;
+  return meta->valid ? 0 : -1;
+}
+
+void *redisStreamObjectGroups(void *obj) {
+  robj *o = obj;
+  serverAssert(o->type == OBJ_STREAM);
+  return ((stream *)o->ptr)->cgroups;
+}
+
+void redisStreamGroupLastID(void *cg, redisStreamID *id) {
+  streamCG *g = cg;
+  id->ms = g->last_id.ms, id->seq = g->last_id.seq;
+}
+
+long long redisStreamGroupEntriesRead(void *obj, void *cg) {
+  robj *o = obj;
+  serverAssert(o->type == OBJ_STREAM);
+  if (o->encoding != REDIS_ENCODING_STREAM_EXT) {
+    return -1;
+  }
+  return ((redisStreamCGExt *)cg)->entries_read;
+}
+
+void *redisStreamGroupPEL(void *cg) { return ((streamCG *)cg)->pel; }
+
+void *redisStreamGroupConsumers(void *cg) {
+  return ((streamCG *)cg)->consumers;
+}
+
+void redisStreamNACKLoad(void *nack, long long *delivery_time,
+                         uint64_t *delivery_count, redisSds *consumer) {
+  streamNACK *n = nack;
+  *delivery_time = n->delivery_time;
+  *delivery_count = n->delivery_count;
+  memset(consumer, 0, sizeof(*consumer));
+  if (n->consumer != NULL) {
+    consumer->ptr = n->consumer->name;
+    consumer->len = sdslen(n->consumer->name);
+  }
+}
+
+void redisStreamConsumerLoad(void *consumer, long long *seen_time) {
+  *seen_time = ((streamConsumer *)consumer)->seen_time;
+}
+
+void *redisStreamConsumerPEL(void *consumer) {
+  return ((streamConsumer *)consumer)->pel;
+}
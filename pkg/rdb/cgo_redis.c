@@ -1,3 +1,6 @@
+//go:build !purego
+// +build !purego
+
 #include "cgo_redis.h"
 
 extern void initServerConfig(void);
@@ -5,7 +8,19 @@ extern void loadServerConfigFromString(char *config);
 extern void createSharedObjects(void);
 extern void initLazyfreeThreads(void);
 
+/* Lengths of corrupted RDBs that can't be allocated by rdb.c fail the loading
+ * like the other corruptions, instead of aborting. */
+static void redisOutOfMemory(size_t size) {
+  char buf[128];
+  size_t len = snprintf(buf, sizeof(buf),
+                        "Out of memory trying to allocate %zu bytes.", size);
+  redisRioAbort(buf, len);
+  fprintf(stderr, "%s\n", buf);
+  abort();
+}
+
 void initRedisServer(char *config) {
+  zmalloc_set_oom_handler(redisOutOfMemory);
   initServerConfig();
   createSharedObjects();
   loadServerConfigFromString(config);
@@ -28,10 +43,12 @@ static size_t rioRedisRioRead(rio *rdb, void *buf, size_t len) {
       len -= nbytes, buf = (char *)buf + nbytes, p->pos += nbytes;
     } else if (len >= sizeof(p->buf)) {
       size_t nbytes = onRedisRioRead(p, buf, len);
+      if (nbytes == 0) return 0;
       len -= nbytes, buf = (char *)buf + nbytes;
     } else {
       p->pos = 0;
       p->end = onRedisRioRead(p, p->buf, sizeof(p->buf));
+      if (p->end == 0) return 0;
     }
   }
   return 1;
@@ -67,6 +84,12 @@ void redisRioInit(redisRio *p) {
   memset(p->buf, 0, sizeof(p->buf));
 }
 
+void redisRioSeek(redisRio *p, size_t offset) {
+  p->rdb.cksum = 0;
+  p->rdb.processed_bytes = offset;
+  p->pos = p->end = 0;
+}
+
 int redisRioRead(redisRio *p, void *buf, size_t len) {
   return rioRead(&p->rdb, buf, len) != 0 ? 0 : -1;
 }
@@ -90,17 +113,68 @@ int redisRioLoadTimeMillisecond(redisRio *p, long long *val) {
 }
 
 extern robj *rdbLoadZsetObject(int rdbtype, rio *rdb);
+extern robj *rdbLoadStreamObject(int rdbtype, rio *rdb);
+extern robj *rdbLoadListpackObject(int rdbtype, rio *rdb);
+extern robj *rdbLoadQuicklist2Object(int rdbtype, rio *rdb);
+
+#include <setjmp.h>
+
+/* The loading functions that are called by Go set the jump target of the
+ * thread, corruptions reported by rdb.c and assertions of redis jump back to
+ * them and the loading fails, instead of exiting or unwinding the C frames by
+ * a Go panic. The partly loaded object is leaked, but the loader stops at the
+ * first failure. */
+static __thread redisRio *abortRio;
+static __thread jmp_buf *abortJmp;
+
+void redisRioAbort(const char *msg, size_t len) {
+  if (abortJmp == NULL) return;
+  snprintf(abortRio->abort, sizeof(abortRio->abort), "%.*s", (int)len, msg);
+  longjmp(*abortJmp, 1);
+}
 
-void *redisRioLoadObject(redisRio *p, int typ) {
+static void *redisRioTryLoad(redisRio *p, int typ,
+                             void *(*load)(redisRio *p, int typ)) {
+  jmp_buf env;
+  p->abort[0] = '\0';
+  if (setjmp(env) != 0) {
+    abortRio = NULL, abortJmp = NULL;
+    return NULL;
+  }
+  abortRio = p, abortJmp = &env;
+  void *o = load(p, typ);
+  abortRio = NULL, abortJmp = NULL;
+  return o;
+}
+
+static void *loadObject(redisRio *p, int typ) {
   switch (typ) {
   default:
     return rdbLoadObject(typ, &p->rdb);
   case RDB_TYPE_ZSET:
   case RDB_TYPE_ZSET_2:
     return rdbLoadZsetObject(typ, &p->rdb);
+  case RDB_TYPE_STREAM_LISTPACKS:
+  case RDB_TYPE_STREAM_LISTPACKS_2:
+  case RDB_TYPE_STREAM_LISTPACKS_3:
+    return rdbLoadStreamObject(typ, &p->rdb);
+  case RDB_TYPE_HASH_LISTPACK:
+  case RDB_TYPE_ZSET_LISTPACK:
+  case RDB_TYPE_SET_LISTPACK:
+    return rdbLoadListpackObject(typ, &p->rdb);
+  case RDB_TYPE_LIST_QUICKLIST_2:
+    return rdbLoadQuicklist2Object(typ, &p->rdb);
   }
 }
 
-void *redisRioLoadStringObject(redisRio *p) {
+static void *loadStringObject(redisRio *p, int typ) {
   return rdbLoadStringObject(&p->rdb);
 }
+
+void *redisRioLoadObject(redisRio *p, int typ) {
+  return redisRioTryLoad(p, typ, loadObject);
+}
+
+void *redisRioLoadStringObject(redisRio *p) {
+  return redisRioTryLoad(p, 0, loadStringObject);
+}
@@ -1,3 +1,6 @@
+//go:build !purego
+// +build !purego
+
 package rdb
 
 // #cgo        CFLAGS: -I.
@@ -28,7 +31,6 @@ import (
 	"unsafe"
 
 	"github.com/CodisLabs/codis/pkg/utils/bytesize"
-	"github.com/CodisLabs/codis/pkg/utils/errors"
 	"github.com/CodisLabs/codis/pkg/utils/log"
 	"github.com/CodisLabs/codis/pkg/utils/sync2/atomic2"
 )
@@ -83,38 +85,55 @@ func unsafeCastToString(buf unsafe.Pointer, len C.size_t) string {
 	return *(*string)(unsafe.Pointer(hdr))
 }
 
-func unsafeCastToLoader(rio *C.redisRio) *Loader {
-	var l *Loader
-	var ptr = uintptr(unsafe.Pointer(rio)) -
-		(unsafe.Offsetof(l.rio) + unsafe.Offsetof(l.rio.rio))
-	return (*Loader)(unsafe.Pointer(ptr))
+func unsafeCastToRedisRio(rio *C.redisRio) *redisRio {
+	var r *redisRio
+	var ptr = uintptr(unsafe.Pointer(rio)) - unsafe.Offsetof(r.rio)
+	return (*redisRio)(unsafe.Pointer(ptr))
 }
 
 //export onRedisRioRead
 func onRedisRioRead(rio *C.redisRio, buf unsafe.Pointer, len C.size_t) C.size_t {
-	loader, buffer := unsafeCastToLoader(rio), unsafeCastToSlice(buf, len)
-	n, err := loader.r.Read(buffer)
-	if err != nil {
-		log.PanicErrorf(err, "Read bytes failed.")
+	r, buffer := unsafeCastToRedisRio(rio), unsafeCastToSlice(buf, len)
+	if r.err != nil {
+		return 0
+	}
+	for {
+		n, err := r.rd.Read(buffer)
+		if err != nil {
+			r.err = err
+		}
+		if n != 0 || err != nil {
+			return C.size_t(n)
+		}
 	}
-	return C.size_t(n)
 }
 
 type redisRio struct {
 	rio C.redisRio
+	rd  io.Reader
+	err error
 }
 
-func (r *redisRio) init() {
+func (r *redisRio) init(rd io.Reader) {
+	r.rd = rd
 	C.redisRioInit(&r.rio)
 }
 
-func (r *redisRio) Read(b []byte) error {
+func (r *redisRio) Offset() int64 {
+	return int64(C.redisRioOffset(&r.rio))
+}
+
+// seek drops the buffered bytes, rd has been moved to offset.
+func (r *redisRio) seek(offset int64) {
+	C.redisRioSeek(&r.rio, C.size_t(offset))
+}
+
+func (r *redisRio) Read(b []byte) {
 	var hdr = (*reflect.SliceHeader)(unsafe.Pointer(&b))
-	var ret = C.redisRioRead(&r.rio, unsafe.Pointer(hdr.Data), C.size_t(hdr.Cap))
+	var ret = C.redisRioRead(&r.rio, unsafe.Pointer(hdr.Data), C.size_t(hdr.Len))
 	if ret != 0 {
-		return errors.Trace(io.ErrUnexpectedEOF)
+		r.throwf("Read %d bytes failed.", len(b))
 	}
-	return nil
 }
 
 func (r *redisRio) Checksum() uint64 {
@@ -125,7 +144,7 @@ func (r *redisRio) LoadLen() uint64 {
 	var len C.uint64_t
 	var ret = C.redisRioLoadLen(&r.rio, &len)
 	if ret != 0 {
-		log.PanicErrorf(io.ErrUnexpectedEOF, "Read RDB LoadLen() failed")
+		r.throwf("Read RDB LoadLen() failed.")
 	}
 	return uint64(len)
 }
@@ -134,7 +153,7 @@ func (r *redisRio) LoadType() int {
 	var typ C.int
 	var ret = C.redisRioLoadType(&r.rio, &typ)
 	if ret != 0 {
-		log.PanicErrorf(io.ErrUnexpectedEOF, "Read RDB LoadType() failed.")
+		r.throwf("Read RDB LoadType() failed.")
 	}
 	return int(typ)
 }
@@ -143,7 +162,7 @@ func (r *redisRio) LoadTime() time.Duration {
 	var val C.time_t
 	var ret = C.redisRioLoadTime(&r.rio, &val)
 	if ret != 0 {
-		log.PanicErrorf(io.ErrUnexpectedEOF, "Read RDB LoadTime() failed.")
+		r.throwf("Read RDB LoadTime() failed.")
 	}
 	return time.Duration(val) * time.Second
 }
@@ -152,15 +171,24 @@ func (r *redisRio) LoadTimeMillisecond() time.Duration {
 	var val C.longlong
 	var ret = C.redisRioLoadTimeMillisecond(&r.rio, &val)
 	if ret != 0 {
-		log.PanicErrorf(io.ErrUnexpectedEOF, "Read RDB LoadTimeMillisecond() failed.")
+		r.throwf("Read RDB LoadTimeMillisecond() failed.")
 	}
 	return time.Duration(val) * time.Millisecond
 }
 
+// aborted throws the corruption or assertion that aborts the loading of the
+// last object, if there's one.
+func (r *redisRio) aborted() {
+	if r.rio.abort[0] != 0 {
+		throwError(r.Offset(), ErrCorrupted, "%s", C.GoString(&r.rio.abort[0]))
+	}
+}
+
 func (r *redisRio) LoadObject(typ int) *RedisObject {
 	var obj = C.redisRioLoadObject(&r.rio, C.int(typ))
 	if obj == nil {
-		log.PanicErrorf(io.ErrUnexpectedEOF, "Read RDB LoadObject() failed.")
+		r.aborted()
+		r.throwf("Read RDB LoadObject() failed, type = %d.", typ)
 	}
 	return newRedisObject(obj)
 }
@@ -168,13 +196,15 @@ func (r *redisRio) LoadObject(typ int) *RedisObject {
 func (r *redisRio) LoadStringObject() *RedisStringObject {
 	var obj = C.redisRioLoadStringObject(&r.rio)
 	if obj == nil {
-		log.PanicErrorf(io.ErrUnexpectedEOF, "Read RDB LoadStringObject() failed.")
+		r.aborted()
+		r.throwf("Read RDB LoadStringObject() failed.")
 	}
 	return &RedisStringObject{newRedisObject(obj)}
 }
 
 const (
-	RDB_VERSION = int64(C.RDB_VERSION)
+	RDB_VERSION     = int64(C.RDB_VERSION)
+	RDB_VERSION_MAX = int64(C.RDB_VERSION_MAX)
 )
 
 const (
@@ -185,6 +215,13 @@ const (
 	RDB_OPCODE_RESIZEDB      = int(C.RDB_OPCODE_RESIZEDB)
 	RDB_OPCODE_SELECTDB      = int(C.RDB_OPCODE_SELECTDB)
 
+	RDB_OPCODE_SLOT_INFO       = int(C.RDB_OPCODE_SLOT_INFO)
+	RDB_OPCODE_FUNCTION2       = int(C.RDB_OPCODE_FUNCTION2)
+	RDB_OPCODE_FUNCTION_PRE_GA = int(C.RDB_OPCODE_FUNCTION_PRE_GA)
+	RDB_OPCODE_MODULE_AUX      = int(C.RDB_OPCODE_MODULE_AUX)
+	RDB_OPCODE_IDLE            = int(C.RDB_OPCODE_IDLE)
+	RDB_OPCODE_FREQ            = int(C.RDB_OPCODE_FREQ)
+
 	RDB_TYPE_STRING           = int(C.RDB_TYPE_STRING)
 	RDB_TYPE_LIST             = int(C.RDB_TYPE_LIST)
 	RDB_TYPE_SET              = int(C.RDB_TYPE_SET)
@@ -200,6 +237,13 @@ const (
 	RDB_TYPE_HASH_ZIPLIST     = int(C.RDB_TYPE_HASH_ZIPLIST)
 	RDB_TYPE_LIST_QUICKLIST   = int(C.RDB_TYPE_LIST_QUICKLIST)
 	RDB_TYPE_STREAM_LISTPACKS = int(C.RDB_TYPE_STREAM_LISTPACKS)
+
+	RDB_TYPE_HASH_LISTPACK      = int(C.RDB_TYPE_HASH_LISTPACK)
+	RDB_TYPE_ZSET_LISTPACK      = int(C.RDB_TYPE_ZSET_LISTPACK)
+	RDB_TYPE_LIST_QUICKLIST_2   = int(C.RDB_TYPE_LIST_QUICKLIST_2)
+	RDB_TYPE_STREAM_LISTPACKS_2 = int(C.RDB_TYPE_STREAM_LISTPACKS_2)
+	RDB_TYPE_SET_LISTPACK       = int(C.RDB_TYPE_SET_LISTPACK)
+	RDB_TYPE_STREAM_LISTPACKS_3 = int(C.RDB_TYPE_STREAM_LISTPACKS_3)
 )
 
 const (
@@ -212,28 +256,6 @@ const (
 	OBJ_STREAM = RedisType(C.OBJ_STREAM)
 )
 
-type RedisType int
-
-func (t RedisType) String() string {
-	switch t {
-	case OBJ_STRING:
-		return "OBJ_STRING"
-	case OBJ_LIST:
-		return "OBJ_LIST"
-	case OBJ_SET:
-		return "OBJ_SET"
-	case OBJ_ZSET:
-		return "OBJ_ZSET"
-	case OBJ_HASH:
-		return "OBJ_HASH"
-	case OBJ_MODULE:
-		return "OBJ_MODULE"
-	case OBJ_STREAM:
-		return "OBJ_STREAM"
-	}
-	return fmt.Sprintf("OBJ_UNKNOWN[%d]", t)
-}
-
 const (
 	OBJ_ENCODING_RAW        = RedisEncoding(C.OBJ_ENCODING_RAW)
 	OBJ_ENCODING_INT        = RedisEncoding(C.OBJ_ENCODING_INT)
@@ -248,36 +270,6 @@ const (
 	OBJ_ENCODING_STREAM     = RedisEncoding(C.OBJ_ENCODING_STREAM)
 )
 
-type RedisEncoding int
-
-func (t RedisEncoding) String() string {
-	switch t {
-	case OBJ_ENCODING_RAW:
-		return "ENCODING_RAW"
-	case OBJ_ENCODING_INT:
-		return "ENCODING_INT"
-	case OBJ_ENCODING_HT:
-		return "ENCODING_HT"
-	case OBJ_ENCODING_ZIPMAP:
-		return "ENCODING_ZIPMAP"
-	case OBJ_ENCODING_LINKEDLIST:
-		return "ENCODING_LINKEDLIST"
-	case OBJ_ENCODING_ZIPLIST:
-		return "ENCODING_ZIPLIST"
-	case OBJ_ENCODING_INTSET:
-		return "ENCODING_INTSET"
-	case OBJ_ENCODING_SKIPLIST:
-		return "ENCODING_SKIPLIST"
-	case OBJ_ENCODING_EMBSTR:
-		return "ENCODING_EMBSTR"
-	case OBJ_ENCODING_QUICKLIST:
-		return "ENCODING_QUICKLIST"
-	case OBJ_ENCODING_STREAM:
-		return "ENCODING_STREAM"
-	}
-	return fmt.Sprintf("ENCODING_UNKNOWN[%d]", t)
-}
-
 type RedisSds struct {
 	Ptr   unsafe.Pointer
 	Len   int
@@ -355,15 +347,6 @@ func (o *RedisObject) Encoding() RedisEncoding {
 	return RedisEncoding(C.redisObjectEncoding(o.obj))
 }
 
-func (o *RedisObject) IsEncodedObject() bool {
-	switch o.Encoding() {
-	default:
-		return true
-	case OBJ_ENCODING_QUICKLIST, OBJ_ENCODING_HT, OBJ_ENCODING_SKIPLIST:
-		return false
-	}
-}
-
 func (o *RedisObject) SetLazyfree(enable bool) *RedisObject {
 	if enable {
 		o.lazyfree = C.int(1)
@@ -396,13 +379,6 @@ func (o *RedisObject) DecrRefCount() {
 	}
 }
 
-func (o *RedisObject) CreateDumpPayload() string {
-	var sds = o.CreateDumpPayloadUnsafe()
-	var str = sds.String()
-	sds.Release()
-	return str
-}
-
 func (o *RedisObject) CreateDumpPayloadUnsafe() *RedisSds {
 	var sds C.redisSds
 	C.redisObjectCreateDumpPayload(o.obj, &sds)
@@ -418,48 +394,11 @@ func DecodeFromPayload(buf []byte) *RedisObject {
 	return newRedisObject(obj)
 }
 
-func (o *RedisObject) IsString() bool {
-	return o.Type() == OBJ_STRING
-}
-
-func (o *RedisObject) AsString() *RedisStringObject {
-	return &RedisStringObject{o}
-}
-
-func (o *RedisObject) IsList() bool {
-	return o.Type() == OBJ_LIST
-}
-
-func (o *RedisObject) AsList() *RedisListObject {
-	return &RedisListObject{o}
-}
-
-func (o *RedisObject) IsHash() bool {
-	return o.Type() == OBJ_HASH
-}
-
-func (o *RedisObject) AsHash() *RedisHashObject {
-	return &RedisHashObject{o}
-}
-
-func (o *RedisObject) IsZset() bool {
-	return o.Type() == OBJ_ZSET
-}
-
-func (o *RedisObject) AsZset() *RedisZsetObject {
-	return &RedisZsetObject{o}
-}
-
-func (o *RedisObject) IsSet() bool {
-	return o.Type() == OBJ_SET
-}
-
-func (o *RedisObject) AsSet() *RedisSetObject {
-	return &RedisSetObject{o}
-}
-
-type RedisStringObject struct {
-	*RedisObject
+// NewRedisStringObject creates a string object with a copy of b.
+func NewRedisStringObject(b []byte) *RedisStringObject {
+	var hdr = (*reflect.SliceHeader)(unsafe.Pointer(&b))
+	var obj = C.redisStringObjectCreate(unsafe.Pointer(hdr.Data), C.size_t(hdr.Len))
+	return &RedisStringObject{newRedisObject(obj)}
 }
 
 func (o *RedisStringObject) Len() int {
@@ -472,70 +411,10 @@ func (o *RedisStringObject) RedisSds() *RedisSds {
 	return &RedisSds{Ptr: sds.ptr, Len: int(sds.len), Value: int64(sds.val)}
 }
 
-func (o *RedisStringObject) String() string {
-	return o.RedisSds().String()
-}
-
-func (o *RedisStringObject) StringUnsafe() string {
-	return o.RedisSds().StringUnsafe()
-}
-
-func (o *RedisStringObject) Bytes() []byte {
-	return o.RedisSds().Bytes()
-}
-
-func (o *RedisStringObject) BytesUnsafe() []byte {
-	return o.RedisSds().BytesUnsafe()
-}
-
-type RedisListObject struct {
-	*RedisObject
-}
-
 func (o *RedisListObject) Len() int {
 	return int(C.redisListObjectLen(o.obj))
 }
 
-func (o *RedisListObject) NewIterator() *RedisListIterator {
-	return newRedisListIterator(o)
-}
-
-func (o *RedisListObject) ForEach(on func(iter *RedisListIterator, step int) bool) int {
-	var step int
-	var iter = o.NewIterator()
-	for on(iter, step) {
-		step++
-	}
-	iter.Release()
-	return step
-}
-
-func (o *RedisListObject) Strings() []string {
-	var list []string
-	o.ForEach(func(iter *RedisListIterator, step int) bool {
-		var key = iter.Next()
-		if key == nil {
-			return false
-		}
-		list = append(list, key.String())
-		return true
-	})
-	return list
-}
-
-func (o *RedisListObject) StringsUnsafe() []string {
-	var list []string
-	o.ForEach(func(iter *RedisListIterator, step int) bool {
-		var key = iter.Next()
-		if key == nil {
-			return false
-		}
-		list = append(list, key.StringUnsafe())
-		return true
-	})
-	return list
-}
-
 func redisTypeIteratorHasNext(p *C.redisTypeIterator) bool {
 	var empty = func() bool { return p.index == p.slice.len }
 	if !empty() {
@@ -576,54 +455,10 @@ func (p *RedisListIterator) Next() *RedisSds {
 	return redisTypeIteratorNext(p.iter)
 }
 
-type RedisHashObject struct {
-	*RedisObject
-}
-
 func (o *RedisHashObject) Len() int {
 	return int(C.redisHashObjectLen(o.obj))
 }
 
-func (o *RedisHashObject) NewIterator() *RedisHashIterator {
-	return newRedisHashIterator(o)
-}
-
-func (o *RedisHashObject) ForEach(on func(iter *RedisHashIterator, step int) bool) int {
-	var step int
-	var iter = o.NewIterator()
-	for on(iter, step) {
-		step++
-	}
-	iter.Release()
-	return step
-}
-
-func (o *RedisHashObject) Map() map[string]string {
-	var hash = make(map[string]string)
-	o.ForEach(func(iter *RedisHashIterator, step int) bool {
-		var key, value = iter.Next()
-		if key == nil {
-			return false
-		}
-		hash[key.String()] = value.String()
-		return true
-	})
-	return hash
-}
-
-func (o *RedisHashObject) MapUnsafe() map[string]string {
-	var hash = make(map[string]string)
-	o.ForEach(func(iter *RedisHashIterator, step int) bool {
-		var key, value = iter.Next()
-		if key == nil {
-			return false
-		}
-		hash[key.StringUnsafe()] = value.StringUnsafe()
-		return true
-	})
-	return hash
-}
-
 type RedisHashIterator struct {
 	iter *C.redisTypeIterator
 	robj *RedisObject
@@ -649,140 +484,164 @@ func (p *RedisHashIterator) Next() (*RedisSds, *RedisSds) {
 	return nil, nil
 }
 
-type RedisZsetObject struct {
-	*RedisObject
-}
-
 func (o *RedisZsetObject) Len() int {
 	return int(C.redisZsetObjectLen(o.obj))
 }
 
-func (o *RedisZsetObject) NewIterator() *RedisZsetIterator {
-	return newRedisZsetIterator(o)
+type RedisZsetIterator struct {
+	iter *C.redisTypeIterator
+	robj *RedisObject
 }
 
-func (o *RedisZsetObject) ForEach(on func(iter *RedisZsetIterator, step int) bool) int {
-	var step int
-	var iter = o.NewIterator()
-	for on(iter, step) {
-		step++
+func newRedisZsetIterator(o *RedisZsetObject) *RedisZsetIterator {
+	return &RedisZsetIterator{
+		iter: C.redisZsetObjectNewIterator(o.obj),
+		robj: o.IncrRefCount(),
 	}
-	iter.Release()
-	return step
 }
 
-func (o *RedisZsetObject) Map() map[string]float64 {
-	var zset = make(map[string]float64)
-	o.ForEach(func(iter *RedisZsetIterator, step int) bool {
-		var key = iter.Next()
-		if key == nil {
-			return false
-		}
-		zset[key.String()] = key.Score
-		return true
-	})
-	return zset
+func (p *RedisZsetIterator) Release() {
+	C.redisZsetIteratorRelease(p.iter)
+	p.robj.DecrRefCount()
 }
 
-func (o *RedisZsetObject) MapUnsafe() map[string]float64 {
-	var zset = make(map[string]float64)
-	o.ForEach(func(iter *RedisZsetIterator, step int) bool {
-		var key = iter.Next()
-		if key == nil {
-			return false
-		}
-		zset[key.StringUnsafe()] = key.Score
-		return true
-	})
-	return zset
+func (p *RedisZsetIterator) Next() *RedisSds {
+	return redisTypeIteratorNext(p.iter)
 }
 
-type RedisZsetIterator struct {
+func (o *RedisSetObject) Len() int {
+	return int(C.redisSetObjectLen(o.obj))
+}
+
+type RedisSetIterator struct {
 	iter *C.redisTypeIterator
 	robj *RedisObject
 }
 
-func newRedisZsetIterator(o *RedisZsetObject) *RedisZsetIterator {
-	return &RedisZsetIterator{
-		iter: C.redisZsetObjectNewIterator(o.obj),
+func newRedisSetIterator(o *RedisSetObject) *RedisSetIterator {
+	return &RedisSetIterator{
+		iter: C.redisSetObjectNewIterator(o.obj),
 		robj: o.IncrRefCount(),
 	}
 }
 
-func (p *RedisZsetIterator) Release() {
-	C.redisZsetIteratorRelease(p.iter)
+func (p *RedisSetIterator) Release() {
+	C.redisSetIteratorRelease(p.iter)
 	p.robj.DecrRefCount()
 }
 
-func (p *RedisZsetIterator) Next() *RedisSds {
+func (p *RedisSetIterator) Next() *RedisSds {
 	return redisTypeIteratorNext(p.iter)
 }
 
-type RedisSetObject struct {
-	*RedisObject
+func newRedisStreamID(id *C.redisStreamID) RedisStreamID {
+	return RedisStreamID{Ms: uint64(id.ms), Seq: uint64(id.seq)}
 }
 
-func (o *RedisSetObject) Len() int {
-	return int(C.redisSetObjectLen(o.obj))
+func (o *RedisStreamObject) Len() int {
+	return int(C.redisStreamObjectLen(o.obj))
 }
 
-func (o *RedisSetObject) ForEach(on func(iter *RedisSetIterator, step int) bool) int {
-	var step int
-	var iter = o.NewIterator()
-	for on(iter, step) {
-		step++
-	}
-	iter.Release()
-	return step
+func (o *RedisStreamObject) LastID() RedisStreamID {
+	var id C.redisStreamID
+	C.redisStreamObjectLastID(o.obj, &id)
+	return newRedisStreamID(&id)
 }
 
-func (o *RedisSetObject) Map() map[string]bool {
-	var set = make(map[string]bool)
-	o.ForEach(func(iter *RedisSetIterator, step int) bool {
-		var key = iter.Next()
-		if key == nil {
-			return false
-		}
-		set[key.String()] = true
-		return true
-	})
-	return set
+func (o *RedisStreamObject) Meta() *RedisStreamMeta {
+	var meta C.redisStreamMeta
+	if C.redisStreamObjectMeta(o.obj, &meta) != 0 {
+		return nil
+	}
+	return &RedisStreamMeta{
+		FirstID:      newRedisStreamID(&meta.first_id),
+		MaxDeletedID: newRedisStreamID(&meta.max_deleted_id),
+		EntriesAdded: uint64(meta.entries_added),
+	}
 }
 
-func (o *RedisSetObject) MapUnsafe() map[string]bool {
-	var set = make(map[string]bool)
-	o.ForEach(func(iter *RedisSetIterator, step int) bool {
-		var key = iter.Next()
-		if key == nil {
-			return false
+func (o *RedisStreamObject) Groups() []*RedisStreamGroup {
+	var groups []*RedisStreamGroup
+	redisRaxForEach(C.redisStreamObjectGroups(o.obj), func(key []byte, cg unsafe.Pointer) {
+		var id C.redisStreamID
+		C.redisStreamGroupLastID(cg, &id)
+		var group = &RedisStreamGroup{
+			Name: string(key), LastID: newRedisStreamID(&id),
+			EntriesRead: int64(C.redisStreamGroupEntriesRead(o.obj, cg)),
 		}
-		set[key.StringUnsafe()] = true
-		return true
+		redisRaxForEach(C.redisStreamGroupPEL(cg), func(key []byte, nack unsafe.Pointer) {
+			var deliveryTime C.longlong
+			var deliveryCount C.uint64_t
+			var consumer C.redisSds
+			C.redisStreamNACKLoad(nack, &deliveryTime, &deliveryCount, &consumer)
+			group.Pending = append(group.Pending, &RedisStreamNACK{
+				ID:            decodeRedisStreamID(key),
+				Consumer:      C.GoStringN((*C.char)(consumer.ptr), C.int(consumer.len)),
+				DeliveryTime:  time.Duration(deliveryTime) * time.Millisecond,
+				DeliveryCount: uint64(deliveryCount),
+			})
+		})
+		redisRaxForEach(C.redisStreamGroupConsumers(cg), func(key []byte, consumer unsafe.Pointer) {
+			var seenTime C.longlong
+			C.redisStreamConsumerLoad(consumer, &seenTime)
+			var c = &RedisStreamConsumer{
+				Name: string(key), SeenTime: time.Duration(seenTime) * time.Millisecond,
+			}
+			redisRaxForEach(C.redisStreamConsumerPEL(consumer), func(key []byte, _ unsafe.Pointer) {
+				c.Pending = append(c.Pending, decodeRedisStreamID(key))
+			})
+			group.Consumers = append(group.Consumers, c)
+		})
+		groups = append(groups, group)
 	})
-	return set
+	return groups
 }
 
-func (o *RedisSetObject) NewIterator() *RedisSetIterator {
-	return newRedisSetIterator(o)
+func redisRaxForEach(rax unsafe.Pointer, on func(key []byte, data unsafe.Pointer)) {
+	if rax == nil {
+		return
+	}
+	var iter = C.redisRaxNewIterator(rax)
+	for {
+		var key C.redisSds
+		var data unsafe.Pointer
+		if C.redisRaxIteratorNext(iter, &key, &data) != 0 {
+			break
+		}
+		on(unsafeCastToSlice(key.ptr, key.len), data)
+	}
+	C.redisRaxIteratorRelease(iter)
 }
 
-type RedisSetIterator struct {
-	iter *C.redisTypeIterator
+type RedisStreamIterator struct {
+	iter unsafe.Pointer
 	robj *RedisObject
 }
 
-func newRedisSetIterator(o *RedisSetObject) *RedisSetIterator {
-	return &RedisSetIterator{
-		iter: C.redisSetObjectNewIterator(o.obj),
+func newRedisStreamIterator(o *RedisStreamObject) *RedisStreamIterator {
+	return &RedisStreamIterator{
+		iter: C.redisStreamObjectNewIterator(o.obj),
 		robj: o.IncrRefCount(),
 	}
 }
 
-func (p *RedisSetIterator) Release() {
-	C.redisSetIteratorRelease(p.iter)
+func (p *RedisStreamIterator) Release() {
+	C.redisStreamIteratorRelease(p.iter)
 	p.robj.DecrRefCount()
 }
 
-func (p *RedisSetIterator) Next() *RedisSds {
-	return redisTypeIteratorNext(p.iter)
+func (p *RedisStreamIterator) Next() *RedisStreamEntry {
+	var id C.redisStreamID
+	var numfields C.int64_t
+	if C.redisStreamIteratorNext(p.iter, &id, &numfields) != 0 {
+		return nil
+	}
+	var entry = &RedisStreamEntry{ID: newRedisStreamID(&id)}
+	for i := 0; i < int(numfields); i++ {
+		var field, value C.redisSds
+		C.redisStreamIteratorField(p.iter, &field, &value)
+		entry.Fields = append(entry.Fields, &RedisSds{Ptr: field.ptr, Len: int(field.len), Value: int64(field.val)})
+		entry.Values = append(entry.Values, &RedisSds{Ptr: value.ptr, Len: int(value.len), Value: int64(value.val)})
+	}
+	return entry
 }
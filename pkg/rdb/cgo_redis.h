@@ -2,6 +2,26 @@
 
 void initRedisServer(char *config);
 
+/* RDB types and opcodes of Redis 7.x, unknown to the bundled redis */
+#define RDB_VERSION_MAX 12
+
+#define RDB_TYPE_HASH_LISTPACK 16
+#define RDB_TYPE_ZSET_LISTPACK 17
+#define RDB_TYPE_LIST_QUICKLIST_2 18
+#define RDB_TYPE_STREAM_LISTPACKS_2 19
+#define RDB_TYPE_SET_LISTPACK 20
+#define RDB_TYPE_STREAM_LISTPACKS_3 21
+
+#define RDB_OPCODE_SLOT_INFO 244
+#define RDB_OPCODE_FUNCTION2 245
+#define RDB_OPCODE_FUNCTION_PRE_GA 246
+#define RDB_OPCODE_MODULE_AUX 247
+#define RDB_OPCODE_IDLE 248
+#define RDB_OPCODE_FREQ 249
+
+#define QUICKLIST_NODE_CONTAINER_PLAIN 1
+#define QUICKLIST_NODE_CONTAINER_PACKED 2
+
 /* API of Redis Rio/Rdb */
 
 #define REDIS_RIO_BUFSIZE (1024 * 16)
@@ -10,9 +30,12 @@ typedef struct {
   rio rdb;
   size_t pos, end;
   char buf[REDIS_RIO_BUFSIZE];
+  /* The message of the corruption or assertion that aborts the loading. */
+  char abort[512];
 } redisRio;
 
 void redisRioInit(redisRio *p);
+void redisRioSeek(redisRio *p, size_t offset);
 
 int redisRioRead(redisRio *p, void *buf, size_t len);
 int redisRioLoadLen(redisRio *p, uint64_t *len);
@@ -22,8 +45,10 @@ int redisRioLoadTimeMillisecond(redisRio *p, long long *val);
 
 void *redisRioLoadObject(redisRio *p, int typ);
 void *redisRioLoadStringObject(redisRio *p);
+void redisRioAbort(const char *msg, size_t len);
 
 inline uint64_t redisRioChecksum(redisRio *p) { return p->rdb.cksum; }
+inline size_t redisRioOffset(redisRio *p) { return p->rdb.processed_bytes; }
 
 /* API of Sds */
 typedef struct {
@@ -59,6 +84,7 @@ void redisObjectCreateDumpPayload(void *obj, redisSds *p);
 void *redisObjectDecodeFromPayload(void *buf, size_t len);
 
 /* API of redis String */
+void *redisStringObjectCreate(void *buf, size_t len);
 size_t redisStringObjectLen(void *obj);
 void redisStringObjectLoad(void *obj, redisSds *sds);
 
@@ -82,6 +108,57 @@ size_t redisSetObjectLen(void *obj);
 redisTypeIterator *redisSetObjectNewIterator(void *obj);
 void redisSetIteratorRelease(redisTypeIterator *p);
 
+/* API of redis Stream */
+typedef struct {
+  uint64_t ms, seq;
+} redisStreamID;
+
+typedef struct {
+  int valid;
+  redisStreamID first_id, max_deleted_id;
+  uint64_t entries_added;
+} redisStreamMeta;
+
+/* Streams and groups are loaded with the metadata of RDB_TYPE_STREAM_LISTPACKS_2
+ * that is unknown to the bundled redis, the redis structs come first, so they
+ * are still freed by freeStream and streamFreeCG. Streams of the loader are
+ * tagged by REDIS_ENCODING_STREAM_EXT, which is unused by the bundled redis,
+ * others such as the streams of DUMP payloads have no metadata. */
+#define REDIS_ENCODING_STREAM_EXT 15
+
+typedef struct {
+  stream s;
+  redisStreamMeta meta;
+} redisStreamExt;
+
+typedef struct {
+  streamCG cg;
+  long long entries_read;
+} redisStreamCGExt;
+
+size_t redisStreamObjectLen(void *obj);
+void redisStreamObjectLastID(void *obj, redisStreamID *id);
+int redisStreamObjectMeta(void *obj, redisStreamMeta *meta);
+void *redisStreamObjectGroups(void *obj);
+void *redisStreamObjectNewIterator(void *obj);
+int redisStreamIteratorNext(void *iter, redisStreamID *id, int64_t *numfields);
+void redisStreamIteratorField(void *iter, redisSds *field, redisSds *value);
+void redisStreamIteratorRelease(void *iter);
+
+void redisStreamGroupLastID(void *cg, redisStreamID *id);
+long long redisStreamGroupEntriesRead(void *obj, void *cg);
+void *redisStreamGroupPEL(void *cg);
+void *redisStreamGroupConsumers(void *cg);
+void redisStreamNACKLoad(void *nack, long long *delivery_time,
+                         uint64_t *delivery_count, redisSds *consumer);
+void redisStreamConsumerLoad(void *consumer, long long *seen_time);
+void *redisStreamConsumerPEL(void *consumer);
+
+/* API of redis Rax */
+void *redisRaxNewIterator(void *rax);
+int redisRaxIteratorNext(void *iter, redisSds *key, void **data);
+void redisRaxIteratorRelease(void *iter);
+
 /* API of redis zmalloc */
 extern size_t zmalloc_used_memory(void);
 extern size_t zmalloc_memory_size(void);
@@ -0,0 +1,11 @@
+package rdb
+
+import "hash/crc64"
+
+// Redis uses the Jones polynomial without the initial and final inversion
+// that hash/crc64 applies, so the inversions are undone here.
+var crc64Table = crc64.MakeTable(0x95AC9329AC4BC9B5)
+
+func crc64Update(crc uint64, p []byte) uint64 {
+	return ^crc64.Update(^crc, crc64Table, p)
+}
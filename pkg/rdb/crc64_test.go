@@ -0,0 +1,13 @@
+package rdb
+
+import (
+	"testing"
+
+	"github.com/CodisLabs/codis/pkg/utils/assert"
+)
+
+func TestCrc64(t *testing.T) {
+	assert.Must(crc64Update(0, []byte("123456789")) == 0xe9c6d914c4b8d9ca)
+	var crc = crc64Update(0, []byte("1234"))
+	assert.Must(crc64Update(crc, []byte("56789")) == 0xe9c6d914c4b8d9ca)
+}
@@ -0,0 +1,76 @@
+package rdb
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+var (
+	ErrBadMagic           = errors.New("bad magic string")
+	ErrUnsupportedVersion = errors.New("unsupported rdb version")
+	ErrChecksumMismatch   = errors.New("checksum mismatch")
+	ErrUnexpectedEOF      = io.ErrUnexpectedEOF
+	ErrUnsupportedType    = errors.New("unsupported object type")
+	ErrCorrupted          = errors.New("corrupted rdb")
+)
+
+// Error is returned by Loader, Offset is the number of bytes that had been
+// parsed when the failure happened. Err is one of the errors above, or the
+// error returned by the underlying reader.
+type Error struct {
+	Offset int64
+	Err    error
+	Msg    string
+}
+
+func (e *Error) Error() string {
+	if e.Msg == "" {
+		return fmt.Sprintf("rdb: %s at offset %d", e.Err, e.Offset)
+	}
+	return fmt.Sprintf("rdb: %s at offset %d, %s", e.Err, e.Offset, e.Msg)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Cause returns the error that caused the failure of Loader, err itself if
+// it isn't an *Error.
+func Cause(err error) error {
+	if e, ok := err.(*Error); ok {
+		return e.Err
+	}
+	return err
+}
+
+// throwError aborts the loading, it's recovered by Loader and returned to
+// the caller as an *Error. A negative offset is replaced by the current one.
+func throwError(offset int64, err error, format string, args ...interface{}) {
+	panic(&Error{Offset: offset, Err: err, Msg: fmt.Sprintf(format, args...)})
+}
+
+func (l *Loader) recover(err *error) {
+	if x := recover(); x != nil {
+		e, ok := x.(*Error)
+		if !ok {
+			panic(x)
+		}
+		if e.Offset < 0 {
+			e.Offset = l.rio.Offset()
+		}
+		l.err, *err = e, e
+	}
+}
+
+// throwf aborts the loading, blames the underlying reader if it has failed.
+func (r *redisRio) throwf(format string, args ...interface{}) {
+	switch err := r.err; {
+	case err == nil:
+		throwError(r.Offset(), ErrCorrupted, format, args...)
+	case err == io.EOF || err == io.ErrUnexpectedEOF:
+		throwError(r.Offset(), ErrUnexpectedEOF, format, args...)
+	default:
+		throwError(r.Offset(), err, format, args...)
+	}
+}
@@ -4,14 +4,13 @@ import (
 	"encoding/binary"
 	"io"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/CodisLabs/codis/pkg/utils/log"
 )
 
 type Loader struct {
-	r io.Reader
-
 	header struct {
 		version int64 // rdb version
 	}
@@ -20,54 +19,152 @@ type Loader struct {
 	}
 	footer struct {
 		checksum uint64 // expected checksum
+		unknown  bool   // the checksum is unknown after SeekTo
 	}
 	rio redisRio
+
+	mu       sync.Mutex
+	aux      map[string]string
+	dbsize   map[uint64]DBSize
+	selectdb map[uint64]int64
+
+	err error // the first failure, returned by all subsequent calls
+
+	accept func(db uint64, key []byte) bool
+}
+
+// DBSize is the hint of RDB_OPCODE_RESIZEDB, written before the keys of
+// each database.
+type DBSize struct {
+	Keys    uint64
+	Expires uint64
 }
 
 func NewLoader(r io.Reader) *Loader {
 	if r == nil {
 		log.Panicf("Create loader with nil reader.")
 	}
-	l := &Loader{r: r}
-	l.rio.init()
+	l := &Loader{}
+	l.aux = make(map[string]string)
+	l.dbsize = make(map[uint64]DBSize)
+	l.selectdb = make(map[uint64]int64)
+	l.rio.init(r)
 	return l
 }
 
-func (l *Loader) Header() {
-	header := make([]byte, 9)
-	if err := l.rio.Read(header); err != nil {
-		log.PanicErrorf(err, "Read RDB header failed.")
+func (l *Loader) Version() int64 {
+	return l.header.version
+}
+
+// Aux returns the auxiliary fields (redis-ver, redis-bits, ctime, used-mem,
+// repl-id, repl-offset, aof-preamble, ...) that have been loaded so far.
+func (l *Loader) Aux() map[string]string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var aux = make(map[string]string, len(l.aux))
+	for k, v := range l.aux {
+		aux[k] = v
+	}
+	return aux
+}
+
+// DBSize returns the key counts of the databases that have been reached.
+func (l *Loader) DBSize() map[uint64]DBSize {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var dbsize = make(map[uint64]DBSize, len(l.dbsize))
+	for db, size := range l.dbsize {
+		dbsize[db] = size
+	}
+	return dbsize
+}
+
+// SelectDB returns the offsets of RDB_OPCODE_SELECTDB of the databases that
+// have been reached.
+func (l *Loader) SelectDB() map[uint64]int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var selectdb = make(map[uint64]int64, len(l.selectdb))
+	for db, offset := range l.selectdb {
+		selectdb[db] = offset
 	}
+	return selectdb
+}
+
+// SeekTo moves the loader to offset, which is DBEntry.Offset or an offset of
+// SelectDB() of a previous load, db is the database of the offset. The reader
+// must be an io.Seeker, and Footer doesn't verify the checksum after SeekTo.
+func (l *Loader) SeekTo(offset int64, db uint64) (err error) {
+	if l.err != nil {
+		return l.err
+	}
+	defer l.recover(&err)
+
+	s, ok := l.rio.rd.(io.Seeker)
+	if !ok {
+		log.Panicf("Seek loader with a reader that isn't an io.Seeker.")
+	}
+	if _, err := s.Seek(offset, io.SeekStart); err != nil {
+		throwError(offset, err, "Seek to offset = %d failed.", offset)
+	}
+	l.rio.seek(offset)
+	l.cursor.db = db
+	l.footer.unknown = true
+	return nil
+}
+
+// SetKeyFilter sets the filter of keys, the values of keys that are not
+// accepted are skipped without being decoded, and the keys are not returned.
+func (l *Loader) SetKeyFilter(accept func(db uint64, key []byte) bool) {
+	l.accept = accept
+}
+
+func (l *Loader) Header() (err error) {
+	if l.err != nil {
+		return l.err
+	}
+	defer l.recover(&err)
+
+	header := make([]byte, 9)
+	l.rio.Read(header)
 	if format := string(header[:5]); format != "REDIS" {
-		log.Panicf("Verify magic string, invalid format = %q.", format)
+		throwError(0, ErrBadMagic, "Verify magic string, invalid format = %q.", format)
 	}
 	n, err := strconv.ParseInt(string(header[5:]), 10, 64)
 	if err != nil {
-		log.PanicErrorf(err, "Try to parse version = %q.", header[5:])
+		throwError(5, ErrUnsupportedVersion, "Try to parse version = %q.", header[5:])
 	}
 	switch {
-	case n < 1 || n > RDB_VERSION:
-		log.Panicf("Can't handle RDB format version = %d.", n)
+	case n < 1 || n > RDB_VERSION_MAX:
+		throwError(5, ErrUnsupportedVersion, "Can't handle RDB format version = %d.", n)
 	default:
 		l.header.version = n
 	}
+	return nil
 }
 
-func (l *Loader) Footer() {
+func (l *Loader) Footer() (err error) {
+	if l.err != nil {
+		return l.err
+	}
+	defer l.recover(&err)
+
 	if l.header.version >= 5 {
+		var offset = l.rio.Offset()
 		var expected = l.rio.Checksum()
 		footer := make([]byte, 8)
-		if err := l.rio.Read(footer); err != nil {
-			log.PanicErrorf(err, "Read RDB footer failed.")
-		}
+		l.rio.Read(footer)
 		l.footer.checksum = binary.LittleEndian.Uint64(footer)
 		switch {
+		case l.footer.unknown:
+			log.Debugf("RDB checksum isn't verified after seek.")
 		case l.footer.checksum == 0:
 			log.Debugf("RDB file was saved with checksum disabled.")
 		case l.footer.checksum != expected:
-			log.Panicf("Wrong checksum, expected = %#16x, footer = %#16x.", expected, l.footer.checksum)
+			throwError(offset, ErrChecksumMismatch, "Wrong checksum, expected = %#16x, footer = %#16x.", expected, l.footer.checksum)
 		}
 	}
+	return nil
 }
 
 const NoExpire = time.Duration(-1)
@@ -77,6 +174,23 @@ type DBEntry struct {
 	Expire time.Duration
 	Key    *RedisStringObject
 	Value  *RedisObject
+
+	// Offset is where the entry starts in the RDB, including its expire,
+	// the entry is loaded again by Next() after SeekTo(Offset, DB).
+	Offset int64
+
+	// Module is set instead of Value for module types.
+	Module *RedisModuleObject
+
+	// RDBType is the type of the object in the RDB, e.g. RDB_TYPE_HASH_LISTPACK.
+	RDBType int
+}
+
+func (e *DBEntry) Type() RedisType {
+	if e.Module != nil {
+		return OBJ_MODULE
+	}
+	return e.Value.Type()
 }
 
 func (e *DBEntry) IncrRefCount() *DBEntry {
@@ -98,52 +212,130 @@ func (e *DBEntry) DecrRefCount() {
 	}
 }
 
-func (l *Loader) Next() *DBEntry {
+// Next returns the next object, or nil at the end of the RDB.
+func (l *Loader) Next() (e *DBEntry, err error) {
+	if l.err != nil {
+		return nil, l.err
+	}
+	defer l.recover(&err)
+	return l.next(), nil
+}
+
+func (l *Loader) next() *DBEntry {
+	var expire = NoExpire
+	var offset int64 = -1
 	for {
-		expire := NoExpire
+		var pos = l.rio.Offset()
 		opcode := l.rio.LoadType()
 		switch opcode {
+		case RDB_OPCODE_EXPIRETIME, RDB_OPCODE_EXPIRETIME_MS, RDB_OPCODE_IDLE, RDB_OPCODE_FREQ:
+			if offset < 0 {
+				offset = pos
+			}
+		}
+		switch opcode {
 		case RDB_OPCODE_EXPIRETIME:
 			expire = l.rio.LoadTime()
-			opcode = l.rio.LoadType()
+			continue
 		case RDB_OPCODE_EXPIRETIME_MS:
 			expire = l.rio.LoadTimeMillisecond()
-			opcode = l.rio.LoadType()
+			continue
+		case RDB_OPCODE_IDLE:
+			l.rio.LoadLen()
+			continue
+		case RDB_OPCODE_FREQ:
+			l.rio.Read(make([]byte, 1))
+			continue
 		case RDB_OPCODE_EOF:
 			return nil
 		case RDB_OPCODE_SELECTDB:
 			l.cursor.db = l.rio.LoadLen()
+			l.mu.Lock()
+			l.selectdb[l.cursor.db] = pos
+			l.mu.Unlock()
 			continue
 		case RDB_OPCODE_RESIZEDB:
+			var size DBSize
+			size.Keys = l.rio.LoadLen()
+			size.Expires = l.rio.LoadLen()
+			l.mu.Lock()
+			l.dbsize[l.cursor.db] = size
+			l.mu.Unlock()
+			continue
+		case RDB_OPCODE_SLOT_INFO:
+			l.rio.LoadLen()
 			l.rio.LoadLen()
 			l.rio.LoadLen()
 			continue
 		case RDB_OPCODE_AUX:
-			l.rio.LoadStringObject().DecrRefCount()
+			var key, value = l.rio.LoadStringObject(), l.rio.LoadStringObject()
+			l.mu.Lock()
+			l.aux[key.String()] = value.String()
+			l.mu.Unlock()
+			key.DecrRefCount()
+			value.DecrRefCount()
+			continue
+		case RDB_OPCODE_MODULE_AUX:
+			l.skipModuleAux()
+			continue
+		case RDB_OPCODE_FUNCTION2:
 			l.rio.LoadStringObject().DecrRefCount()
 			continue
+		case RDB_OPCODE_FUNCTION_PRE_GA:
+			throwError(l.rio.Offset()-1, ErrUnsupportedType, "Don't support functions saved by Redis 7.0 release candidates.")
 		}
 
 		switch opcode {
 		case RDB_TYPE_MODULE, RDB_TYPE_MODULE_2:
-			log.Panicf("Don't support module object yet.")
-		case RDB_TYPE_STREAM_LISTPACKS:
-			log.Panicf("Don't support stream object yet.")
+		case RDB_TYPE_STRING, RDB_TYPE_LIST, RDB_TYPE_SET, RDB_TYPE_ZSET, RDB_TYPE_HASH, RDB_TYPE_ZSET_2:
+		case RDB_TYPE_HASH_ZIPMAP, RDB_TYPE_LIST_ZIPLIST, RDB_TYPE_SET_INTSET, RDB_TYPE_ZSET_ZIPLIST, RDB_TYPE_HASH_ZIPLIST:
+		case RDB_TYPE_LIST_QUICKLIST, RDB_TYPE_LIST_QUICKLIST_2:
+		case RDB_TYPE_HASH_LISTPACK, RDB_TYPE_ZSET_LISTPACK, RDB_TYPE_SET_LISTPACK:
+		case RDB_TYPE_STREAM_LISTPACKS, RDB_TYPE_STREAM_LISTPACKS_2, RDB_TYPE_STREAM_LISTPACKS_3:
+		default:
+			throwError(l.rio.Offset()-1, ErrUnsupportedType, "Don't support RDB object type = %d.", opcode)
+		}
+		if offset < 0 {
+			offset = pos
 		}
+		if e := l.loadEntry(opcode, expire, offset); e != nil {
+			return e
+		}
+		expire, offset = NoExpire, -1
+	}
+}
 
-		return &DBEntry{
-			DB:     l.cursor.db,
-			Expire: expire,
-			Key:    l.rio.LoadStringObject(),
-			Value:  l.rio.LoadObject(opcode),
+// loadEntry returns nil if the key is skipped by the filter.
+func (l *Loader) loadEntry(opcode int, expire time.Duration, offset int64) *DBEntry {
+	var e = &DBEntry{DB: l.cursor.db, Expire: expire, Offset: offset, RDBType: opcode}
+	e.Key = l.rio.LoadStringObject()
+	defer func() {
+		if e.Value == nil && e.Module == nil {
+			e.Key.DecrRefCount()
 		}
+	}()
+	if l.accept != nil && !l.accept(e.DB, e.Key.BytesUnsafe()) {
+		l.skipObject(opcode)
+		return nil
 	}
+	switch opcode {
+	case RDB_TYPE_MODULE, RDB_TYPE_MODULE_2:
+		e.Module = l.loadModuleObject(opcode)
+	default:
+		e.Value = l.rio.LoadObject(opcode)
+	}
+	return e
 }
 
-func (l *Loader) ForEach(on func(e *DBEntry) bool) int {
+// ForEach calls on for every object until on returns false, or the end of
+// the RDB, the number of steps is returned.
+func (l *Loader) ForEach(on func(e *DBEntry) bool) (int, error) {
 	var step int
 	for stop := false; !stop; step++ {
-		var e = l.Next()
+		e, err := l.Next()
+		if err != nil {
+			return step, err
+		}
 		if e != nil {
 			stop = !on(e)
 			e.DecrRefCount()
@@ -151,5 +343,5 @@ func (l *Loader) ForEach(on func(e *DBEntry) bool) int {
 			stop = true
 		}
 	}
-	return step
+	return step, nil
 }
@@ -0,0 +1,86 @@
+package rdb_test
+
+import (
+	"testing"
+
+	"github.com/CodisLabs/redis-port/pkg/rdb"
+
+	"github.com/CodisLabs/codis/pkg/utils/assert"
+)
+
+func loadErrorFromHexString(text string) *rdb.Error {
+	loader := newLoaderFromHexString(text)
+	err := loader.Header()
+	if err == nil {
+		_, err = loader.ForEach(func(e *rdb.DBEntry) bool {
+			return true
+		})
+	}
+	if err == nil {
+		err = loader.Footer()
+	}
+	assert.Must(err != nil)
+	e, ok := err.(*rdb.Error)
+	assert.Must(ok)
+
+	// The loader is broken, all of the following calls fail with the same error.
+	_, again := loader.Next()
+	assert.Must(again == err)
+	return e
+}
+
+func TestErrorBadMagic(t *testing.T) {
+	e := loadErrorFromHexString(`
+		584544495330303036ff0000000000000000
+	`)
+	assert.Must(rdb.Cause(e) == rdb.ErrBadMagic)
+	assert.Must(e.Offset == 0)
+}
+
+func TestErrorUnsupportedVersion(t *testing.T) {
+	e := loadErrorFromHexString(`
+		524544495330303939ff0000000000000000
+	`)
+	assert.Must(rdb.Cause(e) == rdb.ErrUnsupportedVersion)
+	assert.Must(e.Offset == 5)
+}
+
+func TestErrorUnexpectedEOF(t *testing.T) {
+	e := loadErrorFromHexString(`
+		524544495330303036fe00fc0098f73e5d01
+	`)
+	assert.Must(rdb.Cause(e) == rdb.ErrUnexpectedEOF)
+	assert.Must(e.Offset == 12)
+}
+
+func TestErrorChecksumMismatch(t *testing.T) {
+	e := loadErrorFromHexString(`
+		524544495330303036fe00fc0098f73e5d010000000c737472696e675f74746c
+		6d730c737472696e675f74746c6d73fc0098f73e5d010000000b737472696e67
+		5f74746c730b737472696e675f74746c73ffd15acd935a3fe948
+	`)
+	assert.Must(rdb.Cause(e) == rdb.ErrChecksumMismatch)
+	assert.Must(e.Offset == 82)
+}
+
+func TestErrorUnsupportedType(t *testing.T) {
+	e := loadErrorFromHexString(`
+		524544495330303039fe001e01610162ff0000000000000000
+	`)
+	assert.Must(rdb.Cause(e) == rdb.ErrUnsupportedType)
+	assert.Must(e.Offset == 11)
+}
+
+func TestErrorHugeLength(t *testing.T) {
+	// A string of 0x7fffffffffffffff bytes can't be allocated.
+	e := loadErrorFromHexString(`
+		524544495330303039fe00000161817fffffffffffffff
+	`)
+	assert.Must(rdb.Cause(e) == rdb.ErrCorrupted)
+
+	// Elements of a list are loaded until the input runs out.
+	e = loadErrorFromHexString(`
+		524544495330303039fe00010161817fffffffffffffff0162
+	`)
+	assert.Must(rdb.Cause(e) == rdb.ErrUnexpectedEOF)
+}
@@ -7,6 +7,7 @@ import (
 	"path/filepath"
 	"sort"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -65,6 +66,24 @@ func (d Database) ValidateSetObject(key string, size int) map[string]bool {
 	return d[key].Value.AsSet().Map()
 }
 
+func (d Database) ValidateStreamObject(key string, size int) []*rdb.RedisStreamEntry {
+	assert.Must(d != nil)
+	assert.Must(d[key] != nil)
+	assert.Must(d[key].Value.IsStream())
+	assert.Must(d[key].Value.AsStream().Len() == size)
+	var entries []*rdb.RedisStreamEntry
+	d[key].Value.AsStream().ForEach(func(iter *rdb.RedisStreamIterator, step int) bool {
+		var entry = iter.Next()
+		if entry == nil {
+			return false
+		}
+		entries = append(entries, entry)
+		return true
+	})
+	assert.Must(len(entries) == size)
+	return entries
+}
+
 type DatabaseSet map[uint64]Database
 
 func (databases DatabaseSet) ValidateSize(expected map[uint64]int) {
@@ -76,8 +95,8 @@ func (databases DatabaseSet) ValidateSize(expected map[uint64]int) {
 
 func loadFromLoader(loader *rdb.Loader) DatabaseSet {
 	databases := make(map[uint64]Database)
-	loader.Header()
-	loader.ForEach(func(e *rdb.DBEntry) bool {
+	assert.MustNoError(loader.Header())
+	_, err := loader.ForEach(func(e *rdb.DBEntry) bool {
 		db, ok := databases[e.DB]
 		if !ok {
 			db = make(map[string]*rdb.DBEntry)
@@ -87,7 +106,8 @@ func loadFromLoader(loader *rdb.Loader) DatabaseSet {
 		db[e.Key.String()] = e.IncrRefCount()
 		return true
 	})
-	loader.Footer()
+	assert.MustNoError(err)
+	assert.MustNoError(loader.Footer())
 	return databases
 }
 
@@ -257,6 +277,7 @@ func TestHashAsZiplist(t *testing.T) {
 	assert.Must(hash["a"] == "aa")
 	assert.Must(hash["aa"] == "aaaa")
 	assert.Must(hash["aaaaa"] == "aaaaaaaaaaaaaa")
+	assert.Must(databases[0]["zipmap_compresses_easily"].Value.Encoding() == rdb.OBJ_ENCODING_ZIPLIST)
 }
 
 func TestHashAsZipmapWithCompression(t *testing.T) {
@@ -302,6 +323,7 @@ func TestZsetAsZiplist(t *testing.T) {
 	assert.Must(floatEqual(zset["8b6ba6718a786daefa69438148361901"], 1))
 	assert.Must(floatEqual(zset["cb7a24bb7528f934b841b34c3a73e0c7"], 2.37))
 	assert.Must(floatEqual(zset["523af537946b79c4f8369ed39ba78605"], 3.423))
+	assert.Must(databases[0]["sorted_set_as_ziplist"].Value.Encoding() == rdb.OBJ_ENCODING_ZIPLIST)
 }
 
 func TestZsetRegularZset(t *testing.T) {
@@ -324,6 +346,7 @@ func TestSetIntset16(t *testing.T) {
 	for _, v := range []int{0x7ffe, 0x7ffd, 0x7ffc} {
 		assert.Must(set[strconv.Itoa(v)])
 	}
+	assert.Must(databases[0]["intset_16"].Value.Encoding() == rdb.OBJ_ENCODING_INTSET)
 }
 
 func TestSetIntset32(t *testing.T) {
@@ -395,6 +418,190 @@ func TestKeysWithExpiry(t *testing.T) {
 	assert.Must(expire.In(utc).Format("2006-01-02 15:04:05.000000") == "2022-12-25 10:11:12.573000")
 }
 
+func TestStreamListpacks(t *testing.T) {
+	databases := loadFromFile("stream_listpacks.rdb")
+	defer release(databases)
+	databases.ValidateSize(map[uint64]int{0: 3})
+	databases[0].ValidateStringObject("string", "value")
+
+	const ms = 1526919030474
+	var entries = databases[0].ValidateStreamObject("mystream", 3)
+	var expected = []struct {
+		id     rdb.RedisStreamID
+		fields []string
+	}{
+		{rdb.RedisStreamID{Ms: ms, Seq: 0}, []string{"sensor", "1234", "temp", "19.8"}},
+		{rdb.RedisStreamID{Ms: ms, Seq: 1}, []string{"sensor", "1235", "temp", "20.1"}},
+		{rdb.RedisStreamID{Ms: ms + 6, Seq: 0}, []string{"sensor", "1236", "temp", "18.5", "humidity", "42"}},
+	}
+	for i, entry := range entries {
+		assert.Must(entry.ID == expected[i].id)
+		assert.Must(len(entry.Fields)*2 == len(expected[i].fields))
+		for j := range entry.Fields {
+			assert.Must(entry.Fields[j].String() == expected[i].fields[j*2])
+			assert.Must(entry.Values[j].String() == expected[i].fields[j*2+1])
+		}
+	}
+
+	var stream = databases[0]["mystream"].Value.AsStream()
+	assert.Must(stream.LastID() == rdb.RedisStreamID{Ms: ms + 16, Seq: 3})
+	var groups = stream.Groups()
+	assert.Must(len(groups) == 2)
+
+	var g1 = groups[0]
+	assert.Must(g1.Name == "g1" && g1.LastID == rdb.RedisStreamID{Ms: ms, Seq: 1})
+	assert.Must(len(g1.Pending) == 2)
+	assert.Must(g1.Pending[0].ID == rdb.RedisStreamID{Ms: ms, Seq: 0})
+	assert.Must(g1.Pending[0].Consumer == "alice")
+	assert.Must(g1.Pending[0].DeliveryTime == 1526919040000*time.Millisecond)
+	assert.Must(g1.Pending[0].DeliveryCount == 2)
+	assert.Must(g1.Pending[1].ID == rdb.RedisStreamID{Ms: ms, Seq: 1})
+	assert.Must(g1.Pending[1].Consumer == "bob")
+	assert.Must(g1.Pending[1].DeliveryCount == 1)
+	assert.Must(len(g1.Consumers) == 3)
+	assert.Must(g1.Consumers[0].Name == "alice" && len(g1.Consumers[0].Pending) == 1)
+	assert.Must(g1.Consumers[0].SeenTime == 1526919040000*time.Millisecond)
+	assert.Must(g1.Consumers[1].Name == "bob" && len(g1.Consumers[1].Pending) == 1)
+	assert.Must(g1.Consumers[1].Pending[0] == rdb.RedisStreamID{Ms: ms, Seq: 1})
+	assert.Must(g1.Consumers[2].Name == "carol" && len(g1.Consumers[2].Pending) == 0)
+
+	var g2 = groups[1]
+	assert.Must(g2.Name == "g2" && g2.LastID.IsZero())
+	assert.Must(len(g2.Pending) == 0 && len(g2.Consumers) == 0)
+
+	databases[0].ValidateStreamObject("emptystream", 0)
+	var empty = databases[0]["emptystream"].Value.AsStream()
+	assert.Must(empty.LastID() == rdb.RedisStreamID{Ms: 7, Seq: 1})
+	assert.Must(len(empty.Groups()) == 0 && empty.Meta() == nil)
+	assert.Must(groups[0].EntriesRead == -1)
+}
+
+func TestModuleObject(t *testing.T) {
+	databases := loadFromFile("module_2.rdb")
+	defer release(databases)
+	databases.ValidateSize(map[uint64]int{0: 2})
+	databases[0].ValidateStringObject("string", "value")
+
+	var entry = databases[0]["doc"]
+	assert.Must(entry != nil && entry.Value == nil)
+	assert.Must(entry.Type() == rdb.OBJ_MODULE)
+	assert.Must(entry.Expire == 1671963072573*time.Millisecond)
+
+	var module = entry.Module
+	assert.Must(module.Name == "ReJSON-RL" && module.Version == 3)
+	assert.Must(module.Len() == 75)
+
+	var payload = module.CreateDumpPayload()
+	assert.Must(len(payload) == 1+75+2+8)
+	assert.Must(payload[0] == byte(rdb.RDB_TYPE_MODULE_2))
+	assert.Must(bytes.Equal(payload[1:76], module.Raw))
+	assert.Must(bytes.HasSuffix(module.Raw, []byte("\x04hello\x00")))
+}
+
+func TestHashAsListpack(t *testing.T) {
+	databases := loadFromFile("hash_listpack.rdb")
+	defer release(databases)
+	databases.ValidateSize(map[uint64]int{0: 2})
+	var hash = databases[0].ValidateHashObject("hash", 4)
+	assert.Must(hash["a"] == "1")
+	assert.Must(hash["b"] == "hello")
+	assert.Must(hash["c"] == "-100000")
+	assert.Must(hash[strings.Repeat("d", 70)] == strings.Repeat("e", 5000))
+	var single = databases[0].ValidateHashObject("single", 1)
+	assert.Must(single["k"] == "v")
+	assert.Must(databases[0]["single"].Value.Encoding() == rdb.OBJ_ENCODING_HT)
+	assert.Must(databases[0]["single"].RDBType == rdb.RDB_TYPE_HASH_LISTPACK)
+}
+
+func TestAuxFieldsAndDBSize(t *testing.T) {
+	loader := newLoaderFromFile("hash_listpack.rdb")
+	databases := loadFromLoader(loader)
+	defer release(databases)
+	assert.Must(loader.Version() == 11)
+	var aux = loader.Aux()
+	assert.Must(len(aux) == 5)
+	assert.Must(aux["redis-ver"] == "7.2.4")
+	assert.Must(aux["redis-bits"] == "64")
+	assert.Must(aux["ctime"] == "1700000000")
+	assert.Must(aux["used-mem"] == "1234567")
+	assert.Must(aux["aof-base"] == "0")
+	var dbsize = loader.DBSize()
+	assert.Must(len(dbsize) == 1)
+	assert.Must(dbsize[0] == rdb.DBSize{Keys: 2, Expires: 0})
+}
+
+func TestZsetAsListpack(t *testing.T) {
+	databases := loadFromFile("zset_listpack.rdb")
+	defer release(databases)
+	databases.ValidateSize(map[uint64]int{0: 1})
+	var zset = databases[0].ValidateZsetObject("zset", 5)
+	assert.Must(floatEqual(zset["one"], 1))
+	assert.Must(floatEqual(zset["two"], 2.5))
+	assert.Must(floatEqual(zset["neg"], -3.25))
+	assert.Must(floatEqual(zset["big"], 1<<40))
+	assert.Must(math.IsInf(zset["inf"], 1))
+	assert.Must(databases[0]["zset"].RDBType == rdb.RDB_TYPE_ZSET_LISTPACK)
+}
+
+func TestSetAsListpack(t *testing.T) {
+	databases := loadFromFile("set_listpack.rdb")
+	defer release(databases)
+	databases.ValidateSize(map[uint64]int{0: 1})
+	var set = databases[0].ValidateSetObject("set", 5)
+	for _, member := range []string{"alpha", "beta", "7", "-70000", strings.Repeat("gamma", 20)} {
+		assert.Must(set[member])
+	}
+	assert.Must(databases[0]["set"].RDBType == rdb.RDB_TYPE_SET_LISTPACK)
+}
+
+func TestListAsQuicklist2(t *testing.T) {
+	databases := loadFromFile("list_quicklist_2.rdb")
+	defer release(databases)
+	databases.ValidateSize(map[uint64]int{0: 2})
+	databases[0].ValidateStringObject("string", "value")
+	var list = databases[0].ValidateListObject("list", 7)
+	var expected = []string{"1", "two", "3", strings.Repeat("x", 300), "four", "-5", "8589934592"}
+	for i := range expected {
+		assert.Must(list[i] == expected[i])
+	}
+	assert.Must(databases[0]["list"].Expire == 1671963072573*time.Millisecond)
+	assert.Must(databases[0]["string"].Expire == rdb.NoExpire)
+	assert.Must(databases[0]["list"].RDBType == rdb.RDB_TYPE_LIST_QUICKLIST_2)
+	assert.Must(databases[0]["string"].RDBType == rdb.RDB_TYPE_STRING)
+}
+
+func TestStreamListpacks3(t *testing.T) {
+	databases := loadFromFile("stream_listpacks_3.rdb")
+	defer release(databases)
+	databases.ValidateSize(map[uint64]int{0: 1})
+
+	const ms = 1700000000000
+	var entries = databases[0].ValidateStreamObject("stream", 2)
+	assert.Must(entries[0].ID == rdb.RedisStreamID{Ms: ms, Seq: 0})
+	assert.Must(entries[1].ID == rdb.RedisStreamID{Ms: ms + 5, Seq: 0})
+	assert.Must(entries[1].Values[0].String() == "3")
+
+	var groups = databases[0]["stream"].Value.AsStream().Groups()
+	assert.Must(len(groups) == 1 && groups[0].Name == "grp")
+	assert.Must(len(groups[0].Pending) == 1 && groups[0].Pending[0].DeliveryCount == 4)
+	assert.Must(len(groups[0].Consumers) == 1)
+	assert.Must(groups[0].Consumers[0].Name == "worker")
+	assert.Must(groups[0].Consumers[0].SeenTime == (ms+200)*time.Millisecond)
+	assert.Must(groups[0].EntriesRead == 1)
+
+	var meta = databases[0]["stream"].Value.AsStream().Meta()
+	assert.Must(meta != nil && meta.EntriesAdded == 3)
+	assert.Must(meta.FirstID == rdb.RedisStreamID{Ms: ms, Seq: 0})
+	assert.Must(meta.MaxDeletedID == rdb.RedisStreamID{Ms: ms, Seq: 1})
+
+	// Payloads of DUMP don't carry the metadata.
+	var payload = databases[0]["stream"].Value.CreateDumpPayload()
+	var o = rdb.DecodeFromPayload([]byte(payload))
+	defer o.DecrRefCount()
+	assert.Must(o.AsStream().Meta() == nil)
+	assert.Must(len(o.AsStream().Groups()) == 1 && o.AsStream().Groups()[0].EntriesRead == -1)
+}
+
 func TestListDecode(t *testing.T) {
 	databases := loadFromFile("list_decode.rdb")
 	defer release(databases)
@@ -404,6 +611,84 @@ func TestListDecode(t *testing.T) {
 	}
 }
 
+func TestKeyFilter(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("testing", "*.rdb"))
+	assert.MustNoError(err)
+	assert.Must(len(files) != 0)
+	for _, file := range files {
+		databases := loadFromFile(filepath.Base(file))
+		// Keys are accepted alternately, the skipped values must be walked
+		// over exactly for the following keys and the checksum.
+		for parity := 0; parity < 2; parity++ {
+			var expected = make(DatabaseSet)
+			var n int
+			loader := newLoaderFromFile(filepath.Base(file))
+			loader.SetKeyFilter(func(db uint64, key []byte) bool {
+				n++
+				if n%2 != parity {
+					return false
+				}
+				if expected[db] == nil {
+					expected[db] = make(Database)
+				}
+				expected[db][string(key)] = databases[db][string(key)]
+				return true
+			})
+			filtered := loadFromLoader(loader)
+			assert.Must(len(filtered) == len(expected))
+			for db, entries := range expected {
+				filtered[db].ValidateSameAs(entries)
+			}
+			release(filtered)
+		}
+		release(databases)
+	}
+}
+
+func TestSeek(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("testing", "*.rdb"))
+	assert.MustNoError(err)
+	assert.Must(len(files) != 0)
+	for _, file := range files {
+		var entries []*rdb.DBEntry
+		var first = make(map[uint64]*rdb.DBEntry)
+		loader := newLoaderFromFile(filepath.Base(file))
+		assert.MustNoError(loader.Header())
+		_, err := loader.ForEach(func(e *rdb.DBEntry) bool {
+			entries = append(entries, e.IncrRefCount())
+			if first[e.DB] == nil {
+				first[e.DB] = e
+			}
+			return true
+		})
+		assert.MustNoError(err)
+		assert.MustNoError(loader.Footer())
+
+		var selectdb = loader.SelectDB()
+		for db, e := range first {
+			assert.Must(selectdb[db] > 0 && selectdb[db] < e.Offset)
+		}
+		var seek = func(offset int64, db uint64, expected *rdb.DBEntry) {
+			loader := newLoaderFromFile(filepath.Base(file))
+			assert.MustNoError(loader.SeekTo(offset, db))
+			e, err := loader.Next()
+			assert.MustNoError(err)
+			assert.Must(e != nil && e.Offset == expected.Offset)
+			Database{e.Key.String(): e}.ValidateSameAs(Database{expected.Key.String(): expected})
+			e.DecrRefCount()
+		}
+		for _, e := range entries {
+			seek(e.Offset, e.DB, e)
+		}
+		for db, e := range first {
+			seek(selectdb[db], 0, e)
+		}
+		for _, e := range entries {
+			e.DecrRefCount()
+		}
+	}
+}
+
 func BenchmarkListIterator(b *testing.B) {
 	databases := loadFromFile("list_decode.rdb")
 	defer release(databases)
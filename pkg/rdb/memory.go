@@ -0,0 +1,368 @@
+package rdb
+
+import (
+	"strconv"
+)
+
+// The memory usage is estimated for a 64-bit redis with jemalloc, like the
+// memory profiler of redis-rdb-tools, from the type, the encoding and the
+// elements of the object.
+const (
+	memPointerSize   = 8
+	memRobjSize      = 16
+	memDictEntrySize = 24
+	memDictSize      = 96
+
+	memZiplistHeaderSize  = 11
+	memListpackHeaderSize = 7
+	memQuicklistSize      = 40
+	memQuicklistNodeSize  = 32
+	memQuicklistFill      = 8192
+
+	memSkiplistSize     = 32
+	memSkiplistNodeSize = 24
+	memSkiplistLevel    = 16
+
+	memStreamSize          = 64
+	memStreamNodeEntries   = 100
+	memStreamNodeSize      = 48
+	memStreamGroupSize     = 48
+	memStreamConsumerSize  = 40
+	memStreamNACKSize      = 24
+	memStreamRaxEntrySize  = 40
+	memStreamEntryOverhead = 3
+)
+
+// MemoryUsage is the estimated memory usage of an entry.
+type MemoryUsage struct {
+	// Size includes the key, the value and the expire.
+	Size int64
+
+	// Elements is the number of elements, fields of hashes, members of sets
+	// and zsets, or entries of streams.
+	Elements int
+
+	// LargestElement is the largest element of lists, the largest field of
+	// hashes, the largest member of sets and zsets, or the id of the largest
+	// entry of streams. The size of hash fields includes their values.
+	LargestElement     []byte
+	LargestElementSize int64
+}
+
+func (u *MemoryUsage) element(name func() []byte, size int64) {
+	u.Elements++
+	if u.Elements == 1 || size > u.LargestElementSize {
+		u.LargestElement, u.LargestElementSize = name(), size
+	}
+}
+
+// MemoryUsage returns the estimated memory usage of the entry in redis.
+func (e *DBEntry) MemoryUsage() *MemoryUsage {
+	var u = &MemoryUsage{}
+	u.Size = memPointerSize + mallocSize(memDictEntrySize) + sdsSize(len(e.Key.BytesUnsafe()))
+	if e.Expire != NoExpire {
+		u.Size += memPointerSize + mallocSize(memDictEntrySize)
+	}
+	if e.Module != nil {
+		u.Size += mallocSize(memRobjSize) + mallocSize(int64(e.Module.Len()))
+		return u
+	}
+	u.Size += mallocSize(memRobjSize)
+	switch o := e.Value; o.Type() {
+	case OBJ_STRING:
+		var sds = o.AsString().RedisSds()
+		var n = len(sds.BytesUnsafe())
+		u.element(func() []byte { return nil }, int64(n))
+		switch o.Encoding() {
+		case OBJ_ENCODING_INT:
+		case OBJ_ENCODING_EMBSTR:
+			u.Size += mallocSize(memRobjSize+3+int64(n)+1) - mallocSize(memRobjSize)
+		default:
+			u.Size += sdsSize(n)
+		}
+	case OBJ_LIST:
+		u.Size += memoryOfList(o.AsList(), u)
+	case OBJ_HASH:
+		u.Size += memoryOfHash(o.AsHash(), u)
+	case OBJ_SET:
+		u.Size += memoryOfSet(o.AsSet(), u)
+	case OBJ_ZSET:
+		u.Size += memoryOfZset(o.AsZset(), u)
+	case OBJ_STREAM:
+		u.Size += memoryOfStream(o.AsStream(), u)
+	}
+	return u
+}
+
+func memoryOfList(o *RedisListObject, u *MemoryUsage) int64 {
+	var size = mallocSize(memQuicklistSize)
+	var node int64
+	var flush = func() {
+		if node != 0 {
+			size += mallocSize(memQuicklistNodeSize) + mallocSize(memZiplistHeaderSize+node+1)
+		}
+		node = 0
+	}
+	o.ForEach(func(iter *RedisListIterator, step int) bool {
+		var elem = iter.Next()
+		if elem == nil {
+			return false
+		}
+		var b = elem.BytesUnsafe()
+		u.element(elem.Bytes, int64(len(b)))
+		var n = ziplistEntrySize(elem)
+		if node != 0 && node+n > memQuicklistFill {
+			flush()
+		}
+		node += n
+		return true
+	})
+	flush()
+	return size
+}
+
+func memoryOfHash(o *RedisHashObject, u *MemoryUsage) int64 {
+	var ziplist = o.Encoding() == OBJ_ENCODING_ZIPLIST
+	var size int64
+	o.ForEach(func(iter *RedisHashIterator, step int) bool {
+		var field, value = iter.Next()
+		if field == nil {
+			return false
+		}
+		var f, v = field.BytesUnsafe(), value.BytesUnsafe()
+		u.element(field.Bytes, int64(len(f)+len(v)))
+		if ziplist {
+			size += ziplistEntrySize(field) + ziplistEntrySize(value)
+		} else {
+			size += sdsSize(len(f)) + sdsSize(len(v))
+		}
+		return true
+	})
+	if ziplist {
+		return mallocSize(memZiplistHeaderSize + size + 1)
+	}
+	return dictSize(u.Elements) + size
+}
+
+func memoryOfSet(o *RedisSetObject, u *MemoryUsage) int64 {
+	var intset = o.Encoding() == OBJ_ENCODING_INTSET
+	var size, width int64 = 0, 2
+	o.ForEach(func(iter *RedisSetIterator, step int) bool {
+		var member = iter.Next()
+		if member == nil {
+			return false
+		}
+		var b = member.BytesUnsafe()
+		u.element(member.Bytes, int64(len(b)))
+		if !intset {
+			size += sdsSize(len(b))
+		} else if v, ok := sdsInteger(member); ok {
+			switch {
+			case v < -1<<31 || v > 1<<31-1:
+				width = 8
+			case (v < -1<<15 || v > 1<<15-1) && width < 4:
+				width = 4
+			}
+		}
+		return true
+	})
+	if intset {
+		return mallocSize(8 + int64(u.Elements)*width)
+	}
+	return dictSize(u.Elements) + size
+}
+
+func memoryOfZset(o *RedisZsetObject, u *MemoryUsage) int64 {
+	var ziplist = o.Encoding() == OBJ_ENCODING_ZIPLIST
+	var size int64
+	o.ForEach(func(iter *RedisZsetIterator, step int) bool {
+		var member = iter.Next()
+		if member == nil {
+			return false
+		}
+		var b = member.BytesUnsafe()
+		u.element(member.Bytes, int64(len(b)))
+		if ziplist {
+			var score = strconv.FormatFloat(member.Score, 'g', 17, 64)
+			size += ziplistEntrySize(member) + ziplistStringSize(len(score))
+		} else {
+			// The average level of skiplist nodes is 4/3.
+			size += sdsSize(len(b)) + mallocSize(memSkiplistNodeSize+memSkiplistLevel*4/3)
+		}
+		return true
+	})
+	if ziplist {
+		return mallocSize(memZiplistHeaderSize + size + 1)
+	}
+	return mallocSize(memPointerSize*2) + dictSize(u.Elements) + mallocSize(memSkiplistSize) +
+		mallocSize(memSkiplistNodeSize+memSkiplistLevel*32) + size
+}
+
+func memoryOfStream(o *RedisStreamObject, u *MemoryUsage) int64 {
+	var size = mallocSize(memStreamSize)
+	var node, entries int64
+	var flush = func() {
+		if entries != 0 {
+			size += mallocSize(memStreamNodeSize) + mallocSize(memListpackHeaderSize+node+1)
+		}
+		node, entries = 0, 0
+	}
+	o.ForEach(func(iter *RedisStreamIterator, step int) bool {
+		var entry = iter.Next()
+		if entry == nil {
+			return false
+		}
+		var n, lp = int64(0), int64(memStreamEntryOverhead)
+		for i := range entry.Fields {
+			n += int64(len(entry.Fields[i].BytesUnsafe()) + len(entry.Values[i].BytesUnsafe()))
+			lp += listpackEntrySize(entry.Fields[i]) + listpackEntrySize(entry.Values[i])
+		}
+		u.element(func() []byte { return []byte(entry.ID.String()) }, n)
+		if entries == memStreamNodeEntries {
+			flush()
+		}
+		node, entries = node+lp, entries+1
+		return true
+	})
+	flush()
+	for _, g := range o.Groups() {
+		size += mallocSize(memStreamGroupSize) + sdsSize(len(g.Name))
+		size += int64(len(g.Pending)) * (mallocSize(memStreamNACKSize) + memStreamRaxEntrySize)
+		for _, c := range g.Consumers {
+			size += mallocSize(memStreamConsumerSize) + sdsSize(len(c.Name))
+			size += int64(len(c.Pending)) * memStreamRaxEntrySize
+		}
+	}
+	return size
+}
+
+// mallocSize returns the size of the jemalloc size class of n bytes.
+func mallocSize(n int64) int64 {
+	switch {
+	case n <= 0:
+		return 0
+	case n <= 8:
+		return 8
+	case n <= 128:
+		return (n + 15) &^ 15
+	}
+	var step int64 = 32
+	for step*4 < n-1 {
+		step *= 2
+	}
+	return (n + step - 1) / step * step
+}
+
+func sdsSize(n int) int64 {
+	var header int64
+	switch l := int64(n); {
+	case l < 1<<5:
+		header = 1
+	case l < 1<<8:
+		header = 3
+	case l < 1<<16:
+		header = 5
+	case l < 1<<32:
+		header = 9
+	default:
+		header = 17
+	}
+	return mallocSize(header + int64(n) + 1)
+}
+
+func dictSize(n int) int64 {
+	var buckets int64 = 4
+	for buckets < int64(n) {
+		buckets *= 2
+	}
+	return mallocSize(memDictSize) + mallocSize(buckets*memPointerSize) + int64(n)*mallocSize(memDictEntrySize)
+}
+
+// sdsInteger returns the value if the sds is stored as an integer by redis.
+func sdsInteger(p *RedisSds) (int64, bool) {
+	if p.IsInteger() {
+		return p.AsInteger(), true
+	}
+	var b = p.BytesUnsafe()
+	if len(b) == 0 || len(b) > 20 {
+		return 0, false
+	}
+	v, err := strconv.ParseInt(string(b), 10, 64)
+	if err != nil || strconv.FormatInt(v, 10) != string(b) {
+		return 0, false
+	}
+	return v, true
+}
+
+func ziplistEntrySize(p *RedisSds) int64 {
+	if v, ok := sdsInteger(p); ok {
+		switch {
+		case v >= 0 && v <= 12:
+			return 2
+		case v >= -1<<7 && v < 1<<7:
+			return 3
+		case v >= -1<<15 && v < 1<<15:
+			return 4
+		case v >= -1<<23 && v < 1<<23:
+			return 5
+		case v >= -1<<31 && v < 1<<31:
+			return 6
+		default:
+			return 10
+		}
+	}
+	return ziplistStringSize(len(p.BytesUnsafe()))
+}
+
+// ziplistStringSize includes the prevlen, which is 1 byte for most entries.
+func ziplistStringSize(n int) int64 {
+	switch {
+	case n < 1<<6:
+		return 1 + 1 + int64(n)
+	case n < 1<<14:
+		return 1 + 2 + int64(n)
+	default:
+		return 5 + 5 + int64(n)
+	}
+}
+
+func listpackEntrySize(p *RedisSds) int64 {
+	var n int64
+	if v, ok := sdsInteger(p); ok {
+		switch {
+		case v >= 0 && v < 1<<7:
+			n = 1
+		case v >= -1<<12 && v < 1<<12:
+			n = 2
+		case v >= -1<<15 && v < 1<<15:
+			n = 3
+		case v >= -1<<23 && v < 1<<23:
+			n = 4
+		case v >= -1<<31 && v < 1<<31:
+			n = 5
+		default:
+			n = 9
+		}
+	} else {
+		switch l := int64(len(p.BytesUnsafe())); {
+		case l < 1<<6:
+			n = 1 + l
+		case l < 1<<12:
+			n = 2 + l
+		default:
+			n = 5 + l
+		}
+	}
+	switch {
+	case n < 1<<7:
+		return n + 1
+	case n < 1<<14:
+		return n + 2
+	case n < 1<<21:
+		return n + 3
+	case n < 1<<28:
+		return n + 4
+	default:
+		return n + 5
+	}
+}
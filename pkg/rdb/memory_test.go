@@ -0,0 +1,49 @@
+package rdb_test
+
+import (
+	"testing"
+
+	"github.com/CodisLabs/redis-port/pkg/rdb"
+
+	"github.com/CodisLabs/codis/pkg/utils/assert"
+)
+
+func TestMemoryUsageIntset(t *testing.T) {
+	databases := loadFromFile("intset_16.rdb")
+	defer release(databases)
+	var u = databases[0]["intset_16"].MemoryUsage()
+	// bucket 8 + dictEntry 32 + key 16 + robj 16 + intset 16
+	assert.Must(u.Size == 88)
+	assert.Must(u.Elements == 3)
+	assert.Must(u.LargestElementSize == 5)
+}
+
+func TestMemoryUsageHash(t *testing.T) {
+	databases := loadFromFile("hash_as_ziplist.rdb")
+	defer release(databases)
+	var u = databases[0]["zipmap_compresses_easily"].MemoryUsage()
+	assert.Must(u.Elements == 3)
+	assert.Must(string(u.LargestElement) == "aaaaa")
+	assert.Must(u.LargestElementSize == 19)
+}
+
+func TestMemoryUsageEncoding(t *testing.T) {
+	ziplist := loadFromFile("sorted_set_as_ziplist.rdb")
+	defer release(ziplist)
+	skiplist := loadFromFile("regular_sorted_set.rdb")
+	defer release(skiplist)
+	var u1 = ziplist[0]["sorted_set_as_ziplist"].MemoryUsage()
+	var u2 = skiplist[0]["force_sorted_set"].MemoryUsage()
+	assert.Must(u1.Elements == 3 && u2.Elements == 500)
+	assert.Must(u1.Size/int64(u1.Elements) < u2.Size/int64(u2.Elements))
+}
+
+func TestMemoryUsageExpire(t *testing.T) {
+	databases := loadFromFile("keys_with_expiry.rdb")
+	defer release(databases)
+	var e = databases[0]["expires_ms_precision"]
+	var u = e.MemoryUsage()
+	var x = *e
+	x.Expire = rdb.NoExpire
+	assert.Must(u.Size > x.MemoryUsage().Size)
+}
@@ -0,0 +1,93 @@
+package rdb
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+const (
+	RDB_MODULE_OPCODE_EOF    = 0
+	RDB_MODULE_OPCODE_SINT   = 1
+	RDB_MODULE_OPCODE_UINT   = 2
+	RDB_MODULE_OPCODE_FLOAT  = 3
+	RDB_MODULE_OPCODE_DOUBLE = 4
+	RDB_MODULE_OPCODE_STRING = 5
+)
+
+const moduleNameCharset = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_"
+
+// RedisModuleObject keeps a module value as it was serialized, the loader
+// doesn't need the module to walk over it.
+type RedisModuleObject struct {
+	ID      uint64
+	Name    string
+	Version int
+
+	Raw []byte // module id and the serialized value
+}
+
+func decodeModuleName(id uint64) string {
+	var name = make([]byte, 9)
+	id >>= 10
+	for i := len(name) - 1; i >= 0; i-- {
+		name[i] = moduleNameCharset[id&63]
+		id >>= 6
+	}
+	return string(name)
+}
+
+func (m *RedisModuleObject) Len() int {
+	return len(m.Raw)
+}
+
+// CreateDumpPayload wraps the module value into the format of DUMP/RESTORE.
+func (m *RedisModuleObject) CreateDumpPayload() []byte {
+	var b = make([]byte, 0, len(m.Raw)+11)
+	b = append(b, byte(RDB_TYPE_MODULE_2))
+	b = append(b, m.Raw...)
+	b = append(b, byte(RDB_VERSION), byte(RDB_VERSION>>8))
+	var footer [8]byte
+	binary.LittleEndian.PutUint64(footer[:], crc64Update(0, b))
+	return append(b, footer[:]...)
+}
+
+func (r *rawReader) skipOpcodes(id uint64) {
+	for {
+		opcode, _ := r.loadLen()
+		switch opcode {
+		case RDB_MODULE_OPCODE_EOF:
+			return
+		case RDB_MODULE_OPCODE_SINT, RDB_MODULE_OPCODE_UINT:
+			r.loadLen()
+		case RDB_MODULE_OPCODE_FLOAT:
+			r.readFull(4)
+		case RDB_MODULE_OPCODE_DOUBLE:
+			r.readFull(8)
+		case RDB_MODULE_OPCODE_STRING:
+			r.skipString()
+		default:
+			r.rio.throwf("Unknown module opcode = %d, module = %s.", opcode, decodeModuleName(id))
+		}
+	}
+}
+
+func (l *Loader) loadModuleObject(typ int) *RedisModuleObject {
+	if typ != RDB_TYPE_MODULE_2 {
+		throwError(l.rio.Offset(), ErrUnsupportedType, "Don't support module object without opcodes (RDB_TYPE_MODULE).")
+	}
+	var r = &rawReader{rio: &l.rio, buf: &bytes.Buffer{}}
+	id, _ := r.loadLen()
+	r.skipOpcodes(id)
+	return &RedisModuleObject{
+		ID: id, Name: decodeModuleName(id), Version: int(id & 1023),
+		Raw: r.buf.Bytes(),
+	}
+}
+
+// Module aux data is framed by the same opcodes, the `when` field goes
+// first as an unsigned integer.
+func (l *Loader) skipModuleAux() {
+	var r = &rawReader{rio: &l.rio}
+	id, _ := r.loadLen()
+	r.skipOpcodes(id)
+}
@@ -0,0 +1,11 @@
+package rdb
+
+import (
+	"testing"
+
+	"github.com/CodisLabs/codis/pkg/utils/assert"
+)
+
+func TestDecodeModuleName(t *testing.T) {
+	assert.Must(decodeModuleName(0x45e25238df912c03) == "ReJSON-RL")
+}
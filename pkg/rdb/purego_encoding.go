@@ -0,0 +1,328 @@
+//go:build purego
+// +build purego
+
+package rdb
+
+import (
+	"encoding/binary"
+	"strconv"
+)
+
+const (
+	quicklistContainerPlain  = 1
+	quicklistContainerPacked = 2
+)
+
+const (
+	streamItemFlagDeleted    = 1
+	streamItemFlagSameFields = 2
+)
+
+// blobReader walks over a serialized ziplist, listpack, zipmap or intset,
+// running out of the blob means the RDB is corrupted.
+type blobReader struct {
+	name string
+	b    []byte
+	p    int
+}
+
+func (r *blobReader) next(n int) []byte {
+	if n < 0 || n > len(r.b)-r.p {
+		throwError(-1, ErrCorrupted, "Invalid %s, read %d bytes at %d of %d.", r.name, n, r.p, len(r.b))
+	}
+	var b = r.b[r.p : r.p+n]
+	r.p += n
+	return b
+}
+
+func (r *blobReader) peek() byte {
+	if r.p >= len(r.b) {
+		throwError(-1, ErrCorrupted, "Invalid %s, missing terminator.", r.name)
+	}
+	return r.b[r.p]
+}
+
+// allocHint bounds the capacity that is preallocated for n elements, n is
+// read from the RDB and can't be trusted.
+func allocHint(n uint64, limit int) int {
+	if n > uint64(limit) {
+		return limit
+	}
+	return int(n)
+}
+
+func (r *blobReader) int64(n int) int64 {
+	var b = r.next(n)
+	var v uint64
+	for i := n - 1; i >= 0; i-- {
+		v = v<<8 | uint64(b[i])
+	}
+	// sign extension of the n bytes little endian integer
+	var shift = uint(64 - n*8)
+	return int64(v<<shift) >> shift
+}
+
+func decodeZiplist(zl []byte) []*RedisSds {
+	var r = &blobReader{name: "ziplist", b: zl}
+	var n = binary.LittleEndian.Uint16(r.next(10)[8:])
+	var elems = make([]*RedisSds, 0, allocHint(uint64(n), len(zl)/2))
+	for r.peek() != 0xff {
+		if r.next(1)[0] == 0xfe {
+			r.next(4)
+		}
+		var enc = r.next(1)[0]
+		switch enc >> 6 {
+		case 0:
+			elems = append(elems, newRedisSds(r.next(int(enc&0x3f))))
+			continue
+		case 1:
+			var n = int(enc&0x3f)<<8 | int(r.next(1)[0])
+			elems = append(elems, newRedisSds(r.next(n)))
+			continue
+		case 2:
+			var n = binary.BigEndian.Uint32(r.next(4))
+			elems = append(elems, newRedisSds(r.next(int(n))))
+			continue
+		}
+		var v int64
+		switch enc {
+		case 0xc0:
+			v = r.int64(2)
+		case 0xd0:
+			v = r.int64(4)
+		case 0xe0:
+			v = r.int64(8)
+		case 0xf0:
+			v = r.int64(3)
+		case 0xfe:
+			v = r.int64(1)
+		default:
+			if enc < 0xf1 || enc > 0xfd {
+				throwError(-1, ErrCorrupted, "Invalid ziplist encoding = %#x.", enc)
+			}
+			v = int64(enc&0x0f) - 1
+		}
+		elems = append(elems, newRedisSdsInteger(v))
+	}
+	return elems
+}
+
+func decodeListpack(lp []byte) []*RedisSds {
+	var r = &blobReader{name: "listpack", b: lp}
+	var n = binary.LittleEndian.Uint16(r.next(6)[4:])
+	var elems = make([]*RedisSds, 0, allocHint(uint64(n), len(lp)/2))
+	for r.peek() != 0xff {
+		var start = r.p
+		var enc = r.next(1)[0]
+		switch {
+		case enc&0x80 == 0:
+			elems = append(elems, newRedisSdsInteger(int64(enc&0x7f)))
+		case enc&0xc0 == 0x80:
+			elems = append(elems, newRedisSds(r.next(int(enc&0x3f))))
+		case enc&0xe0 == 0xc0:
+			var v = int64(enc&0x1f)<<8 | int64(r.next(1)[0])
+			elems = append(elems, newRedisSdsInteger(v<<51>>51))
+		case enc&0xf0 == 0xe0:
+			var n = int(enc&0x0f)<<8 | int(r.next(1)[0])
+			elems = append(elems, newRedisSds(r.next(n)))
+		case enc == 0xf0:
+			var n = binary.LittleEndian.Uint32(r.next(4))
+			elems = append(elems, newRedisSds(r.next(int(n))))
+		case enc == 0xf1:
+			elems = append(elems, newRedisSdsInteger(r.int64(2)))
+		case enc == 0xf2:
+			elems = append(elems, newRedisSdsInteger(r.int64(3)))
+		case enc == 0xf3:
+			elems = append(elems, newRedisSdsInteger(r.int64(4)))
+		case enc == 0xf4:
+			elems = append(elems, newRedisSdsInteger(r.int64(8)))
+		default:
+			throwError(-1, ErrCorrupted, "Invalid listpack encoding = %#x.", enc)
+		}
+		// skip the backlen, it's only used to iterate backwards
+		switch l := r.p - start; {
+		case l <= 127:
+			r.next(1)
+		case l < 16383:
+			r.next(2)
+		case l < 2097151:
+			r.next(3)
+		case l < 268435455:
+			r.next(4)
+		default:
+			r.next(5)
+		}
+	}
+	return elems
+}
+
+func decodeZipmap(zm []byte) []*RedisSds {
+	var r = &blobReader{name: "zipmap", b: zm}
+	var load = func() int {
+		switch n := r.next(1)[0]; n {
+		case 254:
+			return int(binary.LittleEndian.Uint32(r.next(4)))
+		case 255:
+			throwError(-1, ErrCorrupted, "Invalid zipmap, unexpected terminator.")
+		default:
+			return int(n)
+		}
+		return 0
+	}
+	var elems []*RedisSds
+	for r.next(1); r.peek() != 0xff; {
+		elems = append(elems, newRedisSds(r.next(load())))
+		var n = load()
+		var free = int(r.next(1)[0])
+		elems = append(elems, newRedisSds(r.next(n)))
+		r.next(free)
+	}
+	return elems
+}
+
+func decodeIntset(is []byte) []*RedisSds {
+	var r = &blobReader{name: "intset", b: is}
+	var size = int(binary.LittleEndian.Uint32(r.next(4)))
+	switch size {
+	case 2, 4, 8:
+	default:
+		throwError(-1, ErrCorrupted, "Invalid intset encoding = %d.", size)
+	}
+	var n = int(binary.LittleEndian.Uint32(r.next(4)))
+	if n > (len(is)-8)/size {
+		throwError(-1, ErrCorrupted, "Invalid intset length = %d.", n)
+	}
+	var elems = make([]*RedisSds, 0, n)
+	for i := 0; i < n; i++ {
+		elems = append(elems, newRedisSdsInteger(r.int64(size)))
+	}
+	return elems
+}
+
+// decodeScores folds the member, score pairs of a ziplist or listpack.
+func decodeScores(pairs []*RedisSds) []*RedisSds {
+	if len(pairs)%2 != 0 {
+		throwError(-1, ErrCorrupted, "Invalid zset, %d elements.", len(pairs))
+	}
+	var elems = make([]*RedisSds, 0, len(pairs)/2)
+	for i := 0; i < len(pairs); i += 2 {
+		var member, score = pairs[i], pairs[i+1]
+		if score.IsInteger() {
+			member.Score = float64(score.Value)
+		} else {
+			f, err := strconv.ParseFloat(score.StringUnsafe(), 64)
+			if err != nil {
+				throwError(-1, ErrCorrupted, "Invalid zset score = %q.", score.String())
+			}
+			member.Score = f
+		}
+		elems = append(elems, member)
+	}
+	return elems
+}
+
+func lzfDecompress(in []byte, n uint64) []byte {
+	var out = make([]byte, 0, allocHint(n, len(in)*4))
+	for i := 0; i < len(in); {
+		var ctrl = int(in[i])
+		i++
+		if ctrl < 32 {
+			ctrl++
+			if i+ctrl > len(in) || uint64(len(out)+ctrl) > n {
+				throwError(-1, ErrCorrupted, "Invalid LZF literal run.")
+			}
+			out = append(out, in[i:i+ctrl]...)
+			i += ctrl
+			continue
+		}
+		var length = ctrl >> 5
+		if length == 7 {
+			if i >= len(in) {
+				throwError(-1, ErrCorrupted, "Invalid LZF back reference.")
+			}
+			length += int(in[i])
+			i++
+		}
+		if i >= len(in) {
+			throwError(-1, ErrCorrupted, "Invalid LZF back reference.")
+		}
+		var ref = len(out) - (ctrl&0x1f)<<8 - int(in[i]) - 1
+		i++
+		length += 2
+		if ref < 0 || uint64(len(out)+length) > n {
+			throwError(-1, ErrCorrupted, "Invalid LZF back reference.")
+		}
+		for j := 0; j < length; j++ {
+			out = append(out, out[ref+j])
+		}
+	}
+	if uint64(len(out)) != n {
+		throwError(-1, ErrCorrupted, "Invalid LZF length = %d, expected = %d.", len(out), n)
+	}
+	return out
+}
+
+type streamListpackCursor struct {
+	elems []*RedisSds
+	index int
+}
+
+func (c *streamListpackCursor) next() *RedisSds {
+	if c.index >= len(c.elems) {
+		throwError(-1, ErrCorrupted, "Invalid stream listpack, %d elements.", len(c.elems))
+	}
+	c.index++
+	return c.elems[c.index-1]
+}
+
+func (c *streamListpackCursor) int64() int64 {
+	var sds = c.next()
+	if sds.IsInteger() {
+		return sds.Value
+	}
+	v, err := strconv.ParseInt(sds.StringUnsafe(), 10, 64)
+	if err != nil {
+		throwError(-1, ErrCorrupted, "Invalid stream listpack integer = %q.", sds.String())
+	}
+	return v
+}
+
+// decodeStreamListpack decodes the entries of a stream node, IDs and fields
+// are delta-encoded to the master entry which goes first.
+func decodeStreamListpack(master RedisStreamID, lp []byte) []*RedisStreamEntry {
+	var c = &streamListpackCursor{elems: decodeListpack(lp)}
+	var count = c.int64() + c.int64()
+	var n = c.int64()
+	if n < 0 || n > int64(len(c.elems)-c.index) {
+		throwError(-1, ErrCorrupted, "Invalid stream listpack, %d master fields.", n)
+	}
+	var fields = make([]*RedisSds, n)
+	for i := range fields {
+		fields[i] = c.next()
+	}
+	c.int64() // the master entry terminator
+
+	var entries []*RedisStreamEntry
+	for ; count > 0; count-- {
+		var flags = c.int64()
+		var entry = &RedisStreamEntry{}
+		entry.ID.Ms = master.Ms + uint64(c.int64())
+		entry.ID.Seq = master.Seq + uint64(c.int64())
+		if flags&streamItemFlagSameFields != 0 {
+			for _, field := range fields {
+				entry.Fields = append(entry.Fields, field)
+				entry.Values = append(entry.Values, c.next())
+			}
+		} else {
+			for n := c.int64(); n > 0; n-- {
+				entry.Fields = append(entry.Fields, c.next())
+				entry.Values = append(entry.Values, c.next())
+			}
+		}
+		c.int64() // lp-count
+		if flags&streamItemFlagDeleted == 0 {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
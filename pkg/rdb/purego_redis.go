@@ -0,0 +1,479 @@
+//go:build purego
+// +build purego
+
+package rdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
+	"unsafe"
+
+	"github.com/CodisLabs/codis/pkg/utils/bytesize"
+	"github.com/CodisLabs/codis/pkg/utils/log"
+	"github.com/CodisLabs/codis/pkg/utils/sync2/atomic2"
+)
+
+var DefaultLazyfree = false
+
+type ZmallocMemStats struct {
+	MemoryUsed bytesize.Int64
+	Rss        bytesize.Int64
+	MemorySize bytesize.Int64
+}
+
+// ReadZmallocMemStats reports the Go heap, there is no zmalloc without cgo.
+func ReadZmallocMemStats() *ZmallocMemStats {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	return &ZmallocMemStats{
+		MemoryUsed: bytesize.Int64(stats.HeapAlloc),
+		Rss:        bytesize.Int64(stats.Sys),
+	}
+}
+
+const (
+	RDB_VERSION     = int64(9)
+	RDB_VERSION_MAX = int64(12)
+)
+
+const (
+	RDB_OPCODE_AUX           = int(250)
+	RDB_OPCODE_EOF           = int(255)
+	RDB_OPCODE_EXPIRETIME    = int(253)
+	RDB_OPCODE_EXPIRETIME_MS = int(252)
+	RDB_OPCODE_RESIZEDB      = int(251)
+	RDB_OPCODE_SELECTDB      = int(254)
+
+	RDB_OPCODE_SLOT_INFO       = int(244)
+	RDB_OPCODE_FUNCTION2       = int(245)
+	RDB_OPCODE_FUNCTION_PRE_GA = int(246)
+	RDB_OPCODE_MODULE_AUX      = int(247)
+	RDB_OPCODE_IDLE            = int(248)
+	RDB_OPCODE_FREQ            = int(249)
+
+	RDB_TYPE_STRING           = int(0)
+	RDB_TYPE_LIST             = int(1)
+	RDB_TYPE_SET              = int(2)
+	RDB_TYPE_ZSET             = int(3)
+	RDB_TYPE_HASH             = int(4)
+	RDB_TYPE_ZSET_2           = int(5)
+	RDB_TYPE_MODULE           = int(6)
+	RDB_TYPE_MODULE_2         = int(7)
+	RDB_TYPE_HASH_ZIPMAP      = int(9)
+	RDB_TYPE_LIST_ZIPLIST     = int(10)
+	RDB_TYPE_SET_INTSET       = int(11)
+	RDB_TYPE_ZSET_ZIPLIST     = int(12)
+	RDB_TYPE_HASH_ZIPLIST     = int(13)
+	RDB_TYPE_LIST_QUICKLIST   = int(14)
+	RDB_TYPE_STREAM_LISTPACKS = int(15)
+
+	RDB_TYPE_HASH_LISTPACK      = int(16)
+	RDB_TYPE_ZSET_LISTPACK      = int(17)
+	RDB_TYPE_LIST_QUICKLIST_2   = int(18)
+	RDB_TYPE_STREAM_LISTPACKS_2 = int(19)
+	RDB_TYPE_SET_LISTPACK       = int(20)
+	RDB_TYPE_STREAM_LISTPACKS_3 = int(21)
+)
+
+const (
+	OBJ_STRING = RedisType(0)
+	OBJ_LIST   = RedisType(1)
+	OBJ_SET    = RedisType(2)
+	OBJ_ZSET   = RedisType(3)
+	OBJ_HASH   = RedisType(4)
+	OBJ_MODULE = RedisType(5)
+	OBJ_STREAM = RedisType(6)
+)
+
+const (
+	OBJ_ENCODING_RAW        = RedisEncoding(0)
+	OBJ_ENCODING_INT        = RedisEncoding(1)
+	OBJ_ENCODING_HT         = RedisEncoding(2)
+	OBJ_ENCODING_ZIPMAP     = RedisEncoding(3)
+	OBJ_ENCODING_LINKEDLIST = RedisEncoding(4)
+	OBJ_ENCODING_ZIPLIST    = RedisEncoding(5)
+	OBJ_ENCODING_INTSET     = RedisEncoding(6)
+	OBJ_ENCODING_SKIPLIST   = RedisEncoding(7)
+	OBJ_ENCODING_EMBSTR     = RedisEncoding(8)
+	OBJ_ENCODING_QUICKLIST  = RedisEncoding(9)
+	OBJ_ENCODING_STREAM     = RedisEncoding(10)
+)
+
+// RedisSds points to memory owned by the Go heap, Ptr keeps it alive.
+type RedisSds struct {
+	Ptr   unsafe.Pointer
+	Len   int
+	Value int64
+	Score float64
+
+	IsLeak bool
+}
+
+var emptySds [1]byte
+
+func newRedisSds(b []byte) *RedisSds {
+	if len(b) == 0 {
+		return &RedisSds{Ptr: unsafe.Pointer(&emptySds[0])}
+	}
+	return &RedisSds{Ptr: unsafe.Pointer(&b[0]), Len: len(b)}
+}
+
+func newRedisSdsInteger(v int64) *RedisSds {
+	return &RedisSds{Value: v}
+}
+
+func (p *RedisSds) Release() {
+}
+
+func (p *RedisSds) IsPointer() bool {
+	return p.Ptr != nil
+}
+
+func (p *RedisSds) IsInteger() bool {
+	return p.Ptr == nil
+}
+
+func (p *RedisSds) AsInteger() int64 {
+	return p.Value
+}
+
+func (p *RedisSds) String() string {
+	if p.IsInteger() {
+		return strconv.FormatInt(p.Value, 10)
+	}
+	return string(p.BytesUnsafe())
+}
+
+func (p *RedisSds) Bytes() []byte {
+	if p.IsInteger() {
+		return strconv.AppendInt(make([]byte, 0, 32), p.Value, 10)
+	}
+	return append([]byte{}, p.BytesUnsafe()...)
+}
+
+func (p *RedisSds) StringUnsafe() string {
+	if p.IsInteger() {
+		return strconv.FormatInt(p.Value, 10)
+	}
+	var s string
+	var hdr = (*reflect.StringHeader)(unsafe.Pointer(&s))
+	hdr.Data, hdr.Len = uintptr(p.Ptr), p.Len
+	return s
+}
+
+func (p *RedisSds) BytesUnsafe() []byte {
+	if p.IsInteger() {
+		return strconv.AppendInt(make([]byte, 0, 32), p.Value, 10)
+	}
+	var b []byte
+	var hdr = (*reflect.SliceHeader)(unsafe.Pointer(&b))
+	hdr.Data, hdr.Len, hdr.Cap = uintptr(p.Ptr), p.Len, p.Len
+	return b
+}
+
+// RedisObject holds the decoded value, elements of lists, sets and zsets
+// are kept in order of the RDB, fields and values of hashes are interleaved.
+type RedisObject struct {
+	typ RedisType
+	enc RedisEncoding
+
+	sds    *RedisSds
+	elems  []*RedisSds
+	stream *redisStream
+
+	lazyfree bool
+	refcount atomic2.Int64
+}
+
+type redisStream struct {
+	length uint64
+	lastID RedisStreamID
+
+	entries []*RedisStreamEntry
+	groups  []*RedisStreamGroup
+
+	meta *RedisStreamMeta
+}
+
+func newRedisObject(typ RedisType, enc RedisEncoding) *RedisObject {
+	o := &RedisObject{typ: typ, enc: enc, refcount: atomic2.Int64(1)}
+	return o.SetLazyfree(DefaultLazyfree)
+}
+
+func newRedisStringObject(sds *RedisSds) *RedisObject {
+	var enc = OBJ_ENCODING_RAW
+	switch {
+	case sds.IsInteger():
+		enc = OBJ_ENCODING_INT
+	case sds.Len <= 44:
+		enc = OBJ_ENCODING_EMBSTR
+	}
+	o := newRedisObject(OBJ_STRING, enc)
+	o.sds = sds
+	return o
+}
+
+func (o *RedisObject) Type() RedisType {
+	return o.typ
+}
+
+func (o *RedisObject) Encoding() RedisEncoding {
+	return o.enc
+}
+
+func (o *RedisObject) SetLazyfree(enable bool) *RedisObject {
+	o.lazyfree = enable
+	return o
+}
+
+func (o *RedisObject) RefCount() int {
+	return o.refcount.AsInt()
+}
+
+func (o *RedisObject) IncrRefCount() *RedisObject {
+	switch after := o.refcount.Incr(); {
+	case after <= 1:
+		fallthrough
+	case after > 1024:
+		log.Panicf("Invalid IncrRefCount - [%d]", after-1)
+	}
+	return o
+}
+
+func (o *RedisObject) DecrRefCount() {
+	switch after := o.refcount.Decr(); {
+	case after == 0:
+		o.sds, o.elems, o.stream = nil, nil, nil
+	case after < 0:
+		log.Panicf("Invalid DecrRefCount - [%d]", after+1)
+	}
+}
+
+func (o *RedisObject) CreateDumpPayloadUnsafe() *RedisSds {
+	var b rdbEncoder
+	b.WriteByte(b.objectType(o))
+	b.writeObject(o)
+	var footer [10]byte
+	binary.LittleEndian.PutUint16(footer[0:], uint16(RDB_VERSION))
+	b.Write(footer[:2])
+	binary.LittleEndian.PutUint64(footer[2:], crc64Update(0, b.Bytes()))
+	b.Write(footer[2:])
+	return newRedisSds(b.Bytes())
+}
+
+func DecodeFromPayload(buf []byte) *RedisObject {
+	var n = len(buf)
+	if n < 11 || binary.LittleEndian.Uint64(buf[n-8:]) != crc64Update(0, buf[:n-8]) {
+		log.Panicf("Decode From Payload failed.")
+	}
+	if version := binary.LittleEndian.Uint16(buf[n-10:]); int64(version) > RDB_VERSION_MAX {
+		log.Panicf("Decode From Payload failed, version = %d.", version)
+	}
+	var r redisRio
+	r.init(bytes.NewReader(buf[1 : n-10]))
+	defer func() {
+		if x := recover(); x != nil {
+			log.Panicf("Decode From Payload failed, %v.", x)
+		}
+	}()
+	return r.LoadObject(int(buf[0]))
+}
+
+// NewRedisStringObject creates a string object with a copy of b.
+func NewRedisStringObject(b []byte) *RedisStringObject {
+	var sds = newRedisSds(append([]byte(nil), b...))
+	return &RedisStringObject{newRedisStringObject(sds)}
+}
+
+func (o *RedisStringObject) Len() int {
+	if o.sds.IsInteger() {
+		return len(o.sds.String())
+	}
+	return o.sds.Len
+}
+
+func (o *RedisStringObject) RedisSds() *RedisSds {
+	var sds = *o.sds
+	return &sds
+}
+
+type redisElemsIterator struct {
+	elems []*RedisSds
+	index int
+}
+
+func (p *redisElemsIterator) next() *RedisSds {
+	if p.index == len(p.elems) {
+		return nil
+	}
+	var sds = *p.elems[p.index]
+	p.index++
+	return &sds
+}
+
+func (o *RedisListObject) Len() int {
+	return len(o.elems)
+}
+
+type RedisListIterator struct {
+	iter redisElemsIterator
+	robj *RedisObject
+}
+
+func newRedisListIterator(o *RedisListObject) *RedisListIterator {
+	return &RedisListIterator{
+		iter: redisElemsIterator{elems: o.elems},
+		robj: o.IncrRefCount(),
+	}
+}
+
+func (p *RedisListIterator) Release() {
+	p.robj.DecrRefCount()
+}
+
+func (p *RedisListIterator) Next() *RedisSds {
+	return p.iter.next()
+}
+
+func (o *RedisHashObject) Len() int {
+	return len(o.elems) / 2
+}
+
+type RedisHashIterator struct {
+	iter redisElemsIterator
+	robj *RedisObject
+}
+
+func newRedisHashIterator(o *RedisHashObject) *RedisHashIterator {
+	return &RedisHashIterator{
+		iter: redisElemsIterator{elems: o.elems},
+		robj: o.IncrRefCount(),
+	}
+}
+
+func (p *RedisHashIterator) Release() {
+	p.robj.DecrRefCount()
+}
+
+func (p *RedisHashIterator) Next() (*RedisSds, *RedisSds) {
+	var key = p.iter.next()
+	if key != nil {
+		return key, p.iter.next()
+	}
+	return nil, nil
+}
+
+func (o *RedisZsetObject) Len() int {
+	return len(o.elems)
+}
+
+type RedisZsetIterator struct {
+	iter redisElemsIterator
+	robj *RedisObject
+}
+
+func newRedisZsetIterator(o *RedisZsetObject) *RedisZsetIterator {
+	return &RedisZsetIterator{
+		iter: redisElemsIterator{elems: o.elems},
+		robj: o.IncrRefCount(),
+	}
+}
+
+func (p *RedisZsetIterator) Release() {
+	p.robj.DecrRefCount()
+}
+
+func (p *RedisZsetIterator) Next() *RedisSds {
+	return p.iter.next()
+}
+
+func (o *RedisSetObject) Len() int {
+	return len(o.elems)
+}
+
+type RedisSetIterator struct {
+	iter redisElemsIterator
+	robj *RedisObject
+}
+
+func newRedisSetIterator(o *RedisSetObject) *RedisSetIterator {
+	return &RedisSetIterator{
+		iter: redisElemsIterator{elems: o.elems},
+		robj: o.IncrRefCount(),
+	}
+}
+
+func (p *RedisSetIterator) Release() {
+	p.robj.DecrRefCount()
+}
+
+func (p *RedisSetIterator) Next() *RedisSds {
+	return p.iter.next()
+}
+
+func (o *RedisStreamObject) Len() int {
+	return int(o.stream.length)
+}
+
+func (o *RedisStreamObject) LastID() RedisStreamID {
+	return o.stream.lastID
+}
+
+func (o *RedisStreamObject) Groups() []*RedisStreamGroup {
+	return o.stream.groups
+}
+
+func (o *RedisStreamObject) Meta() *RedisStreamMeta {
+	return o.stream.meta
+}
+
+type RedisStreamIterator struct {
+	entries []*RedisStreamEntry
+	robj    *RedisObject
+}
+
+func newRedisStreamIterator(o *RedisStreamObject) *RedisStreamIterator {
+	return &RedisStreamIterator{
+		entries: o.stream.entries,
+		robj:    o.IncrRefCount(),
+	}
+}
+
+func (p *RedisStreamIterator) Release() {
+	p.robj.DecrRefCount()
+}
+
+func (p *RedisStreamIterator) Next() *RedisStreamEntry {
+	if len(p.entries) == 0 {
+		return nil
+	}
+	var entry = p.entries[0]
+	p.entries = p.entries[1:]
+	return entry
+}
+
+func sortRedisStreamGroups(groups []*RedisStreamGroup) {
+	var less = func(a, b RedisStreamID) bool {
+		return a.Ms < b.Ms || (a.Ms == b.Ms && a.Seq < b.Seq)
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		return groups[i].Name < groups[j].Name
+	})
+	for _, g := range groups {
+		sort.Slice(g.Pending, func(i, j int) bool {
+			return less(g.Pending[i].ID, g.Pending[j].ID)
+		})
+		sort.Slice(g.Consumers, func(i, j int) bool {
+			return g.Consumers[i].Name < g.Consumers[j].Name
+		})
+		for _, c := range g.Consumers {
+			sort.Slice(c.Pending, func(i, j int) bool {
+				return less(c.Pending[i], c.Pending[j])
+			})
+		}
+	}
+}
@@ -0,0 +1,339 @@
+//go:build purego
+// +build purego
+
+package rdb
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+	"strconv"
+	"time"
+)
+
+const (
+	rdbEncInt8  = 0
+	rdbEncInt16 = 1
+	rdbEncInt32 = 2
+	rdbEncLZF   = 3
+)
+
+type redisRio struct {
+	rd  io.Reader
+	err error
+
+	offset   int64
+	checksum uint64
+}
+
+func (r *redisRio) init(rd io.Reader) {
+	r.rd = rd
+}
+
+func (r *redisRio) Offset() int64 {
+	return r.offset
+}
+
+// seek resets the offset, rd has been moved to offset.
+func (r *redisRio) seek(offset int64) {
+	r.offset, r.checksum = offset, 0
+}
+
+func (r *redisRio) Read(b []byte) {
+	if r.err == nil {
+		_, r.err = io.ReadFull(r.rd, b)
+	}
+	if r.err != nil {
+		r.throwf("Read %d bytes failed.", len(b))
+	}
+	r.offset += int64(len(b))
+	r.checksum = crc64Update(r.checksum, b)
+}
+
+func (r *redisRio) Checksum() uint64 {
+	return r.checksum
+}
+
+func (r *redisRio) readByte() byte {
+	var b [1]byte
+	r.Read(b[:])
+	return b[0]
+}
+
+func (r *redisRio) loadLen() (uint64, bool) {
+	var b = r.readByte()
+	switch b >> 6 {
+	case 0:
+		return uint64(b & 0x3f), false
+	case 1:
+		return uint64(b&0x3f)<<8 | uint64(r.readByte()), false
+	case 3:
+		return uint64(b & 0x3f), true
+	}
+	var buf [8]byte
+	switch b {
+	case 0x80:
+		r.Read(buf[:4])
+		return uint64(binary.BigEndian.Uint32(buf[:4])), false
+	case 0x81:
+		r.Read(buf[:8])
+		return binary.BigEndian.Uint64(buf[:8]), false
+	}
+	r.throwf("Unknown RDB length encoding = %#x.", b)
+	return 0, false
+}
+
+func (r *redisRio) LoadLen() uint64 {
+	n, _ := r.loadLen()
+	return n
+}
+
+func (r *redisRio) LoadType() int {
+	return int(r.readByte())
+}
+
+func (r *redisRio) LoadTime() time.Duration {
+	var buf [4]byte
+	r.Read(buf[:])
+	return time.Duration(int32(binary.LittleEndian.Uint32(buf[:]))) * time.Second
+}
+
+func (r *redisRio) LoadTimeMillisecond() time.Duration {
+	var buf [8]byte
+	r.Read(buf[:])
+	return time.Duration(int64(binary.LittleEndian.Uint64(buf[:]))) * time.Millisecond
+}
+
+// maxLoadBytes is far beyond the proto-max-bulk-len of redis, longer strings
+// mean the RDB is corrupted.
+const maxLoadBytes = 1 << 40
+
+// loadBytes reads n bytes, n is read from the RDB and can't be trusted, so
+// large strings are read by chunks instead of being allocated at once.
+func (r *redisRio) loadBytes(n uint64) []byte {
+	const chunk = 1 << 20
+	if n > maxLoadBytes {
+		r.throwf("Invalid RDB string length = %d.", n)
+	}
+	var b = make([]byte, 0, allocHint(n, chunk))
+	for uint64(len(b)) < n {
+		var p, m = len(b), n - uint64(len(b))
+		if m > chunk {
+			m = chunk
+		}
+		b = append(b, make([]byte, m)...)
+		r.Read(b[p:])
+	}
+	return b
+}
+
+func (r *redisRio) loadSds() *RedisSds {
+	n, encoded := r.loadLen()
+	if !encoded {
+		return newRedisSds(r.loadBytes(n))
+	}
+	switch n {
+	case rdbEncInt8:
+		return newRedisSdsInteger(int64(int8(r.readByte())))
+	case rdbEncInt16:
+		return newRedisSdsInteger(int64(int16(binary.LittleEndian.Uint16(r.loadBytes(2)))))
+	case rdbEncInt32:
+		return newRedisSdsInteger(int64(int32(binary.LittleEndian.Uint32(r.loadBytes(4)))))
+	case rdbEncLZF:
+		var clen, ulen = r.LoadLen(), r.LoadLen()
+		return newRedisSds(lzfDecompress(r.loadBytes(clen), ulen))
+	}
+	r.throwf("Unknown RDB string encoding = %d.", n)
+	return nil
+}
+
+// loadBlob loads the serialized ziplist, listpack, zipmap or intset.
+func (r *redisRio) loadBlob() []byte {
+	var sds = r.loadSds()
+	if sds.IsInteger() {
+		r.throwf("Invalid RDB blob, integer = %d.", sds.Value)
+	}
+	return sds.BytesUnsafe()
+}
+
+func (r *redisRio) loadDouble() float64 {
+	switch n := r.readByte(); n {
+	case 253:
+		return math.NaN()
+	case 254:
+		return math.Inf(1)
+	case 255:
+		return math.Inf(-1)
+	default:
+		var s = string(r.loadBytes(uint64(n)))
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			r.throwf("Invalid RDB double = %q.", s)
+		}
+		return f
+	}
+}
+
+func (r *redisRio) loadBinaryDouble() float64 {
+	return math.Float64frombits(binary.LittleEndian.Uint64(r.loadBytes(8)))
+}
+
+func (r *redisRio) LoadStringObject() *RedisStringObject {
+	return &RedisStringObject{newRedisStringObject(r.loadSds())}
+}
+
+func (r *redisRio) LoadObject(typ int) *RedisObject {
+	switch typ {
+	case RDB_TYPE_STRING:
+		return newRedisStringObject(r.loadSds())
+	case RDB_TYPE_LIST, RDB_TYPE_SET, RDB_TYPE_HASH:
+		var n = r.LoadLen()
+		var elems = make([]*RedisSds, 0, allocHint(n, 1024))
+		for i := uint64(0); i < n; i++ {
+			elems = append(elems, r.loadSds())
+			if typ == RDB_TYPE_HASH {
+				elems = append(elems, r.loadSds())
+			}
+		}
+		switch typ {
+		case RDB_TYPE_LIST:
+			return newRedisElemsObject(OBJ_LIST, elems)
+		case RDB_TYPE_SET:
+			return newRedisElemsObject(OBJ_SET, elems)
+		default:
+			return newRedisElemsObject(OBJ_HASH, elems)
+		}
+	case RDB_TYPE_ZSET, RDB_TYPE_ZSET_2:
+		var n = r.LoadLen()
+		var elems = make([]*RedisSds, 0, allocHint(n, 1024))
+		for i := uint64(0); i < n; i++ {
+			var member = r.loadSds()
+			if typ == RDB_TYPE_ZSET_2 {
+				member.Score = r.loadBinaryDouble()
+			} else {
+				member.Score = r.loadDouble()
+			}
+			elems = append(elems, member)
+		}
+		return newRedisElemsObject(OBJ_ZSET, elems)
+	case RDB_TYPE_HASH_ZIPMAP:
+		return newRedisEncodedObject(OBJ_HASH, OBJ_ENCODING_ZIPLIST, decodeZipmap(r.loadBlob()))
+	case RDB_TYPE_LIST_ZIPLIST:
+		return newRedisElemsObject(OBJ_LIST, decodeZiplist(r.loadBlob()))
+	case RDB_TYPE_SET_INTSET:
+		return newRedisEncodedObject(OBJ_SET, OBJ_ENCODING_INTSET, decodeIntset(r.loadBlob()))
+	case RDB_TYPE_HASH_ZIPLIST:
+		return newRedisEncodedObject(OBJ_HASH, OBJ_ENCODING_ZIPLIST, decodeZiplist(r.loadBlob()))
+	case RDB_TYPE_ZSET_ZIPLIST:
+		return newRedisEncodedObject(OBJ_ZSET, OBJ_ENCODING_ZIPLIST, decodeScores(decodeZiplist(r.loadBlob())))
+	case RDB_TYPE_HASH_LISTPACK:
+		return newRedisElemsObject(OBJ_HASH, decodeListpack(r.loadBlob()))
+	case RDB_TYPE_SET_LISTPACK:
+		return newRedisElemsObject(OBJ_SET, decodeListpack(r.loadBlob()))
+	case RDB_TYPE_ZSET_LISTPACK:
+		return newRedisElemsObject(OBJ_ZSET, decodeScores(decodeListpack(r.loadBlob())))
+	case RDB_TYPE_LIST_QUICKLIST, RDB_TYPE_LIST_QUICKLIST_2:
+		var elems []*RedisSds
+		for n := r.LoadLen(); n != 0; n-- {
+			if typ == RDB_TYPE_LIST_QUICKLIST {
+				elems = append(elems, decodeZiplist(r.loadBlob())...)
+				continue
+			}
+			switch container := r.LoadLen(); container {
+			case quicklistContainerPlain:
+				elems = append(elems, r.loadSds())
+			case quicklistContainerPacked:
+				elems = append(elems, decodeListpack(r.loadBlob())...)
+			default:
+				r.throwf("Unknown quicklist container = %d.", container)
+			}
+		}
+		return newRedisElemsObject(OBJ_LIST, elems)
+	case RDB_TYPE_STREAM_LISTPACKS, RDB_TYPE_STREAM_LISTPACKS_2, RDB_TYPE_STREAM_LISTPACKS_3:
+		var o = newRedisObject(OBJ_STREAM, OBJ_ENCODING_STREAM)
+		o.stream = r.loadStream(typ)
+		return o
+	}
+	r.throwf("Read RDB LoadObject() failed, type = %d.", typ)
+	return nil
+}
+
+func newRedisElemsObject(typ RedisType, elems []*RedisSds) *RedisObject {
+	var enc RedisEncoding
+	switch typ {
+	case OBJ_LIST:
+		enc = OBJ_ENCODING_QUICKLIST
+	case OBJ_ZSET:
+		enc = OBJ_ENCODING_SKIPLIST
+	default:
+		enc = OBJ_ENCODING_HT
+	}
+	return newRedisEncodedObject(typ, enc, elems)
+}
+
+// newRedisEncodedObject keeps the encoding of the compact types, the same as
+// the objects loaded by redis, listpacks are converted like the cgo loader.
+func newRedisEncodedObject(typ RedisType, enc RedisEncoding, elems []*RedisSds) *RedisObject {
+	var o = newRedisObject(typ, enc)
+	o.elems = elems
+	return o
+}
+
+func (r *redisRio) loadStreamID() RedisStreamID {
+	var ms = r.LoadLen()
+	return RedisStreamID{Ms: ms, Seq: r.LoadLen()}
+}
+
+func (r *redisRio) loadStream(typ int) *redisStream {
+	var s = &redisStream{}
+	for n := r.LoadLen(); n != 0; n-- {
+		var master = r.loadBlob()
+		if len(master) != 16 {
+			r.throwf("Invalid stream master id, length = %d.", len(master))
+		}
+		s.entries = append(s.entries, decodeStreamListpack(decodeRedisStreamID(master), r.loadBlob())...)
+	}
+	s.length = r.LoadLen()
+	s.lastID = r.loadStreamID()
+	if typ >= RDB_TYPE_STREAM_LISTPACKS_2 {
+		s.meta = &RedisStreamMeta{}
+		s.meta.FirstID = r.loadStreamID()
+		s.meta.MaxDeletedID = r.loadStreamID()
+		s.meta.EntriesAdded = r.LoadLen()
+	}
+	for n := r.LoadLen(); n != 0; n-- {
+		var g = &RedisStreamGroup{Name: r.loadSds().String(), EntriesRead: -1}
+		g.LastID = r.loadStreamID()
+		if typ >= RDB_TYPE_STREAM_LISTPACKS_2 {
+			g.EntriesRead = int64(r.LoadLen())
+		}
+		var pel = make(map[RedisStreamID]*RedisStreamNACK)
+		for n := r.LoadLen(); n != 0; n-- {
+			var nack = &RedisStreamNACK{ID: decodeRedisStreamID(r.loadBytes(16))}
+			nack.DeliveryTime = r.LoadTimeMillisecond()
+			nack.DeliveryCount = r.LoadLen()
+			pel[nack.ID] = nack
+			g.Pending = append(g.Pending, nack)
+		}
+		for n := r.LoadLen(); n != 0; n-- {
+			var c = &RedisStreamConsumer{Name: r.loadSds().String()}
+			c.SeenTime = r.LoadTimeMillisecond()
+			if typ >= RDB_TYPE_STREAM_LISTPACKS_3 {
+				r.LoadTimeMillisecond() // active_time
+			}
+			for n := r.LoadLen(); n != 0; n-- {
+				var id = decodeRedisStreamID(r.loadBytes(16))
+				var nack = pel[id]
+				if nack == nil {
+					r.throwf("Stream consumer %q has an unknown pending entry %s.", c.Name, id)
+				}
+				nack.Consumer = c.Name
+				c.Pending = append(c.Pending, id)
+			}
+			g.Consumers = append(g.Consumers, c)
+		}
+		s.groups = append(s.groups, g)
+	}
+	sortRedisStreamGroups(s.groups)
+	return s
+}
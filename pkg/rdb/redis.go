@@ -0,0 +1,399 @@
+package rdb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/CodisLabs/codis/pkg/utils/log"
+)
+
+type RedisType int
+
+func (t RedisType) String() string {
+	switch t {
+	case OBJ_STRING:
+		return "OBJ_STRING"
+	case OBJ_LIST:
+		return "OBJ_LIST"
+	case OBJ_SET:
+		return "OBJ_SET"
+	case OBJ_ZSET:
+		return "OBJ_ZSET"
+	case OBJ_HASH:
+		return "OBJ_HASH"
+	case OBJ_MODULE:
+		return "OBJ_MODULE"
+	case OBJ_STREAM:
+		return "OBJ_STREAM"
+	}
+	return fmt.Sprintf("OBJ_UNKNOWN[%d]", t)
+}
+
+type RedisEncoding int
+
+func (t RedisEncoding) String() string {
+	switch t {
+	case OBJ_ENCODING_RAW:
+		return "ENCODING_RAW"
+	case OBJ_ENCODING_INT:
+		return "ENCODING_INT"
+	case OBJ_ENCODING_HT:
+		return "ENCODING_HT"
+	case OBJ_ENCODING_ZIPMAP:
+		return "ENCODING_ZIPMAP"
+	case OBJ_ENCODING_LINKEDLIST:
+		return "ENCODING_LINKEDLIST"
+	case OBJ_ENCODING_ZIPLIST:
+		return "ENCODING_ZIPLIST"
+	case OBJ_ENCODING_INTSET:
+		return "ENCODING_INTSET"
+	case OBJ_ENCODING_SKIPLIST:
+		return "ENCODING_SKIPLIST"
+	case OBJ_ENCODING_EMBSTR:
+		return "ENCODING_EMBSTR"
+	case OBJ_ENCODING_QUICKLIST:
+		return "ENCODING_QUICKLIST"
+	case OBJ_ENCODING_STREAM:
+		return "ENCODING_STREAM"
+	}
+	return fmt.Sprintf("ENCODING_UNKNOWN[%d]", t)
+}
+
+func (o *RedisObject) IsEncodedObject() bool {
+	switch o.Encoding() {
+	default:
+		return true
+	case OBJ_ENCODING_QUICKLIST, OBJ_ENCODING_HT, OBJ_ENCODING_SKIPLIST:
+		return false
+	}
+}
+
+func (o *RedisObject) CreateDumpPayload() string {
+	var sds = o.CreateDumpPayloadUnsafe()
+	var str = sds.String()
+	sds.Release()
+	return str
+}
+
+func (o *RedisObject) IsString() bool {
+	return o.Type() == OBJ_STRING
+}
+
+func (o *RedisObject) AsString() *RedisStringObject {
+	return &RedisStringObject{o}
+}
+
+func (o *RedisObject) IsList() bool {
+	return o.Type() == OBJ_LIST
+}
+
+func (o *RedisObject) AsList() *RedisListObject {
+	return &RedisListObject{o}
+}
+
+func (o *RedisObject) IsHash() bool {
+	return o.Type() == OBJ_HASH
+}
+
+func (o *RedisObject) AsHash() *RedisHashObject {
+	return &RedisHashObject{o}
+}
+
+func (o *RedisObject) IsZset() bool {
+	return o.Type() == OBJ_ZSET
+}
+
+func (o *RedisObject) AsZset() *RedisZsetObject {
+	return &RedisZsetObject{o}
+}
+
+func (o *RedisObject) IsSet() bool {
+	return o.Type() == OBJ_SET
+}
+
+func (o *RedisObject) AsSet() *RedisSetObject {
+	return &RedisSetObject{o}
+}
+
+func (o *RedisObject) IsStream() bool {
+	return o.Type() == OBJ_STREAM
+}
+
+func (o *RedisObject) AsStream() *RedisStreamObject {
+	return &RedisStreamObject{o}
+}
+
+type RedisStringObject struct {
+	*RedisObject
+}
+
+func (o *RedisStringObject) String() string {
+	return o.RedisSds().String()
+}
+
+func (o *RedisStringObject) StringUnsafe() string {
+	return o.RedisSds().StringUnsafe()
+}
+
+func (o *RedisStringObject) Bytes() []byte {
+	return o.RedisSds().Bytes()
+}
+
+func (o *RedisStringObject) BytesUnsafe() []byte {
+	return o.RedisSds().BytesUnsafe()
+}
+
+type RedisListObject struct {
+	*RedisObject
+}
+
+func (o *RedisListObject) NewIterator() *RedisListIterator {
+	return newRedisListIterator(o)
+}
+
+func (o *RedisListObject) ForEach(on func(iter *RedisListIterator, step int) bool) int {
+	var step int
+	var iter = o.NewIterator()
+	for on(iter, step) {
+		step++
+	}
+	iter.Release()
+	return step
+}
+
+func (o *RedisListObject) Strings() []string {
+	var list []string
+	o.ForEach(func(iter *RedisListIterator, step int) bool {
+		var key = iter.Next()
+		if key == nil {
+			return false
+		}
+		list = append(list, key.String())
+		return true
+	})
+	return list
+}
+
+func (o *RedisListObject) StringsUnsafe() []string {
+	var list []string
+	o.ForEach(func(iter *RedisListIterator, step int) bool {
+		var key = iter.Next()
+		if key == nil {
+			return false
+		}
+		list = append(list, key.StringUnsafe())
+		return true
+	})
+	return list
+}
+
+type RedisHashObject struct {
+	*RedisObject
+}
+
+func (o *RedisHashObject) NewIterator() *RedisHashIterator {
+	return newRedisHashIterator(o)
+}
+
+func (o *RedisHashObject) ForEach(on func(iter *RedisHashIterator, step int) bool) int {
+	var step int
+	var iter = o.NewIterator()
+	for on(iter, step) {
+		step++
+	}
+	iter.Release()
+	return step
+}
+
+func (o *RedisHashObject) Map() map[string]string {
+	var hash = make(map[string]string)
+	o.ForEach(func(iter *RedisHashIterator, step int) bool {
+		var key, value = iter.Next()
+		if key == nil {
+			return false
+		}
+		hash[key.String()] = value.String()
+		return true
+	})
+	return hash
+}
+
+func (o *RedisHashObject) MapUnsafe() map[string]string {
+	var hash = make(map[string]string)
+	o.ForEach(func(iter *RedisHashIterator, step int) bool {
+		var key, value = iter.Next()
+		if key == nil {
+			return false
+		}
+		hash[key.StringUnsafe()] = value.StringUnsafe()
+		return true
+	})
+	return hash
+}
+
+type RedisZsetObject struct {
+	*RedisObject
+}
+
+func (o *RedisZsetObject) NewIterator() *RedisZsetIterator {
+	return newRedisZsetIterator(o)
+}
+
+func (o *RedisZsetObject) ForEach(on func(iter *RedisZsetIterator, step int) bool) int {
+	var step int
+	var iter = o.NewIterator()
+	for on(iter, step) {
+		step++
+	}
+	iter.Release()
+	return step
+}
+
+func (o *RedisZsetObject) Map() map[string]float64 {
+	var zset = make(map[string]float64)
+	o.ForEach(func(iter *RedisZsetIterator, step int) bool {
+		var key = iter.Next()
+		if key == nil {
+			return false
+		}
+		zset[key.String()] = key.Score
+		return true
+	})
+	return zset
+}
+
+func (o *RedisZsetObject) MapUnsafe() map[string]float64 {
+	var zset = make(map[string]float64)
+	o.ForEach(func(iter *RedisZsetIterator, step int) bool {
+		var key = iter.Next()
+		if key == nil {
+			return false
+		}
+		zset[key.StringUnsafe()] = key.Score
+		return true
+	})
+	return zset
+}
+
+type RedisSetObject struct {
+	*RedisObject
+}
+
+func (o *RedisSetObject) ForEach(on func(iter *RedisSetIterator, step int) bool) int {
+	var step int
+	var iter = o.NewIterator()
+	for on(iter, step) {
+		step++
+	}
+	iter.Release()
+	return step
+}
+
+func (o *RedisSetObject) Map() map[string]bool {
+	var set = make(map[string]bool)
+	o.ForEach(func(iter *RedisSetIterator, step int) bool {
+		var key = iter.Next()
+		if key == nil {
+			return false
+		}
+		set[key.String()] = true
+		return true
+	})
+	return set
+}
+
+func (o *RedisSetObject) MapUnsafe() map[string]bool {
+	var set = make(map[string]bool)
+	o.ForEach(func(iter *RedisSetIterator, step int) bool {
+		var key = iter.Next()
+		if key == nil {
+			return false
+		}
+		set[key.StringUnsafe()] = true
+		return true
+	})
+	return set
+}
+
+func (o *RedisSetObject) NewIterator() *RedisSetIterator {
+	return newRedisSetIterator(o)
+}
+
+type RedisStreamID struct {
+	Ms, Seq uint64
+}
+
+func decodeRedisStreamID(raw []byte) RedisStreamID {
+	if len(raw) != 16 {
+		log.Panicf("Invalid stream id, length = %d.", len(raw))
+	}
+	return RedisStreamID{
+		Ms:  binary.BigEndian.Uint64(raw[0:8]),
+		Seq: binary.BigEndian.Uint64(raw[8:16]),
+	}
+}
+
+func (id RedisStreamID) IsZero() bool {
+	return id.Ms == 0 && id.Seq == 0
+}
+
+func (id RedisStreamID) String() string {
+	return fmt.Sprintf("%d-%d", id.Ms, id.Seq)
+}
+
+type RedisStreamEntry struct {
+	ID     RedisStreamID
+	Fields []*RedisSds
+	Values []*RedisSds
+}
+
+type RedisStreamNACK struct {
+	ID            RedisStreamID
+	Consumer      string
+	DeliveryTime  time.Duration
+	DeliveryCount uint64
+}
+
+type RedisStreamConsumer struct {
+	Name     string
+	SeenTime time.Duration
+	Pending  []RedisStreamID
+}
+
+type RedisStreamGroup struct {
+	Name      string
+	LastID    RedisStreamID
+	Pending   []*RedisStreamNACK
+	Consumers []*RedisStreamConsumer
+
+	// EntriesRead is the entries_read of RDB_TYPE_STREAM_LISTPACKS_2 and
+	// later, it's -1 if it's unknown.
+	EntriesRead int64
+}
+
+// RedisStreamMeta is the metadata that streams of RDB_TYPE_STREAM_LISTPACKS_2
+// and later carry, which is used by XSETID of redis 7.0.
+type RedisStreamMeta struct {
+	FirstID      RedisStreamID
+	MaxDeletedID RedisStreamID
+	EntriesAdded uint64
+}
+
+type RedisStreamObject struct {
+	*RedisObject
+}
+
+func (o *RedisStreamObject) NewIterator() *RedisStreamIterator {
+	return newRedisStreamIterator(o)
+}
+
+func (o *RedisStreamObject) ForEach(on func(iter *RedisStreamIterator, step int) bool) int {
+	var step int
+	var iter = o.NewIterator()
+	for on(iter, step) {
+		step++
+	}
+	iter.Release()
+	return step
+}
@@ -0,0 +1,191 @@
+package rdb
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// rawReader walks over serialized values without decoding them, the bytes
+// are kept in buf if it's not nil.
+type rawReader struct {
+	rio *redisRio
+	buf *bytes.Buffer
+
+	scratch [64]byte
+}
+
+func (r *rawReader) readFull(n int) []byte {
+	var b []byte
+	if n <= len(r.scratch) {
+		b = r.scratch[:n]
+	} else {
+		b = make([]byte, n)
+	}
+	r.rio.Read(b)
+	if r.buf != nil {
+		r.buf.Write(b)
+	}
+	return b
+}
+
+// skip reads n bytes in chunks, large values are never held in memory
+// unless they are kept in buf.
+func (r *rawReader) skip(n uint64) {
+	var chunk []byte
+	for n != 0 {
+		var size = n
+		if size > 32*1024 {
+			size = 32 * 1024
+		}
+		if uint64(len(chunk)) < size {
+			chunk = make([]byte, size)
+		}
+		r.rio.Read(chunk[:size])
+		if r.buf != nil {
+			r.buf.Write(chunk[:size])
+		}
+		n -= size
+	}
+}
+
+func (r *rawReader) loadLen() (uint64, bool) {
+	var b = r.readFull(1)[0]
+	switch b >> 6 {
+	case 0:
+		return uint64(b & 0x3f), false
+	case 1:
+		return uint64(b&0x3f)<<8 | uint64(r.readFull(1)[0]), false
+	case 3:
+		return uint64(b & 0x3f), true
+	}
+	switch b {
+	case 0x80:
+		return uint64(binary.BigEndian.Uint32(r.readFull(4))), false
+	case 0x81:
+		return binary.BigEndian.Uint64(r.readFull(8)), false
+	}
+	r.rio.throwf("Unknown RDB length encoding = %#x.", b)
+	return 0, false
+}
+
+func (r *rawReader) skipString() {
+	n, encoded := r.loadLen()
+	if !encoded {
+		r.skip(n)
+		return
+	}
+	switch n {
+	case 0: // RDB_ENC_INT8
+		r.skip(1)
+	case 1: // RDB_ENC_INT16
+		r.skip(2)
+	case 2: // RDB_ENC_INT32
+		r.skip(4)
+	case 3: // RDB_ENC_LZF
+		clen, _ := r.loadLen()
+		r.loadLen()
+		r.skip(clen)
+	default:
+		r.rio.throwf("Unknown RDB string encoding = %d.", n)
+	}
+}
+
+// skipDouble skips a double of RDB_TYPE_ZSET, nan and infinities are saved
+// as a single byte.
+func (r *rawReader) skipDouble() {
+	switch n := r.readFull(1)[0]; n {
+	case 253, 254, 255:
+	default:
+		r.skip(uint64(n))
+	}
+}
+
+func (r *rawReader) skipStreamID() {
+	r.loadLen()
+	r.loadLen()
+}
+
+func (r *rawReader) skipObject(typ int) {
+	switch typ {
+	case RDB_TYPE_STRING:
+		r.skipString()
+	case RDB_TYPE_LIST, RDB_TYPE_SET, RDB_TYPE_HASH:
+		var n, _ = r.loadLen()
+		if typ == RDB_TYPE_HASH {
+			n *= 2
+		}
+		for ; n != 0; n-- {
+			r.skipString()
+		}
+	case RDB_TYPE_ZSET, RDB_TYPE_ZSET_2:
+		for n, _ := r.loadLen(); n != 0; n-- {
+			r.skipString()
+			if typ == RDB_TYPE_ZSET_2 {
+				r.skip(8)
+			} else {
+				r.skipDouble()
+			}
+		}
+	case RDB_TYPE_HASH_ZIPMAP, RDB_TYPE_LIST_ZIPLIST, RDB_TYPE_SET_INTSET, RDB_TYPE_ZSET_ZIPLIST, RDB_TYPE_HASH_ZIPLIST:
+		r.skipString()
+	case RDB_TYPE_HASH_LISTPACK, RDB_TYPE_ZSET_LISTPACK, RDB_TYPE_SET_LISTPACK:
+		r.skipString()
+	case RDB_TYPE_LIST_QUICKLIST, RDB_TYPE_LIST_QUICKLIST_2:
+		for n, _ := r.loadLen(); n != 0; n-- {
+			if typ == RDB_TYPE_LIST_QUICKLIST_2 {
+				r.loadLen() // container, both plain and packed nodes are strings
+			}
+			r.skipString()
+		}
+	case RDB_TYPE_STREAM_LISTPACKS, RDB_TYPE_STREAM_LISTPACKS_2, RDB_TYPE_STREAM_LISTPACKS_3:
+		r.skipStream(typ)
+	case RDB_TYPE_MODULE_2:
+		id, _ := r.loadLen()
+		r.skipOpcodes(id)
+	default:
+		r.rio.throwf("Skip RDB object failed, type = %d.", typ)
+	}
+}
+
+func (r *rawReader) skipStream(typ int) {
+	for n, _ := r.loadLen(); n != 0; n-- {
+		r.skipString() // master id
+		r.skipString() // listpack
+	}
+	r.loadLen() // length
+	r.skipStreamID()
+	if typ >= RDB_TYPE_STREAM_LISTPACKS_2 {
+		r.skipStreamID()
+		r.skipStreamID()
+		r.loadLen()
+	}
+	for n, _ := r.loadLen(); n != 0; n-- {
+		r.skipString() // name
+		r.skipStreamID()
+		if typ >= RDB_TYPE_STREAM_LISTPACKS_2 {
+			r.loadLen()
+		}
+		for n, _ := r.loadLen(); n != 0; n-- {
+			r.skip(16 + 8) // id and delivery time
+			r.loadLen()
+		}
+		for n, _ := r.loadLen(); n != 0; n-- {
+			r.skipString() // name
+			r.skip(8)
+			if typ >= RDB_TYPE_STREAM_LISTPACKS_3 {
+				r.skip(8)
+			}
+			var pending, _ = r.loadLen()
+			r.skip(pending * 16)
+		}
+	}
+}
+
+// skipObject skips the value of an entry, the key has been loaded.
+func (l *Loader) skipObject(typ int) {
+	if typ == RDB_TYPE_MODULE {
+		throwError(l.rio.Offset(), ErrUnsupportedType, "Don't support module object without opcodes (RDB_TYPE_MODULE).")
+	}
+	var r = &rawReader{rio: &l.rio}
+	r.skipObject(typ)
+}
@@ -0,0 +1,423 @@
+package rdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"time"
+
+	"github.com/CodisLabs/codis/pkg/utils/errors"
+	"github.com/CodisLabs/codis/pkg/utils/log"
+)
+
+// Writer writes objects in the format of RDB_VERSION, which is loaded by
+// Loader and redis-server. Lists, sets, zsets and hashes are written with the
+// plain encodings, streams with one listpack per 100 entries, the metadata of
+// RDB_TYPE_STREAM_LISTPACKS_2 is dropped.
+type Writer struct {
+	w io.Writer
+
+	db       int64 // current database, -1 before the first SELECTDB
+	checksum uint64
+
+	enc rdbEncoder
+	err error
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w, db: -1}
+}
+
+func (w *Writer) flush() error {
+	if w.err != nil {
+		return w.err
+	}
+	var b = w.enc.Bytes()
+	w.checksum = crc64Update(w.checksum, b)
+	if _, err := w.w.Write(b); err != nil {
+		w.err = errors.Trace(err)
+	}
+	w.enc.Reset()
+	return w.err
+}
+
+func (w *Writer) Header() error {
+	fmt.Fprintf(&w.enc, "REDIS%04d", RDB_VERSION)
+	return w.flush()
+}
+
+func (w *Writer) WriteAux(key, value string) error {
+	w.enc.WriteByte(byte(RDB_OPCODE_AUX))
+	w.enc.writeString([]byte(key))
+	w.enc.writeString([]byte(value))
+	return w.flush()
+}
+
+// SelectDB switches to db, WriteEntry does it implicitly.
+func (w *Writer) SelectDB(db uint64) error {
+	w.enc.WriteByte(byte(RDB_OPCODE_SELECTDB))
+	w.enc.writeLen(db)
+	w.db = int64(db)
+	return w.flush()
+}
+
+// ResizeDB writes the hint of the current database, it should follow SelectDB.
+func (w *Writer) ResizeDB(size DBSize) error {
+	w.enc.WriteByte(byte(RDB_OPCODE_RESIZEDB))
+	w.enc.writeLen(size.Keys)
+	w.enc.writeLen(size.Expires)
+	return w.flush()
+}
+
+func (w *Writer) WriteEntry(e *DBEntry) error {
+	if w.db != int64(e.DB) {
+		if err := w.SelectDB(e.DB); err != nil {
+			return err
+		}
+	}
+	if e.Expire != NoExpire {
+		w.enc.WriteByte(byte(RDB_OPCODE_EXPIRETIME_MS))
+		w.enc.writeInt64(int64(e.Expire / time.Millisecond))
+	}
+	if e.Module != nil {
+		w.enc.WriteByte(byte(RDB_TYPE_MODULE_2))
+		w.enc.writeString(e.Key.BytesUnsafe())
+		w.enc.Write(e.Module.Raw)
+	} else {
+		w.enc.WriteByte(w.enc.objectType(e.Value))
+		w.enc.writeString(e.Key.BytesUnsafe())
+		w.enc.writeObject(e.Value)
+	}
+	return w.flush()
+}
+
+// Footer writes RDB_OPCODE_EOF and the checksum, the underlying writer isn't
+// flushed or closed.
+func (w *Writer) Footer() error {
+	w.enc.WriteByte(byte(RDB_OPCODE_EOF))
+	if err := w.flush(); err != nil {
+		return err
+	}
+	w.enc.writeInt64(int64(w.checksum))
+	return w.flush()
+}
+
+type rdbEncoder struct {
+	bytes.Buffer
+}
+
+func (b *rdbEncoder) writeLen(n uint64) {
+	var buf [9]byte
+	switch {
+	case n < 1<<6:
+		b.WriteByte(byte(n))
+	case n < 1<<14:
+		b.WriteByte(byte(n>>8) | 0x40)
+		b.WriteByte(byte(n))
+	case n <= math.MaxUint32:
+		buf[0] = 0x80
+		binary.BigEndian.PutUint32(buf[1:], uint32(n))
+		b.Write(buf[:5])
+	default:
+		buf[0] = 0x81
+		binary.BigEndian.PutUint64(buf[1:], n)
+		b.Write(buf[:9])
+	}
+}
+
+func (b *rdbEncoder) writeString(s []byte) {
+	b.writeLen(uint64(len(s)))
+	b.Write(s)
+}
+
+func (b *rdbEncoder) writeInt64(v int64) {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], uint64(v))
+	b.Write(buf[:])
+}
+
+func (b *rdbEncoder) writeStreamID(id RedisStreamID) {
+	b.writeLen(id.Ms)
+	b.writeLen(id.Seq)
+}
+
+func (b *rdbEncoder) objectType(o *RedisObject) byte {
+	switch o.Type() {
+	case OBJ_STRING:
+		return byte(RDB_TYPE_STRING)
+	case OBJ_LIST:
+		return byte(RDB_TYPE_LIST)
+	case OBJ_SET:
+		return byte(RDB_TYPE_SET)
+	case OBJ_ZSET:
+		return byte(RDB_TYPE_ZSET_2)
+	case OBJ_HASH:
+		return byte(RDB_TYPE_HASH)
+	case OBJ_STREAM:
+		return byte(RDB_TYPE_STREAM_LISTPACKS)
+	}
+	log.Panicf("can't encode object type = %s", o.Type())
+	return 0
+}
+
+// writeObject writes the value of o, the type is written by the caller.
+func (b *rdbEncoder) writeObject(o *RedisObject) {
+	switch o.Type() {
+	case OBJ_STRING:
+		b.writeString(o.AsString().BytesUnsafe())
+	case OBJ_LIST:
+		var list = o.AsList()
+		b.writeLen(uint64(list.Len()))
+		list.ForEach(func(iter *RedisListIterator, step int) bool {
+			var elem = iter.Next()
+			if elem == nil {
+				return false
+			}
+			b.writeString(elem.BytesUnsafe())
+			return true
+		})
+	case OBJ_SET:
+		var set = o.AsSet()
+		b.writeLen(uint64(set.Len()))
+		set.ForEach(func(iter *RedisSetIterator, step int) bool {
+			var member = iter.Next()
+			if member == nil {
+				return false
+			}
+			b.writeString(member.BytesUnsafe())
+			return true
+		})
+	case OBJ_ZSET:
+		var zset = o.AsZset()
+		b.writeLen(uint64(zset.Len()))
+		zset.ForEach(func(iter *RedisZsetIterator, step int) bool {
+			var member = iter.Next()
+			if member == nil {
+				return false
+			}
+			b.writeString(member.BytesUnsafe())
+			b.writeInt64(int64(math.Float64bits(member.Score)))
+			return true
+		})
+	case OBJ_HASH:
+		var hash = o.AsHash()
+		b.writeLen(uint64(hash.Len()))
+		hash.ForEach(func(iter *RedisHashIterator, step int) bool {
+			var field, value = iter.Next()
+			if field == nil {
+				return false
+			}
+			b.writeString(field.BytesUnsafe())
+			b.writeString(value.BytesUnsafe())
+			return true
+		})
+	case OBJ_STREAM:
+		b.writeStream(o.AsStream())
+	default:
+		log.Panicf("can't encode object type = %s", o.Type())
+	}
+}
+
+const streamNodeMaxEntries = 100
+
+func (b *rdbEncoder) writeStream(s *RedisStreamObject) {
+	var nodes [][]*RedisStreamEntry
+	s.ForEach(func(iter *RedisStreamIterator, step int) bool {
+		var entry = iter.Next()
+		if entry == nil {
+			return false
+		}
+		if n := len(nodes); n == 0 || len(nodes[n-1]) == streamNodeMaxEntries {
+			nodes = append(nodes, nil)
+		}
+		nodes[len(nodes)-1] = append(nodes[len(nodes)-1], entry)
+		return true
+	})
+	b.writeLen(uint64(len(nodes)))
+	for _, entries := range nodes {
+		var master = entries[0].ID
+		var key [16]byte
+		binary.BigEndian.PutUint64(key[0:], master.Ms)
+		binary.BigEndian.PutUint64(key[8:], master.Seq)
+		b.writeString(key[:])
+		b.writeString(encodeStreamListpack(master, entries))
+	}
+	b.writeLen(uint64(s.Len()))
+	b.writeStreamID(s.LastID())
+
+	var groups = s.Groups()
+	b.writeLen(uint64(len(groups)))
+	for _, g := range groups {
+		b.writeString([]byte(g.Name))
+		b.writeStreamID(g.LastID)
+		b.writeLen(uint64(len(g.Pending)))
+		for _, nack := range g.Pending {
+			b.writeRawStreamID(nack.ID)
+			b.writeInt64(int64(nack.DeliveryTime / time.Millisecond))
+			b.writeLen(nack.DeliveryCount)
+		}
+		b.writeLen(uint64(len(g.Consumers)))
+		for _, c := range g.Consumers {
+			b.writeString([]byte(c.Name))
+			b.writeInt64(int64(c.SeenTime / time.Millisecond))
+			b.writeLen(uint64(len(c.Pending)))
+			for _, id := range c.Pending {
+				b.writeRawStreamID(id)
+			}
+		}
+	}
+}
+
+func (b *rdbEncoder) writeRawStreamID(id RedisStreamID) {
+	var raw [16]byte
+	binary.BigEndian.PutUint64(raw[0:], id.Ms)
+	binary.BigEndian.PutUint64(raw[8:], id.Seq)
+	b.Write(raw[:])
+}
+
+// encodeStreamListpack encodes a stream node, the first entry is the master
+// entry, entries with the same fields are flagged with SAMEFIELDS.
+func encodeStreamListpack(master RedisStreamID, entries []*RedisStreamEntry) []byte {
+	const (
+		flagNone       = 0
+		flagSameFields = 2
+	)
+	var lp listpackEncoder
+	var fields = entries[0].Fields
+	lp.appendInteger(int64(len(entries)))
+	lp.appendInteger(0)
+	lp.appendInteger(int64(len(fields)))
+	for _, field := range fields {
+		lp.appendSds(field)
+	}
+	lp.appendInteger(0)
+
+	var sameFields = func(e *RedisStreamEntry) bool {
+		if len(e.Fields) != len(fields) {
+			return false
+		}
+		for i := range fields {
+			if !bytes.Equal(e.Fields[i].BytesUnsafe(), fields[i].BytesUnsafe()) {
+				return false
+			}
+		}
+		return true
+	}
+	for _, e := range entries {
+		var n = int64(len(e.Fields))
+		if sameFields(e) {
+			lp.appendInteger(flagSameFields)
+			lp.appendInteger(int64(e.ID.Ms - master.Ms))
+			lp.appendInteger(int64(e.ID.Seq - master.Seq))
+			for _, value := range e.Values {
+				lp.appendSds(value)
+			}
+			lp.appendInteger(n + 3)
+		} else {
+			lp.appendInteger(flagNone)
+			lp.appendInteger(int64(e.ID.Ms - master.Ms))
+			lp.appendInteger(int64(e.ID.Seq - master.Seq))
+			lp.appendInteger(n)
+			for i := range e.Fields {
+				lp.appendSds(e.Fields[i])
+				lp.appendSds(e.Values[i])
+			}
+			lp.appendInteger(n + 3 + n + 1)
+		}
+	}
+	return lp.Bytes()
+}
+
+type listpackEncoder struct {
+	body  bytes.Buffer
+	count int
+}
+
+func (lp *listpackEncoder) appendSds(s *RedisSds) {
+	if s.IsInteger() {
+		lp.appendInteger(s.Value)
+	} else {
+		lp.appendString(s.BytesUnsafe())
+	}
+}
+
+func (lp *listpackEncoder) appendInteger(v int64) {
+	var buf [9]byte
+	var enc []byte
+	switch {
+	case v >= 0 && v <= 127:
+		buf[0] = byte(v)
+		enc = buf[:1]
+	case v >= -4096 && v <= 4095:
+		buf[0], buf[1] = 0xc0|byte(v>>8)&0x1f, byte(v)
+		enc = buf[:2]
+	case v >= math.MinInt16 && v <= math.MaxInt16:
+		buf[0] = 0xf1
+		binary.LittleEndian.PutUint16(buf[1:], uint16(v))
+		enc = buf[:3]
+	case v >= -1<<23 && v < 1<<23:
+		buf[0] = 0xf2
+		binary.LittleEndian.PutUint32(buf[1:], uint32(v))
+		enc = buf[:4]
+	case v >= math.MinInt32 && v <= math.MaxInt32:
+		buf[0] = 0xf3
+		binary.LittleEndian.PutUint32(buf[1:], uint32(v))
+		enc = buf[:5]
+	default:
+		buf[0] = 0xf4
+		binary.LittleEndian.PutUint64(buf[1:], uint64(v))
+		enc = buf[:9]
+	}
+	lp.append(enc, nil)
+}
+
+func (lp *listpackEncoder) appendString(s []byte) {
+	var buf [5]byte
+	switch n := len(s); {
+	case n < 64:
+		buf[0] = 0x80 | byte(n)
+		lp.append(buf[:1], s)
+	case n < 4096:
+		buf[0], buf[1] = 0xe0|byte(n>>8), byte(n)
+		lp.append(buf[:2], s)
+	default:
+		buf[0] = 0xf0
+		binary.LittleEndian.PutUint32(buf[1:], uint32(n))
+		lp.append(buf[:5], s)
+	}
+}
+
+func (lp *listpackEncoder) append(enc, data []byte) {
+	lp.body.Write(enc)
+	lp.body.Write(data)
+	// backlen, the length of the entry encoded from right to left
+	var l = len(enc) + len(data)
+	switch {
+	case l <= 127:
+		lp.body.WriteByte(byte(l))
+	case l < 16383:
+		lp.body.Write([]byte{byte(l >> 7), byte(l&127) | 128})
+	case l < 2097151:
+		lp.body.Write([]byte{byte(l >> 14), byte(l>>7&127) | 128, byte(l&127) | 128})
+	case l < 268435455:
+		lp.body.Write([]byte{byte(l >> 21), byte(l>>14&127) | 128, byte(l>>7&127) | 128, byte(l&127) | 128})
+	default:
+		lp.body.Write([]byte{byte(l >> 28), byte(l>>21&127) | 128, byte(l>>14&127) | 128, byte(l>>7&127) | 128, byte(l&127) | 128})
+	}
+	lp.count++
+}
+
+func (lp *listpackEncoder) Bytes() []byte {
+	var b = make([]byte, 6, 6+lp.body.Len()+1)
+	b = append(b, lp.body.Bytes()...)
+	b = append(b, 0xff)
+	binary.LittleEndian.PutUint32(b[0:], uint32(len(b)))
+	var count = lp.count
+	if count > math.MaxUint16 {
+		count = math.MaxUint16
+	}
+	binary.LittleEndian.PutUint16(b[4:], uint16(count))
+	return b
+}
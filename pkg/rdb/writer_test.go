@@ -0,0 +1,129 @@
+package rdb_test
+
+import (
+	"bytes"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/CodisLabs/redis-port/pkg/rdb"
+
+	"github.com/CodisLabs/codis/pkg/utils/assert"
+)
+
+func writeToBuffer(aux map[string]string, databases DatabaseSet) (*bytes.Buffer, map[uint64]rdb.DBSize) {
+	var b = &bytes.Buffer{}
+	var w = rdb.NewWriter(b)
+	assert.MustNoError(w.Header())
+
+	var keys []string
+	for key := range aux {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		assert.MustNoError(w.WriteAux(key, aux[key]))
+	}
+
+	var dbsize = make(map[uint64]rdb.DBSize)
+	for db, entries := range databases {
+		var size = rdb.DBSize{Keys: uint64(len(entries))}
+		for _, e := range entries {
+			if e.Expire != rdb.NoExpire {
+				size.Expires++
+			}
+		}
+		assert.MustNoError(w.SelectDB(db))
+		assert.MustNoError(w.ResizeDB(size))
+		for _, e := range entries {
+			assert.MustNoError(w.WriteEntry(e))
+		}
+		dbsize[db] = size
+	}
+	assert.MustNoError(w.Footer())
+	return b, dbsize
+}
+
+func streamEntries(stream *rdb.RedisStreamObject) [][]string {
+	var entries [][]string
+	stream.ForEach(func(iter *rdb.RedisStreamIterator, step int) bool {
+		var entry = iter.Next()
+		if entry == nil {
+			return false
+		}
+		var fields = []string{entry.ID.String()}
+		for i := range entry.Fields {
+			fields = append(fields, entry.Fields[i].String(), entry.Values[i].String())
+		}
+		entries = append(entries, fields)
+		return true
+	})
+	return entries
+}
+
+// streamGroups returns the groups without EntriesRead, which isn't written
+// in the format of RDB_VERSION.
+func streamGroups(stream *rdb.RedisStreamObject) []rdb.RedisStreamGroup {
+	var groups []rdb.RedisStreamGroup
+	for _, g := range stream.Groups() {
+		var group = *g
+		group.EntriesRead = -1
+		groups = append(groups, group)
+	}
+	return groups
+}
+
+func (d Database) ValidateSameAs(expected Database) {
+	assert.Must(len(d) == len(expected))
+	for key, e := range expected {
+		var a = d[key]
+		assert.Must(a != nil)
+		assert.Must(a.DB == e.DB && a.Expire == e.Expire && a.Type() == e.Type())
+		switch e.Type() {
+		case rdb.OBJ_MODULE:
+			assert.Must(reflect.DeepEqual(a.Module, e.Module))
+		case rdb.OBJ_STRING:
+			assert.Must(a.Value.AsString().String() == e.Value.AsString().String())
+		case rdb.OBJ_LIST:
+			assert.Must(reflect.DeepEqual(a.Value.AsList().Strings(), e.Value.AsList().Strings()))
+		case rdb.OBJ_HASH:
+			assert.Must(reflect.DeepEqual(a.Value.AsHash().Map(), e.Value.AsHash().Map()))
+		case rdb.OBJ_SET:
+			assert.Must(reflect.DeepEqual(a.Value.AsSet().Map(), e.Value.AsSet().Map()))
+		case rdb.OBJ_ZSET:
+			assert.Must(reflect.DeepEqual(a.Value.AsZset().Map(), e.Value.AsZset().Map()))
+		case rdb.OBJ_STREAM:
+			var x, y = a.Value.AsStream(), e.Value.AsStream()
+			assert.Must(x.Len() == y.Len() && x.LastID() == y.LastID())
+			assert.Must(reflect.DeepEqual(streamEntries(x), streamEntries(y)))
+			assert.Must(reflect.DeepEqual(streamGroups(x), streamGroups(y)))
+		default:
+			assert.Must(false)
+		}
+	}
+}
+
+func TestWriterRoundTrip(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("testing", "*.rdb"))
+	assert.MustNoError(err)
+	assert.Must(len(files) != 0)
+	for _, file := range files {
+		loader := newLoaderFromFile(filepath.Base(file))
+		databases := loadFromLoader(loader)
+
+		b, dbsize := writeToBuffer(loader.Aux(), databases)
+		reloader := rdb.NewLoader(b)
+		reloaded := loadFromLoader(reloader)
+		assert.Must(reloader.Version() == rdb.RDB_VERSION)
+		assert.Must(reflect.DeepEqual(reloader.Aux(), loader.Aux()))
+		assert.Must(reflect.DeepEqual(reloader.DBSize(), dbsize))
+
+		assert.Must(len(reloaded) == len(databases))
+		for db, entries := range databases {
+			reloaded[db].ValidateSameAs(entries)
+		}
+		release(databases)
+		release(reloaded)
+	}
+}